@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+A change made to a book. Before is nil for creates and After is nil for deletes.
+*/
+type Mutation struct {
+	Op      string
+	Actor   string
+	Role    Role
+	Client  string
+	Time    time.Time
+	Before  *Book
+	After   *Book
+	Changes []FieldChange
+}
+
+/*
+Called by every handler that changes a book, with the mutex still held so mutations are recorded in the order they
+happened. Actor is who the request was authenticated as, or "anonymous", and "system" when r is nil because the
+server made the change itself. Updates that didn't change anything aren't recorded.
+*/
+func recordMutation(r *http.Request, op string, before *Book, after *Book) {
+	m := Mutation{Op: op, Actor: "system", Role: RoleLibrarian, Time: time.Now().UTC()}
+	if r != nil {
+		m.Actor, m.Role, m.Client = "anonymous", RoleAnonymous, clientIP(r, trustedProxies)
+		if principal := requestPrincipal(r); principal != nil {
+			m.Actor, m.Role = principal.Name, principal.Role
+		}
+	}
+	if before != nil {
+		b := *before
+		m.Before = &b
+	}
+	if after != nil {
+		a := *after
+		m.After = &a
+	}
+	m.Changes = diffBooks(m.Before, m.After)
+	if m.Before != nil && m.After != nil && len(m.Changes) == 0 {
+		return
+	}
+
+	ctx, span := tracer().Start(logContext(r), "catalog.record", trace.WithAttributes(attribute.String("op", op)))
+	defer span.End()
+	recordRevision(m)
+	saveCatalog(ctx)
+	feed.record(ctx, m)
+	if auditLog != nil {
+		if err := auditLog.record(ctx, m); err != nil {
+			slog.ErrorContext(ctx, "Could not write to the audit log", "err", err)
+		}
+	}
+}
+
+/*
+One line of the audit log.
+*/
+type AuditEntry struct {
+	Time    time.Time     `json:"time"`
+	Actor   string        `json:"actor"`
+	Role    Role          `json:"role"`
+	Client  string        `json:"client"`
+	Op      string        `json:"op"`
+	BookID  int           `json:"bookid"`
+	Book    string        `json:"book"` // The book's title after the change, or before it for deletes
+	Changes []FieldChange `json:"changes"`
+}
+
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+/*
+Compares two versions of a book field by field, using the names the fields have in the book's JSON.
+A nil book has no fields, so every field of the other one counts as changed. Reviews aren't in the book's JSON, but
+they are compared too, as "reviews", so writing or editing a review that is still waiting to be moderated is a change.
+*/
+func diffBooks(before *Book, after *Book) []FieldChange {
+	fields := func(book *Book) map[string]interface{} {
+		values := map[string]interface{}{}
+		if book != nil {
+			data, _ := json.Marshal(book)
+			json.Unmarshal(data, &values)
+			if len(book.Reviews) > 0 {
+				var reviews interface{}
+				data, _ = json.Marshal(book.Reviews)
+				json.Unmarshal(data, &reviews)
+				values["reviews"] = reviews
+			}
+		}
+		return values
+	}
+	a, b := fields(before), fields(after)
+
+	names := map[string]bool{}
+	for name := range a {
+		names[name] = true
+	}
+	for name := range b {
+		names[name] = true
+	}
+
+	changes := []FieldChange{}
+	for name := range names {
+		if !reflect.DeepEqual(a[name], b[name]) {
+			changes = append(changes, FieldChange{Field: name, Before: a[name], After: b[name]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+/*
+The append-only audit log, one JSON object per line. It is only ever appended to, and queries read it back from the
+file so it survives restarts.
+*/
+type auditFile struct {
+	mutex sync.Mutex
+	path  string
+	file  *os.File
+}
+
+var auditLog *auditFile
+
+func openAuditLog(path string) (*auditFile, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditFile{path: path, file: f}, nil
+}
+
+func (a *auditFile) record(ctx context.Context, m Mutation) error {
+	entry := AuditEntry{Time: m.Time, Actor: m.Actor, Role: m.Role, Client: m.Client, Op: m.Op, Changes: m.Changes}
+	book := m.After
+	if book == nil {
+		book = m.Before
+	}
+	entry.BookID, entry.Book = book.ID, book.Title
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return persist(ctx, "audit", func() error {
+		if _, err := a.file.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		return a.file.Sync()
+	})
+}
+
+func (a *auditFile) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+/*
+What GET /admin/audit can filter on. Empty fields match everything.
+*/
+type auditFilter struct {
+	actor  string
+	book   string // Matched against the title the same way book URLs are
+	bookID int
+	op     string
+	since  time.Time
+	until  time.Time
+}
+
+func (f auditFilter) matches(entry AuditEntry) bool {
+	switch {
+	case f.actor != "" && entry.Actor != f.actor:
+		return false
+	case f.book != "" && !strings.EqualFold(f.book, bookSlug(Book{Title: entry.Book})):
+		return false
+	case f.bookID != 0 && entry.BookID != f.bookID:
+		return false
+	case f.op != "" && entry.Op != f.op:
+		return false
+	case !f.since.IsZero() && entry.Time.Before(f.since):
+		return false
+	case !f.until.IsZero() && !entry.Time.Before(f.until):
+		return false
+	}
+	return true
+}
+
+/*
+Reads the log back, calling found for every entry that matches the filter, oldest first.
+*/
+func (a *auditFile) query(filter auditFilter, found func(AuditEntry) error) error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // A line cut short by a crash, the rest of the log is still good
+		}
+		if filter.matches(entry) {
+			if err := found(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+/*
+GET /admin/audit lists the audit log, filtered by ?actor=, ?book= (the book's URL id), ?bookid=, ?op=, and a time range
+with ?since= and ?until= as RFC 3339 timestamps. ?format=jsonl exports the entries as JSON Lines instead of an array.
+*/
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+	if auditLog == nil {
+		http.Error(w, "404, the audit log is not enabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := auditFilter{actor: query.Get("actor"), book: query.Get("book"), op: query.Get("op")}
+	if query.Get("bookid") != "" {
+		id, err := strconv.Atoi(query.Get("bookid"))
+		if err != nil {
+			http.Error(w, "400, bookid not an int", http.StatusBadRequest)
+			return
+		}
+		filter.bookID = id
+	}
+	for name, t := range map[string]*time.Time{"since": &filter.since, "until": &filter.until} {
+		if query.Get(name) != "" {
+			parsed, err := time.Parse(time.RFC3339, query.Get(name))
+			if err != nil {
+				http.Error(w, "400, "+name+" must be an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	switch query.Get("format") {
+	case "", "json":
+		entries := []AuditEntry{}
+		err := auditLog.query(filter, func(entry AuditEntry) error {
+			entries = append(entries, entry)
+			return nil
+		})
+		if err != nil {
+			http.Error(w, "500, could not read the audit log", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		if err := auditLog.query(filter, func(entry AuditEntry) error { return encoder.Encode(entry) }); err != nil {
+			slog.ErrorContext(r.Context(), "Audit export failed", "err", err)
+		}
+
+	default:
+		http.Error(w, "400, format must be json or jsonl", http.StatusBadRequest)
+	}
+}
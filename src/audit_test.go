@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+Points the audit log at a temporary file for the length of the test.
+*/
+func withAuditLog(t *testing.T) {
+	saved := auditLog
+	log, err := openAuditLog(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog = log
+	t.Cleanup(func() {
+		log.Close()
+		auditLog = saved
+	})
+}
+
+func auditEntries(t *testing.T, query string) []AuditEntry {
+	w := formRequest(requireRole(routes()), "GET", "/admin/audit"+query, nil, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, " ", w.Body.String())
+	}
+	var entries []AuditEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestAuditMutations(t *testing.T) {
+	withTestKeys(t)
+	withAuditLog(t)
+	readFromFile("books.csv")
+
+	data := url.Values{"title": {"Book 3"}, "author": {"Author 3"}, "publishdate": {"11111113"}, "rating": {"2"}, "ischeckedin": {"true"}}
+	if w := formRequest(requireRole(routes()), "POST", "/new", data, "X-API-Key", "librarian-key"); w.Code != http.StatusCreated {
+		t.Fatal("Could not create a book. Recieved ", w.Code)
+	}
+	formRequest(requireRole(routes()), "PATCH", "/books/book-3", url.Values{"author": {"Someone Else"}}, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "PATCH", "/books/book-3", url.Values{"author": {"Someone Else"}}, "X-API-Key", "librarian-key") // Changes nothing
+	formRequest(requireRole(routes()), "POST", "/books/book-3/checkout", nil, "X-API-Key", "patron-key")
+	formRequest(requireRole(routes()), "DELETE", "/books/book-3", nil, "X-API-Key", "librarian-key")
+
+	entries := auditEntries(t, "")
+	ops := []string{}
+	for _, entry := range entries {
+		ops = append(ops, entry.Op)
+		if entry.BookID != 3 || entry.Book != "Book 3" {
+			t.Error("Entry is for the wrong book. Recieved ", entry.BookID, " ", entry.Book)
+		}
+	}
+	if len(ops) != 4 || ops[0] != "create" || ops[1] != "update" || ops[2] != "checkout" || ops[3] != "delete" {
+		t.Fatal("Expected create, update, checkout and delete. Recieved ", ops)
+	}
+
+	update := entries[1]
+	if update.Actor != "lucy" || update.Role != RoleLibrarian || update.Client != "192.0.2.1" {
+		t.Error("Update attributed incorrectly. Recieved ", update.Actor, " ", update.Role, " ", update.Client)
+	}
+	if len(update.Changes) != 1 || update.Changes[0] != (FieldChange{Field: "author", Before: "Author 3", After: "Someone Else"}) {
+		t.Error("Update diff incorrect. Recieved ", update.Changes)
+	}
+	if entries[2].Actor != "alice" {
+		t.Error("Checkout attributed to ", entries[2].Actor)
+	}
+	for _, change := range entries[3].Changes {
+		if change.After != nil {
+			t.Error("Delete left a value behind for ", change.Field)
+		}
+	}
+}
+
+/*
+A book's ID has to stay the same across a restart, and a purged book's ID mustn't be given to a new one, or the audit
+log would mix up their entries.
+*/
+func TestAuditFollowsBooksAcrossRestarts(t *testing.T) {
+	withTestKeys(t)
+	withAuditLog(t)
+	readFromFile("books.csv")
+
+	data := url.Values{"title": {"Book 3"}, "publishdate": {"11111113"}, "rating": {"2"}, "ischeckedin": {"true"}}
+	formRequest(requireRole(routes()), "POST", "/new", data, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "DELETE", "/books/book-3", nil, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "DELETE", "/trash/book-3", nil, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "DELETE", "/books/book-1", nil, "X-API-Key", "librarian-key")
+
+	path := filepath.Join(t.TempDir(), "books.csv")
+	if err := writeToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	readFromFile(path)
+	formRequest(requireRole(routes()), "POST", "/trash/book-1/restore", nil, "X-API-Key", "librarian-key")
+	data.Set("title", "Book 4")
+	formRequest(requireRole(routes()), "POST", "/new", data, "X-API-Key", "librarian-key")
+
+	for id, title := range map[int]string{1: "Book 1", 3: "Book 3", 4: "Book 4"} {
+		entries := auditEntries(t, "?bookid="+strconv.Itoa(id))
+		if len(entries) == 0 {
+			t.Error("Expected entries for ", title)
+		}
+		for _, entry := range entries {
+			if entry.Book != title {
+				t.Error("Expected only ", title, " under ID ", id, ". Recieved ", entry.Book, " ", entry.Op)
+			}
+		}
+	}
+}
+
+func TestAuditFilters(t *testing.T) {
+	withTestKeys(t)
+	withAuditLog(t)
+	readFromFile("books.csv")
+
+	start := time.Now().UTC().Add(-time.Second)
+	formRequest(requireRole(routes()), "POST", "/books/book-1/checkout", nil, "X-API-Key", "patron-key")
+	formRequest(requireRole(routes()), "PATCH", "/books/book-2", url.Values{"publisher": {"Another"}}, "X-API-Key", "librarian-key")
+
+	tests := []struct {
+		query string
+		count int
+	}{
+		{"", 2},
+		{"?actor=alice", 1},
+		{"?actor=nobody", 0},
+		{"?book=book-2", 1},
+		{"?bookid=1", 1},
+		{"?op=checkout", 1},
+		{"?since=" + start.Format(time.RFC3339), 2},
+		{"?until=" + start.Format(time.RFC3339), 0},
+	}
+	for _, test := range tests {
+		if entries := auditEntries(t, test.query); len(entries) != test.count {
+			t.Error("Expected ", test.count, " entries for ", test.query, ". Recieved ", len(entries))
+		}
+	}
+
+	for _, bad := range []string{"?bookid=one", "?since=yesterday", "?format=xml"} {
+		if w := formRequest(requireRole(routes()), "GET", "/admin/audit"+bad, nil, "X-API-Key", "librarian-key"); w.Code != http.StatusBadRequest {
+			t.Error("Expected Response code 400 for ", bad, ". Recieved ", w.Code)
+		}
+	}
+}
+
+func TestAuditExportAndAccess(t *testing.T) {
+	withTestKeys(t)
+	withAuditLog(t)
+	readFromFile("books.csv")
+	formRequest(requireRole(routes()), "POST", "/books/book-1/checkout", nil, "X-API-Key", "patron-key")
+
+	if w := formRequest(requireRole(routes()), "GET", "/admin/audit", nil, "X-API-Key", "patron-key"); w.Code != http.StatusForbidden {
+		t.Error("Expected Response code 403 for a patron. Recieved ", w.Code)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/admin/audit", nil); w.Code != http.StatusUnauthorized {
+		t.Error("Expected Response code 401 without credentials. Recieved ", w.Code)
+	}
+
+	w := formRequest(requireRole(routes()), "GET", "/admin/audit?format=jsonl", nil, "X-API-Key", "librarian-key")
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Error("Expected JSON Lines. Recieved ", w.Header().Get("Content-Type"))
+	}
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Error("Line is not an entry: ", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 1 {
+		t.Error("Expected 1 line. Recieved ", lines)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Anonymous users can read, patrons can also check out, rate and review books, and librarians can do everything.
+Each role can do everything the roles before it can.
+*/
+type Role string
+
+const (
+	RoleAnonymous Role = "anonymous"
+	RolePatron    Role = "patron"
+	RoleLibrarian Role = "librarian"
+)
+
+var roleRank = map[Role]int{RoleAnonymous: 0, RolePatron: 1, RoleLibrarian: 2}
+
+func parseRole(s string) (Role, bool) {
+	role := Role(strings.ToLower(strings.TrimSpace(s)))
+	_, ok := roleRank[role]
+	return role, ok && role != RoleAnonymous
+}
+
+func (role Role) atLeast(other Role) bool {
+	return roleRank[role] >= roleRank[other]
+}
+
+/*
+Who made the request. Name is what patrons are known by in ratings and reviews.
+*/
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+/*
+Authenticators check one kind of credential. They return nil and no error when the request doesn't carry their
+kind of credential, so the next one can have a look, and an error when it does but the credential isn't valid.
+*/
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+/*
+The authenticators tried, in order, by requireRole. When there are none authentication is turned off and every
+request is allowed, which is how the API behaved before there was authentication.
+*/
+var authenticators []Authenticator
+
+var errBadCredentials = errors.New("invalid credentials")
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+Static API keys sent in the X-API-Key header. Only a hash of each key is kept in memory. The keys can be swapped for
+new ones while the server is running, see reloadKeys.
+*/
+type apiKeyAuthenticator struct {
+	mutex sync.RWMutex
+	keys  map[string]Principal
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		return nil, nil
+	}
+	a.mutex.RLock()
+	principal, ok := a.keys[hashSecret(key)]
+	a.mutex.RUnlock()
+	if !ok {
+		return nil, errBadCredentials
+	}
+	return &principal, nil
+}
+
+/*
+Short lived bearer tokens handed out by POST /auth/token, sent as "Authorization: Bearer <token>".
+Tokens are random, so anything that looks like a JWT is left for another authenticator.
+*/
+type tokenAuthenticator struct {
+	mutex  sync.Mutex
+	ttl    time.Duration
+	tokens map[string]issuedToken // Keyed by the hash of the token
+}
+
+type issuedToken struct {
+	principal Principal
+	expires   time.Time
+}
+
+func newTokenAuthenticator(ttl time.Duration) *tokenAuthenticator {
+	return &tokenAuthenticator{ttl: ttl, tokens: map[string]issuedToken{}}
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+func (a *tokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if token == "" || strings.Count(token, ".") == 2 {
+		return nil, nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	issued, ok := a.tokens[hashSecret(token)]
+	if !ok {
+		return nil, errBadCredentials
+	}
+	if time.Now().After(issued.expires) {
+		delete(a.tokens, hashSecret(token))
+		return nil, errors.New("token expired")
+	}
+	return &issued.principal, nil
+}
+
+func (a *tokenAuthenticator) issue(principal Principal) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(a.ttl).UTC()
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for hash, issued := range a.tokens {
+		if time.Now().After(issued.expires) {
+			delete(a.tokens, hash)
+		}
+	}
+	a.tokens[hashSecret(token)] = issuedToken{principal: principal, expires: expires}
+	return token, expires, nil
+}
+
+func (a *tokenAuthenticator) revoke(token string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.tokens, hashSecret(token))
+}
+
+var (
+	tokens  *tokenAuthenticator  // The token authenticator used by /auth/token, nil until keys have been loaded
+	apiKeys *apiKeyAuthenticator // nil until keys have been loaded
+)
+
+/*
+Reads the API keys, one per line as key,name,role where role is patron or librarian. The file is optional if JWTs are
+accepted, without either the server only starts with -insecure-no-auth. Loading keys also turns on bearer tokens.
+*/
+func readKeys(filepath string, tokenTTL time.Duration) {
+	keys, err := parseKeys(filepath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalln("keys:", err)
+	}
+	apiKeys = &apiKeyAuthenticator{keys: keys}
+	tokens = newTokenAuthenticator(tokenTTL)
+	authenticators = append(authenticators, apiKeys, tokens)
+}
+
+/*
+Reads the keys file again, on SIGHUP, and swaps the keys in it for the ones in use, so keys can be added and taken away
+without a restart. Bearer tokens already handed out last until they expire. If the file can't be read the keys in use
+are kept. Must only be called once readKeys has loaded keys, as authentication can't be turned on this way.
+*/
+func reloadKeys(filepath string) error {
+	keys, err := parseKeys(filepath)
+	if err != nil {
+		return err
+	}
+	apiKeys.mutex.Lock()
+	defer apiKeys.mutex.Unlock()
+	apiKeys.keys = keys
+	return nil
+}
+
+/*
+The keys in the file, keyed by the hash of each key.
+*/
+func parseKeys(filepath string) (map[string]Principal, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := map[string]Principal{}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 3
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		role, ok := parseRole(record[2])
+		if !ok {
+			return nil, fmt.Errorf("unknown role %q for %v in %v", record[2], record[1], filepath)
+		}
+		keys[hashSecret(record[0])] = Principal{Name: record[1], Role: role}
+	}
+	return keys, nil
+}
+
+type principalKey struct{}
+
+/*
+The principal the request was authenticated as, or nil for anonymous requests and when authentication is off.
+*/
+func requestPrincipal(r *http.Request) *Principal {
+	principal, _ := r.Context().Value(principalKey{}).(*Principal)
+	return principal
+}
+
+/*
+The name a patron acts under in ratings and reviews. Once authentication is on this is who they logged in as,
+otherwise they say who they are in the patron form value.
+*/
+func patronName(r *http.Request) string {
+	if principal := requestPrincipal(r); principal != nil {
+		return principal.Name
+	}
+	return r.FormValue("patron")
+}
+
+/*
+True if the request can act for patron, either because it is them or because it comes from a librarian.
+With authentication turned off everybody is trusted.
+*/
+func actingFor(r *http.Request, patron string) bool {
+	if principal := requestPrincipal(r); principal != nil && principal.Role == RoleLibrarian {
+		return true
+	}
+	return patronName(r) == patron
+}
+
+/*
+The least role needed for a request. Reading is open to everyone, the patron actions on a book need a patron, and
+everything else needs a librarian.
+*/
+func requiredRole(r *http.Request) Role {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if strings.HasPrefix(path, "/auth/") {
+		return RolePatron
+	}
+	if path == "/admin" || strings.HasPrefix(path, "/admin/") || path == "/trash" || strings.HasPrefix(path, "/trash/") {
+		return RoleLibrarian
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		if strings.HasPrefix(path, "/books/") && strings.Contains(path, "/reviews") {
+			if state := r.URL.Query().Get("state"); state != "" && ReviewState(state) != ReviewPublished {
+				return RoleLibrarian
+			}
+		}
+		return RoleAnonymous
+	}
+
+	if strings.HasPrefix(path, "/books/") {
+		_, action, _ := splitBookPath(path)
+		switch {
+		case action == "checkout" || action == "checkin" || action == "ratings" || action == "reviews":
+			return RolePatron
+		case strings.HasPrefix(action, "reviews/") && !strings.HasSuffix(action, "/moderate"):
+			return RolePatron // Editing and deleting are limited to the author in bookReviews
+		}
+	}
+	return RoleLibrarian
+}
+
+/*
+Middleware that authenticates every request and checks it has the role it needs. Requests without credentials get
+401 if they need more than anonymous access, and authenticated requests without the role they need get 403.
+It is split in two so other middleware, like the rate limiter, can go between working out who the caller is and
+turning them away.
+*/
+func requireRole(next http.Handler) http.Handler {
+	return authenticate(authorize(next))
+}
+
+type authErrorKey struct{}
+
+/*
+Works out who the request is from and puts them in the request's context. Bad credentials are put there too, for
+authorize to reject, so nothing is turned away here.
+*/
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(r)
+			if err != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authErrorKey{}, err)))
+				return
+			}
+			if principal != nil {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(authenticators) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err, ok := r.Context().Value(authErrorKey{}).(error); ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="books"`)
+			http.Error(w, "401, "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		required := requiredRole(r)
+		principal := requestPrincipal(r)
+		if principal == nil {
+			if required != RoleAnonymous {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="books"`)
+				http.Error(w, "401, authentication required", http.StatusUnauthorized)
+				return
+			}
+		} else if !principal.Role.atLeast(required) {
+			http.Error(w, "403, "+string(required)+" role required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+Bearer tokens and who the caller is.
+
+	GET    /auth/token    who the request is authenticated as
+	POST   /auth/token    swap credentials, normally an API key, for a bearer token
+	DELETE /auth/token    revoke the bearer token the request was made with
+*/
+func authToken(w http.ResponseWriter, r *http.Request) {
+	principal := requestPrincipal(r)
+	if principal == nil || tokens == nil {
+		http.Error(w, "404, authentication is not enabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(principal)
+
+	case "POST":
+		token, expires, err := tokens.issue(*principal)
+		if err != nil {
+			http.Error(w, "500, could not create a token", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":   token,
+			"type":    "Bearer",
+			"expires": expires,
+		})
+
+	case "DELETE":
+		token := bearerToken(r)
+		if token == "" {
+			http.Error(w, "400, no bearer token to revoke", http.StatusBadRequest)
+			return
+		}
+		tokens.revoke(token)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "405 Method not allowed, only GET, POST and DELETE are permited", http.StatusMethodNotAllowed)
+	}
+}
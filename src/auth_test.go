@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+Sets up keys for a patron and a librarian, and puts the authenticators back the way they were when the test ends.
+*/
+func withTestKeys(t *testing.T) {
+	saved, savedTokens, savedKeys := authenticators, tokens, apiKeys
+	t.Cleanup(func() { authenticators, tokens, apiKeys = saved, savedTokens, savedKeys })
+	authenticators = nil
+
+	keysFile := filepath.Join(t.TempDir(), "keys.csv")
+	keys := "patron-key,alice,patron\nlibrarian-key,lucy,librarian\n"
+	if err := os.WriteFile(keysFile, []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	readKeys(keysFile, time.Hour)
+}
+
+func TestAuthRoles(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		code   int
+	}{
+		{"GET", "/books", "", http.StatusOK},
+		{"GET", "/books/book-1", "", http.StatusOK},
+		{"DELETE", "/books/book-2", "", http.StatusUnauthorized},
+		{"DELETE", "/books/book-2", "wrong-key", http.StatusUnauthorized},
+		{"DELETE", "/books/book-2", "patron-key", http.StatusForbidden},
+		{"POST", "/books/book-1/checkout", "", http.StatusUnauthorized},
+		{"POST", "/books/book-1/checkout", "patron-key", http.StatusOK},
+		{"GET", "/books/book-1/reviews?state=pending", "patron-key", http.StatusForbidden},
+		{"GET", "/books/book-1/reviews?state=pending", "librarian-key", http.StatusOK},
+		{"DELETE", "/books/book-2", "librarian-key", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := formRequest(requireRole(routes()), test.method, test.path, nil, "X-API-Key", test.key)
+		if w.Code != test.code {
+			t.Error(test.method, " ", test.path, " with key ", test.key, ": Expected Response code ", test.code, ". Recieved ", w.Code)
+		}
+	}
+}
+
+/*
+Patrons are who they authenticated as, the patron form value can't be used to rate as someone else.
+*/
+func TestAuthPatronIdentity(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+
+	w := formRequest(requireRole(routes()), "POST", "/books/book-1/ratings", url.Values{"patron": {"mallory"}, "rating": {"2"}}, "X-API-Key", "patron-key")
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+	if _, ok := Books[0].Ratings["alice"]; !ok {
+		t.Error("Rating was not stored under the authenticated patron. Recieved ", Books[0].Ratings)
+	}
+	if _, ok := Books[0].Ratings["mallory"]; ok {
+		t.Error("Rating was stored under the patron form value")
+	}
+
+	formRequest(requireRole(routes()), "POST", "/books/book-1/reviews", url.Values{"text": {"Loved it"}}, "X-API-Key", "patron-key")
+	w = formRequest(requireRole(routes()), "DELETE", "/books/book-1/reviews/1", nil, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusOK {
+		t.Error("Librarians should be able to delete any review. Recieved ", w.Code)
+	}
+}
+
+func TestAuthBearerTokens(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+
+	w := formRequest(requireRole(routes()), "POST", "/auth/token", nil, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+	var issued struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(w.Body).Decode(&issued)
+
+	w = formRequest(requireRole(routes()), "GET", "/auth/token", nil, "Authorization", "Bearer "+issued.Token)
+	var principal Principal
+	json.NewDecoder(w.Body).Decode(&principal)
+	if principal.Name != "lucy" || principal.Role != RoleLibrarian {
+		t.Error("Token is for the wrong principal. Recieved ", principal)
+	}
+
+	w = formRequest(requireRole(routes()), "DELETE", "/auth/token", nil, "Authorization", "Bearer "+issued.Token)
+	if w.Code != http.StatusNoContent {
+		t.Error("Expected Response code 204. Recieved ", w.Code)
+	}
+	w = formRequest(requireRole(routes()), "DELETE", "/books/book-2", nil, "Authorization", "Bearer "+issued.Token)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Revoked token was accepted. Recieved ", w.Code)
+	}
+
+	expired := newTokenAuthenticator(-time.Second)
+	token, _, _ := expired.issue(Principal{Name: "lucy", Role: RoleLibrarian})
+	req := httptest.NewRequest("GET", "/books", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if _, err := expired.Authenticate(req); err == nil {
+		t.Error("Expired token was accepted")
+	}
+}
+
+func TestAuthOffWithoutKeys(t *testing.T) {
+	saved := authenticators
+	t.Cleanup(func() { authenticators = saved })
+	authenticators = nil
+	readFromFile("books.csv")
+
+	w := formRequest(requireRole(routes()), "DELETE", "/books/book-2", nil)
+	if w.Code != http.StatusOK {
+		t.Error("Expected Response code 200 with authentication off. Recieved ", w.Code)
+	}
+}
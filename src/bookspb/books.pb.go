@@ -0,0 +1,1068 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: books.proto
+
+// The books API over gRPC. Every call does what the REST endpoint it mirrors does, with the same validation, roles,
+// audit log and change feed, so the two can be used side by side on the same catalog.
+//
+// Credentials go in the request metadata as they would in HTTP headers: x-api-key, or authorization with a bearer
+// token.
+
+package bookspb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type BookStatus int32
+
+const (
+	BookStatus_BOOK_STATUS_UNSPECIFIED BookStatus = 0
+	BookStatus_BOOK_STATUS_AVAILABLE   BookStatus = 1
+	BookStatus_BOOK_STATUS_CHECKED_OUT BookStatus = 2
+	BookStatus_BOOK_STATUS_ON_HOLD     BookStatus = 3
+	BookStatus_BOOK_STATUS_IN_REPAIR   BookStatus = 4
+	BookStatus_BOOK_STATUS_LOST        BookStatus = 5
+	BookStatus_BOOK_STATUS_WITHDRAWN   BookStatus = 6
+)
+
+// Enum value maps for BookStatus.
+var (
+	BookStatus_name = map[int32]string{
+		0: "BOOK_STATUS_UNSPECIFIED",
+		1: "BOOK_STATUS_AVAILABLE",
+		2: "BOOK_STATUS_CHECKED_OUT",
+		3: "BOOK_STATUS_ON_HOLD",
+		4: "BOOK_STATUS_IN_REPAIR",
+		5: "BOOK_STATUS_LOST",
+		6: "BOOK_STATUS_WITHDRAWN",
+	}
+	BookStatus_value = map[string]int32{
+		"BOOK_STATUS_UNSPECIFIED": 0,
+		"BOOK_STATUS_AVAILABLE":   1,
+		"BOOK_STATUS_CHECKED_OUT": 2,
+		"BOOK_STATUS_ON_HOLD":     3,
+		"BOOK_STATUS_IN_REPAIR":   4,
+		"BOOK_STATUS_LOST":        5,
+		"BOOK_STATUS_WITHDRAWN":   6,
+	}
+)
+
+func (x BookStatus) Enum() *BookStatus {
+	p := new(BookStatus)
+	*p = x
+	return p
+}
+
+func (x BookStatus) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (BookStatus) Descriptor() protoreflect.EnumDescriptor {
+	return file_books_proto_enumTypes[0].Descriptor()
+}
+
+func (BookStatus) Type() protoreflect.EnumType {
+	return &file_books_proto_enumTypes[0]
+}
+
+func (x BookStatus) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use BookStatus.Descriptor instead.
+func (BookStatus) EnumDescriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{0}
+}
+
+type Book struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	Id                 int32                  `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Title              string                 `protobuf:"bytes,2,opt,name=title,proto3" json:"title,omitempty"`
+	Author             string                 `protobuf:"bytes,3,opt,name=author,proto3" json:"author,omitempty"`
+	Publisher          string                 `protobuf:"bytes,4,opt,name=publisher,proto3" json:"publisher,omitempty"`
+	PublishDate        string                 `protobuf:"bytes,5,opt,name=publish_date,json=publishDate,proto3" json:"publish_date,omitempty"` // MMDDYYYY
+	Rating             int32                  `protobuf:"varint,6,opt,name=rating,proto3" json:"rating,omitempty"`                             // The average rating rounded to the nearest whole number
+	IsCheckedIn        bool                   `protobuf:"varint,7,opt,name=is_checked_in,json=isCheckedIn,proto3" json:"is_checked_in,omitempty"`
+	Status             BookStatus             `protobuf:"varint,8,opt,name=status,proto3,enum=books.v1.BookStatus" json:"status,omitempty"`
+	RatingAverage      float64                `protobuf:"fixed64,9,opt,name=rating_average,json=ratingAverage,proto3" json:"rating_average,omitempty"`
+	RatingCount        int32                  `protobuf:"varint,10,opt,name=rating_count,json=ratingCount,proto3" json:"rating_count,omitempty"`
+	RatingDistribution map[int32]int32        `protobuf:"bytes,11,rep,name=rating_distribution,json=ratingDistribution,proto3" json:"rating_distribution,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	ReviewCount        int32                  `protobuf:"varint,12,opt,name=review_count,json=reviewCount,proto3" json:"review_count,omitempty"`
+	Tags               []string               `protobuf:"bytes,13,rep,name=tags,proto3" json:"tags,omitempty"`
+	Genres             []string               `protobuf:"bytes,14,rep,name=genres,proto3" json:"genres,omitempty"`
+	CallNumber         string                 `protobuf:"bytes,15,opt,name=call_number,json=callNumber,proto3" json:"call_number,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
+}
+
+func (x *Book) Reset() {
+	*x = Book{}
+	mi := &file_books_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Book) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Book) ProtoMessage() {}
+
+func (x *Book) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Book.ProtoReflect.Descriptor instead.
+func (*Book) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Book) GetId() int32 {
+	if x != nil {
+		return x.Id
+	}
+	return 0
+}
+
+func (x *Book) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *Book) GetAuthor() string {
+	if x != nil {
+		return x.Author
+	}
+	return ""
+}
+
+func (x *Book) GetPublisher() string {
+	if x != nil {
+		return x.Publisher
+	}
+	return ""
+}
+
+func (x *Book) GetPublishDate() string {
+	if x != nil {
+		return x.PublishDate
+	}
+	return ""
+}
+
+func (x *Book) GetRating() int32 {
+	if x != nil {
+		return x.Rating
+	}
+	return 0
+}
+
+func (x *Book) GetIsCheckedIn() bool {
+	if x != nil {
+		return x.IsCheckedIn
+	}
+	return false
+}
+
+func (x *Book) GetStatus() BookStatus {
+	if x != nil {
+		return x.Status
+	}
+	return BookStatus_BOOK_STATUS_UNSPECIFIED
+}
+
+func (x *Book) GetRatingAverage() float64 {
+	if x != nil {
+		return x.RatingAverage
+	}
+	return 0
+}
+
+func (x *Book) GetRatingCount() int32 {
+	if x != nil {
+		return x.RatingCount
+	}
+	return 0
+}
+
+func (x *Book) GetRatingDistribution() map[int32]int32 {
+	if x != nil {
+		return x.RatingDistribution
+	}
+	return nil
+}
+
+func (x *Book) GetReviewCount() int32 {
+	if x != nil {
+		return x.ReviewCount
+	}
+	return 0
+}
+
+func (x *Book) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *Book) GetGenres() []string {
+	if x != nil {
+		return x.Genres
+	}
+	return nil
+}
+
+func (x *Book) GetCallNumber() string {
+	if x != nil {
+		return x.CallNumber
+	}
+	return ""
+}
+
+type ListBooksRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Withdrawn books are left out unless this asks for them
+	Status BookStatus `protobuf:"varint,1,opt,name=status,proto3,enum=books.v1.BookStatus" json:"status,omitempty"`
+	// Books with all of them
+	Tags []string `protobuf:"bytes,2,rep,name=tags,proto3" json:"tags,omitempty"`
+	// Books within all of them, subgenres included
+	Genres []string `protobuf:"bytes,3,rep,name=genres,proto3" json:"genres,omitempty"`
+	// Sort by call number instead of the order the books were added
+	ShelfOrder    bool `protobuf:"varint,4,opt,name=shelf_order,json=shelfOrder,proto3" json:"shelf_order,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListBooksRequest) Reset() {
+	*x = ListBooksRequest{}
+	mi := &file_books_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListBooksRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListBooksRequest) ProtoMessage() {}
+
+func (x *ListBooksRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListBooksRequest.ProtoReflect.Descriptor instead.
+func (*ListBooksRequest) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ListBooksRequest) GetStatus() BookStatus {
+	if x != nil {
+		return x.Status
+	}
+	return BookStatus_BOOK_STATUS_UNSPECIFIED
+}
+
+func (x *ListBooksRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *ListBooksRequest) GetGenres() []string {
+	if x != nil {
+		return x.Genres
+	}
+	return nil
+}
+
+func (x *ListBooksRequest) GetShelfOrder() bool {
+	if x != nil {
+		return x.ShelfOrder
+	}
+	return false
+}
+
+type ListBooksResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Books []*Book                `protobuf:"bytes,1,rep,name=books,proto3" json:"books,omitempty"`
+	// Where the change feed was up to, which WatchBooks can carry on from
+	ChangeSeq     int64 `protobuf:"varint,2,opt,name=change_seq,json=changeSeq,proto3" json:"change_seq,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListBooksResponse) Reset() {
+	*x = ListBooksResponse{}
+	mi := &file_books_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListBooksResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListBooksResponse) ProtoMessage() {}
+
+func (x *ListBooksResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListBooksResponse.ProtoReflect.Descriptor instead.
+func (*ListBooksResponse) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ListBooksResponse) GetBooks() []*Book {
+	if x != nil {
+		return x.Books
+	}
+	return nil
+}
+
+func (x *ListBooksResponse) GetChangeSeq() int64 {
+	if x != nil {
+		return x.ChangeSeq
+	}
+	return 0
+}
+
+type GetBookRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The title with spaces replaced by dashes
+	Id            string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetBookRequest) Reset() {
+	*x = GetBookRequest{}
+	mi := &file_books_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetBookRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetBookRequest) ProtoMessage() {}
+
+func (x *GetBookRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetBookRequest.ProtoReflect.Descriptor instead.
+func (*GetBookRequest) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *GetBookRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+type CreateBookRequest struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Title       string                 `protobuf:"bytes,1,opt,name=title,proto3" json:"title,omitempty"`
+	Author      string                 `protobuf:"bytes,2,opt,name=author,proto3" json:"author,omitempty"`
+	Publisher   string                 `protobuf:"bytes,3,opt,name=publisher,proto3" json:"publisher,omitempty"`
+	PublishDate string                 `protobuf:"bytes,4,opt,name=publish_date,json=publishDate,proto3" json:"publish_date,omitempty"`
+	Rating      int32                  `protobuf:"varint,5,opt,name=rating,proto3" json:"rating,omitempty"`
+	// Available when unspecified
+	Status        BookStatus `protobuf:"varint,6,opt,name=status,proto3,enum=books.v1.BookStatus" json:"status,omitempty"`
+	Tags          []string   `protobuf:"bytes,7,rep,name=tags,proto3" json:"tags,omitempty"`
+	Genres        []string   `protobuf:"bytes,8,rep,name=genres,proto3" json:"genres,omitempty"`
+	CallNumber    string     `protobuf:"bytes,9,opt,name=call_number,json=callNumber,proto3" json:"call_number,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CreateBookRequest) Reset() {
+	*x = CreateBookRequest{}
+	mi := &file_books_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CreateBookRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CreateBookRequest) ProtoMessage() {}
+
+func (x *CreateBookRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CreateBookRequest.ProtoReflect.Descriptor instead.
+func (*CreateBookRequest) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *CreateBookRequest) GetTitle() string {
+	if x != nil {
+		return x.Title
+	}
+	return ""
+}
+
+func (x *CreateBookRequest) GetAuthor() string {
+	if x != nil {
+		return x.Author
+	}
+	return ""
+}
+
+func (x *CreateBookRequest) GetPublisher() string {
+	if x != nil {
+		return x.Publisher
+	}
+	return ""
+}
+
+func (x *CreateBookRequest) GetPublishDate() string {
+	if x != nil {
+		return x.PublishDate
+	}
+	return ""
+}
+
+func (x *CreateBookRequest) GetRating() int32 {
+	if x != nil {
+		return x.Rating
+	}
+	return 0
+}
+
+func (x *CreateBookRequest) GetStatus() BookStatus {
+	if x != nil {
+		return x.Status
+	}
+	return BookStatus_BOOK_STATUS_UNSPECIFIED
+}
+
+func (x *CreateBookRequest) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *CreateBookRequest) GetGenres() []string {
+	if x != nil {
+		return x.Genres
+	}
+	return nil
+}
+
+func (x *CreateBookRequest) GetCallNumber() string {
+	if x != nil {
+		return x.CallNumber
+	}
+	return ""
+}
+
+type StringList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Values        []string               `protobuf:"bytes,1,rep,name=values,proto3" json:"values,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StringList) Reset() {
+	*x = StringList{}
+	mi := &file_books_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StringList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StringList) ProtoMessage() {}
+
+func (x *StringList) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StringList.ProtoReflect.Descriptor instead.
+func (*StringList) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *StringList) GetValues() []string {
+	if x != nil {
+		return x.Values
+	}
+	return nil
+}
+
+// Fields that aren't set are left as they are
+type UpdateBookRequest struct {
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	Id          string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Title       *string                `protobuf:"bytes,2,opt,name=title,proto3,oneof" json:"title,omitempty"`
+	Author      *string                `protobuf:"bytes,3,opt,name=author,proto3,oneof" json:"author,omitempty"`
+	Publisher   *string                `protobuf:"bytes,4,opt,name=publisher,proto3,oneof" json:"publisher,omitempty"`
+	PublishDate *string                `protobuf:"bytes,5,opt,name=publish_date,json=publishDate,proto3,oneof" json:"publish_date,omitempty"`
+	Rating      *int32                 `protobuf:"varint,6,opt,name=rating,proto3,oneof" json:"rating,omitempty"`
+	Status      BookStatus             `protobuf:"varint,7,opt,name=status,proto3,enum=books.v1.BookStatus" json:"status,omitempty"`
+	// Replace the book's when set, so an empty list clears them
+	Tags          *StringList `protobuf:"bytes,8,opt,name=tags,proto3" json:"tags,omitempty"`
+	Genres        *StringList `protobuf:"bytes,9,opt,name=genres,proto3" json:"genres,omitempty"`
+	CallNumber    *string     `protobuf:"bytes,10,opt,name=call_number,json=callNumber,proto3,oneof" json:"call_number,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UpdateBookRequest) Reset() {
+	*x = UpdateBookRequest{}
+	mi := &file_books_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UpdateBookRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UpdateBookRequest) ProtoMessage() {}
+
+func (x *UpdateBookRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UpdateBookRequest.ProtoReflect.Descriptor instead.
+func (*UpdateBookRequest) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *UpdateBookRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *UpdateBookRequest) GetTitle() string {
+	if x != nil && x.Title != nil {
+		return *x.Title
+	}
+	return ""
+}
+
+func (x *UpdateBookRequest) GetAuthor() string {
+	if x != nil && x.Author != nil {
+		return *x.Author
+	}
+	return ""
+}
+
+func (x *UpdateBookRequest) GetPublisher() string {
+	if x != nil && x.Publisher != nil {
+		return *x.Publisher
+	}
+	return ""
+}
+
+func (x *UpdateBookRequest) GetPublishDate() string {
+	if x != nil && x.PublishDate != nil {
+		return *x.PublishDate
+	}
+	return ""
+}
+
+func (x *UpdateBookRequest) GetRating() int32 {
+	if x != nil && x.Rating != nil {
+		return *x.Rating
+	}
+	return 0
+}
+
+func (x *UpdateBookRequest) GetStatus() BookStatus {
+	if x != nil {
+		return x.Status
+	}
+	return BookStatus_BOOK_STATUS_UNSPECIFIED
+}
+
+func (x *UpdateBookRequest) GetTags() *StringList {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *UpdateBookRequest) GetGenres() *StringList {
+	if x != nil {
+		return x.Genres
+	}
+	return nil
+}
+
+func (x *UpdateBookRequest) GetCallNumber() string {
+	if x != nil && x.CallNumber != nil {
+		return *x.CallNumber
+	}
+	return ""
+}
+
+type DeleteBookRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Id    string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	// Delete for good instead of moving to the trash
+	Purge         bool `protobuf:"varint,2,opt,name=purge,proto3" json:"purge,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteBookRequest) Reset() {
+	*x = DeleteBookRequest{}
+	mi := &file_books_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteBookRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteBookRequest) ProtoMessage() {}
+
+func (x *DeleteBookRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteBookRequest.ProtoReflect.Descriptor instead.
+func (*DeleteBookRequest) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *DeleteBookRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *DeleteBookRequest) GetPurge() bool {
+	if x != nil {
+		return x.Purge
+	}
+	return false
+}
+
+type WatchBooksRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// The sequence number to carry on after, from ListBooksResponse or the last change seen. Only changes made after
+	// the call starts are sent when it isn't set.
+	Since         *int64 `protobuf:"varint,1,opt,name=since,proto3,oneof" json:"since,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *WatchBooksRequest) Reset() {
+	*x = WatchBooksRequest{}
+	mi := &file_books_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchBooksRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchBooksRequest) ProtoMessage() {}
+
+func (x *WatchBooksRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchBooksRequest.ProtoReflect.Descriptor instead.
+func (*WatchBooksRequest) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *WatchBooksRequest) GetSince() int64 {
+	if x != nil && x.Since != nil {
+		return *x.Since
+	}
+	return 0
+}
+
+type BookChange struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Seq   int64                  `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	Time  *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	// created, updated or deleted
+	Type string `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	// The mutation behind it, like checkout or revert
+	Op     string `protobuf:"bytes,4,opt,name=op,proto3" json:"op,omitempty"`
+	BookId int32  `protobuf:"varint,5,opt,name=book_id,json=bookId,proto3" json:"book_id,omitempty"`
+	// Not set when the book was deleted
+	Book          *Book `protobuf:"bytes,6,opt,name=book,proto3" json:"book,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BookChange) Reset() {
+	*x = BookChange{}
+	mi := &file_books_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BookChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BookChange) ProtoMessage() {}
+
+func (x *BookChange) ProtoReflect() protoreflect.Message {
+	mi := &file_books_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BookChange.ProtoReflect.Descriptor instead.
+func (*BookChange) Descriptor() ([]byte, []int) {
+	return file_books_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *BookChange) GetSeq() int64 {
+	if x != nil {
+		return x.Seq
+	}
+	return 0
+}
+
+func (x *BookChange) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *BookChange) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *BookChange) GetOp() string {
+	if x != nil {
+		return x.Op
+	}
+	return ""
+}
+
+func (x *BookChange) GetBookId() int32 {
+	if x != nil {
+		return x.BookId
+	}
+	return 0
+}
+
+func (x *BookChange) GetBook() *Book {
+	if x != nil {
+		return x.Book
+	}
+	return nil
+}
+
+var File_books_proto protoreflect.FileDescriptor
+
+const file_books_proto_rawDesc = "" +
+	"\n" +
+	"\vbooks.proto\x12\bbooks.v1\x1a\x1bgoogle/protobuf/empty.proto\x1a\x1fgoogle/protobuf/timestamp.proto\"\xc9\x04\n" +
+	"\x04Book\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\x05R\x02id\x12\x14\n" +
+	"\x05title\x18\x02 \x01(\tR\x05title\x12\x16\n" +
+	"\x06author\x18\x03 \x01(\tR\x06author\x12\x1c\n" +
+	"\tpublisher\x18\x04 \x01(\tR\tpublisher\x12!\n" +
+	"\fpublish_date\x18\x05 \x01(\tR\vpublishDate\x12\x16\n" +
+	"\x06rating\x18\x06 \x01(\x05R\x06rating\x12\"\n" +
+	"\ris_checked_in\x18\a \x01(\bR\visCheckedIn\x12,\n" +
+	"\x06status\x18\b \x01(\x0e2\x14.books.v1.BookStatusR\x06status\x12%\n" +
+	"\x0erating_average\x18\t \x01(\x01R\rratingAverage\x12!\n" +
+	"\frating_count\x18\n" +
+	" \x01(\x05R\vratingCount\x12W\n" +
+	"\x13rating_distribution\x18\v \x03(\v2&.books.v1.Book.RatingDistributionEntryR\x12ratingDistribution\x12!\n" +
+	"\freview_count\x18\f \x01(\x05R\vreviewCount\x12\x12\n" +
+	"\x04tags\x18\r \x03(\tR\x04tags\x12\x16\n" +
+	"\x06genres\x18\x0e \x03(\tR\x06genres\x12\x1f\n" +
+	"\vcall_number\x18\x0f \x01(\tR\n" +
+	"callNumber\x1aE\n" +
+	"\x17RatingDistributionEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x05R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x05R\x05value:\x028\x01\"\x8d\x01\n" +
+	"\x10ListBooksRequest\x12,\n" +
+	"\x06status\x18\x01 \x01(\x0e2\x14.books.v1.BookStatusR\x06status\x12\x12\n" +
+	"\x04tags\x18\x02 \x03(\tR\x04tags\x12\x16\n" +
+	"\x06genres\x18\x03 \x03(\tR\x06genres\x12\x1f\n" +
+	"\vshelf_order\x18\x04 \x01(\bR\n" +
+	"shelfOrder\"X\n" +
+	"\x11ListBooksResponse\x12$\n" +
+	"\x05books\x18\x01 \x03(\v2\x0e.books.v1.BookR\x05books\x12\x1d\n" +
+	"\n" +
+	"change_seq\x18\x02 \x01(\x03R\tchangeSeq\" \n" +
+	"\x0eGetBookRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\"\x95\x02\n" +
+	"\x11CreateBookRequest\x12\x14\n" +
+	"\x05title\x18\x01 \x01(\tR\x05title\x12\x16\n" +
+	"\x06author\x18\x02 \x01(\tR\x06author\x12\x1c\n" +
+	"\tpublisher\x18\x03 \x01(\tR\tpublisher\x12!\n" +
+	"\fpublish_date\x18\x04 \x01(\tR\vpublishDate\x12\x16\n" +
+	"\x06rating\x18\x05 \x01(\x05R\x06rating\x12,\n" +
+	"\x06status\x18\x06 \x01(\x0e2\x14.books.v1.BookStatusR\x06status\x12\x12\n" +
+	"\x04tags\x18\a \x03(\tR\x04tags\x12\x16\n" +
+	"\x06genres\x18\b \x03(\tR\x06genres\x12\x1f\n" +
+	"\vcall_number\x18\t \x01(\tR\n" +
+	"callNumber\"$\n" +
+	"\n" +
+	"StringList\x12\x16\n" +
+	"\x06values\x18\x01 \x03(\tR\x06values\"\xbe\x03\n" +
+	"\x11UpdateBookRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x19\n" +
+	"\x05title\x18\x02 \x01(\tH\x00R\x05title\x88\x01\x01\x12\x1b\n" +
+	"\x06author\x18\x03 \x01(\tH\x01R\x06author\x88\x01\x01\x12!\n" +
+	"\tpublisher\x18\x04 \x01(\tH\x02R\tpublisher\x88\x01\x01\x12&\n" +
+	"\fpublish_date\x18\x05 \x01(\tH\x03R\vpublishDate\x88\x01\x01\x12\x1b\n" +
+	"\x06rating\x18\x06 \x01(\x05H\x04R\x06rating\x88\x01\x01\x12,\n" +
+	"\x06status\x18\a \x01(\x0e2\x14.books.v1.BookStatusR\x06status\x12(\n" +
+	"\x04tags\x18\b \x01(\v2\x14.books.v1.StringListR\x04tags\x12,\n" +
+	"\x06genres\x18\t \x01(\v2\x14.books.v1.StringListR\x06genres\x12$\n" +
+	"\vcall_number\x18\n" +
+	" \x01(\tH\x05R\n" +
+	"callNumber\x88\x01\x01B\b\n" +
+	"\x06_titleB\t\n" +
+	"\a_authorB\f\n" +
+	"\n" +
+	"_publisherB\x0f\n" +
+	"\r_publish_dateB\t\n" +
+	"\a_ratingB\x0e\n" +
+	"\f_call_number\"9\n" +
+	"\x11DeleteBookRequest\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x14\n" +
+	"\x05purge\x18\x02 \x01(\bR\x05purge\"8\n" +
+	"\x11WatchBooksRequest\x12\x19\n" +
+	"\x05since\x18\x01 \x01(\x03H\x00R\x05since\x88\x01\x01B\b\n" +
+	"\x06_since\"\xaf\x01\n" +
+	"\n" +
+	"BookChange\x12\x10\n" +
+	"\x03seq\x18\x01 \x01(\x03R\x03seq\x12.\n" +
+	"\x04time\x18\x02 \x01(\v2\x1a.google.protobuf.TimestampR\x04time\x12\x12\n" +
+	"\x04type\x18\x03 \x01(\tR\x04type\x12\x0e\n" +
+	"\x02op\x18\x04 \x01(\tR\x02op\x12\x17\n" +
+	"\abook_id\x18\x05 \x01(\x05R\x06bookId\x12\"\n" +
+	"\x04book\x18\x06 \x01(\v2\x0e.books.v1.BookR\x04book*\xc6\x01\n" +
+	"\n" +
+	"BookStatus\x12\x1b\n" +
+	"\x17BOOK_STATUS_UNSPECIFIED\x10\x00\x12\x19\n" +
+	"\x15BOOK_STATUS_AVAILABLE\x10\x01\x12\x1b\n" +
+	"\x17BOOK_STATUS_CHECKED_OUT\x10\x02\x12\x17\n" +
+	"\x13BOOK_STATUS_ON_HOLD\x10\x03\x12\x19\n" +
+	"\x15BOOK_STATUS_IN_REPAIR\x10\x04\x12\x14\n" +
+	"\x10BOOK_STATUS_LOST\x10\x05\x12\x19\n" +
+	"\x15BOOK_STATUS_WITHDRAWN\x10\x062\x84\x03\n" +
+	"\vBookService\x12D\n" +
+	"\tListBooks\x12\x1a.books.v1.ListBooksRequest\x1a\x1b.books.v1.ListBooksResponse\x123\n" +
+	"\aGetBook\x12\x18.books.v1.GetBookRequest\x1a\x0e.books.v1.Book\x129\n" +
+	"\n" +
+	"CreateBook\x12\x1b.books.v1.CreateBookRequest\x1a\x0e.books.v1.Book\x129\n" +
+	"\n" +
+	"UpdateBook\x12\x1b.books.v1.UpdateBookRequest\x1a\x0e.books.v1.Book\x12A\n" +
+	"\n" +
+	"DeleteBook\x12\x1b.books.v1.DeleteBookRequest\x1a\x16.google.protobuf.Empty\x12A\n" +
+	"\n" +
+	"WatchBooks\x12\x1b.books.v1.WatchBooksRequest\x1a\x14.books.v1.BookChange0\x01B\"Z github.com/RESTChallenge/bookspbb\x06proto3"
+
+var (
+	file_books_proto_rawDescOnce sync.Once
+	file_books_proto_rawDescData []byte
+)
+
+func file_books_proto_rawDescGZIP() []byte {
+	file_books_proto_rawDescOnce.Do(func() {
+		file_books_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_books_proto_rawDesc), len(file_books_proto_rawDesc)))
+	})
+	return file_books_proto_rawDescData
+}
+
+var file_books_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_books_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_books_proto_goTypes = []any{
+	(BookStatus)(0),               // 0: books.v1.BookStatus
+	(*Book)(nil),                  // 1: books.v1.Book
+	(*ListBooksRequest)(nil),      // 2: books.v1.ListBooksRequest
+	(*ListBooksResponse)(nil),     // 3: books.v1.ListBooksResponse
+	(*GetBookRequest)(nil),        // 4: books.v1.GetBookRequest
+	(*CreateBookRequest)(nil),     // 5: books.v1.CreateBookRequest
+	(*StringList)(nil),            // 6: books.v1.StringList
+	(*UpdateBookRequest)(nil),     // 7: books.v1.UpdateBookRequest
+	(*DeleteBookRequest)(nil),     // 8: books.v1.DeleteBookRequest
+	(*WatchBooksRequest)(nil),     // 9: books.v1.WatchBooksRequest
+	(*BookChange)(nil),            // 10: books.v1.BookChange
+	nil,                           // 11: books.v1.Book.RatingDistributionEntry
+	(*timestamppb.Timestamp)(nil), // 12: google.protobuf.Timestamp
+	(*emptypb.Empty)(nil),         // 13: google.protobuf.Empty
+}
+var file_books_proto_depIdxs = []int32{
+	0,  // 0: books.v1.Book.status:type_name -> books.v1.BookStatus
+	11, // 1: books.v1.Book.rating_distribution:type_name -> books.v1.Book.RatingDistributionEntry
+	0,  // 2: books.v1.ListBooksRequest.status:type_name -> books.v1.BookStatus
+	1,  // 3: books.v1.ListBooksResponse.books:type_name -> books.v1.Book
+	0,  // 4: books.v1.CreateBookRequest.status:type_name -> books.v1.BookStatus
+	0,  // 5: books.v1.UpdateBookRequest.status:type_name -> books.v1.BookStatus
+	6,  // 6: books.v1.UpdateBookRequest.tags:type_name -> books.v1.StringList
+	6,  // 7: books.v1.UpdateBookRequest.genres:type_name -> books.v1.StringList
+	12, // 8: books.v1.BookChange.time:type_name -> google.protobuf.Timestamp
+	1,  // 9: books.v1.BookChange.book:type_name -> books.v1.Book
+	2,  // 10: books.v1.BookService.ListBooks:input_type -> books.v1.ListBooksRequest
+	4,  // 11: books.v1.BookService.GetBook:input_type -> books.v1.GetBookRequest
+	5,  // 12: books.v1.BookService.CreateBook:input_type -> books.v1.CreateBookRequest
+	7,  // 13: books.v1.BookService.UpdateBook:input_type -> books.v1.UpdateBookRequest
+	8,  // 14: books.v1.BookService.DeleteBook:input_type -> books.v1.DeleteBookRequest
+	9,  // 15: books.v1.BookService.WatchBooks:input_type -> books.v1.WatchBooksRequest
+	3,  // 16: books.v1.BookService.ListBooks:output_type -> books.v1.ListBooksResponse
+	1,  // 17: books.v1.BookService.GetBook:output_type -> books.v1.Book
+	1,  // 18: books.v1.BookService.CreateBook:output_type -> books.v1.Book
+	1,  // 19: books.v1.BookService.UpdateBook:output_type -> books.v1.Book
+	13, // 20: books.v1.BookService.DeleteBook:output_type -> google.protobuf.Empty
+	10, // 21: books.v1.BookService.WatchBooks:output_type -> books.v1.BookChange
+	16, // [16:22] is the sub-list for method output_type
+	10, // [10:16] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_books_proto_init() }
+func file_books_proto_init() {
+	if File_books_proto != nil {
+		return
+	}
+	file_books_proto_msgTypes[6].OneofWrappers = []any{}
+	file_books_proto_msgTypes[8].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_books_proto_rawDesc), len(file_books_proto_rawDesc)),
+			NumEnums:      1,
+			NumMessages:   11,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_books_proto_goTypes,
+		DependencyIndexes: file_books_proto_depIdxs,
+		EnumInfos:         file_books_proto_enumTypes,
+		MessageInfos:      file_books_proto_msgTypes,
+	}.Build()
+	File_books_proto = out.File
+	file_books_proto_goTypes = nil
+	file_books_proto_depIdxs = nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+Books can be given a call number in either Dewey Decimal (813.52 F553g) or Library of Congress (PS3511.I9 G7 1925) format.
+Which one it is can be told from the first character, Dewey starts with a digit and LCC with a letter.
+Call numbers don't sort as plain strings, so they are broken into their parts here and compared part by part.
+*/
+const (
+	SchemeDewey = "dewey"
+	SchemeLCC   = "lcc"
+)
+
+var (
+	deweyPattern  = regexp.MustCompile(`^(\d{3})(?:\.(\d+))?((?:\s+\S+)*)$`)
+	lccPattern    = regexp.MustCompile(`^([A-Z]{1,3})\s*(\d{1,4})(?:\.(\d+))?((?:\s*\.?[A-Z]\d+[A-Z]*)*)((?:\s+\S+)*)$`)
+	cutterPattern = regexp.MustCompile(`^\.?([A-Za-z]+)(\d*)([A-Za-z]*)$`)
+	lccCutter     = regexp.MustCompile(`\.?[A-Z]\d+[A-Z]*`)
+)
+
+/*
+A parsed call number. The class number is split into its whole and decimal parts, so 813.6 sorts after 813.52.
+Cutters are a letter followed by digits that are also read as a decimal, so .G63 sorts before .G7.
+*/
+type callNumber struct {
+	scheme   string
+	class    string // LCC class letters, empty for Dewey
+	whole    int
+	fraction string // Digits after the decimal point with trailing zeros removed
+	cutters  []cutter
+	extra    []string // Anything after the cutters, like a year or volume
+}
+
+type cutter struct {
+	letters  string
+	fraction string
+	suffix   string // Dewey work marks, like the g in F553g
+}
+
+/*
+Trims the call number and squeezes repeated spaces. LCC call numbers are uppercased as their letters are always capitals.
+*/
+func normalizeCallNumber(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if value != "" && (value[0] < '0' || value[0] > '9') {
+		value = strings.ToUpper(value)
+	}
+	return value
+}
+
+func parseCallNumber(value string) (callNumber, error) {
+	value = normalizeCallNumber(value)
+	if value == "" {
+		return callNumber{}, errors.New("callnumber is empty")
+	}
+
+	if value[0] >= '0' && value[0] <= '9' {
+		m := deweyPattern.FindStringSubmatch(value)
+		if m == nil {
+			return callNumber{}, errors.New("callnumber is not a valid Dewey call number, expected a form like 813.52 F553g")
+		}
+		whole, _ := strconv.Atoi(m[1])
+		cn := callNumber{scheme: SchemeDewey, whole: whole, fraction: strings.TrimRight(m[2], "0")}
+		fields := strings.Fields(m[3])
+		for i, field := range fields {
+			c := cutterPattern.FindStringSubmatch(field)
+			if c == nil || c[2] == "" {
+				cn.extra = fields[i:]
+				break
+			}
+			cn.cutters = append(cn.cutters, cutter{letters: strings.ToUpper(c[1]), fraction: strings.TrimRight(c[2], "0"), suffix: c[3]})
+		}
+		return cn, nil
+	}
+
+	m := lccPattern.FindStringSubmatch(value)
+	if m == nil {
+		return callNumber{}, errors.New("callnumber is not a valid Library of Congress call number, expected a form like PS3511.I9 G7 1925")
+	}
+	whole, _ := strconv.Atoi(m[2])
+	cn := callNumber{scheme: SchemeLCC, class: m[1], whole: whole, fraction: strings.TrimRight(m[3], "0")}
+	for _, field := range lccCutter.FindAllString(m[4], -1) {
+		c := cutterPattern.FindStringSubmatch(field)
+		cn.cutters = append(cn.cutters, cutter{letters: c[1], fraction: strings.TrimRight(c[2], "0"), suffix: c[3]})
+	}
+	cn.extra = strings.Fields(m[5])
+	return cn, nil
+}
+
+func compareStrings(a, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+/*
+Compares the extra parts, numerically when both are numbers (so v.9 and 1925 before v.10 and 2001), otherwise as text.
+*/
+func compareExtra(a, b string) int {
+	an, aErr := strconv.Atoi(strings.TrimLeft(a, "Vv."))
+	bn, bErr := strconv.Atoi(strings.TrimLeft(b, "Vv."))
+	if aErr == nil && bErr == nil {
+		return compareInts(an, bn)
+	}
+	return compareStrings(strings.ToUpper(a), strings.ToUpper(b))
+}
+
+/*
+Returns -1, 0 or 1 depending on whether a is shelved before, with, or after b. Dewey shelves come before LCC shelves.
+A shorter call number sorts before a longer one it is the start of, so 813.52 comes before 813.52 F553g.
+*/
+func compareCallNumbers(a, b callNumber) int {
+	if c := compareStrings(a.scheme, b.scheme); c != 0 {
+		return c
+	}
+	if c := compareStrings(a.class, b.class); c != 0 {
+		return c
+	}
+	if c := compareInts(a.whole, b.whole); c != 0 {
+		return c
+	}
+	if c := compareStrings(a.fraction, b.fraction); c != 0 {
+		return c
+	}
+	for i := 0; i < len(a.cutters) && i < len(b.cutters); i++ {
+		if c := compareStrings(a.cutters[i].letters, b.cutters[i].letters); c != 0 {
+			return c
+		}
+		if c := compareStrings(a.cutters[i].fraction, b.cutters[i].fraction); c != 0 {
+			return c
+		}
+		if c := compareStrings(a.cutters[i].suffix, b.cutters[i].suffix); c != 0 {
+			return c
+		}
+	}
+	if c := compareInts(len(a.cutters), len(b.cutters)); c != 0 {
+		return c
+	}
+	for i := 0; i < len(a.extra) && i < len(b.extra); i++ {
+		if c := compareExtra(a.extra[i], b.extra[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(a.extra), len(b.extra))
+}
+
+/*
+The books that have a call number, in shelf order. Withdrawn books aren't on the shelves so they are left out.
+*/
+func shelvedBooks() []Book {
+	type shelved struct {
+		book Book
+		cn   callNumber
+	}
+	var shelf []shelved
+	for _, book := range Books {
+		if book.CallNumber == "" || book.Status == StatusWithdrawn {
+			continue
+		}
+		cn, err := parseCallNumber(book.CallNumber)
+		if err != nil {
+			continue
+		}
+		shelf = append(shelf, shelved{book, cn})
+	}
+	sort.SliceStable(shelf, func(i, j int) bool { return compareCallNumbers(shelf[i].cn, shelf[j].cn) < 0 })
+
+	books := make([]Book, len(shelf))
+	for i, s := range shelf {
+		books[i] = s.book
+	}
+	return books
+}
+
+const (
+	defaultShelfCount = 10
+	maxShelfCount     = 100
+)
+
+/*
+Browses the shelf around a call number with GET /shelf?from=&count=. It returns up to count books shelved before from,
+followed by up to count books shelved at or after it. from doesn't have to belong to a book, the books around the spot
+where it would be shelved are returned. Without from the shelf is read from the start.
+*/
+func shelfHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+
+	count := defaultShelfCount
+	if query.Get("count") != "" {
+		var err error
+		count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || count < 1 || count > maxShelfCount {
+			http.Error(w, "400, count must be between 1 and "+strconv.Itoa(maxShelfCount), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.LockContext(r.Context())
+	shelf := shelvedBooks()
+	mutex.Unlock()
+
+	position := 0
+	if query.Get("from") != "" {
+		from, err := parseCallNumber(query.Get("from"))
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		position = sort.Search(len(shelf), func(i int) bool {
+			cn, _ := parseCallNumber(shelf[i].CallNumber)
+			return compareCallNumbers(cn, from) >= 0
+		})
+	}
+
+	start := position - count
+	if start < 0 {
+		start = 0
+	}
+	end := position + count
+	if end > len(shelf) {
+		end = len(shelf)
+	}
+	json.NewEncoder(w).Encode(shelf[start:end])
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseCallNumber(t *testing.T) {
+	good := []string{"813.52 F553g", "813", "005.133 P999 2019", "ps3511.i9 g7 1925", "QA76.73.G63 D66 2015", "KF 4558 .A2"}
+	for _, value := range good {
+		if _, err := parseCallNumber(value); err != nil {
+			t.Error("Expected ", value, " to be valid. Recieved ", err)
+		}
+	}
+	bad := []string{"81.5", "813.", "813.52.1", "ABCD123", "PS", "Q A76", "3511PS"}
+	for _, value := range bad {
+		if _, err := parseCallNumber(value); err == nil {
+			t.Error("Expected ", value, " to be rejected")
+		}
+	}
+}
+
+/*
+Each list is already in shelf order and gets shuffled before sorting.
+*/
+func TestCallNumberShelfOrder(t *testing.T) {
+	orders := [][]string{
+		{"813", "813.5", "813.52", "813.52 F553g", "813.52 F56", "813.6", "814"},
+		{"P35", "PA6", "PS3511.I9 G7 1925", "PS3511.I9 G7 2001", "PS3511.I92", "QA9", "QA76.73.G63 D66 2015", "QA76.73.G7", "QA76.9", "QA760"},
+		{"999.9", "A1"},
+	}
+	for _, want := range orders {
+		got := append([]string{}, want...)
+		sort.Slice(got, func(i, j int) bool { return got[i] > got[j] })
+		sort.SliceStable(got, func(i, j int) bool {
+			a, _ := parseCallNumber(got[i])
+			b, _ := parseCallNumber(got[j])
+			return compareCallNumbers(a, b) < 0
+		})
+		if strings.Join(got, " | ") != strings.Join(want, " | ") {
+			t.Error("Shelf order is incorrect. Recieved \n", got, "\nexpected\n", want)
+		}
+	}
+}
+
+func TestShelfBrowse(t *testing.T) {
+	readFromFile("books.csv")
+	callNumbers := []string{"813.6", "813.52 F553g", "QA76.73 .G63", "823.912", "813.54"}
+	Books = Books[:0]
+	for i, cn := range callNumbers {
+		Books = append(Books, Book{Title: "Shelf " + string(rune('A'+i)), CallNumber: cn, Status: StatusAvailable})
+	}
+
+	w := httptest.NewRecorder()
+	shelfHandler(w, httptest.NewRequest("GET", "/shelf?from=813.54&count=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	var books []Book
+	json.NewDecoder(w.Body).Decode(&books)
+	if len(books) != 2 || books[0].CallNumber != "813.52 F553g" || books[1].CallNumber != "813.54" {
+		t.Error("Expected the neighbour before 813.54 and 813.54 itself. Recieved ", books)
+	}
+
+	// 813.7 isn't on the shelf, the books either side of where it would go are returned
+	w = httptest.NewRecorder()
+	shelfHandler(w, httptest.NewRequest("GET", "/shelf?from=813.7&count=2", nil))
+	books = nil
+	json.NewDecoder(w.Body).Decode(&books)
+	if len(books) != 4 || books[1].CallNumber != "813.6" || books[2].CallNumber != "823.912" {
+		t.Error("Expected the books around 813.7. Recieved ", books)
+	}
+
+	w = httptest.NewRecorder()
+	shelfHandler(w, httptest.NewRequest("GET", "/shelf?from=not-a-call-number", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+}
+
+func TestCallNumberOnPatch(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"callnumber": {"qa76.73  .g63"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if Books[0].CallNumber != "QA76.73 .G63" {
+		t.Error("Call number was not normalized. Recieved ", Books[0].CallNumber)
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"callnumber": {"81.3"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"callnumber": {"813.52"}})
+	books := listBooks(t, "/books?sort=callnumber")
+	if books[0].Title != "Book 2" || books[1].Title != "Book 1" {
+		t.Error("Expected Dewey before LCC. Recieved ", books)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+One entry in the change feed. Deleted books are sent as tombstones, with only their ID, so clients know to drop them.
+*/
+type Change struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"` // created, updated or deleted
+	Op     string    `json:"op"`   // The mutation behind the change, like checkout or revert
+	BookID int       `json:"bookid"`
+	Book   *Book     `json:"book,omitempty"`
+
+	before *Book // What the book was before the change, for filtering events. Not kept across restarts
+}
+
+/*
+Every mutation gets the next sequence number in the feed, so a client that remembers the last one it saw can ask for
+everything after it. Only the last retain changes are kept, and they are appended to a file so the sequence carries on
+after a restart.
+*/
+type changeFeed struct {
+	mutex   sync.Mutex
+	retain  int
+	changes []Change
+	seq     int64
+	file    *os.File
+	waiting chan struct{} // Closed and replaced whenever a change is added, to wake up long polls
+}
+
+var feed = newChangeFeed(10000)
+
+func newChangeFeed(retain int) *changeFeed {
+	return &changeFeed{retain: retain, waiting: make(chan struct{})}
+}
+
+/*
+Loads the changes kept in the file and appends new ones to it. If the file has grown past what is retained it is
+rewritten with just the retained changes, which also drops a last line that was cut short.
+*/
+func (f *changeFeed) open(path string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if data, err := os.Open(path); err == nil {
+		reader := bufio.NewReader(data)
+		lines := 0
+		var complete int64 // Where the last line with its newline ends
+		torn := false
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				torn = len(line) > 0
+				break
+			}
+			if err != nil {
+				data.Close()
+				return err
+			}
+			complete += int64(len(line))
+			var change Change
+			if err := json.Unmarshal(line, &change); err != nil {
+				continue // Cut short by a crash
+			}
+			f.add(change)
+			lines++
+		}
+		data.Close()
+
+		/*
+			Every change is written with its newline in one go, so a last line without one was cut short by a crash. It
+			is cut off, or the next change would be appended onto the end of it.
+		*/
+		if lines > len(f.changes) {
+			if err := f.rewrite(path); err != nil {
+				return err
+			}
+		} else if torn {
+			if err := os.Truncate(path, complete); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	return nil
+}
+
+func (f *changeFeed) rewrite(path string) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "changes-*.jsonl")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(temp)
+	for _, change := range f.changes {
+		if err := encoder.Encode(change); err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+			return err
+		}
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+/*
+Flushes the feed's file to disk and closes it. Changes recorded after this are only kept in memory.
+*/
+func (f *changeFeed) close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Sync()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file = nil
+	return err
+}
+
+/*
+Keeps a change in memory, dropping the oldest once there are more than retain. Must be called with the feed's mutex.
+*/
+func (f *changeFeed) add(change Change) {
+	f.changes = append(f.changes, change)
+	if len(f.changes) > f.retain {
+		f.changes = append([]Change(nil), f.changes[len(f.changes)-f.retain:]...)
+	}
+	if change.Seq > f.seq {
+		f.seq = change.Seq
+	}
+}
+
+/*
+Adds a mutation to the feed. Called from recordMutation, so changes get their numbers in the order they happened.
+*/
+func (f *changeFeed) record(ctx context.Context, m Mutation) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	change := Change{Seq: f.seq + 1, Time: m.Time, Op: m.Op, Book: snapshot(m.After), before: snapshot(m.Before)}
+	switch {
+	case m.After == nil:
+		change.Type, change.BookID = "deleted", m.Before.ID
+	case m.Before == nil:
+		change.Type, change.BookID = "created", m.After.ID
+	default:
+		change.Type, change.BookID = "updated", m.After.ID
+	}
+	f.add(change)
+
+	if f.file != nil {
+		line, _ := json.Marshal(change)
+		err := persist(ctx, "changes", func() error {
+			_, err := f.file.Write(append(line, '\n'))
+			return err
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Could not write to the change feed", "err", err)
+		}
+	}
+	close(f.waiting)
+	f.waiting = make(chan struct{})
+}
+
+/*
+The changes after since, up to limit of them. ok is false when changes after since have already been dropped, and the
+client has to download the whole catalog again. It is false too when since is ahead of the feed, which happens when
+the feed's file was lost or replaced and the sequence numbers started again, as the client's copy can't be trusted.
+*/
+func (f *changeFeed) since(since int64, limit int) (changes []Change, latest int64, waiting chan struct{}, ok bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	changes = []Change{}
+	if since > f.seq || (len(f.changes) > 0 && since < f.changes[0].Seq-1) {
+		return changes, f.seq, f.waiting, false
+	}
+	for _, change := range f.changes {
+		if change.Seq > since {
+			changes = append(changes, change)
+			if len(changes) == limit {
+				break
+			}
+		}
+	}
+	return changes, f.seq, f.waiting, true
+}
+
+func (f *changeFeed) latest() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.seq
+}
+
+const maxChangesWait = time.Minute
+
+/*
+GET /changes?since=<seq> returns the changes made after since, oldest first, at most ?limit= of them (default 100).
+With ?wait=<duration>, like 30s, it waits up to that long for a change when there isn't one yet. The response's next
+is what to pass as since to carry on from, and if since is older than the changes kept, or ahead of the feed, it
+answers 410 Gone, and the client should start again from GET /books, which gives the sequence it is up to in the
+X-Change-Seq header.
+*/
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var since int64
+	if query.Get("since") != "" {
+		var err error
+		if since, err = strconv.ParseInt(query.Get("since"), 10, 64); err != nil || since < 0 {
+			http.Error(w, "400, since must be a sequence number", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 100
+	if query.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 1 || limit > 1000 {
+			http.Error(w, "400, limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	var wait time.Duration
+	if query.Get("wait") != "" {
+		var err error
+		if wait, err = time.ParseDuration(query.Get("wait")); err != nil || wait < 0 {
+			http.Error(w, "400, wait must be a duration like 30s", http.StatusBadRequest)
+			return
+		}
+		if wait > maxChangesWait {
+			wait = maxChangesWait
+		}
+	}
+
+	changes, latest, waiting, ok := feed.since(since, limit)
+	if ok && len(changes) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-waiting:
+			changes, latest, _, ok = feed.since(since, limit)
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		problem := "changes after " + strconv.FormatInt(since, 10) + " are no longer kept, download the catalog again"
+		if since > latest {
+			problem = "the change feed is only up to " + strconv.FormatInt(latest, 10) + ", download the catalog again"
+		}
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  problem,
+			"latest": latest,
+		})
+		return
+	}
+	next := since
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"changes": changes,
+		"next":    next,
+		"latest":  latest,
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Gives the test its own change feed, kept in a temporary file.
+*/
+func withChangeFeed(t *testing.T, retain int) string {
+	saved := feed
+	t.Cleanup(func() { feed = saved })
+	path := filepath.Join(t.TempDir(), "changes.jsonl")
+	feed = newChangeFeed(retain)
+	if err := feed.open(path); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+type changePage struct {
+	Changes []Change
+	Next    int64
+	Latest  int64
+}
+
+func getChanges(t *testing.T, query string) (int, changePage) {
+	w := formRequest(requireRole(routes()), "GET", "/changes"+query, nil)
+	var page changePage
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, page
+}
+
+func TestChangeFeed(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+
+	data := url.Values{"title": {"Book 3"}, "publishdate": {"11111113"}, "rating": {"2"}, "ischeckedin": {"true"}}
+	formRequest(requireRole(routes()), "POST", "/new", data)
+	formRequest(requireRole(routes()), "POST", "/books/book-3/checkout", nil)
+	formRequest(requireRole(routes()), "DELETE", "/books/book-3", nil)
+
+	_, page := getChanges(t, "")
+	if len(page.Changes) != 3 || page.Next != 3 || page.Latest != 3 {
+		t.Fatal("Expected 3 changes. Recieved ", page)
+	}
+	for i, want := range []string{"created", "updated", "deleted"} {
+		change := page.Changes[i]
+		if change.Seq != int64(i+1) || change.Type != want || change.BookID != 3 {
+			t.Error("Change ", i, " incorrect. Recieved ", change)
+		}
+	}
+	if page.Changes[1].Op != "checkout" || page.Changes[1].Book.Status != StatusCheckedOut {
+		t.Error("The checkout was not in the feed. Recieved ", page.Changes[1])
+	}
+	if page.Changes[2].Book != nil {
+		t.Error("A tombstone should not carry the book")
+	}
+
+	_, page = getChanges(t, "?since=1&limit=1")
+	if len(page.Changes) != 1 || page.Changes[0].Seq != 2 || page.Next != 2 {
+		t.Error("Paging incorrect. Recieved ", page)
+	}
+
+	w := formRequest(requireRole(routes()), "GET", "/books", nil)
+	if w.Header().Get("X-Change-Seq") != "3" {
+		t.Error("Expected X-Change-Seq 3. Recieved ", w.Header().Get("X-Change-Seq"))
+	}
+
+	for _, bad := range []string{"?since=-1", "?since=x", "?limit=0", "?wait=soon"} {
+		if code, _ := getChanges(t, bad); code != http.StatusBadRequest {
+			t.Error("Expected Response code 400 for ", bad, ". Recieved ", code)
+		}
+	}
+}
+
+func TestChangeFeedRetention(t *testing.T) {
+	path := withChangeFeed(t, 2)
+	readFromFile("books.csv")
+
+	for _, status := range []string{"in_repair", "available", "lost"} {
+		formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"status": {status}})
+	}
+	if code, _ := getChanges(t, "?since=0"); code != http.StatusGone {
+		t.Error("Expected Response code 410 for changes no longer kept. Recieved ", code)
+	}
+	if code, _ := getChanges(t, "?since=4"); code != http.StatusGone {
+		t.Error("Expected Response code 410 for a sequence the feed hasn't reached. Recieved ", code)
+	}
+	if code, page := getChanges(t, "?since=1"); code != http.StatusOK || len(page.Changes) != 2 {
+		t.Error("Expected the 2 kept changes. Recieved ", code, " ", page)
+	}
+
+	// Starting again from the file carries on the sequence
+	feed = newChangeFeed(2)
+	if err := feed.open(path); err != nil {
+		t.Fatal(err)
+	}
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"status": {"available"}})
+	if _, page := getChanges(t, "?since=2"); len(page.Changes) != 2 || page.Changes[1].Seq != 4 {
+		t.Error("The sequence did not survive a restart. Recieved ", page)
+	}
+}
+
+/*
+A change cut short by a crash is dropped, and the next one starts on a line of its own.
+*/
+func TestChangeFeedTornTail(t *testing.T) {
+	path := withChangeFeed(t, 10)
+	readFromFile("books.csv")
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"status": {"in_repair"}})
+	feed.close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"time":"2026-`)
+	f.Close()
+
+	for restart := 0; restart < 2; restart++ {
+		feed = newChangeFeed(10)
+		if err := feed.open(path); err != nil {
+			t.Fatal(err)
+		}
+		if restart == 0 {
+			formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"status": {"available"}})
+		}
+		feed.close()
+	}
+	if changes, _, _, _ := feed.since(0, 10); len(changes) != 2 || changes[1].Seq != 2 || changes[1].Book.Status != StatusAvailable {
+		t.Error("Expected both changes back after the torn line. Recieved ", changes)
+	}
+	data, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(lines) != 2 {
+		t.Error("Expected the torn line cut off. Recieved ", string(data))
+	}
+}
+
+func TestChangeFeedLongPoll(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+
+	start := time.Now()
+	if _, page := getChanges(t, "?wait=50ms"); len(page.Changes) != 0 || time.Since(start) < 50*time.Millisecond {
+		t.Error("Expected to wait and get nothing. Recieved ", page)
+	}
+
+	done := make(chan changePage)
+	go func() {
+		_, page := getChanges(t, "?since=0&wait=10s")
+		done <- page
+	}()
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	before := Books[0]
+	Books[0].setStatus(StatusInRepair)
+	recordMutation(nil, "update", &before, &Books[0])
+	mutex.Unlock()
+
+	select {
+	case page := <-done:
+		if len(page.Changes) != 1 || page.Changes[0].Seq != 1 {
+			t.Error("Expected the new change. Recieved ", page)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The long poll was not woken by the change")
+	}
+}
@@ -0,0 +1,349 @@
+package client
+
+import (
+	"context"
+	"iter"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BookStatus string
+
+const (
+	StatusAvailable  BookStatus = "available"
+	StatusCheckedOut BookStatus = "checked_out"
+	StatusOnHold     BookStatus = "on_hold"
+	StatusInRepair   BookStatus = "in_repair"
+	StatusLost       BookStatus = "lost"
+	StatusWithdrawn  BookStatus = "withdrawn"
+)
+
+/*
+A book, as the API sends it.
+*/
+type Book struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Author      string     `json:"author"`
+	Publisher   string     `json:"publisher"`
+	PublishDate string     `json:"publishdate"` // MMDDYYYY
+	Rating      int        `json:"rating"`
+	IsCheckedIn bool       `json:"ischeckedin"`
+	Status      BookStatus `json:"status"`
+
+	RatingAverage      float64     `json:"ratingaverage"`
+	RatingCount        int         `json:"ratingcount"`
+	RatingDistribution map[int]int `json:"ratingdistribution"`
+	ReviewCount        int         `json:"reviewcount"`
+
+	Tags       []string `json:"tags,omitempty"`
+	Genres     []string `json:"genres,omitempty"`
+	CallNumber string   `json:"callnumber,omitempty"`
+}
+
+/*
+The id a book has in the API's URLs, its title with spaces replaced by dashes.
+*/
+func BookID(title string) string {
+	return strings.ReplaceAll(title, " ", "-")
+}
+
+func (b Book) URLID() string {
+	return BookID(b.Title)
+}
+
+/*
+What a new book is made from. Title, PublishDate and Rating are required.
+*/
+type NewBook struct {
+	Title       string
+	Author      string
+	Publisher   string
+	PublishDate string // MMDDYYYY
+	Rating      int
+	Status      BookStatus // Available when empty
+	Tags        []string
+	Genres      []string
+	CallNumber  string
+}
+
+/*
+The changes to make to a book. Nil fields are left as they are. Tags and Genres replace the book's when they aren't
+nil, so an empty slice clears them.
+*/
+type BookUpdate struct {
+	Title       *string
+	Author      *string
+	Publisher   *string
+	PublishDate *string
+	Rating      *int
+	Status      *BookStatus
+	Tags        []string
+	Genres      []string
+	CallNumber  *string
+}
+
+/*
+Filters for ListBooks. Withdrawn books are left out unless Status asks for them.
+*/
+type ListOptions struct {
+	Status     BookStatus
+	Tags       []string // Books with all of them
+	Genres     []string // Books within all of them
+	ShelfOrder bool     // Sort by call number instead of the order the books were added
+}
+
+func (o ListOptions) query() url.Values {
+	query := url.Values{}
+	if o.Status != "" {
+		query.Set("status", string(o.Status))
+	}
+	for _, tag := range o.Tags {
+		query.Add("tag", tag)
+	}
+	for _, genre := range o.Genres {
+		query.Add("genre", genre)
+	}
+	if o.ShelfOrder {
+		query.Set("sort", "callnumber")
+	}
+	return query
+}
+
+func bookPath(id string) string {
+	return "/books/" + url.PathEscape(id)
+}
+
+func (c *Client) ListBooks(ctx context.Context, options ListOptions) ([]Book, error) {
+	var books []Book
+	err := c.do(ctx, "GET", "/books", options.query(), nil, &books)
+	return books, err
+}
+
+/*
+The books ListBooks returns, one at a time. The API sends the whole list in one response, so this is for code that
+wants to treat every listing the same way as the paged ones.
+*/
+func (c *Client) Books(ctx context.Context, options ListOptions) iter.Seq2[Book, error] {
+	return func(yield func(Book, error) bool) {
+		books, err := c.ListBooks(ctx, options)
+		if err != nil {
+			yield(Book{}, err)
+			return
+		}
+		for _, book := range books {
+			if !yield(book, nil) {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) GetBook(ctx context.Context, id string) (*Book, error) {
+	var book Book
+	if err := c.do(ctx, "GET", bookPath(id), nil, nil, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+/*
+Adds a book, and returns it as it was added, with its ID.
+*/
+func (c *Client) CreateBook(ctx context.Context, book NewBook) (*Book, error) {
+	form := url.Values{
+		"title":       {book.Title},
+		"author":      {book.Author},
+		"publisher":   {book.Publisher},
+		"publishdate": {book.PublishDate},
+		"rating":      {strconv.Itoa(book.Rating)},
+	}
+	if book.Status != "" {
+		form.Set("status", string(book.Status))
+	} else {
+		form.Set("status", string(StatusAvailable))
+	}
+	if book.CallNumber != "" {
+		form.Set("callnumber", book.CallNumber)
+	}
+	if len(book.Tags) > 0 {
+		form["tag"] = book.Tags
+	}
+	if len(book.Genres) > 0 {
+		form["genre"] = book.Genres
+	}
+	var created Book
+	if err := c.do(ctx, "POST", "/new", nil, form, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+func (c *Client) UpdateBook(ctx context.Context, id string, update BookUpdate) (*Book, error) {
+	form := url.Values{}
+	set := func(name string, value *string) {
+		if value != nil {
+			form.Set(name, *value)
+		}
+	}
+	set("title", update.Title)
+	set("author", update.Author)
+	set("publisher", update.Publisher)
+	set("publishdate", update.PublishDate)
+	set("callnumber", update.CallNumber)
+	if update.Rating != nil {
+		form.Set("rating", strconv.Itoa(*update.Rating))
+	}
+	if update.Status != nil {
+		form.Set("status", string(*update.Status))
+	}
+	// An empty value clears them, as a field with no values wouldn't be sent at all
+	if update.Tags != nil {
+		form["tag"] = append([]string{""}, update.Tags...)
+	}
+	if update.Genres != nil {
+		form["genre"] = append([]string{""}, update.Genres...)
+	}
+
+	var book Book
+	if err := c.do(ctx, "PATCH", bookPath(id), nil, form, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+/*
+Moves a book to the trash, where a librarian can restore it from.
+*/
+func (c *Client) DeleteBook(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", bookPath(id), nil, nil, nil)
+}
+
+/*
+Deletes a book for good, without going through the trash.
+*/
+func (c *Client) PurgeBook(ctx context.Context, id string) error {
+	return c.do(ctx, "DELETE", bookPath(id), url.Values{"purge": {"true"}}, nil, nil)
+}
+
+func (c *Client) Checkout(ctx context.Context, id string) (*Book, error) {
+	var book Book
+	if err := c.do(ctx, "POST", bookPath(id)+"/checkout", nil, url.Values{}, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+func (c *Client) Checkin(ctx context.Context, id string) (*Book, error) {
+	var book Book
+	if err := c.do(ctx, "POST", bookPath(id)+"/checkin", nil, url.Values{}, &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+/*
+Gives the book a status that circulation doesn't cover, like in_repair or lost.
+*/
+func (c *Client) SetStatus(ctx context.Context, id string, status BookStatus) (*Book, error) {
+	return c.UpdateBook(ctx, id, BookUpdate{Status: &status})
+}
+
+type Review struct {
+	ID           int       `json:"id"`
+	Patron       string    `json:"patron"`
+	Text         string    `json:"text"`
+	State        string    `json:"state"` // pending, published or rejected
+	HelpfulVotes int       `json:"helpfulvotes"`
+	Created      time.Time `json:"created"`
+	Updated      time.Time `json:"updated"`
+}
+
+type ReviewOptions struct {
+	State   string // published when empty, the others need a librarian
+	Sort    string // helpful (the default), newest or oldest
+	PerPage int    // 10 when 0, at most 100
+}
+
+/*
+Every review of a book, fetched a page at a time as the loop gets to them.
+*/
+func (c *Client) Reviews(ctx context.Context, id string, options ReviewOptions) iter.Seq2[Review, error] {
+	return func(yield func(Review, error) bool) {
+		query := url.Values{}
+		if options.State != "" {
+			query.Set("state", options.State)
+		}
+		if options.Sort != "" {
+			query.Set("sort", options.Sort)
+		}
+		if options.PerPage > 0 {
+			query.Set("perpage", strconv.Itoa(options.PerPage))
+		}
+		for page := 1; ; page++ {
+			query.Set("page", strconv.Itoa(page))
+			var result struct {
+				Reviews []Review `json:"reviews"`
+				PerPage int      `json:"perpage"`
+				Total   int      `json:"total"`
+			}
+			if err := c.do(ctx, "GET", bookPath(id)+"/reviews", query, nil, &result); err != nil {
+				yield(Review{}, err)
+				return
+			}
+			for _, review := range result.Reviews {
+				if !yield(review, nil) {
+					return
+				}
+			}
+			if len(result.Reviews) == 0 || page*result.PerPage >= result.Total {
+				return
+			}
+		}
+	}
+}
+
+/*
+One change to the catalog. Book is nil when it was deleted.
+*/
+type Change struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"` // created, updated or deleted
+	Op     string    `json:"op"`   // The mutation behind it, like checkout or revert
+	BookID int       `json:"bookid"`
+	Book   *Book     `json:"book,omitempty"`
+}
+
+/*
+The changes made after since, oldest first, fetched in pages of up to 100 until the loop has caught up with the
+server. If the server no longer has the changes after since the error is ErrGone, and the catalog should be listed
+again. The Seq of the last change seen is what to pass as since next time.
+*/
+func (c *Client) Changes(ctx context.Context, since int64) iter.Seq2[Change, error] {
+	return func(yield func(Change, error) bool) {
+		for {
+			var result struct {
+				Changes []Change `json:"changes"`
+				Next    int64    `json:"next"`
+				Latest  int64    `json:"latest"`
+			}
+			query := url.Values{"since": {strconv.FormatInt(since, 10)}, "limit": {"100"}}
+			if err := c.do(ctx, "GET", "/changes", query, nil, &result); err != nil {
+				yield(Change{}, err)
+				return
+			}
+			for _, change := range result.Changes {
+				if !yield(change, nil) {
+					return
+				}
+			}
+			if len(result.Changes) == 0 || result.Next >= result.Latest {
+				return
+			}
+			since = result.Next
+		}
+	}
+}
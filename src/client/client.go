@@ -0,0 +1,265 @@
+/*
+Package client is a Go client for the books API.
+
+	c, err := client.New("http://localhost:8080", client.WithAPIKey(os.Getenv("BOOKS_API_KEY")))
+	if err != nil {
+		return err
+	}
+	book, err := c.GetBook(ctx, client.BookID("The Hobbit"))
+	if errors.Is(err, client.ErrNotFound) {
+		...
+	}
+
+Every call takes a context, which bounds the whole call including retries. Calls that are safe to repeat (GET and
+DELETE) are retried with a growing backoff when the server can't be reached, is overloaded, or rate limits the
+client. Errors the API answers with are *Error, which errors.Is matches against ErrNotFound, ErrConflict and the rest.
+*/
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Talks to one server. It is safe to use from more than one goroutine.
+*/
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	apiKey     string
+	token      string
+	userAgent  string
+
+	maxRetries int
+	backoff    time.Duration // Before the first retry, doubled after each one
+	maxBackoff time.Duration
+}
+
+type Option func(*Client)
+
+/*
+Authenticates with an API key, sent in X-API-Key.
+*/
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+/*
+Authenticates with a bearer token, either one from POST /auth/token or a JWT.
+*/
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+/*
+Sends requests with the given client instead of one with a 30 second timeout.
+*/
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+/*
+How many times a call that is safe to repeat is retried, and how long to wait before the first retry. The wait doubles
+after each retry, up to 30 seconds. The default is 3 retries starting at 200ms, and 0 turns retries off.
+*/
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.backoff = maxRetries, backoff }
+}
+
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) { c.userAgent = userAgent }
+}
+
+/*
+A client for the server at baseURL, like "http://localhost:8080".
+*/
+func New(baseURL string, options ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("client: base URL must be an http or https URL, was %q", baseURL)
+	}
+	c := &Client{
+		baseURL:    u,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		userAgent:  "books-go-client",
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+		maxBackoff: 30 * time.Second,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrGone         = errors.New("gone")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrUnavailable  = errors.New("unavailable")
+)
+
+/*
+An error the API answered with. Message is the API's own, without the status code it starts with.
+*/
+type Error struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // From the Retry-After header of a 429, 0 otherwise
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("books API: %v %v", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("books API: %v %v", e.StatusCode, e.Message)
+}
+
+/*
+Lets errors.Is(err, ErrNotFound) and the like work.
+*/
+func (e *Error) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrBadRequest
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusGone:
+		return target == ErrGone
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return target == ErrUnavailable
+	}
+	return false
+}
+
+/*
+Errors are plain text starting with the status code, like "404, not found.", apart from a few JSON ones with an
+error field.
+*/
+func responseError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	e := &Error{StatusCode: resp.StatusCode}
+	var problem struct{ Error string }
+	if json.Unmarshal(body, &problem) == nil && problem.Error != "" {
+		e.Message = problem.Error
+	} else {
+		message := strings.TrimSpace(string(body))
+		code := strconv.Itoa(resp.StatusCode)
+		if strings.HasPrefix(message, code) {
+			message = strings.TrimLeft(strings.TrimPrefix(message, code), ", ")
+		}
+		e.Message = message
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "PUT" || method == "DELETE"
+}
+
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+/*
+Sends a request and decodes the JSON response into out, when out isn't nil. path is already escaped, like bookPath
+gives, and form is sent form encoded when it isn't nil. Calls that are safe to repeat are retried when they fail in a
+way that might not happen again.
+*/
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, form url.Values, out interface{}) error {
+	u := *c.baseURL
+	u.RawPath = u.EscapedPath() + path
+	var err error
+	if u.Path, err = url.PathUnescape(u.RawPath); err != nil {
+		return fmt.Errorf("books API: %v %v: %w", method, path, err)
+	}
+	u.RawQuery = query.Encode()
+
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, u.String(), form)
+		if err == nil && resp.StatusCode < 300 {
+			defer resp.Body.Close()
+			if out == nil {
+				return nil
+			}
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("books API: decoding the response to %v %v: %w", method, path, err)
+			}
+			return nil
+		}
+
+		var apiErr *Error
+		if err == nil {
+			apiErr = responseError(resp)
+			resp.Body.Close()
+			err = apiErr
+		}
+		if ctx.Err() != nil || !idempotent(method) || attempt >= c.maxRetries || (apiErr != nil && !retryable(apiErr.StatusCode)) {
+			return err
+		}
+
+		// Full jitter, so clients that failed together don't all come back together
+		delay := time.Duration(rand.Int64N(int64(wait) + 1))
+		if apiErr != nil && apiErr.RetryAfter > delay {
+			delay = apiErr.RetryAfter
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		wait = min(wait*2, c.maxBackoff)
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, target string, form url.Values) (*http.Response, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.httpClient.Do(req)
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+A server that answers each request with the next status in statuses, and with body once they run out.
+*/
+func flakyServer(t *testing.T, body string, statuses ...int) (*Client, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if call := int(calls.Add(1)); call <= len(statuses) {
+			http.Error(w, fmt.Sprintf("%v, try again", statuses[call-1]), statuses[call-1])
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+	c, err := New(server.URL, WithRetries(3, time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, &calls
+}
+
+func TestRetries(t *testing.T) {
+	c, calls := flakyServer(t, `{"title":"Book 1"}`, http.StatusServiceUnavailable, http.StatusBadGateway)
+	book, err := c.GetBook(context.Background(), "Book-1")
+	if err != nil || book.Title != "Book 1" || calls.Load() != 3 {
+		t.Error("Expected the GET to be tried again until it worked. Recieved ", book, " ", err, " after ", calls.Load(), " calls")
+	}
+
+	c, calls = flakyServer(t, `{}`, http.StatusServiceUnavailable)
+	if _, err := c.Checkout(context.Background(), "Book-1"); !errors.Is(err, ErrUnavailable) || calls.Load() != 1 {
+		t.Error("Expected a POST not to be tried again. Recieved ", err, " after ", calls.Load(), " calls")
+	}
+
+	c, calls = flakyServer(t, `{}`, http.StatusNotFound)
+	if _, err := c.GetBook(context.Background(), "Book-1"); !errors.Is(err, ErrNotFound) || calls.Load() != 1 {
+		t.Error("Expected a 404 not to be tried again. Recieved ", err, " after ", calls.Load(), " calls")
+	}
+
+	c, calls = flakyServer(t, `[]`, 503, 503, 503, 503, 503)
+	if _, err := c.ListBooks(context.Background(), ListOptions{}); !errors.Is(err, ErrUnavailable) || calls.Load() != 4 {
+		t.Error("Expected the retries to run out. Recieved ", err, " after ", calls.Load(), " calls")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	var retried time.Time
+	started := time.Now()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		retried = time.Now()
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	c, _ := New(server.URL, WithRetries(1, time.Millisecond))
+	if _, err := c.ListBooks(context.Background(), ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if retried.Sub(started) < time.Second {
+		t.Error("Expected the client to wait as long as Retry-After said. Recieved ", retried.Sub(started))
+	}
+
+	calls.Store(0)
+	c, _ = New(server.URL, WithRetries(0, 0))
+	_, err := c.ListBooks(context.Background(), ListOptions{})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || !errors.Is(err, ErrRateLimited) || apiErr.RetryAfter != time.Second {
+		t.Error("Expected a rate limit error. Recieved ", err)
+	}
+}
+
+func TestRetriesStopWithContext(t *testing.T) {
+	c, calls := flakyServer(t, `[]`, 503, 503, 503, 503)
+	c.backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := c.ListBooks(ctx, ListOptions{}); !errors.Is(err, ErrUnavailable) || time.Since(started) > time.Second {
+		t.Error("Expected the wait to end with the context. Recieved ", err, " after ", time.Since(started), " and ", calls.Load(), " calls")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		body    string
+		target  error
+		message string
+	}{
+		{400, "400, rating not on 1-3 scale\n", ErrBadRequest, "rating not on 1-3 scale"},
+		{401, "401, authentication required\n", ErrUnauthorized, "authentication required"},
+		{403, "403, librarian role required\n", ErrForbidden, "librarian role required"},
+		{404, "404 not found\n", ErrNotFound, "not found"},
+		{409, "409, cannot checkout a book that is lost\n", ErrConflict, "cannot checkout a book that is lost"},
+		{410, `{"error":"changes after 3 are no longer kept","latest":900}`, ErrGone, "changes after 3 are no longer kept"},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		c, _ := New(server.URL)
+		_, err := c.GetBook(context.Background(), "Book-1")
+		server.Close()
+
+		var apiErr *Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != test.status || apiErr.Message != test.message || !errors.Is(err, test.target) {
+			t.Error("Expected ", test.target, " with ", strconv.Quote(test.message), ". Recieved ", err)
+		}
+		if errors.Is(err, ErrUnavailable) {
+			t.Error("Expected ", test.status, " not to match other errors")
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, bad := range []string{"", "localhost:8080", "ftp://example.com", "http://"} {
+		if _, err := New(bad); err == nil {
+			t.Error("Expected ", bad, " to be refused")
+		}
+	}
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+	c, _ := New(server.URL+"/", WithAPIKey("key"), WithBearerToken("token"), WithUserAgent("tests"))
+	c.ListBooks(context.Background(), ListOptions{})
+	if header.Get("X-API-Key") != "key" || header.Get("Authorization") != "Bearer token" || header.Get("User-Agent") != "tests" {
+		t.Error("Expected the credentials to be sent. Recieved ", header)
+	}
+}
+
+/*
+Book ids are escaped once, however the title is written and whatever path the server is under.
+*/
+func TestEscapedPaths(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path, r.URL.EscapedPath())
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+	c, _ := New(server.URL + "/library/")
+
+	if _, err := c.GetBook(context.Background(), BookID("Café au lait?")); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 || paths[0] != "/library/books/Café-au-lait?" || paths[1] != "/library/books/Caf%C3%A9-au-lait%3F" {
+		t.Error("Expected the id escaped once. Recieved ", paths)
+	}
+}
+
+func TestReviewPages(t *testing.T) {
+	var pages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		pages = append(pages, r.URL.Query().Get("page"))
+		reviews := `{"id":` + strconv.Itoa(page*2-1) + `},{"id":` + strconv.Itoa(page*2) + `}`
+		if page == 3 {
+			reviews = `{"id":5}`
+		}
+		fmt.Fprintf(w, `{"reviews":[%v],"page":%v,"perpage":2,"total":5}`, reviews, page)
+	}))
+	defer server.Close()
+	c, _ := New(server.URL)
+
+	var ids []int
+	for review, err := range c.Reviews(context.Background(), "Book-1", ReviewOptions{PerPage: 2}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, review.ID)
+	}
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" || len(pages) != 3 {
+		t.Error("Expected every page. Recieved ", ids, " from pages ", pages)
+	}
+
+	pages = nil
+	for review := range c.Reviews(context.Background(), "Book-1", ReviewOptions{PerPage: 2}) {
+		if review.ID == 2 {
+			break
+		}
+	}
+	if len(pages) != 1 {
+		t.Error("Expected no more pages once the loop stopped. Recieved ", pages)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RESTChallenge/client"
+)
+
+/*
+What the commands work on, either a running server or a csv file.
+*/
+type catalog interface {
+	list(ctx context.Context, options client.ListOptions) ([]client.Book, error)
+	get(ctx context.Context, id string) (*client.Book, error)
+	add(ctx context.Context, book client.NewBook) (*client.Book, error)
+	edit(ctx context.Context, id string, update client.BookUpdate) (*client.Book, error)
+	remove(ctx context.Context, id string, purge bool) error
+	checkout(ctx context.Context, id string) (*client.Book, error)
+	checkin(ctx context.Context, id string) (*client.Book, error)
+}
+
+type remoteCatalog struct {
+	c *client.Client
+}
+
+func (r remoteCatalog) list(ctx context.Context, options client.ListOptions) ([]client.Book, error) {
+	return r.c.ListBooks(ctx, options)
+}
+
+func (r remoteCatalog) get(ctx context.Context, id string) (*client.Book, error) {
+	return r.c.GetBook(ctx, id)
+}
+
+func (r remoteCatalog) add(ctx context.Context, book client.NewBook) (*client.Book, error) {
+	return r.c.CreateBook(ctx, book)
+}
+
+func (r remoteCatalog) edit(ctx context.Context, id string, update client.BookUpdate) (*client.Book, error) {
+	return r.c.UpdateBook(ctx, id, update)
+}
+
+func (r remoteCatalog) remove(ctx context.Context, id string, purge bool) error {
+	if purge {
+		return r.c.PurgeBook(ctx, id)
+	}
+	return r.c.DeleteBook(ctx, id)
+}
+
+func (r remoteCatalog) checkout(ctx context.Context, id string) (*client.Book, error) {
+	return r.c.Checkout(ctx, id)
+}
+
+func (r remoteCatalog) checkin(ctx context.Context, id string) (*client.Book, error) {
+	return r.c.Checkin(ctx, id)
+}
+
+/*
+A csv file in the format the server keeps its catalog in, see readFromFile in the server. Every change rewrites the
+whole file, so it shouldn't be used on a file a running server has open, as the server would write its own copy over it
+when it stops.
+Tags, genres and call numbers are shown but can only be changed on a server, which knows the genre vocabulary. The
+columns after them, like reviews and revisions, are written back as they were read.
+*/
+type fileCatalog struct {
+	path    string
+	books   []client.Book
+	rows    map[int][]string       // Each book's row as it was read, keyed by ID
+	ratings map[int]map[string]int // Each book's ratings by patron, with "" for the catalog's own
+	trash   [][]string             // Deleted books, written back as they were read
+	nextID  int
+}
+
+/*
+The first row of the file when it keeps the ID the next book gets.
+*/
+const nextIDColumn = "#next-id"
+
+// The columns after the first six
+const (
+	ratingsColumn = 6 + iota
+	reviewsColumn
+	tagsColumn
+	genresColumn
+	callNumberColumn
+	idColumn
+	revisionsColumn
+	deletedAtColumn
+)
+
+func openFile(path string) (*fileCatalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cat, err := readCatalog(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	cat.path = path
+	return cat, nil
+}
+
+/*
+Reads books in the server's csv format, leaving out the ones in the trash.
+*/
+func readBooks(r io.Reader) ([]client.Book, error) {
+	cat, err := readCatalog(r)
+	if err != nil {
+		return nil, err
+	}
+	return cat.books, nil
+}
+
+/*
+Reads the server's csv format. Older files have only the first six columns, with true/false in the last one instead of
+the status, and their books are numbered in order after any IDs already taken, as the server does.
+*/
+func readCatalog(r io.Reader) (*fileCatalog, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	cat := &fileCatalog{rows: map[int][]string{}, ratings: map[int]map[string]int{}, nextID: 1}
+	type row struct {
+		book    client.Book
+		record  []string
+		ratings map[string]int
+	}
+	var rows []row
+	for i, record := range records {
+		if record[0] == nextIDColumn && len(record) == 2 {
+			if next, err := strconv.Atoi(record[1]); err == nil && next > cat.nextID {
+				cat.nextID = next
+			}
+			continue
+		}
+		if len(record) < 6 {
+			return nil, fmt.Errorf("line %v: expected at least 6 fields, found %v", i+1, len(record))
+		}
+		if column(record, deletedAtColumn) != "" {
+			cat.trash = append(cat.trash, record)
+			if id, _ := strconv.Atoi(record[idColumn]); id >= cat.nextID {
+				cat.nextID = id + 1
+			}
+			continue
+		}
+		book, ratings, err := parseRecord(record)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		if book.ID >= cat.nextID {
+			cat.nextID = book.ID + 1
+		}
+		rows = append(rows, row{book, record, ratings})
+	}
+	for _, row := range rows {
+		if row.book.ID == 0 || cat.rows[row.book.ID] != nil {
+			row.book.ID = cat.nextID
+			cat.nextID++
+		}
+		cat.rows[row.book.ID] = row.record
+		cat.ratings[row.book.ID] = row.ratings
+		cat.books = append(cat.books, row.book)
+	}
+	return cat, nil
+}
+
+func column(record []string, i int) string {
+	if i < len(record) {
+		return record[i]
+	}
+	return ""
+}
+
+func parseRecord(record []string) (client.Book, map[string]int, error) {
+	book := client.Book{Title: record[0], Author: record[1], Publisher: record[2], PublishDate: record[3]}
+	book.Rating, _ = strconv.Atoi(record[4])
+	if checkedIn, err := strconv.ParseBool(record[5]); err == nil {
+		book.Status = client.StatusAvailable
+		if !checkedIn {
+			book.Status = client.StatusCheckedOut
+		}
+	} else if status := client.BookStatus(strings.ToLower(strings.TrimSpace(record[5]))); transitions[status] != nil {
+		book.Status = status
+	} else {
+		return book, nil, fmt.Errorf("unknown status %q", record[5])
+	}
+	book.IsCheckedIn = isCheckedIn(book.Status)
+	if id := column(record, idColumn); id != "" {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 1 {
+			return book, nil, fmt.Errorf("bad ID %q", id)
+		}
+		book.ID = n
+	}
+	book.CallNumber = column(record, callNumberColumn)
+
+	var ratings map[string]int
+	var reviews []struct {
+		State string `json:"state"`
+	}
+	for _, cell := range []struct {
+		name  string
+		i     int
+		value interface{}
+	}{
+		{"tags", tagsColumn, &book.Tags},
+		{"genres", genresColumn, &book.Genres},
+		{"ratings", ratingsColumn, &ratings},
+		{"reviews", reviewsColumn, &reviews},
+	} {
+		if value := column(record, cell.i); value != "" {
+			if err := json.Unmarshal([]byte(value), cell.value); err != nil {
+				return book, nil, fmt.Errorf("%v: %w", cell.name, err)
+			}
+		}
+	}
+	for _, review := range reviews {
+		if review.State == "published" {
+			book.ReviewCount++
+		}
+	}
+	if ratings == nil && book.Rating >= 1 && book.Rating <= 3 {
+		ratings = map[string]int{"": book.Rating}
+	}
+	summarizeRating(&book, ratings)
+	return book, ratings, nil
+}
+
+/*
+The book's row, with the columns bookctl doesn't change kept as they were read.
+*/
+func (f *fileCatalog) record(book client.Book) []string {
+	record := make([]string, revisionsColumn+1)
+	copy(record, f.rows[book.ID])
+	copy(record, []string{book.Title, book.Author, book.Publisher, book.PublishDate, strconv.Itoa(book.Rating), string(book.Status)})
+	record[idColumn] = strconv.Itoa(book.ID)
+	record[ratingsColumn] = ""
+	if ratings := f.ratings[book.ID]; len(ratings) > 0 {
+		data, _ := json.Marshal(ratings)
+		record[ratingsColumn] = string(data)
+	}
+	return record
+}
+
+/*
+Writes books as the first six columns of the server's format, which is all an import needs.
+*/
+func writeBooks(w io.Writer, books []client.Book) error {
+	cw := csv.NewWriter(w)
+	for _, book := range books {
+		cw.Write([]string{book.Title, book.Author, book.Publisher, book.PublishDate, strconv.Itoa(book.Rating), string(book.Status)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+/*
+The same moves between statuses the server allows. Staying in the same status is always allowed.
+*/
+var transitions = map[client.BookStatus][]client.BookStatus{
+	client.StatusAvailable:  {client.StatusCheckedOut, client.StatusOnHold, client.StatusInRepair, client.StatusLost, client.StatusWithdrawn},
+	client.StatusCheckedOut: {client.StatusAvailable, client.StatusInRepair, client.StatusLost},
+	client.StatusOnHold:     {client.StatusAvailable, client.StatusCheckedOut, client.StatusLost},
+	client.StatusInRepair:   {client.StatusAvailable, client.StatusLost, client.StatusWithdrawn},
+	client.StatusLost:       {client.StatusAvailable, client.StatusWithdrawn},
+	client.StatusWithdrawn:  {client.StatusAvailable},
+}
+
+func canTransition(from, to client.BookStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func isCheckedIn(status client.BookStatus) bool {
+	return status != client.StatusCheckedOut && status != client.StatusLost
+}
+
+/*
+Works out the rating summary the way the server does. Files from before patrons could rate books keep one rating a
+book, which counts as the only rating it has been given.
+*/
+func summarizeRating(book *client.Book, ratings map[string]int) {
+	book.RatingDistribution = map[int]int{1: 0, 2: 0, 3: 0}
+	book.RatingAverage, book.RatingCount, book.Rating = 0, len(ratings), 0
+	if len(ratings) == 0 {
+		return
+	}
+	total := 0
+	for _, rating := range ratings {
+		total += rating
+		book.RatingDistribution[rating]++
+	}
+	book.RatingAverage = math.Round(float64(total)/float64(len(ratings))*100) / 100
+	book.Rating = int(math.Round(float64(total) / float64(len(ratings))))
+}
+
+/*
+Checks a book the way the server's /new and PATCH handlers do.
+*/
+func validate(book client.Book) error {
+	if book.Title == "" {
+		return fmt.Errorf("%w: a title is required", client.ErrBadRequest)
+	}
+	if _, err := strconv.Atoi(book.PublishDate); err != nil || len(book.PublishDate) != 8 {
+		return fmt.Errorf("%w: publishdate must be 8 digits, MMDDYYYY", client.ErrBadRequest)
+	}
+	if book.Rating < 1 || book.Rating > 3 {
+		return fmt.Errorf("%w: rating not on 1-3 scale", client.ErrBadRequest)
+	}
+	if transitions[book.Status] == nil {
+		return fmt.Errorf("%w: unknown status %q", client.ErrBadRequest, book.Status)
+	}
+	return nil
+}
+
+func (f *fileCatalog) find(id string) (int, error) {
+	for i, book := range f.books {
+		if strings.EqualFold(id, book.URLID()) {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%w: no book %v in %v", client.ErrNotFound, id, f.path)
+}
+
+/*
+Writes the catalog next to the file and renames it over the file, so a failure part way through leaves the file whole.
+*/
+func (f *fileCatalog) save() error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), ".bookctl-*.csv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if info, err := os.Stat(f.path); err == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+	w := csv.NewWriter(tmp)
+	w.Write([]string{nextIDColumn, strconv.Itoa(f.nextID)})
+	for _, book := range f.books {
+		w.Write(f.record(book))
+	}
+	w.WriteAll(f.trash)
+	if err := w.Error(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *fileCatalog) list(ctx context.Context, options client.ListOptions) ([]client.Book, error) {
+	if len(options.Tags) > 0 || len(options.Genres) > 0 {
+		return nil, errors.New("filtering by tags and genres needs the genre vocabulary, filter by them on a server")
+	}
+	books := []client.Book{}
+	for _, book := range f.books {
+		if (options.Status == "" && book.Status != client.StatusWithdrawn) || book.Status == options.Status {
+			books = append(books, book)
+		}
+	}
+	return books, nil
+}
+
+func (f *fileCatalog) get(ctx context.Context, id string) (*client.Book, error) {
+	i, err := f.find(id)
+	if err != nil {
+		return nil, err
+	}
+	book := f.books[i]
+	return &book, nil
+}
+
+func (f *fileCatalog) add(ctx context.Context, newBook client.NewBook) (*client.Book, error) {
+	if len(newBook.Tags) > 0 || len(newBook.Genres) > 0 || newBook.CallNumber != "" {
+		return nil, errors.New("tags, genres and call numbers can only be set on a server")
+	}
+	book := client.Book{
+		Title:       newBook.Title,
+		Author:      newBook.Author,
+		Publisher:   newBook.Publisher,
+		PublishDate: newBook.PublishDate,
+		Rating:      newBook.Rating,
+		Status:      newBook.Status,
+	}
+	if book.Status == "" {
+		book.Status = client.StatusAvailable
+	}
+	if err := validate(book); err != nil {
+		return nil, err
+	}
+	if _, err := f.find(book.URLID()); err == nil {
+		return nil, fmt.Errorf("%w: %v is already in %v", client.ErrConflict, book.Title, f.path)
+	}
+	book.ID = f.nextID
+	f.nextID++
+	book.IsCheckedIn = isCheckedIn(book.Status)
+	f.ratings[book.ID] = map[string]int{"": book.Rating}
+	summarizeRating(&book, f.ratings[book.ID])
+	f.books = append(f.books, book)
+	return &book, f.save()
+}
+
+func (f *fileCatalog) edit(ctx context.Context, id string, update client.BookUpdate) (*client.Book, error) {
+	if update.Tags != nil || update.Genres != nil || update.CallNumber != nil {
+		return nil, errors.New("tags, genres and call numbers can only be changed on a server")
+	}
+	i, err := f.find(id)
+	if err != nil {
+		return nil, err
+	}
+	book := f.books[i]
+	set := func(field *string, value *string) {
+		if value != nil {
+			*field = *value
+		}
+	}
+	set(&book.Title, update.Title)
+	set(&book.Author, update.Author)
+	set(&book.Publisher, update.Publisher)
+	set(&book.PublishDate, update.PublishDate)
+	if update.Rating != nil {
+		book.Rating = *update.Rating
+	}
+	if update.Status != nil {
+		if !canTransition(book.Status, *update.Status) {
+			return nil, fmt.Errorf("%w: cannot change status from %v to %v", client.ErrConflict, book.Status, *update.Status)
+		}
+		book.Status = *update.Status
+	}
+	if err := validate(book); err != nil {
+		return nil, err
+	}
+	if other, err := f.find(book.URLID()); err == nil && other != i {
+		return nil, fmt.Errorf("%w: %v is already in %v", client.ErrConflict, book.Title, f.path)
+	}
+	book.IsCheckedIn = isCheckedIn(book.Status)
+	if update.Rating != nil {
+		// Like PATCH on the server, the rating given replaces the catalog's own and the patrons' ratings are kept
+		ratings := map[string]int{"": *update.Rating}
+		for patron, rating := range f.ratings[book.ID] {
+			if patron != "" {
+				ratings[patron] = rating
+			}
+		}
+		f.ratings[book.ID] = ratings
+		summarizeRating(&book, ratings)
+	}
+	f.books[i] = book
+	return &book, f.save()
+}
+
+/*
+Moves the book to the trash, where the server can restore it from, or with purge deletes it for good.
+*/
+func (f *fileCatalog) remove(ctx context.Context, id string, purge bool) error {
+	i, err := f.find(id)
+	if err != nil {
+		return err
+	}
+	if !purge {
+		record := append(f.record(f.books[i]), time.Now().UTC().Format(time.RFC3339Nano), "bookctl")
+		f.trash = append(f.trash, record)
+	}
+	delete(f.rows, f.books[i].ID)
+	delete(f.ratings, f.books[i].ID)
+	f.books = append(f.books[:i], f.books[i+1:]...)
+	return f.save()
+}
+
+func (f *fileCatalog) move(id string, action string, target client.BookStatus) (*client.Book, error) {
+	i, err := f.find(id)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransition(f.books[i].Status, target) {
+		return nil, fmt.Errorf("%w: cannot %v a book that is %v", client.ErrConflict, action, f.books[i].Status)
+	}
+	f.books[i].Status = target
+	f.books[i].IsCheckedIn = isCheckedIn(target)
+	book := f.books[i]
+	return &book, f.save()
+}
+
+func (f *fileCatalog) checkout(ctx context.Context, id string) (*client.Book, error) {
+	return f.move(id, "checkout", client.StatusCheckedOut)
+}
+
+func (f *fileCatalog) checkin(ctx context.Context, id string) (*client.Book, error) {
+	return f.move(id, "checkin", client.StatusAvailable)
+}
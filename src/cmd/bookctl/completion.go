@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+/*
+The scripts are made from the commands and their flags, so they can't fall behind them. Book ids are completed by
+running bookctl __ids with the flags given before the command, which lists the catalog they point at.
+*/
+func completionCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return usagef("completion takes the shell: bash, zsh or fish")
+		}
+		switch args[0] {
+		case "bash":
+			writeBash(e.out)
+		case "zsh":
+			fmt.Fprintln(e.out, "# zsh completion for bookctl, load it with: source <(bookctl completion zsh)")
+			fmt.Fprintln(e.out, "autoload -U +X bashcompinit && bashcompinit")
+			writeBash(e.out)
+		case "fish":
+			writeFish(e.out)
+		default:
+			return usagef("no completion for %q, only bash, zsh and fish", args[0])
+		}
+		return nil
+	}
+}
+
+type completionFlag struct {
+	name  string
+	usage string
+	value bool // Takes a value, rather than being a bool
+}
+
+func flagsOf(fs *flag.FlagSet) []completionFlag {
+	var flags []completionFlag
+	fs.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		flags = append(flags, completionFlag{f.Name, f.Usage, !ok || !b.IsBoolFlag()})
+	})
+	return flags
+}
+
+func commandFlags(cmd command) []completionFlag {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.String("o", "", "output format: "+strings.Join(formats, ", "))
+	cmd.setup(fs)
+	return flagsOf(fs)
+}
+
+func globalCompletionFlags() []completionFlag {
+	fs := flag.NewFlagSet("bookctl", flag.ContinueOnError)
+	globalFlags(fs)
+	return flagsOf(fs)
+}
+
+func flagWords(flags []completionFlag) string {
+	var words []string
+	for _, f := range flags {
+		words = append(words, "-"+f.name)
+	}
+	return strings.Join(words, " ")
+}
+
+func statusWords() string {
+	var statuses []string
+	for status := range transitions {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	return strings.Join(statuses, " ")
+}
+
+/*
+What a command's arguments are completed with, as a compgen option for bash and a complete option for fish.
+*/
+func argumentKind(cmd command) string {
+	switch {
+	case cmd.ids:
+		return "ids"
+	case cmd.name == "import" || cmd.name == "export":
+		return "files"
+	case cmd.name == "completion":
+		return "shells"
+	}
+	return ""
+}
+
+func writeBash(w io.Writer) {
+	global := globalCompletionFlags()
+	var valueFlags, names []string
+	for _, f := range global {
+		if f.value {
+			valueFlags = append(valueFlags, "-"+f.name)
+		}
+	}
+	for _, cmd := range commands {
+		if cmd.summary != "" {
+			names = append(names, cmd.name)
+		}
+	}
+
+	fmt.Fprintln(w, "# bash completion for bookctl, load it with: source <(bookctl completion bash)")
+	fmt.Fprintln(w, "_bookctl() {")
+	fmt.Fprintln(w, "\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\" prev=\"${COMP_WORDS[COMP_CWORD-1]}\"")
+	fmt.Fprintln(w, "\tlocal i cmd=\"\" cmdIndex=0")
+	fmt.Fprintln(w, "\tfor ((i = 1; i < COMP_CWORD; i++)); do")
+	fmt.Fprintln(w, "\t\tcase \"${COMP_WORDS[i]}\" in")
+	fmt.Fprintf(w, "\t\t%v) ((i++)) ;;\n", strings.Join(valueFlags, "|"))
+	fmt.Fprintln(w, "\t\t-*) ;;")
+	fmt.Fprintln(w, "\t\t*) cmd=\"${COMP_WORDS[i]}\"; cmdIndex=$i; break ;;")
+	fmt.Fprintln(w, "\t\tesac")
+	fmt.Fprintln(w, "\tdone")
+	fmt.Fprintln(w, "\tcase \"$prev\" in")
+	fmt.Fprintf(w, "\t-o) COMPREPLY=($(compgen -W \"%v\" -- \"$cur\")); return ;;\n", strings.Join(formats, " "))
+	fmt.Fprintf(w, "\t-status) COMPREPLY=($(compgen -W \"%v\" -- \"$cur\")); return ;;\n", statusWords())
+	fmt.Fprintln(w, "\t-file) COMPREPLY=($(compgen -f -- \"$cur\")); return ;;")
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "\tcase \"$cmd\" in")
+	fmt.Fprintf(w, "\t\"\") COMPREPLY=($(compgen -W \"%v %v\" -- \"$cur\")) ;;\n", strings.Join(names, " "), flagWords(global))
+	for _, cmd := range commands {
+		if cmd.summary == "" {
+			continue
+		}
+		var args string
+		switch argumentKind(cmd) {
+		case "ids":
+			args = "$(bookctl \"${COMP_WORDS[@]:1:cmdIndex-1}\" __ids 2>/dev/null)"
+		case "shells":
+			args = "bash zsh fish"
+		}
+		fmt.Fprintf(w, "\t%v)\n", cmd.name)
+		fmt.Fprintln(w, "\t\tif [[ $cur == -* ]]; then")
+		fmt.Fprintf(w, "\t\t\tCOMPREPLY=($(compgen -W \"%v\" -- \"$cur\"))\n", flagWords(commandFlags(cmd)))
+		if argumentKind(cmd) == "files" {
+			fmt.Fprintln(w, "\t\telse")
+			fmt.Fprintln(w, "\t\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))")
+		} else if args != "" {
+			fmt.Fprintln(w, "\t\telse")
+			fmt.Fprintf(w, "\t\t\tCOMPREPLY=($(compgen -W \"%v\" -- \"$cur\"))\n", args)
+		}
+		fmt.Fprintln(w, "\t\tfi ;;")
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _bookctl bookctl")
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func writeFishFlag(w io.Writer, condition string, f completionFlag) {
+	fmt.Fprintf(w, "complete -c bookctl -n %v -o %v", fishQuote(condition), f.name)
+	switch {
+	case f.name == "o":
+		fmt.Fprintf(w, " -x -a %v", fishQuote(strings.Join(formats, " ")))
+	case f.name == "status":
+		fmt.Fprintf(w, " -x -a %v", fishQuote(statusWords()))
+	case f.value:
+		fmt.Fprint(w, " -r")
+	}
+	fmt.Fprintf(w, " -d %v\n", fishQuote(f.usage))
+}
+
+func writeFish(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion for bookctl, load it with: bookctl completion fish | source")
+	fmt.Fprintln(w, "complete -c bookctl -f")
+	for _, f := range globalCompletionFlags() {
+		writeFishFlag(w, "__fish_use_subcommand", f)
+	}
+	for _, cmd := range commands {
+		if cmd.summary == "" {
+			continue
+		}
+		fmt.Fprintf(w, "complete -c bookctl -n __fish_use_subcommand -a %v -d %v\n", cmd.name, fishQuote(cmd.summary))
+		condition := "__fish_seen_subcommand_from " + cmd.name
+		for _, f := range commandFlags(cmd) {
+			writeFishFlag(w, condition, f)
+		}
+		switch argumentKind(cmd) {
+		case "ids":
+			fmt.Fprintf(w, "complete -c bookctl -n %v -a '(bookctl __ids 2>/dev/null)'\n", fishQuote(condition))
+		case "files":
+			fmt.Fprintf(w, "complete -c bookctl -n %v -F\n", fishQuote(condition))
+		case "shells":
+			fmt.Fprintf(w, "complete -c bookctl -n %v -a 'bash zsh fish'\n", fishQuote(condition))
+		}
+	}
+}
@@ -0,0 +1,577 @@
+/*
+Bookctl manages the book catalog from the command line, either through a running server or directly on a csv file.
+
+	bookctl -server http://localhost:8080 -key $KEY list -status available
+	bookctl -file books.csv add -title "The Hobbit" -author Tolkien -publishdate 09211937 -rating 3
+	bookctl -o json get The-Hobbit
+	bookctl -file books.csv export | bookctl -server http://localhost:8080 import -
+
+Run bookctl help for the commands and bookctl help <command> for their flags.
+*/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/RESTChallenge/client"
+)
+
+/*
+What a command runs with. The catalog is opened when a command first asks for it, so help and completion work without
+a server or file.
+*/
+type env struct {
+	in     io.Reader
+	out    io.Writer
+	errOut io.Writer
+	format string
+	open   func() (catalog, error)
+}
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	ids     bool // Its arguments are book ids, which shell completion can fill in
+	/*
+		Adds the command's flags to fs and returns what runs it once they have been parsed.
+	*/
+	setup func(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error
+}
+
+var commands []command
+
+func init() {
+	// Set here rather than in the declaration, as completion refers back to commands
+	commands = []command{
+		{"list", "", "List books, leaving out withdrawn ones unless -status asks for them", false, listCommand},
+		{"get", "ID...", "Show books", true, getCommand},
+		{"add", "", "Add a book", false, addCommand},
+		{"edit", "ID", "Change a book's fields, leaving the ones not given as they are", true, editCommand},
+		{"rm", "ID...", "Delete books", true, rmCommand},
+		{"checkout", "ID...", "Check books out", true, circulationCommand((catalog).checkout)},
+		{"checkin", "ID...", "Check books in", true, circulationCommand((catalog).checkin)},
+		{"import", "FILE", "Add the books in a csv or JSON file, - for csv on stdin, skipping ones already there", false, importCommand},
+		{"export", "[FILE]", "Write every book, withdrawn ones included, as csv unless -o says otherwise", false, exportCommand},
+		{"completion", "bash|zsh|fish", "Print a shell completion script", false, completionCommand},
+		{"__ids", "", "", false, idsCommand}, // Used by the completion scripts
+	}
+}
+
+/*
+Usage errors exit with 2, like the flag package's.
+*/
+type usageError struct{ message string }
+
+func (e usageError) Error() string { return e.message }
+
+func usagef(format string, a ...interface{}) error {
+	return usageError{fmt.Sprintf(format, a...)}
+}
+
+/*
+A flag that can be given more than once.
+*/
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	status := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(status)
+}
+
+func globalFlags(fs *flag.FlagSet) (server, file, key, token, format *string, timeout *time.Duration) {
+	server = fs.String("server", os.Getenv("BOOKCTL_SERVER"), "URL of the server to manage, $BOOKCTL_SERVER")
+	file = fs.String("file", os.Getenv("BOOKCTL_FILE"), "csv file to manage instead of a server, $BOOKCTL_FILE")
+	key = fs.String("key", os.Getenv("BOOKCTL_API_KEY"), "API key for the server, $BOOKCTL_API_KEY")
+	token = fs.String("token", os.Getenv("BOOKCTL_TOKEN"), "bearer token for the server, $BOOKCTL_TOKEN")
+	format = fs.String("o", "table", "output format: "+strings.Join(formats, ", "))
+	timeout = fs.Duration("timeout", 30*time.Second, "how long to wait for the server, retries included")
+	return
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bookctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { usage(stderr, fs) }
+	server, file, key, token, format, timeout := globalFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		usage(stderr, fs)
+		return 2
+	}
+	name, args := fs.Arg(0), fs.Args()[1:]
+	if name == "help" {
+		if len(args) == 0 {
+			usage(stdout, fs)
+			return 0
+		}
+		name, args = args[0], []string{"-h"}
+	}
+	i := slices.IndexFunc(commands, func(c command) bool { return c.name == name })
+	if i < 0 {
+		fmt.Fprintf(stderr, "bookctl: unknown command %q, run bookctl help for the commands\n", name)
+		return 2
+	}
+	cmd := commands[i]
+
+	cmdFlags := flag.NewFlagSet("bookctl "+cmd.name, flag.ContinueOnError)
+	cmdFlags.SetOutput(stderr)
+	cmdFlags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: bookctl [flags] %v [flags] %v\n\n%v\n\n", cmd.name, cmd.args, cmd.summary)
+		cmdFlags.PrintDefaults()
+	}
+	// The output format can go after the command too, as that's where it is easiest to add
+	cmdFlags.StringVar(format, "o", *format, "output format: "+strings.Join(formats, ", "))
+	runCmd := cmd.setup(cmdFlags)
+	if err := cmdFlags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if !slices.Contains(formats, *format) {
+		fmt.Fprintf(stderr, "bookctl: unknown output format %q, use one of %v\n", *format, strings.Join(formats, ", "))
+		return 2
+	}
+
+	e := &env{in: stdin, out: stdout, errOut: stderr, format: *format}
+	formatSet := false
+	fs.Visit(func(f *flag.Flag) { formatSet = formatSet || f.Name == "o" })
+	cmdFlags.Visit(func(f *flag.Flag) { formatSet = formatSet || f.Name == "o" })
+	if cmd.name == "export" && !formatSet {
+		e.format = "csv"
+	}
+	// A server or file on the command line wins over one from the environment
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "file" && os.Getenv("BOOKCTL_SERVER") == *server {
+			*server = ""
+		} else if f.Name == "server" && os.Getenv("BOOKCTL_FILE") == *file {
+			*file = ""
+		}
+	})
+	e.open = func() (catalog, error) {
+		switch {
+		case *server != "" && *file != "":
+			return nil, usagef("give either -server or -file, not both")
+		case *file != "":
+			return openFile(*file)
+		case *server != "":
+			options := []client.Option{client.WithUserAgent("bookctl")}
+			if *key != "" {
+				options = append(options, client.WithAPIKey(*key))
+			}
+			if *token != "" {
+				options = append(options, client.WithBearerToken(*token))
+			}
+			c, err := client.New(*server, options...)
+			if err != nil {
+				return nil, err
+			}
+			return remoteCatalog{c}, nil
+		}
+		return nil, usagef("give a server with -server or $BOOKCTL_SERVER, or a csv file with -file or $BOOKCTL_FILE")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	if err := runCmd(ctx, e, cmdFlags.Args()); err != nil {
+		fmt.Fprintln(stderr, "bookctl:", err)
+		var usageErr usageError
+		if errors.As(err, &usageErr) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+func usage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintln(w, "Usage: bookctl [flags] <command> [command flags] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	tw := newTable(w)
+	for _, cmd := range commands {
+		if cmd.summary != "" {
+			fmt.Fprintf(tw, "  %v %v\t%v\n", cmd.name, cmd.args, cmd.summary)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nBooks are named by their id, the title with spaces changed to dashes, or by the title itself.")
+	fmt.Fprintln(w, "\nFlags:")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+/*
+Book ids are titles with spaces changed to dashes, and either form is accepted.
+*/
+func bookIDs(args []string, min int) ([]string, error) {
+	if len(args) < min {
+		return nil, usagef("expected at least %v book id", min)
+	}
+	ids := make([]string, len(args))
+	for i, arg := range args {
+		ids[i] = client.BookID(arg)
+	}
+	return ids, nil
+}
+
+func listCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	status := fs.String("status", "", "only books with this status")
+	var tags, genres listFlag
+	fs.Var(&tags, "tag", "only books with this tag, can be repeated (server only)")
+	fs.Var(&genres, "genre", "only books within this genre, can be repeated (server only)")
+	shelf := fs.Bool("shelf", false, "sort by call number (server only)")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return usagef("list takes no arguments")
+		}
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		books, err := cat.list(ctx, client.ListOptions{Status: client.BookStatus(*status), Tags: tags, Genres: genres, ShelfOrder: *shelf})
+		if err != nil {
+			return err
+		}
+		return printBooks(e.out, e.format, books, false)
+	}
+}
+
+func getCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		ids, err := bookIDs(args, 1)
+		if err != nil {
+			return err
+		}
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		var books []client.Book
+		for _, id := range ids {
+			book, err := cat.get(ctx, id)
+			if err != nil {
+				return fmt.Errorf("%v: %w", id, err)
+			}
+			books = append(books, *book)
+		}
+		return printBooks(e.out, e.format, books, len(args) == 1)
+	}
+}
+
+func addCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	var book client.NewBook
+	fs.StringVar(&book.Title, "title", "", "title, required")
+	fs.StringVar(&book.Author, "author", "", "author")
+	fs.StringVar(&book.Publisher, "publisher", "", "publisher")
+	fs.StringVar(&book.PublishDate, "publishdate", "", "publish date as MMDDYYYY, required")
+	fs.IntVar(&book.Rating, "rating", 0, "rating from 1 to 3, required")
+	status := fs.String("status", "available", "status")
+	fs.StringVar(&book.CallNumber, "callnumber", "", "call number, one is assigned when not given (server only)")
+	var tags, genres listFlag
+	fs.Var(&tags, "tag", "tag, can be repeated (server only)")
+	fs.Var(&genres, "genre", "genre, can be repeated (server only)")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 0 {
+			return usagef("add takes flags rather than arguments, like -title %q", strings.Join(args, " "))
+		}
+		if book.Title == "" || book.PublishDate == "" || book.Rating == 0 {
+			return usagef("add needs -title, -publishdate and -rating")
+		}
+		book.Status, book.Tags, book.Genres = client.BookStatus(*status), tags, genres
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		added, err := cat.add(ctx, book)
+		if err != nil {
+			return err
+		}
+		return printBooks(e.out, e.format, []client.Book{*added}, true)
+	}
+}
+
+func editCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	title := fs.String("title", "", "new title, which changes the book's id")
+	author := fs.String("author", "", "author")
+	publisher := fs.String("publisher", "", "publisher")
+	publishDate := fs.String("publishdate", "", "publish date as MMDDYYYY")
+	rating := fs.Int("rating", 0, "rating from 1 to 3")
+	status := fs.String("status", "", "status, which has to be one the current status can move to")
+	callNumber := fs.String("callnumber", "", "call number (server only)")
+	tags := fs.String("tags", "", "comma separated tags replacing the book's, empty to clear them (server only)")
+	genres := fs.String("genres", "", "comma separated genres replacing the book's, empty to clear them (server only)")
+	return func(ctx context.Context, e *env, args []string) error {
+		ids, err := bookIDs(args, 1)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 1 {
+			return usagef("edit changes one book at a time")
+		}
+		var update client.BookUpdate
+		changed := false
+		fs.Visit(func(f *flag.Flag) {
+			changed = changed || f.Name != "o"
+			switch f.Name {
+			case "title":
+				update.Title = title
+			case "author":
+				update.Author = author
+			case "publisher":
+				update.Publisher = publisher
+			case "publishdate":
+				update.PublishDate = publishDate
+			case "rating":
+				update.Rating = rating
+			case "status":
+				s := client.BookStatus(*status)
+				update.Status = &s
+			case "callnumber":
+				update.CallNumber = callNumber
+			case "tags":
+				update.Tags = splitList(*tags)
+			case "genres":
+				update.Genres = splitList(*genres)
+			}
+		})
+		if !changed {
+			return usagef("edit needs at least one field to change, see bookctl help edit")
+		}
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		book, err := cat.edit(ctx, ids[0], update)
+		if err != nil {
+			return err
+		}
+		return printBooks(e.out, e.format, []client.Book{*book}, true)
+	}
+}
+
+/*
+Splits a comma separated list, where an empty string is an empty list rather than nil so that it clears.
+*/
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func rmCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	purge := fs.Bool("purge", false, "delete for good instead of moving to the trash")
+	return func(ctx context.Context, e *env, args []string) error {
+		ids, err := bookIDs(args, 1)
+		if err != nil {
+			return err
+		}
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := cat.remove(ctx, id, *purge); err != nil {
+				return fmt.Errorf("%v: %w", id, err)
+			}
+			fmt.Fprintln(e.errOut, "Deleted", id)
+		}
+		return nil
+	}
+}
+
+func circulationCommand(action func(catalog, context.Context, string) (*client.Book, error)) func(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+		return func(ctx context.Context, e *env, args []string) error {
+			ids, err := bookIDs(args, 1)
+			if err != nil {
+				return err
+			}
+			cat, err := e.open()
+			if err != nil {
+				return err
+			}
+			var books []client.Book
+			for _, id := range ids {
+				book, err := action(cat, ctx, id)
+				if err != nil {
+					return fmt.Errorf("%v: %w", id, err)
+				}
+				books = append(books, *book)
+			}
+			return printBooks(e.out, e.format, books, len(ids) == 1)
+		}
+	}
+}
+
+func importCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	dryRun := fs.Bool("n", false, "only report what would be added")
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) != 1 {
+			return usagef("import takes one file, - for stdin")
+		}
+		books, err := readImport(args[0], e.in)
+		if err != nil {
+			return err
+		}
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		var added []client.Book
+		skipped := 0
+		for _, book := range books {
+			if _, err := cat.get(ctx, book.URLID()); err == nil {
+				fmt.Fprintln(e.errOut, "Skipping", book.URLID()+", it is already there")
+				skipped++
+				continue
+			} else if !errors.Is(err, client.ErrNotFound) {
+				return err
+			}
+			if *dryRun {
+				added = append(added, book)
+				continue
+			}
+			newBook, err := cat.add(ctx, client.NewBook{
+				Title:       book.Title,
+				Author:      book.Author,
+				Publisher:   book.Publisher,
+				PublishDate: book.PublishDate,
+				Rating:      book.Rating,
+				Status:      book.Status,
+				Tags:        book.Tags,
+				Genres:      book.Genres,
+				CallNumber:  book.CallNumber,
+			})
+			if err != nil {
+				return fmt.Errorf("%v: %w (%v added before it)", book.URLID(), err, len(added))
+			}
+			added = append(added, *newBook)
+		}
+		if *dryRun {
+			fmt.Fprintf(e.errOut, "Would add %v, skipping %v\n", len(added), skipped)
+		} else {
+			fmt.Fprintf(e.errOut, "Added %v, skipped %v\n", len(added), skipped)
+		}
+		if e.format == "table" && len(added) == 0 {
+			return nil
+		}
+		return printBooks(e.out, e.format, added, false)
+	}
+}
+
+/*
+Files ending in .json hold a list of books as the API sends them, anything else is csv in the server's format.
+*/
+func readImport(path string, stdin io.Reader) ([]client.Book, error) {
+	r := stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var books []client.Book
+		if err := json.NewDecoder(r).Decode(&books); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		return books, nil
+	}
+	books, err := readBooks(r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	return books, nil
+}
+
+func exportCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		if len(args) > 1 {
+			return usagef("export takes at most one file")
+		}
+		cat, err := e.open()
+		if err != nil {
+			return err
+		}
+		books, err := cat.list(ctx, client.ListOptions{})
+		if err != nil {
+			return err
+		}
+		withdrawn, err := cat.list(ctx, client.ListOptions{Status: client.StatusWithdrawn})
+		if err != nil {
+			return err
+		}
+		books = append(books, withdrawn...)
+		sort.SliceStable(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+
+		if len(args) == 0 || args[0] == "-" {
+			return printBooks(e.out, e.format, books, false)
+		}
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		if err := printBooks(f, e.format, books, false); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.errOut, "Exported %v books to %v\n", len(books), args[0])
+		return nil
+	}
+}
+
+/*
+Prints the ids of every book, one a line, for the completion scripts. Errors are left out, as they would end up in the
+middle of the command line being completed.
+*/
+func idsCommand(fs *flag.FlagSet) func(ctx context.Context, e *env, args []string) error {
+	return func(ctx context.Context, e *env, args []string) error {
+		cat, err := e.open()
+		if err != nil {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		books, _ := cat.list(ctx, client.ListOptions{})
+		for _, book := range books {
+			fmt.Fprintln(e.out, book.URLID())
+		}
+		return nil
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/RESTChallenge/client"
+)
+
+/*
+Runs bookctl with args and returns its exit status, stdout and stderr.
+*/
+func bookctl(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	status := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+	return status, stdout.String(), stderr.String()
+}
+
+func testFile(t *testing.T) string {
+	t.Setenv("BOOKCTL_SERVER", "")
+	t.Setenv("BOOKCTL_FILE", "")
+	path := filepath.Join(t.TempDir(), "books.csv")
+	books := "Book 1,Author 1,publisher,11111111,1,true\nBook 2,Author 2,publisher,11111112,3,false\n"
+	if err := os.WriteFile(path, []byte(books), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOfflineCommands(t *testing.T) {
+	file := testFile(t)
+
+	status, out, _ := bookctl(t, "", "-file", file, "add", "-title", "Book 3", "-author", "Author 3", "-publishdate", "11111113", "-rating", "2")
+	if status != 0 || !strings.Contains(out, "Book-3") {
+		t.Fatal("Expected Book 3 to be added. Recieved ", status, " ", out)
+	}
+	if status, _, errOut := bookctl(t, "", "-file", file, "add", "-title", "Book 3", "-publishdate", "11111113", "-rating", "2"); status != 1 || !strings.Contains(errOut, "already") {
+		t.Error("Expected a second Book 3 to be refused. Recieved ", status, " ", errOut)
+	}
+	if status, _, errOut := bookctl(t, "", "-file", file, "add", "-title", "Book 4", "-publishdate", "1111", "-rating", "2"); status != 1 || !strings.Contains(errOut, "publishdate") {
+		t.Error("Expected a bad publishdate to be refused. Recieved ", status, " ", errOut)
+	}
+
+	bookctl(t, "", "-file", file, "checkout", "Book 3")
+	bookctl(t, "", "-file", file, "edit", "-author", "Someone", "book-3")
+	status, out, _ = bookctl(t, "", "-file", file, "-o", "json", "get", "book-3")
+	var book client.Book
+	if err := json.Unmarshal([]byte(out), &book); err != nil || status != 0 {
+		t.Fatal("Expected Book 3 as JSON. Recieved ", status, " ", out)
+	}
+	if book.Author != "Someone" || book.Status != client.StatusCheckedOut || book.IsCheckedIn || book.ID != 3 {
+		t.Error("Book 3 incorrect. Recieved ", book)
+	}
+
+	if status, _, errOut := bookctl(t, "", "-file", file, "edit", "-status", "withdrawn", "book-3"); status != 1 || !strings.Contains(errOut, "cannot change status") {
+		t.Error("Expected a checked out book not to be withdrawn. Recieved ", status, " ", errOut)
+	}
+	bookctl(t, "", "-file", file, "checkin", "book-3")
+	bookctl(t, "", "-file", file, "edit", "-status", "withdrawn", "book-3")
+	if _, out, _ := bookctl(t, "", "-file", file, "list"); strings.Contains(out, "Book-3") || !strings.Contains(out, "Book-2") {
+		t.Error("Expected withdrawn books to be left out. Recieved ", out)
+	}
+	if _, out, _ := bookctl(t, "", "-file", file, "list", "-status", "withdrawn", "-o", "csv"); out != "Book 3,Someone,,11111113,2,withdrawn\n" {
+		t.Error("Expected only Book 3. Recieved ", out)
+	}
+
+	bookctl(t, "", "-file", file, "rm", "Book-1")
+	bookctl(t, "", "-file", file, "rm", "-purge", "Book-3")
+	written, _ := os.ReadFile(file)
+	lines := strings.Split(string(written), "\n")
+	if len(lines) != 4 || lines[0] != "#next-id,4" || lines[1] != `Book 2,Author 2,publisher,11111112,3,checked_out,"{"""":3}",,,,,2,` ||
+		!strings.HasPrefix(lines[2], `Book 1,Author 1,publisher,11111111,1,available,"{"""":1}",,,,,1,,`) || !strings.HasSuffix(lines[2], ",bookctl") {
+		t.Error("File incorrect. Recieved ", string(written))
+	}
+	if status, _, _ := bookctl(t, "", "-file", file, "get", "Book-1"); status != 1 {
+		t.Error("Expected Book 1 to be gone. Recieved ", status)
+	}
+}
+
+/*
+The columns the server writes that bookctl doesn't change have to be written back as they were.
+*/
+func TestServerColumnsKept(t *testing.T) {
+	file := testFile(t)
+	books := "#next-id,9\n" +
+		`Book 1,Author 1,publisher,11111111,2,available,"{"""":1,""alice"":3}","[{""id"":1,""state"":""published""}]","[""classic""]","[""Fiction""]",823 WOO,4,"[{""revision"":1}]"` + "\n" +
+		`Book 2,Author 2,publisher,11111112,3,available,,,,,,7,,2026-01-02T03:04:05Z,lucy` + "\n"
+	os.WriteFile(file, []byte(books), 0600)
+
+	status, out, _ := bookctl(t, "", "-file", file, "-o", "json", "get", "book-1")
+	var book client.Book
+	if err := json.Unmarshal([]byte(out), &book); err != nil || status != 0 {
+		t.Fatal("Expected Book 1 as JSON. Recieved ", status, " ", out)
+	}
+	if book.ID != 4 || book.Rating != 2 || book.RatingCount != 2 || book.ReviewCount != 1 || book.Tags[0] != "classic" || book.CallNumber != "823 WOO" {
+		t.Error("Book 1 incorrect. Recieved ", book)
+	}
+	if status, _, _ := bookctl(t, "", "-file", file, "get", "book-2"); status != 1 {
+		t.Error("Expected Book 2 in the trash to be left out. Recieved ", status)
+	}
+
+	bookctl(t, "", "-file", file, "edit", "-rating", "3", "book-1")
+	bookctl(t, "", "-file", file, "add", "-title", "Book 3", "-publishdate", "11111113", "-rating", "2")
+	written, _ := os.ReadFile(file)
+	want := "#next-id,10\n" +
+		`Book 1,Author 1,publisher,11111111,3,available,"{"""":3,""alice"":3}","[{""id"":1,""state"":""published""}]","[""classic""]","[""Fiction""]",823 WOO,4,"[{""revision"":1}]"` + "\n" +
+		`Book 3,,,11111113,2,available,"{"""":2}",,,,,9,` + "\n" +
+		`Book 2,Author 2,publisher,11111112,3,available,,,,,,7,,2026-01-02T03:04:05Z,lucy` + "\n"
+	if string(written) != want {
+		t.Error("File incorrect. Recieved ", string(written))
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	from, to := testFile(t), testFile(t)
+	os.WriteFile(to, []byte("Book 2,Author 2,publisher,11111112,3,checked_out\n"), 0600)
+	bookctl(t, "", "-file", from, "add", "-title", "Book 3", "-publishdate", "11111113", "-rating", "2", "-status", "in_repair")
+
+	status, exported, _ := bookctl(t, "", "-file", from, "export")
+	if status != 0 || strings.Count(exported, "\n") != 3 {
+		t.Fatal("Expected every book as csv. Recieved ", status, " ", exported)
+	}
+	status, _, errOut := bookctl(t, exported, "-file", to, "import", "-")
+	if status != 0 || !strings.Contains(errOut, "Added 2, skipped 1") {
+		t.Error("Expected Book 2 to be skipped. Recieved ", status, " ", errOut)
+	}
+	if _, reexported, _ := bookctl(t, "", "-file", to, "export"); reexported != "Book 2,Author 2,publisher,11111112,3,checked_out\nBook 1,Author 1,publisher,11111111,1,available\nBook 3,,,11111113,2,in_repair\n" {
+		t.Error("Expected the books to be imported. Recieved ", reexported)
+	}
+
+	jsonFile := filepath.Join(t.TempDir(), "books.json")
+	if status, _, _ := bookctl(t, "", "-file", from, "-o", "json", "export", jsonFile); status != 0 {
+		t.Fatal("Expected the JSON to be written. Recieved ", status)
+	}
+	empty := testFile(t)
+	os.WriteFile(empty, nil, 0600)
+	if status, _, errOut := bookctl(t, "", "-file", empty, "import", jsonFile); status != 0 || !strings.Contains(errOut, "Added 3") {
+		t.Error("Expected the JSON to be imported. Recieved ", status, " ", errOut)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	testFile(t)
+	tests := []struct {
+		args   []string
+		status int
+		output string
+	}{
+		{[]string{}, 2, "Commands:"},
+		{[]string{"help"}, 0, "checkout ID..."},
+		{[]string{"help", "edit"}, 0, "-tags"},
+		{[]string{"shelve"}, 2, "unknown command"},
+		{[]string{"list"}, 2, "give a server"},
+		{[]string{"-file", "x.csv", "-server", "http://localhost", "list"}, 2, "not both"},
+		{[]string{"-o", "yaml", "-file", "x.csv", "list"}, 2, "unknown output format"},
+		{[]string{"-file", "x.csv", "get"}, 2, "book id"},
+		{[]string{"-file", "x.csv", "edit", "book-1"}, 2, "at least one field"},
+		{[]string{"-file", "x.csv", "add", "-title", "Book 3"}, 2, "-publishdate"},
+		{[]string{"-file", "missing.csv", "list"}, 1, "no such file"},
+	}
+	for _, test := range tests {
+		status, out, errOut := bookctl(t, "", test.args...)
+		if status != test.status || !strings.Contains(out+errOut, test.output) {
+			t.Error(test.args, ": expected ", test.status, " and ", test.output, ". Recieved ", status, " ", out, errOut)
+		}
+	}
+}
+
+func TestRemote(t *testing.T) {
+	testFile(t)
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("X-API-Key"))
+		switch r.URL.Path {
+		case "/books":
+			fmt.Fprint(w, `[{"id":1,"title":"Book 1","rating":1,"status":"available","tags":["classic"]}]`)
+		case "/books/Book-1/checkout":
+			fmt.Fprint(w, `{"id":1,"title":"Book 1","rating":1,"status":"checked_out"}`)
+		default:
+			http.Error(w, "404, not found.", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("BOOKCTL_SERVER", server.URL)
+	t.Setenv("BOOKCTL_API_KEY", "librarian-key")
+
+	status, out, _ := bookctl(t, "", "list", "-tag", "classic", "-status", "available")
+	if status != 0 || !strings.Contains(out, "Book-1") {
+		t.Error("Expected Book 1. Recieved ", status, " ", out)
+	}
+	status, out, _ = bookctl(t, "", "checkout", "-o", "csv", "Book 1")
+	if status != 0 || out != "Book 1,,,,1,checked_out\n" {
+		t.Error("Expected Book 1 to be checked out. Recieved ", status, " ", out)
+	}
+	status, _, errOut := bookctl(t, "", "get", "Book-9")
+	if status != 1 || !strings.Contains(errOut, "not found") {
+		t.Error("Expected Book 9 not to be found. Recieved ", status, " ", errOut)
+	}
+	want := []string{
+		"GET /books?status=available&tag=classic librarian-key",
+		"POST /books/Book-1/checkout librarian-key",
+		"GET /books/Book-9 librarian-key",
+	}
+	if strings.Join(requests, "\n") != strings.Join(want, "\n") {
+		t.Error("Requests incorrect. Recieved ", requests)
+	}
+
+	// A file on the command line is used over the server in the environment
+	if status, out, _ := bookctl(t, "", "-file", testFile(t), "list"); status != 0 || !strings.Contains(out, "Book-2") {
+		t.Error("Expected the file to be used. Recieved ", status, " ", out)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	file := testFile(t)
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		status, out, _ := bookctl(t, "", "completion", shell)
+		if status != 0 || !strings.Contains(out, "checkout") || !strings.Contains(out, "publishdate") || !strings.Contains(out, "__ids") || strings.Contains(out, "__ids ID") {
+			t.Error("Expected a ", shell, " script. Recieved ", status, " ", out)
+		}
+	}
+	if status, _, _ := bookctl(t, "", "completion", "powershell"); status != 2 {
+		t.Error("Expected powershell to be refused. Recieved ", status)
+	}
+	if _, out, _ := bookctl(t, "", "-file", file, "__ids"); out != "Book-1\nBook-2\n" {
+		t.Error("Expected the book ids. Recieved ", out)
+	}
+	if status, out, _ := bookctl(t, "", "__ids"); status != 0 || out != "" {
+		t.Error("Expected nothing when there is no catalog. Recieved ", status, " ", out)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/RESTChallenge/client"
+)
+
+var formats = []string{"table", "json", "csv"}
+
+/*
+Prints books as an aligned table, as JSON, or as csv in the format the server keeps its catalog in. When single is true
+the JSON is the one book rather than a list of it.
+*/
+func printBooks(w io.Writer, format string, books []client.Book, single bool) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if single && len(books) == 1 {
+			return enc.Encode(books[0])
+		}
+		if books == nil {
+			books = []client.Book{}
+		}
+		return enc.Encode(books)
+	case "csv":
+		return writeBooks(w, books)
+	case "table":
+		tw := newTable(w)
+		fmt.Fprintln(tw, "ID\tTITLE\tAUTHOR\tPUBLISHER\tPUBLISHED\tRATING\tSTATUS")
+		for _, book := range books {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", book.URLID(), book.Title, book.Author, book.Publisher,
+				publishDate(book.PublishDate), book.Rating, book.Status)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %q, use one of %v", format, strings.Join(formats, ", "))
+}
+
+func newTable(w io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+}
+
+/*
+MMDDYYYY as MM/DD/YYYY, which is easier to read in a table.
+*/
+func publishDate(date string) string {
+	if len(date) != 8 {
+		return date
+	}
+	return date[:2] + "/" + date[2:4] + "/" + date[4:]
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+Every setting is a flag, and each one can also be given as an environment variable or in a YAML or TOML config file.
+When a setting is given more than once the command line wins, then the environment, then the config file, and the
+default is only used when it isn't given at all.
+
+The environment variable for a flag is BOOKS_ followed by its name in upper case with - changed to _, so -rate-limit
+is BOOKS_RATE_LIMIT. The config file is given with -config or BOOKS_CONFIG, and its keys are the flag names:
+
+	addr: ":8080"
+	data: /var/lib/books/books.csv
+	rate-limit: true
+	rate-limits:
+	  patron.write: 1/5
+	trusted-proxies: [10.0.0.0/8, 192.168.1.1]
+
+A file ending in .toml is read as TOML, with the same keys, and any other file as YAML:
+
+	addr = ":8080"
+	rate-limit = true
+	trusted-proxies = ["10.0.0.0/8", "192.168.1.1"]
+
+	[rate-limits]
+	"patron.write" = "1/5"
+
+Lists are joined with commas and maps become comma separated key=value pairs, which is how the flags take them.
+*/
+const envPrefix = "BOOKS_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+/*
+Parses args into fs and then fills in the flags that weren't on the command line from the environment and the config
+file. Returns where each flag's value came from, which is "default" for the ones that weren't set anywhere.
+*/
+func loadConfig(fs *flag.FlagSet, args []string) (sources map[string]string, err error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	sources = map[string]string{}
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = "flag" })
+
+	var file map[string]interface{}
+	if config := fs.Lookup("config"); config != nil {
+		if sources["config"] == "" {
+			if value, ok := os.LookupEnv(envName("config")); ok {
+				fs.Set("config", value)
+				sources["config"] = "env " + envName("config")
+			}
+		}
+		if path := config.Value.String(); path != "" {
+			if file, err = readConfigFile(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for key := range file {
+		if f := fs.Lookup(key); f == nil || key == "config" {
+			return nil, fmt.Errorf("config file: unknown setting %q", key)
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || sources[f.Name] != "" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err = fs.Set(f.Name, value); err != nil {
+				err = fmt.Errorf("%v: %v", envName(f.Name), err)
+			}
+			sources[f.Name] = "env " + envName(f.Name)
+		} else if value, ok := file[f.Name]; ok {
+			if err = fs.Set(f.Name, configValue(value)); err != nil {
+				err = fmt.Errorf("config file: %v: %v", f.Name, err)
+			}
+			sources[f.Name] = "file"
+		} else {
+			sources[f.Name] = "default"
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+func readConfigFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file: %v", err)
+	}
+	return file, nil
+}
+
+/*
+Turns a value from the config file into the string the flag would be given.
+*/
+func configValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		parts := make([]string, len(value))
+		for i, part := range value {
+			parts[i] = configValue(part)
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		parts := make([]string, 0, len(value))
+		for key, part := range value {
+			parts = append(parts, key+"="+configValue(part))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+/*
+Writes the settings the server would run with as a config file, with where each came from after it. The config file
+itself can't be set in a config file, so it is commented out. Credentials in URLs are redacted: the password when
+there is a user and password, and the whole user otherwise, as a nats:// URL can carry a token in its place.
+*/
+func printConfig(w io.Writer, fs *flag.FlagSet, sources map[string]string) {
+	fs.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "print-config":
+			return
+		case "config":
+			fmt.Fprint(w, "# ")
+		}
+		fmt.Fprintf(w, "%v: %q # %v\n", f.Name, redactConfig(f.Value.String()), sources[f.Name])
+	})
+}
+
+func redactConfig(value string) string {
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		if u, err := url.Parse(part); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				parts[i] = u.Redacted()
+			} else {
+				u.User = url.User("xxxxx")
+				parts[i] = u.String()
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+How often an idle event stream gets a comment line, so proxies don't close it and clients notice a dead connection.
+*/
+var sseHeartbeat = 15 * time.Second
+
+/*
+The event type a change is sent as: book.created, book.updated and book.deleted, or book.checkout and book.checkin
+for circulation.
+*/
+func eventType(change Change) string {
+	if change.Op == "checkout" || change.Op == "checkin" {
+		return "book." + change.Op
+	}
+	return "book." + change.Type
+}
+
+/*
+Which events a stream wants. Empty fields match everything.
+*/
+type eventFilter struct {
+	types  map[string]bool
+	author string
+	book   string
+}
+
+func (f eventFilter) matches(change Change) bool {
+	if len(f.types) > 0 && !f.types[eventType(change)] {
+		return false
+	}
+	book := change.Book
+	if book == nil {
+		book = change.before
+	}
+	if f.author != "" && (book == nil || !strings.EqualFold(book.Author, f.author)) {
+		return false
+	}
+	if f.book != "" && (book == nil || !strings.EqualFold(bookSlug(*book), f.book)) {
+		return false
+	}
+	return true
+}
+
+/*
+GET /events streams catalog changes as Server-Sent Events. Each event's id is the change's sequence number in the
+change feed, so a client that reconnects with Last-Event-ID gets what it missed. Events can be filtered with ?type=
+(comma separated event types), ?author= and ?book= (a book's URL id).
+
+The stream reads from the change feed rather than being sent events by the handlers, so a slow client only falls
+behind and never holds up a request that has the mutex. If it falls so far behind that the feed has dropped changes
+it hasn't seen, it is sent a reset event and should download the catalog again.
+*/
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500, streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := eventFilter{author: query.Get("author"), book: query.Get("book")}
+	if query.Get("type") != "" {
+		filter.types = map[string]bool{}
+		for _, t := range strings.Split(query.Get("type"), ",") {
+			filter.types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	last := feed.latest()
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("lastEventId") // For clients that can't set headers, like EventSource on a first connect
+	}
+	if lastEventID != "" {
+		id, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || id < 0 {
+			http.Error(w, "400, Last-Event-ID must be a sequence number", http.StatusBadRequest)
+			return
+		}
+		last = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: 3000\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		changes, latest, waiting, ok := feed.since(last, 100)
+		if !ok {
+			fmt.Fprintf(w, "id: %v\nevent: reset\ndata: {\"latest\":%v}\n\n", latest, latest)
+			flusher.Flush()
+			last = latest
+			continue
+		}
+		for _, change := range changes {
+			last = change.Seq
+			if !filter.matches(change) {
+				continue
+			}
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: %s\n\n", change.Seq, eventType(change), data)
+		}
+		if len(changes) > 0 {
+			flusher.Flush()
+			continue // There may be more than one batch waiting
+		}
+
+		select {
+		case <-waiting:
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+/*
+Connects to /events and returns the events as they arrive. Comment lines come through as events named ":".
+*/
+func streamEvents(t *testing.T, server *httptest.Server, query string, lastEventID string) <-chan sseEvent {
+	req, _ := http.NewRequest("GET", server.URL+"/events"+query, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Expected an event stream. Recieved ", resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event != (sseEvent{}) {
+					events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, ":"):
+				event.event = ":"
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+/*
+A server for streaming tests. Streams never finish on their own, so their connections are cut before it closes.
+*/
+func newEventServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(routes())
+	t.Cleanup(func() {
+		server.CloseClientConnections()
+		server.Close()
+	})
+	return server
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event arrived")
+	}
+	return sseEvent{}
+}
+
+func changeBook(i int, op string, change func(*Book)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	before := Books[i]
+	change(&Books[i])
+	recordMutation(nil, op, &before, &Books[i])
+}
+
+func TestEventStream(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	server := newEventServer(t)
+
+	events := streamEvents(t, server, "", "")
+	changeBook(0, "checkout", func(b *Book) { b.setStatus(StatusCheckedOut) })
+	changeBook(1, "update", func(b *Book) { b.Author = "Someone Else" })
+
+	event := nextEvent(t, events)
+	if event.id != "1" || event.event != "book.checkout" || !strings.Contains(event.data, `"status":"checked_out"`) {
+		t.Error("Checkout event incorrect. Recieved ", event)
+	}
+	if event := nextEvent(t, events); event.id != "2" || event.event != "book.updated" {
+		t.Error("Update event incorrect. Recieved ", event)
+	}
+
+	// Reconnecting with Last-Event-ID replays what was missed
+	resumed := streamEvents(t, server, "", "1")
+	if event := nextEvent(t, resumed); event.id != "2" {
+		t.Error("Expected to resume from event 2. Recieved ", event)
+	}
+}
+
+func TestEventStreamFilters(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	server := newEventServer(t)
+
+	byAuthor := streamEvents(t, server, "?author=author+2", "")
+	byType := streamEvents(t, server, "?type=book.checkin", "")
+	changeBook(0, "update", func(b *Book) { b.Publisher = "Another" })
+	changeBook(1, "checkin", func(b *Book) { b.setStatus(StatusAvailable) })
+
+	if event := nextEvent(t, byAuthor); event.id != "2" {
+		t.Error("Expected only Author 2's book. Recieved ", event)
+	}
+	if event := nextEvent(t, byType); event.event != "book.checkin" {
+		t.Error("Expected only the checkin. Recieved ", event)
+	}
+}
+
+func TestEventStreamHeartbeatAndReset(t *testing.T) {
+	withChangeFeed(t, 1)
+	readFromFile("books.csv")
+	saved := sseHeartbeat
+	sseHeartbeat = 20 * time.Millisecond
+	t.Cleanup(func() { sseHeartbeat = saved })
+	server := newEventServer(t)
+
+	if event := nextEvent(t, streamEvents(t, server, "", "")); event.event != ":" {
+		t.Error("Expected a heartbeat. Recieved ", event)
+	}
+
+	changeBook(0, "update", func(b *Book) { b.Publisher = "One" })
+	changeBook(0, "update", func(b *Book) { b.Publisher = "Two" })
+	if event := nextEvent(t, streamEvents(t, server, "", "0")); event.event != "reset" {
+		t.Error("Expected a reset for changes no longer kept. Recieved ", event)
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Genres are a controlled vocabulary arranged as a tree, written as a path like "Fiction > Mystery > Cozy".
+Books can only be given genres that are in the vocabulary, unlike tags, which can be anything.
+The vocabulary holds every path including the ancestors, so "Fiction > Mystery" is there whenever "Fiction > Mystery > Cozy" is.
+*/
+var genreVocabulary = map[string]bool{}
+
+const genreSeparator = " > "
+
+/*
+Cleans up a genre path so "fiction>Mystery " and "fiction > Mystery" are recognised as the same path.
+Each level keeps the capitalisation it was given.
+*/
+func parseGenrePath(path string) (string, error) {
+	var levels []string
+	for _, level := range strings.Split(path, ">") {
+		level = strings.TrimSpace(level)
+		if level == "" {
+			return "", errors.New("genre path has an empty level")
+		}
+		levels = append(levels, level)
+	}
+	return strings.Join(levels, genreSeparator), nil
+}
+
+/*
+Finds the genre in the vocabulary regardless of case, so clients don't have to match the capitalisation.
+*/
+func lookupGenre(path string) (string, bool) {
+	path, err := parseGenrePath(path)
+	if err != nil {
+		return "", false
+	}
+	for genre := range genreVocabulary {
+		if strings.EqualFold(genre, path) {
+			return genre, true
+		}
+	}
+	return "", false
+}
+
+func genreParent(path string) string {
+	if i := strings.LastIndex(path, genreSeparator); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+/*
+True if genre is ancestor or one of its subgenres.
+*/
+func genreWithin(genre string, ancestor string) bool {
+	return genre == ancestor || strings.HasPrefix(genre, ancestor+genreSeparator)
+}
+
+func addGenre(path string) {
+	for path != "" {
+		genreVocabulary[path] = true
+		path = genreParent(path)
+	}
+}
+
+/*
+Reads the genre vocabulary, one path per line. The file is optional, genres can also be added with POST /genres.
+*/
+func readGenres(filepath string) {
+	genreVocabulary = map[string]bool{}
+	f, err := os.Open(filepath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalln("File open failed", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		path, err := parseGenrePath(scanner.Text())
+		if err != nil {
+			log.Fatalf("Bad genre %q in %v: %v", scanner.Text(), filepath, err)
+		}
+		addGenre(path)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+/*
+Saves the genre vocabulary in the format readGenres reads. Only the leaves are written, as their parents are added
+back when it is read. Like the catalog, it is saved after every change and when the server shuts down, and written
+next to the old file and renamed over it so a crash part way through leaves the old one whole.
+*/
+func writeGenres(path string) error {
+	var leaves []string
+	for genre := range genreVocabulary {
+		leaf := true
+		for other := range genreVocabulary {
+			if genreParent(other) == genre {
+				leaf = false
+				break
+			}
+		}
+		if leaf {
+			leaves = append(leaves, genre)
+		}
+	}
+	sort.Strings(leaves)
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".genres-*.csv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Does nothing once it has been renamed
+	if info, err := os.Stat(path); err == nil {
+		f.Chmod(info.Mode().Perm())
+	}
+	w := bufio.NewWriter(f)
+	for _, leaf := range leaves {
+		w.WriteString(leaf + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+/*
+Tags are free-form, but they are trimmed, lowercased and de-duplicated so "Mystery" and "mystery " are the same tag.
+*/
+func normalizeTags(values []string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag != "" && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+/*
+Checks every genre against the vocabulary and returns them in their canonical form.
+*/
+func normalizeGenres(values []string) ([]string, error) {
+	seen := map[string]bool{}
+	genres := []string{}
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		genre, ok := lookupGenre(value)
+		if !ok {
+			return nil, errors.New("unknown genre " + value)
+		}
+		if !seen[genre] {
+			seen[genre] = true
+			genres = append(genres, genre)
+		}
+	}
+	sort.Strings(genres)
+	return genres, nil
+}
+
+/*
+Reads the tag form values for createNewBook and patchBook. The key can be repeated, and each value can also be comma
+separated. ok is false if the request didn't mention tags, so a PATCH leaves them alone. Sending an empty value clears them.
+*/
+func formTags(r *http.Request) (tags []string, ok bool) {
+	values, ok := r.Form["tag"]
+	if !ok {
+		return nil, false
+	}
+	return normalizeTags(values), true
+}
+
+/*
+Same as formTags for genres, except every genre has to be in the vocabulary.
+*/
+func formGenres(r *http.Request) (genres []string, ok bool, err error) {
+	values, ok := r.Form["genre"]
+	if !ok {
+		return nil, false, nil
+	}
+	genres, err = normalizeGenres(values)
+	return genres, true, err
+}
+
+/*
+True if the book has every one of the tags and falls within every one of the genres.
+*/
+func bookMatches(book Book, tags []string, genres []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range book.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, want := range genres {
+		found := false
+		for _, genre := range book.Genres {
+			if genreWithin(genre, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+A node of the tree returned by GET /genres. Count is the number of books in the genre or any of its subgenres.
+*/
+type genreNode struct {
+	Name     string       `json:"name"`
+	Path     string       `json:"path"`
+	Count    int          `json:"count"`
+	Children []*genreNode `json:"children"`
+}
+
+func genreTree() []*genreNode {
+	paths := make([]string, 0, len(genreVocabulary))
+	for path := range genreVocabulary {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths) // parents sort before their children
+
+	nodes := map[string]*genreNode{}
+	roots := []*genreNode{}
+	for _, path := range paths {
+		node := &genreNode{Name: path, Path: path, Children: []*genreNode{}}
+		if i := strings.LastIndex(path, genreSeparator); i >= 0 {
+			node.Name = path[i+len(genreSeparator):]
+		}
+		for _, book := range Books {
+			for _, genre := range book.Genres {
+				if genreWithin(genre, path) {
+					node.Count++
+					break
+				}
+			}
+		}
+		nodes[path] = node
+		if parent, ok := nodes[genreParent(path)]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+	}
+	return roots
+}
+
+/*
+Moves every genre at or below from to sit at or below to, in both the vocabulary and on every book, including the
+ones in the trash so they come back with genres that still exist. Renaming and merging are the same operation, merging
+just allows to to exist already.
+*/
+func moveGenre(r *http.Request, from string, to string) {
+	move := func(genre string) string {
+		if genreWithin(genre, from) {
+			return to + strings.TrimPrefix(genre, from)
+		}
+		return genre
+	}
+
+	vocabulary := map[string]bool{}
+	for genre := range genreVocabulary {
+		vocabulary[move(genre)] = true
+	}
+	genreVocabulary = vocabulary
+	addGenre(to)
+
+	moveAll := func(book *Book) bool {
+		var genres []string
+		changed := false
+		for _, genre := range book.Genres {
+			moved := move(genre)
+			changed = changed || moved != genre
+			genres = append(genres, moved)
+		}
+		if changed {
+			book.Genres, _ = normalizeGenres(genres)
+		}
+		return changed
+	}
+	for i := range Trash {
+		moveAll(&Trash[i].Book) // Books in the trash aren't in the catalog, so there is no change to record
+	}
+	for i := range Books {
+		before := Books[i]
+		if moveAll(&Books[i]) {
+			recordMutation(r, "genre", &before, &Books[i])
+		}
+	}
+}
+
+/*
+Handles the genre vocabulary.
+
+	GET  /genres                 the genre tree with book counts
+	POST /genres                 path: add a genre, its parents are added too
+	POST /genres/rename          from, to: rename a genre, which must not exist yet
+	POST /genres/merge           from, into: merge a genre into one that already exists
+*/
+func genresHandler(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/genres"), "/")
+
+	if action == "" && r.Method == "GET" {
+		mutex.LockContext(r.Context())
+		tree := genreTree()
+		mutex.Unlock()
+		json.NewEncoder(w).Encode(tree)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "405 Method not allowed, only GET and POST are permited", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	switch action {
+	case "":
+		path, err := parseGenrePath(r.FormValue("path"))
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := lookupGenre(path); ok {
+			http.Error(w, "409, genre already exists", http.StatusConflict)
+			return
+		}
+		addGenre(path)
+		w.WriteHeader(http.StatusCreated)
+
+	case "rename":
+		from, ok := lookupGenre(r.FormValue("from"))
+		if !ok {
+			http.Error(w, "404, genre not found.", http.StatusNotFound)
+			return
+		}
+		to, err := parseGenrePath(r.FormValue("to"))
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if existing, ok := lookupGenre(to); ok && existing != from {
+			http.Error(w, "409, genre already exists, merge it instead", http.StatusConflict)
+			return
+		}
+		if genreWithin(to, from) && to != from {
+			http.Error(w, "400, a genre can't be moved below itself", http.StatusBadRequest)
+			return
+		}
+		moveGenre(r, from, to)
+
+	case "merge":
+		from, ok := lookupGenre(r.FormValue("from"))
+		if !ok {
+			http.Error(w, "404, genre not found.", http.StatusNotFound)
+			return
+		}
+		into, ok := lookupGenre(r.FormValue("into"))
+		if !ok {
+			http.Error(w, "404, genre to merge into not found.", http.StatusNotFound)
+			return
+		}
+		if genreWithin(into, from) {
+			http.Error(w, "400, a genre can't be merged into itself or its subgenres", http.StatusBadRequest)
+			return
+		}
+		moveGenre(r, from, into)
+
+	default:
+		http.Error(w, "404 not found", http.StatusNotFound)
+		return
+	}
+	saveCatalog(logContext(r))
+
+	json.NewEncoder(w).Encode(genreTree())
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func listBooks(t *testing.T, path string) []Book {
+	w := httptest.NewRecorder()
+	allEnteries(w, httptest.NewRequest("GET", path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	var books []Book
+	if err := json.NewDecoder(w.Body).Decode(&books); err != nil {
+		t.Fatal(err)
+	}
+	return books
+}
+
+func TestParseGenrePath(t *testing.T) {
+	path, err := parseGenrePath(" Fiction>Mystery >  Cozy ")
+	if err != nil || path != "Fiction > Mystery > Cozy" {
+		t.Error("Expected Fiction > Mystery > Cozy. Recieved ", path, err)
+	}
+	if _, err := parseGenrePath("Fiction > > Cozy"); err == nil {
+		t.Error("Expected an error for an empty level")
+	}
+}
+
+func TestTagAndGenreFilters(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"tag": {"Classic, favourite"}, "genre": {"fiction > mystery > cozy"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if strings.Join(Books[0].Tags, ",") != "classic,favourite" || Books[0].Genres[0] != "Fiction > Mystery > Cozy" {
+		t.Error("Tags or genres not stored correctly. Recieved ", Books[0].Tags, Books[0].Genres)
+	}
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"genre": {"Fiction > Fantasy"}})
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"genre": {"Fiction > Romance"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400 for a genre outside the vocabulary. Recieved ", w.Code)
+	}
+
+	if books := listBooks(t, "/books?genre=Fiction"); len(books) != 2 {
+		t.Error("Expected both books under Fiction. Recieved ", books)
+	}
+	if books := listBooks(t, "/books?genre=Fiction+>+Mystery"); len(books) != 1 || books[0].Title != "Book 1" {
+		t.Error("Expected only Book 1 under Mystery. Recieved ", books)
+	}
+	if books := listBooks(t, "/books?tag=classic&tag=favourite"); len(books) != 1 {
+		t.Error("Expected only Book 1 tagged classic and favourite. Recieved ", books)
+	}
+	if books := listBooks(t, "/books?tag=classic&genre=Fiction+>+Fantasy"); len(books) != 0 {
+		t.Error("Expected no books. Recieved ", books)
+	}
+
+	// An empty value clears the tags
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"tag": {""}})
+	if len(Books[0].Tags) != 0 {
+		t.Error("Tags were not cleared. Recieved ", Books[0].Tags)
+	}
+}
+
+func TestGenreTreeCounts(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"genre": {"Fiction > Mystery > Cozy"}})
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"genre": {"Fiction > Mystery > Hardboiled", "Fiction > Mystery"}})
+
+	w := formRequest(http.HandlerFunc(genresHandler), "GET", "/genres", nil)
+	var tree []*genreNode
+	if err := json.NewDecoder(w.Body).Decode(&tree); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree) != 2 || tree[0].Name != "Fiction" || tree[0].Count != 2 {
+		t.Fatal("Expected Fiction with 2 books first. Recieved ", tree[0])
+	}
+	for _, child := range tree[0].Children {
+		if child.Name == "Mystery" && (child.Count != 2 || len(child.Children) != 2) {
+			t.Error("Expected Mystery to count each book once. Recieved ", child)
+		}
+	}
+}
+
+func TestRenameAndMergeGenres(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"genre": {"Fiction > Mystery > Cozy"}})
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"genre": {"Fiction > Science Fiction"}})
+
+	w := formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/rename", url.Values{"from": {"Fiction > Mystery"}, "to": {"Fiction > Crime"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if Books[0].Genres[0] != "Fiction > Crime > Cozy" {
+		t.Error("Book genre was not renamed. Recieved ", Books[0].Genres)
+	}
+	if _, ok := lookupGenre("Fiction > Mystery > Cozy"); ok {
+		t.Error("Old genre is still in the vocabulary")
+	}
+
+	w = formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/rename", url.Values{"from": {"Fiction > Crime"}, "to": {"Fiction > Fantasy"}})
+	if w.Code != http.StatusConflict {
+		t.Error("Expected Response code 409 renaming onto an existing genre. Recieved ", w.Code)
+	}
+
+	w = formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/merge", url.Values{"from": {"Fiction > Science Fiction"}, "into": {"Fiction > Fantasy"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if Books[1].Genres[0] != "Fiction > Fantasy" {
+		t.Error("Book genre was not merged. Recieved ", Books[1].Genres)
+	}
+	if _, ok := lookupGenre("Fiction > Science Fiction"); ok {
+		t.Error("Merged genre is still in the vocabulary")
+	}
+
+	w = formRequest(http.HandlerFunc(genresHandler), "POST", "/genres", url.Values{"path": {"Fiction > Romance > Regency"}})
+	if w.Code != http.StatusCreated {
+		t.Error("Expected Response code 201. Recieved ", w.Code)
+	}
+	if _, ok := lookupGenre("Fiction > Romance"); !ok {
+		t.Error("Parent genre was not added")
+	}
+}
+
+/*
+A book in the trash while its genre is renamed comes back under the new name.
+*/
+func TestRestoreAfterGenreRename(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+	formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"genre": {"Fiction > Mystery > Cozy"}})
+	formRequest(requireRole(routes()), "DELETE", "/books/book-1", nil)
+
+	formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/rename", url.Values{"from": {"Fiction > Mystery"}, "to": {"Fiction > Crime"}})
+	w := formRequest(requireRole(routes()), "POST", "/trash/book-1/restore", nil)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	book := Books[len(Books)-1]
+	if book.Title != "Book 1" || len(book.Genres) != 1 || book.Genres[0] != "Fiction > Crime > Cozy" {
+		t.Error("Expected the restored book under the renamed genre. Recieved ", book)
+	}
+	if books := listBooks(t, "/books?genre=Fiction+>+Crime"); len(books) != 1 {
+		t.Error("Expected the restored book to be found by its genre. Recieved ", books)
+	}
+}
+
+func TestGenresSavedAndReadBack(t *testing.T) {
+	readGenres("genres.csv")
+	formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/rename", url.Values{"from": {"Fiction > Mystery"}, "to": {"Fiction > Crime"}})
+	formRequest(http.HandlerFunc(genresHandler), "POST", "/genres", url.Values{"path": {"Poetry"}})
+	saved := genreVocabulary
+
+	path := filepath.Join(t.TempDir(), "genres.csv")
+	if err := writeGenres(path); err != nil {
+		t.Fatal(err)
+	}
+	readGenres(path)
+	if !reflect.DeepEqual(genreVocabulary, saved) {
+		t.Error("Vocabulary changed when read back in. Saved ", saved, " Recieved ", genreVocabulary)
+	}
+	if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data), "Fiction > Crime > Cozy\nFiction > Crime > Hardboiled\nFiction > Fantasy\n") {
+		t.Error("Expected only the leaves, in order. Recieved ", string(data))
+	}
+}
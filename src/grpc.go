@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RESTChallenge/bookspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+/*
+The gRPC BookService from bookspb/books.proto, served on its own port next to the REST API.
+
+Each call is turned into the REST request it mirrors and served by the same handlers, behind the same authentication,
+rate limiting and authorization, so there is one place that validates books and changes the catalog, and the audit
+log, change feed and webhooks see changes made over gRPC like any other. Credentials come from the call's metadata,
+x-api-key or authorization, as they would from the headers.
+*/
+type bookService struct {
+	bookspb.UnimplementedBookServiceServer
+	handler  http.Handler    // The REST API, from guard(routes())
+	stopping context.Context // Done when the server shuts down, which ends the WatchBooks streams
+}
+
+/*
+A gRPC server with the BookService and reflection, so tools like grpcurl can find the calls without the .proto file.
+*/
+func newGRPCServer(service *bookService) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(logUnary), grpc.ChainStreamInterceptor(logStream))
+	bookspb.RegisterBookServiceServer(server, service)
+	reflection.Register(server)
+	return server
+}
+
+/*
+Gives the call a request ID, from x-request-id when the client sent a good one, and logs it once it is done like
+accessLog does for HTTP requests.
+*/
+func grpcCallContext(ctx context.Context) context.Context {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-request-id")) > 0 {
+		id = md.Get("x-request-id")[0]
+	}
+	if !validRequestID(id) {
+		id = randomID()
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func logCall(ctx context.Context, method string, started time.Time, err error) {
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+	}
+	slog.LogAttrs(ctx, slog.LevelInfo, "gRPC call",
+		slog.String("method", method),
+		slog.String("code", status.Code(err).String()),
+		slog.Float64("duration_ms", float64(time.Since(started).Microseconds())/1000),
+		slog.String("client", client),
+	)
+}
+
+func logUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = grpcCallContext(ctx)
+	started := time.Now()
+	resp, err := handler(ctx, req)
+	logCall(ctx, info.FullMethod, started, err)
+	return resp, err
+}
+
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context { return s.ctx }
+
+func logStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := grpcCallContext(stream.Context())
+	started := time.Now()
+	err := handler(srv, contextStream{stream, ctx})
+	logCall(ctx, info.FullMethod, started, err)
+	return err
+}
+
+/*
+Holds on to what a handler writes, to be turned into the call's response.
+*/
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+/*
+The gRPC code for each error status the REST API answers with.
+*/
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusMethodNotAllowed:    codes.Unimplemented,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusGone:                codes.OutOfRange,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusInternalServerError: codes.Internal,
+}
+
+var statusPrefix = regexp.MustCompile(`^\d{3},? *`)
+
+/*
+The handlers' errors start with their status code, like "400, rating not on 1-3 scale", which the gRPC code takes the
+place of.
+*/
+func grpcError(resp *bufferedResponse) error {
+	code, ok := grpcCodes[resp.code]
+	if !ok {
+		code = codes.Unknown
+	}
+	message := strings.TrimSpace(resp.body.String())
+	var problem struct{ Error string }
+	if json.Unmarshal(resp.body.Bytes(), &problem) == nil && problem.Error != "" {
+		message = problem.Error
+	}
+	if resp.code == http.StatusTooManyRequests && resp.header.Get("Retry-After") != "" {
+		message += ", retry after " + resp.header.Get("Retry-After") + "s"
+	}
+	return status.Error(code, statusPrefix.ReplaceAllString(message, ""))
+}
+
+/*
+Serves the REST request a call mirrors. Errors are gRPC status errors.
+*/
+func (s *bookService) call(ctx context.Context, method string, path string, query url.Values, form url.Values) (*bufferedResponse, error) {
+	target := path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	var body *strings.Reader
+	if form == nil {
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+	r, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, name := range []string{"x-api-key", "authorization"} {
+			if values := md.Get(name); len(values) > 0 {
+				r.Header.Set(name, values[0])
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	resp := &bufferedResponse{header: http.Header{}}
+	s.handler.ServeHTTP(resp, r)
+	if resp.code == 0 {
+		resp.code = http.StatusOK
+	}
+	if resp.code >= 300 {
+		return nil, grpcError(resp)
+	}
+	return resp, nil
+}
+
+/*
+The path of a book. Ids with a slash would be taken for one of the actions below a book, like /checkout.
+*/
+func grpcBookPath(id string) (string, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return "", status.Error(codes.InvalidArgument, "id must be a book's title with spaces replaced by dashes")
+	}
+	return "/books/" + url.PathEscape(id), nil
+}
+
+func statusToProto(s BookStatus) bookspb.BookStatus {
+	return bookspb.BookStatus(bookspb.BookStatus_value["BOOK_STATUS_"+strings.ToUpper(string(s))])
+}
+
+/*
+The status name the REST API uses. Numbers the enum doesn't have come out as themselves, which the handlers reject.
+*/
+func statusFromProto(s bookspb.BookStatus) string {
+	return strings.ToLower(strings.TrimPrefix(s.String(), "BOOK_STATUS_"))
+}
+
+func bookToProto(book Book) *bookspb.Book {
+	distribution := map[int32]int32{}
+	for rating, count := range book.RatingDistribution {
+		distribution[int32(rating)] = int32(count)
+	}
+	return &bookspb.Book{
+		Id:                 int32(book.ID),
+		Title:              book.Title,
+		Author:             book.Author,
+		Publisher:          book.Publisher,
+		PublishDate:        book.PublishDate,
+		Rating:             int32(book.Rating),
+		IsCheckedIn:        book.IsCheckedIn,
+		Status:             statusToProto(book.Status),
+		RatingAverage:      book.RatingAverage,
+		RatingCount:        int32(book.RatingCount),
+		RatingDistribution: distribution,
+		ReviewCount:        int32(book.ReviewCount),
+		Tags:               book.Tags,
+		Genres:             book.Genres,
+		CallNumber:         book.CallNumber,
+	}
+}
+
+func decodeBook(resp *bufferedResponse) (*bookspb.Book, error) {
+	var book Book
+	if err := json.Unmarshal(resp.body.Bytes(), &book); err != nil {
+		return nil, status.Error(codes.Internal, "decoding the book: "+err.Error())
+	}
+	return bookToProto(book), nil
+}
+
+func (s *bookService) ListBooks(ctx context.Context, req *bookspb.ListBooksRequest) (*bookspb.ListBooksResponse, error) {
+	query := url.Values{"tag": req.Tags, "genre": req.Genres}
+	if req.Status != bookspb.BookStatus_BOOK_STATUS_UNSPECIFIED {
+		query.Set("status", statusFromProto(req.Status))
+	}
+	if req.ShelfOrder {
+		query.Set("sort", "callnumber")
+	}
+	resp, err := s.call(ctx, "GET", "/books", query, nil)
+	if err != nil {
+		return nil, err
+	}
+	var books []Book
+	if err := json.Unmarshal(resp.body.Bytes(), &books); err != nil {
+		return nil, status.Error(codes.Internal, "decoding the books: "+err.Error())
+	}
+	list := &bookspb.ListBooksResponse{Books: make([]*bookspb.Book, len(books))}
+	list.ChangeSeq, _ = strconv.ParseInt(resp.header.Get("X-Change-Seq"), 10, 64)
+	for i, book := range books {
+		list.Books[i] = bookToProto(book)
+	}
+	return list, nil
+}
+
+func (s *bookService) GetBook(ctx context.Context, req *bookspb.GetBookRequest) (*bookspb.Book, error) {
+	path, err := grpcBookPath(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.call(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBook(resp)
+}
+
+/*
+Adds the book with POST /new and returns the book it sends back, with the id it was given. A book with no status is
+available.
+*/
+func (s *bookService) CreateBook(ctx context.Context, req *bookspb.CreateBookRequest) (*bookspb.Book, error) {
+	form := url.Values{
+		"title":       {req.Title},
+		"author":      {req.Author},
+		"publisher":   {req.Publisher},
+		"publishdate": {req.PublishDate},
+		"rating":      {strconv.Itoa(int(req.Rating))},
+		"status":      {string(StatusAvailable)},
+	}
+	if req.Status != bookspb.BookStatus_BOOK_STATUS_UNSPECIFIED {
+		form.Set("status", statusFromProto(req.Status))
+	}
+	if req.CallNumber != "" {
+		form.Set("callnumber", req.CallNumber)
+	}
+	if len(req.Tags) > 0 {
+		form["tag"] = req.Tags
+	}
+	if len(req.Genres) > 0 {
+		form["genre"] = req.Genres
+	}
+	resp, err := s.call(ctx, "POST", "/new", nil, form)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBook(resp)
+}
+
+func (s *bookService) UpdateBook(ctx context.Context, req *bookspb.UpdateBookRequest) (*bookspb.Book, error) {
+	path, err := grpcBookPath(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	set := func(name string, value *string) {
+		if value != nil {
+			form.Set(name, *value)
+		}
+	}
+	set("title", req.Title)
+	set("author", req.Author)
+	set("publisher", req.Publisher)
+	set("publishdate", req.PublishDate)
+	set("callnumber", req.CallNumber)
+	if req.Rating != nil {
+		form.Set("rating", strconv.Itoa(int(*req.Rating)))
+	}
+	if req.Status != bookspb.BookStatus_BOOK_STATUS_UNSPECIFIED {
+		form.Set("status", statusFromProto(req.Status))
+	}
+	// A tag field that is there but empty clears them, see formTags
+	if req.Tags != nil {
+		form["tag"] = append([]string{""}, req.Tags.Values...)
+	}
+	if req.Genres != nil {
+		form["genre"] = append([]string{""}, req.Genres.Values...)
+	}
+	resp, err := s.call(ctx, "PATCH", path, nil, form)
+	if err != nil {
+		return nil, err
+	}
+	return decodeBook(resp)
+}
+
+func (s *bookService) DeleteBook(ctx context.Context, req *bookspb.DeleteBookRequest) (*emptypb.Empty, error) {
+	path, err := grpcBookPath(req.Id)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	if req.Purge {
+		query.Set("purge", "true")
+	}
+	if _, err := s.call(ctx, "DELETE", path, query, nil); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func changeToProto(change Change) *bookspb.BookChange {
+	c := &bookspb.BookChange{
+		Seq:    change.Seq,
+		Time:   timestamppb.New(change.Time),
+		Type:   change.Type,
+		Op:     change.Op,
+		BookId: int32(change.BookID),
+	}
+	if change.Book != nil {
+		c.Book = bookToProto(*change.Book)
+	}
+	return c
+}
+
+/*
+Follows the change feed the way /events does. Asking /changes for what comes after since first checks the caller may
+read the feed and that since is still kept.
+*/
+func (s *bookService) WatchBooks(req *bookspb.WatchBooksRequest, stream grpc.ServerStreamingServer[bookspb.BookChange]) error {
+	ctx := stream.Context()
+	last := feed.latest()
+	if req.Since != nil {
+		last = req.GetSince()
+	}
+	query := url.Values{"since": {strconv.FormatInt(last, 10)}, "limit": {"1"}}
+	if _, err := s.call(ctx, "GET", "/changes", query, nil); err != nil {
+		return err
+	}
+
+	for {
+		changes, latest, waiting, ok := feed.since(last, 100)
+		if !ok {
+			return status.Errorf(codes.OutOfRange, "changes after %v are no longer kept, list the books again and watch from %v", last, latest)
+		}
+		for _, change := range changes {
+			if err := stream.Send(changeToProto(change)); err != nil {
+				return err
+			}
+			last = change.Seq
+		}
+		if len(changes) > 0 {
+			continue // There may be more than one batch waiting
+		}
+
+		select {
+		case <-waiting:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-s.stopping.Done():
+			return status.Error(codes.Unavailable, "the server is shutting down")
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/RESTChallenge/bookspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+A BookService client talking to a server in memory, and a context that authenticates as the librarian.
+*/
+func grpcTestClient(t *testing.T) (bookspb.BookServiceClient, context.Context, *grpc.ClientConn) {
+	stopping, stop := context.WithCancel(context.Background())
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(&bookService{handler: guard(routes()), stopping: stopping})
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		stop()
+		server.Stop()
+	})
+
+	conn, err := grpc.NewClient("passthrough:///books",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	librarian := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "librarian-key")
+	return bookspb.NewBookServiceClient(conn), librarian, conn
+}
+
+func TestGRPCBooks(t *testing.T) {
+	withTestKeys(t)
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	c, librarian, _ := grpcTestClient(t)
+	ctx := context.Background()
+
+	list, err := c.ListBooks(ctx, &bookspb.ListBooksRequest{})
+	if err != nil || len(list.Books) != 2 || list.Books[1].Status != bookspb.BookStatus_BOOK_STATUS_CHECKED_OUT {
+		t.Fatal("Expected Book 1 and Book 2. Recieved ", list, " ", err)
+	}
+	list, _ = c.ListBooks(ctx, &bookspb.ListBooksRequest{Status: bookspb.BookStatus_BOOK_STATUS_AVAILABLE})
+	if len(list.Books) != 1 || list.Books[0].Title != "Book 1" {
+		t.Error("Expected only Book 1 to be available. Recieved ", list)
+	}
+
+	book, err := c.GetBook(ctx, &bookspb.GetBookRequest{Id: "book-2"})
+	if err != nil || book.Author != "Author 2" || book.IsCheckedIn || book.Rating != 3 {
+		t.Error("Book 2 incorrect. Recieved ", book, " ", err)
+	}
+	for id, want := range map[string]codes.Code{"book-9": codes.NotFound, "": codes.InvalidArgument, "book-1/checkout": codes.InvalidArgument} {
+		if _, err := c.GetBook(ctx, &bookspb.GetBookRequest{Id: id}); status.Code(err) != want {
+			t.Error("Expected ", want, " for ", id, ". Recieved ", err)
+		}
+	}
+
+	newBook := &bookspb.CreateBookRequest{Title: "Book 3", Author: "Author 3", PublishDate: "11111113", Rating: 2, Tags: []string{"Classic"}}
+	if _, err := c.CreateBook(ctx, newBook); status.Code(err) != codes.Unauthenticated {
+		t.Error("Expected a book to need credentials to add. Recieved ", err)
+	}
+	patron := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer nonsense")
+	if _, err := c.CreateBook(patron, newBook); status.Code(err) != codes.Unauthenticated {
+		t.Error("Expected a bad token to be refused. Recieved ", err)
+	}
+	patron = metadata.AppendToOutgoingContext(ctx, "x-api-key", "patron-key")
+	if _, err := c.CreateBook(patron, newBook); status.Code(err) != codes.PermissionDenied {
+		t.Error("Expected a patron not to add books. Recieved ", err)
+	}
+	bad := proto.Clone(newBook).(*bookspb.CreateBookRequest)
+	bad.Rating = 9
+	if _, err := c.CreateBook(librarian, bad); status.Code(err) != codes.InvalidArgument || status.Convert(err).Message() != "rating not on 1-3 scale" {
+		t.Error("Expected the rating to be refused like it is over HTTP. Recieved ", err)
+	}
+	book, err = c.CreateBook(librarian, newBook)
+	if err != nil || book.Id != 3 || book.Status != bookspb.BookStatus_BOOK_STATUS_AVAILABLE || len(book.Tags) != 1 || book.Tags[0] != "classic" {
+		t.Fatal("Expected Book 3. Recieved ", book, " ", err)
+	}
+
+	author := "Someone Else"
+	book, err = c.UpdateBook(librarian, &bookspb.UpdateBookRequest{Id: "Book-3", Author: &author, Tags: &bookspb.StringList{}})
+	if err != nil || book.Author != author || len(book.Tags) != 0 || book.Title != "Book 3" {
+		t.Error("Expected the author to change and the tags to be cleared. Recieved ", book, " ", err)
+	}
+	_, err = c.UpdateBook(librarian, &bookspb.UpdateBookRequest{Id: "Book-2", Status: bookspb.BookStatus_BOOK_STATUS_WITHDRAWN})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Error("Expected a checked out book not to be withdrawn. Recieved ", err)
+	}
+	_, err = c.UpdateBook(librarian, &bookspb.UpdateBookRequest{Id: "Book-3", Status: bookspb.BookStatus(42)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Error("Expected an unknown status to be refused. Recieved ", err)
+	}
+
+	if _, err := c.DeleteBook(librarian, &bookspb.DeleteBookRequest{Id: "Book-3"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetBook(ctx, &bookspb.GetBookRequest{Id: "Book-3"}); status.Code(err) != codes.NotFound {
+		t.Error("Expected Book 3 to be gone. Recieved ", err)
+	}
+	if len(Trash) != 1 || Trash[0].DeletedBy != "lucy" {
+		t.Error("Expected Book 3 in the trash, deleted by lucy. Recieved ", Trash)
+	}
+}
+
+func TestGRPCWatchBooks(t *testing.T) {
+	withTestKeys(t)
+	withChangeFeed(t, 3)
+	readFromFile("books.csv")
+	c, librarian, _ := grpcTestClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	list, _ := c.ListBooks(ctx, &bookspb.ListBooksRequest{})
+	since := list.ChangeSeq
+	stream, err := c.WatchBooks(ctx, &bookspb.WatchBooksRequest{Since: &since})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made over HTTP show up too
+	formRequest(requireRole(routes()), "POST", "/books/book-1/checkout", url.Values{}, "X-API-Key", "patron-key")
+	c.DeleteBook(librarian, &bookspb.DeleteBookRequest{Id: "Book-1"})
+	for i, want := range []string{"updated", "deleted"} {
+		change, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Seq != since+int64(i)+1 || change.Type != want || change.BookId != 1 || (want == "updated") != (change.Book != nil) {
+			t.Error("Change ", i, " incorrect. Recieved ", change)
+		}
+	}
+
+	// The feed only keeps 3 changes, so 0 is too old to carry on from
+	formRequest(requireRole(routes()), "POST", "/books/book-2/checkin", url.Values{}, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "POST", "/books/book-2/checkout", url.Values{}, "X-API-Key", "librarian-key")
+	old := int64(0)
+	stream, _ = c.WatchBooks(ctx, &bookspb.WatchBooksRequest{Since: &old})
+	if _, err := stream.Recv(); status.Code(err) != codes.OutOfRange {
+		t.Error("Expected changes after 0 to be gone. Recieved ", err)
+	}
+}
+
+func TestGRPCWatchEndsOnShutdown(t *testing.T) {
+	withTestKeys(t)
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	stopping, stop := context.WithCancel(context.Background())
+	service := &bookService{handler: guard(routes()), stopping: stopping}
+
+	done := make(chan error, 1)
+	go func() { done <- service.WatchBooks(&bookspb.WatchBooksRequest{}, fakeWatchStream{}) }()
+	stop()
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Error("Expected the stream to end as unavailable. Recieved ", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the stream to end")
+	}
+}
+
+type fakeWatchStream struct {
+	grpc.ServerStream
+}
+
+func (fakeWatchStream) Context() context.Context       { return context.Background() }
+func (fakeWatchStream) Send(*bookspb.BookChange) error { return nil }
+
+func TestGRPCReflection(t *testing.T) {
+	_, _, conn := grpcTestClient(t)
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}})
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		found = found || service.Name == "books.v1.BookService"
+	}
+	if !found {
+		t.Error("Expected the BookService to be listed. Recieved ", resp)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+GET /healthz says the process is up and serving, and is what a liveness probe should use. GET /readyz says whether
+the server should be sent traffic, which needs the catalog to be loaded, the data directory to be writable, and the
+changes still to be published or delivered to be under -ready-max-backlog. It fails as soon as the server starts to
+shut down, so a load balancer stops sending it requests before it stops listening, and while SIGHUP reloads the keys.
+
+Both answer with JSON, and /readyz has each component's status so a failing probe says why:
+
+	{"status": "failing", "components": {"catalog": {"status": "ok"}, "events": {"status": "failing", "backlog": 1200}, ...}}
+*/
+type componentStatus struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Backlog *int64 `json:"backlog,omitempty"`
+}
+
+type healthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+type readinessChecks struct {
+	mutex      sync.Mutex
+	dataPath   string
+	maxBacklog int64
+	outboxes   map[string]*outbox
+	draining   string // Why the server shouldn't be sent traffic even though it is up, like shutting down
+}
+
+var (
+	readiness = &readinessChecks{dataPath: "books.csv", maxBacklog: 1000}
+
+	catalogLoaded atomic.Bool // Set once the books have been read in
+)
+
+/*
+Makes /readyz fail from now on, giving reason.
+*/
+func (c *readinessChecks) drain(reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.draining = reason
+}
+
+/*
+Lets /readyz pass again after drain.
+*/
+func (c *readinessChecks) undrain() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.draining = ""
+}
+
+func (c *readinessChecks) check() healthStatus {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status := healthStatus{Status: "ok", Components: map[string]componentStatus{}}
+	set := func(name string, component componentStatus) {
+		if component.Status == "" {
+			component.Status = "ok"
+			if component.Error != "" {
+				component.Status = "failing"
+			}
+		}
+		if component.Status != "ok" {
+			status.Status = "failing"
+		}
+		status.Components[name] = component
+	}
+
+	if c.draining != "" {
+		set("server", componentStatus{Error: c.draining})
+	} else {
+		set("server", componentStatus{})
+	}
+
+	if catalogLoaded.Load() {
+		set("catalog", componentStatus{})
+	} else {
+		set("catalog", componentStatus{Error: "the catalog has not been loaded"})
+	}
+
+	storage := componentStatus{}
+	if f, err := os.CreateTemp(filepath.Dir(c.dataPath), ".readyz-*"); err != nil {
+		storage.Error = err.Error()
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	set("storage", storage)
+
+	backlog := webhooks.backlog()
+	for _, o := range c.outboxes {
+		if pending := o.backlog(); pending > backlog {
+			backlog = pending
+		}
+	}
+	events := componentStatus{Backlog: &backlog}
+	if backlog > c.maxBacklog {
+		events.Status = "failing"
+		events.Error = "too many changes waiting to be published or delivered"
+	}
+	set("events", events)
+	return status
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(healthStatus{Status: "ok"})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	status := readiness.check()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Checks readiness against a copy of the catalog in a new directory, with nothing draining.
+*/
+func withReadiness(t *testing.T) *readinessChecks {
+	saved := readiness
+	t.Cleanup(func() { readiness = saved })
+	dataPath := filepath.Join(t.TempDir(), "books.csv")
+	copyFile(t, "books.csv", dataPath)
+	readiness = &readinessChecks{dataPath: dataPath, maxBacklog: 1000}
+	return readiness
+}
+
+func probe(t *testing.T, path string) (int, healthStatus) {
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	var status healthStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal("Expected JSON. Recieved ", w.Body.String())
+	}
+	return w.Code, status
+}
+
+func TestHealthz(t *testing.T) {
+	withReadiness(t).drain("shutting down")
+	if code, status := probe(t, "/healthz"); code != http.StatusOK || status.Status != "ok" {
+		t.Error("Expected the server to be alive while draining. Recieved ", code, " ", status)
+	}
+}
+
+func TestProbesNotGuarded(t *testing.T) {
+	withTestKeys(t)
+	withReadiness(t)
+	readFromFile("books.csv")
+	saved := limiter
+	t.Cleanup(func() { limiter = saved })
+	limiter, _ = newTestLimiter(t, "anonymous.read=1/1", "")
+	handler := serverRoutes()
+
+	for _, path := range []string{"/healthz", "/readyz", "/metrics", "/healthz", "/readyz", "/metrics"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-API-Key", "wrong-key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Error("Expected ", path, " to be served whatever the credentials and limits. Recieved ", w.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "/books", nil)
+	req.Header.Set("X-API-Key", "wrong-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Error("Expected the rest of the API to still be guarded. Recieved ", w.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	checks := withReadiness(t)
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+
+	code, status := probe(t, "/readyz")
+	if code != http.StatusOK || status.Status != "ok" {
+		t.Fatal("Expected the server to be ready. Recieved ", code, " ", status)
+	}
+	for _, name := range []string{"server", "catalog", "storage", "events"} {
+		if status.Components[name].Status != "ok" {
+			t.Error("Expected ", name, " to be ok. Recieved ", status.Components[name])
+		}
+	}
+
+	checks.drain("shutting down")
+	code, status = probe(t, "/readyz")
+	if code != http.StatusServiceUnavailable || status.Components["server"].Error != "shutting down" {
+		t.Error("Expected the server to be failing while draining. Recieved ", code, " ", status)
+	}
+}
+
+func TestReadyzBacklog(t *testing.T) {
+	checks := withReadiness(t)
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	checks.maxBacklog = 3
+	checks.outboxes = map[string]*outbox{"test": newOutbox(newTestPublisher(0), "")}
+	for seq := int64(1); seq <= 5; seq++ {
+		feed.add(Change{Seq: seq, Op: "created"})
+	}
+
+	code, status := probe(t, "/readyz")
+	events := status.Components["events"]
+	if code != http.StatusServiceUnavailable || events.Status != "failing" || events.Backlog == nil || *events.Backlog != 5 {
+		t.Fatal("Expected the unpublished changes to fail the check. Recieved ", code, " ", status)
+	}
+
+	checks.outboxes["test"].published.Store(3)
+	if code, status := probe(t, "/readyz"); code != http.StatusOK || *status.Components["events"].Backlog != 2 {
+		t.Error("Expected the server to be ready once the backlog went down. Recieved ", code, " ", status)
+	}
+}
+
+func TestReadyzStorage(t *testing.T) {
+	checks := withReadiness(t)
+	readFromFile("books.csv")
+	checks.dataPath = filepath.Join(t.TempDir(), "missing", "books.csv")
+
+	code, status := probe(t, "/readyz")
+	if code != http.StatusServiceUnavailable || status.Components["storage"].Status != "failing" || status.Components["storage"].Error == "" {
+		t.Error("Expected storage to fail when the data directory is gone. Recieved ", code, " ", status)
+	}
+}
+
+/*
+Once SIGTERM arrives /readyz fails straight away, while everything else is served as normal until the delay is up.
+*/
+func TestReadyzDuringShutdown(t *testing.T) {
+	if testing.Short() || runtime.GOOS == "windows" {
+		t.Skip("builds and signals the server")
+	}
+	cmd, base, output := startServer(t, t.TempDir(), "-shutdown-delay", "2s")
+	get := func(path string) int {
+		resp, err := http.Get(base + path)
+		if err != nil {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatal("Expected the server to be ready. Recieved ", code, "\n", output.String())
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	for deadline := time.Now().Add(time.Second); get("/readyz") != http.StatusServiceUnavailable; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected /readyz to fail once shutting down. Recieved ", output.String())
+		}
+	}
+	if code := get("/books"); code != http.StatusOK {
+		t.Error("Expected requests to be served during the delay. Recieved ", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Error("Expected the server to be alive during the delay. Recieved ", code)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Error("Expected a clean exit. Recieved ", err, "\n", output.String())
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Validates JWTs issued by the organisation's identity provider, sent as "Authorization: Bearer <jwt>".
+Tokens must be signed with RS256 or ES256 by a key in the JWKS, come from the expected issuer, be meant for this API,
+and be within their validity period give or take the allowed clock skew. The role comes from a claim whose values
+are mapped onto patron and librarian.
+*/
+type jwtAuthenticator struct {
+	keys      *jwksCache
+	issuer    string
+	audience  string
+	skew      time.Duration
+	nameClaim string          // Usually "sub" or "preferred_username"
+	roleClaim string          // Can be a path into nested claims, like "realm_access.roles"
+	roleMap   map[string]Role // Claim value to role
+	now       func() time.Time
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	name, _ := claimAt(claims, a.nameClaim).(string)
+	if name == "" {
+		return nil, errors.New("token has no " + a.nameClaim + " claim")
+	}
+	principal := &Principal{Name: name, Role: RoleAnonymous}
+	for _, value := range claimStrings(claimAt(claims, a.roleClaim)) {
+		if role, ok := a.roleMap[value]; ok && role.atLeast(principal.Role) {
+			principal.Role = role
+		}
+	}
+	return principal, nil
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+/*
+Checks the signature and the registered claims, and returns all of the token's claims.
+*/
+func (a *jwtAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+
+	headerJSON, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return nil, fmt.Errorf("token algorithm %q is not allowed", header.Alg)
+	}
+
+	key, err := a.keys.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("token signature is not valid")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, errors.New("token signature is not valid")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errors.New("token signature is not valid")
+		}
+	default:
+		return nil, errors.New("token signature is not valid")
+	}
+
+	payload, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	var claims map[string]interface{}
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+
+	if iss, _ := claims["iss"].(string); iss != a.issuer {
+		return nil, errors.New("token issuer is not trusted")
+	}
+	// aud is either one audience or a list of them, a string of several isn't split like roles are
+	audienceOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audienceOK = aud == a.audience
+	case []interface{}:
+		for _, value := range aud {
+			audienceOK = audienceOK || value == a.audience
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("token is not for this audience")
+	}
+
+	now := a.now()
+	exp, ok := claimTime(claims["exp"])
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(a.skew)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(a.skew).Before(nbf) {
+		return nil, errors.New("token is not valid yet")
+	}
+	return claims, nil
+}
+
+/*
+Follows a dotted path like "realm_access.roles" into nested claims.
+*/
+func claimAt(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+/*
+Role claims can be a list of strings, or a single string of them separated by spaces like scope.
+*/
+func claimStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		var values []string
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func claimTime(value interface{}) (time.Time, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+/*
+The signing keys from a JWKS, read from a file or fetched from a URL. The keys are reloaded once they are older than
+ttl, and straight away when a token names a key that isn't known yet, which is how a rotated key gets picked up.
+Unknown keys can't trigger a reload more often than minRefresh so bad tokens can't be used to hammer the source.
+If a reload fails the keys already loaded keep being used.
+*/
+type jwksCache struct {
+	source     string
+	ttl        time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	loading chan struct{} // Closed when the fetch under way finishes, nil when there isn't one
+}
+
+func newJWKSCache(source string, ttl time.Duration) *jwksCache {
+	return &jwksCache{source: source, ttl: ttl, minRefresh: 30 * time.Second, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (c *jwksCache) key(kid string) (crypto.PublicKey, error) {
+	c.mutex.Lock()
+	keys, fetched := c.keys, c.fetched
+	c.mutex.Unlock()
+
+	if keys == nil || time.Since(fetched) > c.ttl {
+		keys, fetched = c.refresh(fetched)
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(fetched) > c.minRefresh {
+		keys, _ = c.refresh(fetched)
+		if key, ok := keys[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, errors.New("token signing key is not known")
+}
+
+/*
+Makes the next lookup load the JWKS again, for when the signing keys are known to have changed. The keys already
+loaded are kept until then, and if loading fails.
+*/
+func (c *jwksCache) expire() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.fetched = time.Time{}
+}
+
+/*
+Loads the JWKS again unless it has been since the keys fetched at seen were loaded, and returns the keys. The mutex
+isn't held while the JWKS is fetched, so a slow source only holds up the requests that need new keys, and requests
+that arrive while it is being fetched wait for that fetch rather than starting another.
+*/
+func (c *jwksCache) refresh(seen time.Time) (map[string]crypto.PublicKey, time.Time) {
+	c.mutex.Lock()
+	for c.loading != nil {
+		loading := c.loading
+		c.mutex.Unlock()
+		<-loading
+		c.mutex.Lock()
+	}
+	if !c.fetched.Equal(seen) {
+		defer c.mutex.Unlock()
+		return c.keys, c.fetched
+	}
+	loading := make(chan struct{})
+	c.loading = loading
+	c.mutex.Unlock()
+
+	keys, err := c.load()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.fetched = time.Now()
+	if err != nil {
+		slog.Warn("Could not load JWKS", "source", c.source, "err", err)
+	} else {
+		c.keys = keys
+	}
+	c.loading = nil
+	close(loading)
+	return c.keys, c.fetched
+}
+
+func (c *jwksCache) load() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(c.source, "https://") || strings.HasPrefix(c.source, "http://") {
+		resp, err := c.client.Get(c.source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("status %v", resp.StatusCode)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err = os.ReadFile(c.source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return parseJWKS(data)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+/*
+Reads the RSA and P-256 signing keys from a JWKS. Encryption keys and other key types are skipped.
+*/
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := decodeSegment(jwk.N)
+			e, errE := decodeSegment(jwk.E)
+			if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("RSA key %q is malformed", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				continue
+			}
+			x, errX := decodeSegment(jwk.X)
+			y, errY := decodeSegment(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("EC key %q is malformed", jwk.Kid)
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				return nil, fmt.Errorf("EC key %q is not on the P-256 curve", jwk.Kid)
+			}
+			keys[jwk.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+/*
+Reads a role mapping like "library-staff=librarian,library-member=patron".
+*/
+func parseRoleMap(value string) (map[string]Role, error) {
+	roles := map[string]Role{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("role mapping %q should look like claimvalue=role", pair)
+		}
+		role, ok := parseRole(kv[1])
+		if !ok {
+			return nil, fmt.Errorf("unknown role %q", kv[1])
+		}
+		roles[strings.TrimSpace(kv[0])] = role
+	}
+	return roles, nil
+}
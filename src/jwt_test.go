@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+A locally generated key set standing in for the identity provider.
+*/
+type testIssuer struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{rsaKey: rsaKey, ecKey: ecKey}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (i *testIssuer) jwks(rsaKid string, ecKid string) []byte {
+	ecX := make([]byte, 32)
+	ecY := make([]byte, 32)
+	i.ecKey.X.FillBytes(ecX)
+	i.ecKey.Y.FillBytes(ecY)
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": rsaKid, "use": "sig", "n": b64(i.rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(i.rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": ecKid, "crv": "P-256", "x": b64(ecX), "y": b64(ecY)},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+func (i *testIssuer) sign(t *testing.T, alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, i.rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, i.ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signingInput + "." + b64(signature)
+}
+
+func testClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":          "https://id.example.org",
+		"aud":          []string{"books-api", "other-api"},
+		"sub":          "alice",
+		"exp":          now.Add(5 * time.Minute).Unix(),
+		"nbf":          now.Add(-time.Minute).Unix(),
+		"realm_access": map[string]interface{}{"roles": []string{"library-staff"}},
+	}
+}
+
+func newTestJWTAuthenticator(source string, now time.Time) *jwtAuthenticator {
+	return &jwtAuthenticator{
+		keys:      newJWKSCache(source, time.Hour),
+		issuer:    "https://id.example.org",
+		audience:  "books-api",
+		skew:      time.Minute,
+		nameClaim: "sub",
+		roleClaim: "realm_access.roles",
+		roleMap:   map[string]Role{"library-staff": RoleLibrarian, "library-member": RolePatron},
+		now:       func() time.Time { return now },
+	}
+}
+
+func authenticateToken(a Authenticator, token string) (*Principal, error) {
+	req := httptest.NewRequest("GET", "/books", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return a.Authenticate(req)
+}
+
+func TestJWTValidation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, issuer.jwks("rsa-1", "ec-1"), 0600)
+	now := time.Now()
+	auth := newTestJWTAuthenticator(jwksFile, now)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		kid := map[string]string{"RS256": "rsa-1", "ES256": "ec-1"}[alg]
+		principal, err := authenticateToken(auth, issuer.sign(t, alg, kid, testClaims(now)))
+		if err != nil {
+			t.Fatal(alg, " token was rejected: ", err)
+		}
+		if principal.Name != "alice" || principal.Role != RoleLibrarian {
+			t.Error(alg, " token mapped to the wrong principal. Recieved ", principal)
+		}
+	}
+
+	bad := map[string]func(map[string]interface{}){
+		"wrong issuer":          func(c map[string]interface{}) { c["iss"] = "https://evil.example.org" },
+		"wrong audience":        func(c map[string]interface{}) { c["aud"] = "other-api" },
+		"audiences in a string": func(c map[string]interface{}) { c["aud"] = "other-api books-api" },
+		"expired":               func(c map[string]interface{}) { c["exp"] = now.Add(-2 * time.Minute).Unix() },
+		"not valid yet":         func(c map[string]interface{}) { c["nbf"] = now.Add(2 * time.Minute).Unix() },
+		"no expiry":             func(c map[string]interface{}) { delete(c, "exp") },
+		"no subject":            func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, change := range bad {
+		claims := testClaims(now)
+		change(claims)
+		if _, err := authenticateToken(auth, issuer.sign(t, "RS256", "rsa-1", claims)); err == nil {
+			t.Error("Token with ", name, " was accepted")
+		}
+	}
+
+	claims := testClaims(now)
+	claims["aud"] = "books-api"
+	if _, err := authenticateToken(auth, issuer.sign(t, "RS256", "rsa-1", claims)); err != nil {
+		t.Error("Token with a single audience was rejected: ", err)
+	}
+
+	claims = testClaims(now)
+	claims["exp"] = now.Add(-30 * time.Second).Unix()
+	if _, err := authenticateToken(auth, issuer.sign(t, "RS256", "rsa-1", claims)); err != nil {
+		t.Error("Token expired within the clock skew was rejected: ", err)
+	}
+
+	// A token signed by the EC key but claiming to be from the RSA key
+	if _, err := authenticateToken(auth, issuer.sign(t, "ES256", "rsa-1", testClaims(now))); err == nil {
+		t.Error("Token with mismatched key and algorithm was accepted")
+	}
+
+	token := issuer.sign(t, "RS256", "rsa-1", testClaims(now))
+	if _, err := authenticateToken(auth, token[:len(token)-4]+"AAAA"); err == nil {
+		t.Error("Token with a broken signature was accepted")
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "none"})
+	payload, _ := json.Marshal(testClaims(now))
+	if _, err := authenticateToken(auth, b64(header)+"."+b64(payload)+"."); err == nil {
+		t.Error("Unsigned token was accepted")
+	}
+}
+
+func TestJWTRoleMapping(t *testing.T) {
+	issuer := newTestIssuer(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, issuer.jwks("rsa-1", "ec-1"), 0600)
+	now := time.Now()
+	auth := newTestJWTAuthenticator(jwksFile, now)
+
+	claims := testClaims(now)
+	claims["realm_access"] = map[string]interface{}{"roles": []string{"library-member"}}
+	principal, err := authenticateToken(auth, issuer.sign(t, "RS256", "rsa-1", claims))
+	if err != nil || principal.Role != RolePatron {
+		t.Error("Expected a patron. Recieved ", principal, err)
+	}
+
+	claims["realm_access"] = map[string]interface{}{"roles": []string{"cleaner"}}
+	principal, err = authenticateToken(auth, issuer.sign(t, "RS256", "rsa-1", claims))
+	if err != nil || principal.Role != RoleAnonymous {
+		t.Error("Expected no role for unmapped values. Recieved ", principal, err)
+	}
+
+	roles, err := parseRoleMap("library-staff=librarian, library-member=patron")
+	if err != nil || roles["library-staff"] != RoleLibrarian || roles["library-member"] != RolePatron {
+		t.Error("Role map parsed incorrectly. Recieved ", roles, err)
+	}
+	if _, err := parseRoleMap("library-staff=admin"); err == nil {
+		t.Error("Expected an error for an unknown role")
+	}
+}
+
+/*
+The JWKS is served over HTTP, cached, and reloaded when a token is signed with a key it hasn't seen.
+*/
+func TestJWKSRotation(t *testing.T) {
+	oldIssuer := newTestIssuer(t)
+	newIssuer := newTestIssuer(t)
+	current := oldIssuer.jwks("rsa-1", "ec-1")
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write(current)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	auth := newTestJWTAuthenticator(server.URL, now)
+	auth.keys.minRefresh = 0
+
+	for i := 0; i < 3; i++ {
+		if _, err := authenticateToken(auth, oldIssuer.sign(t, "RS256", "rsa-1", testClaims(now))); err != nil {
+			t.Fatal("Token was rejected: ", err)
+		}
+	}
+	if fetches != 1 {
+		t.Error("Expected the JWKS to be fetched once. Fetched ", fetches)
+	}
+
+	current = newIssuer.jwks("rsa-2", "ec-2")
+	if _, err := authenticateToken(auth, newIssuer.sign(t, "ES256", "ec-2", testClaims(now))); err != nil {
+		t.Error("Token signed with the rotated key was rejected: ", err)
+	}
+	if _, err := authenticateToken(auth, oldIssuer.sign(t, "RS256", "rsa-1", testClaims(now))); err == nil {
+		t.Error("Token signed with the retired key was accepted")
+	}
+}
+
+/*
+While the JWKS is being fetched again, tokens signed with keys already loaded are still checked, and the other
+requests waiting for new keys share the one fetch.
+*/
+func TestJWKSFetchedOutsideTheLock(t *testing.T) {
+	oldIssuer := newTestIssuer(t)
+	newIssuer := newTestIssuer(t)
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) == 1 {
+			w.Write(oldIssuer.jwks("rsa-1", "ec-1"))
+			return
+		}
+		<-release
+		w.Write(newIssuer.jwks("rsa-2", "ec-2"))
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	auth := newTestJWTAuthenticator(server.URL, now)
+	auth.keys.minRefresh = 0
+	if _, err := authenticateToken(auth, oldIssuer.sign(t, "RS256", "rsa-1", testClaims(now))); err != nil {
+		t.Fatal("Token was rejected: ", err)
+	}
+
+	rotated := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := authenticateToken(auth, newIssuer.sign(t, "ES256", "ec-2", testClaims(now)))
+			rotated <- err
+		}()
+	}
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := authenticateToken(auth, oldIssuer.sign(t, "RS256", "rsa-1", testClaims(now))); err != nil {
+		t.Error("Token signed with a loaded key was rejected while the JWKS was being fetched: ", err)
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-rotated; err != nil {
+			t.Error("Token signed with the rotated key was rejected: ", err)
+		}
+	}
+	if fetches.Load() != 2 {
+		t.Error("Expected the JWKS to be fetched twice. Fetched ", fetches.Load())
+	}
+}
+
+/*
+JWTs go through the same middleware as API keys.
+*/
+func TestJWTThroughMiddleware(t *testing.T) {
+	issuer := newTestIssuer(t)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(jwksFile, issuer.jwks("rsa-1", "ec-1"), 0600)
+	now := time.Now()
+
+	saved := authenticators
+	t.Cleanup(func() { authenticators = saved })
+	authenticators = []Authenticator{newTestJWTAuthenticator(jwksFile, now)}
+	readFromFile("books.csv")
+
+	claims := testClaims(now)
+	claims["realm_access"] = map[string]interface{}{"roles": []string{"library-member"}}
+	w := formRequest(requireRole(routes()), "DELETE", "/books/book-2", nil, "Authorization", "Bearer "+issuer.sign(t, "RS256", "rsa-1", claims))
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected Response code 403 for a patron. Recieved ", w.Code)
+	}
+	w = formRequest(requireRole(routes()), "DELETE", "/books/book-2", nil, "Authorization", "Bearer "+issuer.sign(t, "RS256", "rsa-1", testClaims(now)))
+	if w.Code != http.StatusOK {
+		t.Error("Expected Response code 200 for a librarian. Recieved ", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/*
+Sends the default logger to a buffer at debug level for the rest of the test, and returns the lines logged.
+*/
+func captureLogs(t *testing.T) func() []map[string]interface{} {
+	var out bytes.Buffer
+	saved := slog.Default()
+	logger, err := newLogger(&out, slog.LevelDebug, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	return func() []map[string]interface{} {
+		var lines []map[string]interface{}
+		for scanner := bufio.NewScanner(bytes.NewReader(out.Bytes())); scanner.Scan(); {
+			var line map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatal("Log line is not JSON: ", scanner.Text())
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	logs := captureLogs(t)
+
+	w := formRequest(accessLog(requireRole(routes())), "PATCH", "/books/book-1?patron=someone", url.Values{"author": {"Secret Author"}}, "X-API-Key", "librarian-key", "X-Request-ID", "abc-123")
+	if w.Header().Get("X-Request-ID") != "abc-123" {
+		t.Error("Expected the request ID to be sent back. Recieved ", w.Header().Get("X-Request-ID"))
+	}
+
+	lines := logs()
+	var access map[string]interface{}
+	for _, line := range lines {
+		if line["request_id"] != "abc-123" {
+			t.Error("Expected every line to have the request ID. Recieved ", line)
+		}
+		if line["msg"] == "Request" {
+			access = line
+		}
+	}
+	if access == nil || access["method"] != "PATCH" || access["path"] != "/books/book-1" || access["status"] != float64(200) ||
+		access["bytes"] == float64(0) || access["client"] != "192.0.2.1" || access["duration_ms"] == nil {
+		t.Error("Access log incorrect. Recieved ", access)
+	}
+	if len(lines) < 2 {
+		t.Error("Expected a debug line for the update. Recieved ", lines)
+	}
+	for _, line := range lines {
+		if encoded, _ := json.Marshal(line); strings.Contains(string(encoded), "Secret Author") || strings.Contains(string(encoded), "someone") {
+			t.Error("Book data or the query was logged: ", string(encoded))
+		}
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	logs := captureLogs(t)
+
+	first := formRequest(accessLog(requireRole(routes())), "GET", "/books", nil, "X-API-Key", "librarian-key", "X-Request-ID", "").Header().Get("X-Request-ID")
+	second := formRequest(accessLog(requireRole(routes())), "GET", "/books", nil, "X-API-Key", "librarian-key", "X-Request-ID", "").Header().Get("X-Request-ID")
+	if first == "" || first == second {
+		t.Error("Expected a new request ID for each request. Recieved ", first, " and ", second)
+	}
+	for _, id := range []string{"has spaces", "new\nline", strings.Repeat("x", 200)} {
+		if got := formRequest(accessLog(requireRole(routes())), "GET", "/books", nil, "X-API-Key", "librarian-key", "X-Request-ID", id).Header().Get("X-Request-ID"); got == id || got == "" {
+			t.Error("Expected ", id, " to be replaced. Recieved ", got)
+		}
+	}
+
+	formRequest(accessLog(requireRole(routes())), "GET", "/nowhere", nil, "X-API-Key", "librarian-key", "X-Request-ID", "")
+	if lines := logs(); lines[len(lines)-1]["status"] != float64(http.StatusNotFound) {
+		t.Error("Expected a 404 to be logged. Recieved ", lines[len(lines)-1])
+	}
+}
@@ -6,34 +6,57 @@ This is a simple RESTful API. It can Create, Update, Read, and Delete enteries t
 DOCKER COMMANDS-
 
 docker build -t will-rest-api .
-docker run -p 80:80 -it will-rest-api
+docker run -p 80:8080 -it will-rest-api
 
 */
 
 //docker run -it -p 80:80
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 )
 
 /*
 The model for the books is given by this struct.
 */
 type Book struct {
-	Title       string `json:"title"`
-	Author      string `json:"author"`
-	Publisher   string `json:"publisher"`
-	PublishDate string `json:"publishdate"` //In the format of MMDDYYYY
-	Rating      int    `json:"rating"`      // Measured on a scale of 1 - 3
-	IsCheckedIn bool   `json:"ischeckedin"` // True if checked in, false if cheched out
+	Title       string     `json:"title"`
+	Author      string     `json:"author"`
+	Publisher   string     `json:"publisher"`
+	PublishDate string     `json:"publishdate"` //In the format of MMDDYYYY
+	Rating      int        `json:"rating"`      // The average rating rounded to the nearest whole number
+	IsCheckedIn bool       `json:"ischeckedin"` // True if checked in, false if cheched out. Derived from Status
+	Status      BookStatus `json:"status"`
+
+	RatingAverage      float64        `json:"ratingaverage"`
+	RatingCount        int            `json:"ratingcount"`
+	RatingDistribution map[int]int    `json:"ratingdistribution"` // How many ratings were given at each point of the scale
+	Ratings            map[string]int `json:"-"`                  // Keyed by patron, see rate()
+
+	ReviewCount int      `json:"reviewcount"` // Published reviews only
+	Reviews     []Review `json:"-"`
+
+	Tags   []string `json:"tags,omitempty"`   // Free-form, lowercase
+	Genres []string `json:"genres,omitempty"` // Paths from the genre vocabulary, like "Fiction > Mystery"
+
+	CallNumber string `json:"callnumber,omitempty"` // Dewey Decimal or Library of Congress, see callnumbers.go
+
+	ID int `json:"id"` // Never changes, even when the title does, so the audit log can follow a book
 }
 
 var (
@@ -43,19 +66,245 @@ var (
 		writers in the system by adding a hierarcical order of semaphores, but its unneccessary in this
 		case as were are hosting through localhost.
 	*/
-	mutex sync.Mutex
+	mutex timedMutex
 	Books []Book //  The list of books read in from our csv "database"
+
+	nextBookID  = 1          // The ID the next book created gets
+	limiter     *rateLimiter // nil when rate limiting is turned off
+	catalogFile string       // Where saveCatalog writes the books, empty in tests so books.csv isn't written over
+	genresFile  string       // Where saveCatalog writes the genre vocabulary, empty to leave it unsaved
 )
 
 func main() {
 
-	readFromFile("books.csv")
-	handleRequests()
+	server := &http.Server{}
+	flag.String("config", "", "YAML or TOML (ending in .toml) file of settings, see config.go. Flags beat environment variables, which beat the file")
+	printSettings := flag.Bool("print-config", false, "print the settings the server would run with and exit")
+	flag.StringVar(&server.Addr, "addr", ":80", "address the server listens on")
+	grpcAddr := flag.String("grpc-addr", ":9090", "address the gRPC BookService listens on. Empty turns gRPC off")
+	dataPath := flag.String("data", "books.csv", "csv file the books are read from")
+	genresPath := flag.String("genres", "genres.csv", "csv file of the genre vocabulary")
+	storage := flag.String("storage", "csv", "where the catalog is stored. Only csv is supported")
+	flag.DurationVar(&server.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "how long a client has to send the request headers")
+	flag.DurationVar(&server.ReadTimeout, "read-timeout", 30*time.Second, "how long a client has to send the whole request")
+	flag.DurationVar(&server.WriteTimeout, "write-timeout", 0, "how long writing a response can take. 0 means no limit, which /events and waiting on /changes need")
+	flag.DurationVar(&server.IdleTimeout, "idle-timeout", 2*time.Minute, "how long an idle keep-alive connection is kept open")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 8*time.Second, "how long shutting down can take. docker stop only waits 10s unless given --time")
+	shutdownDelay := flag.Duration("shutdown-delay", 0, "how long /readyz fails for before the server stops accepting connections when shutting down. Not counted in -shutdown-timeout")
+	flag.Int64Var(&readiness.maxBacklog, "ready-max-backlog", readiness.maxBacklog, "most changes that can be waiting to be published or delivered before /readyz fails")
+	logLevel := flag.String("log-level", "info", "lowest level logged: debug, info, warn or error")
+	logFormat := flag.String("log-format", "json", "how logs are written: json or text")
+	traceExporter := flag.String("trace-exporter", "", "where traces are sent: stdout, otlp, or nowhere when empty")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "URL traces are sent to with the otlp exporter, like http://localhost:4318. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT")
+	traceSample := flag.Float64("trace-sample", 1, "fraction of new traces that are kept, from 0 to 1. Traces started by the client follow its choice")
+	flag.IntVar(&maxReviewLength, "max-review-length", maxReviewLength, "most characters a review can have")
+	flag.IntVar(&ratingScale, "rating-scale", ratingScale, "highest rating a book can be given, ratings start at 1")
+	keysFile := flag.String("keys", "keys.csv", "csv file of API keys as key,name,role. Without it, or -jwks, the server won't start unless -insecure-no-auth is set")
+	insecureNoAuth := flag.Bool("insecure-no-auth", false, "start with authentication off when there are no API keys and no -jwks, so anyone can change the catalog")
+	tokenTTL := flag.Duration("token-ttl", time.Hour, "how long bearer tokens from /auth/token last")
+	jwks := flag.String("jwks", "", "file or URL of the JWKS used to check JWT bearer tokens. JWTs aren't accepted if this is empty")
+	jwksTTL := flag.Duration("jwks-ttl", 10*time.Minute, "how long the JWKS is cached before being loaded again")
+	jwtIssuer := flag.String("jwt-issuer", "", "iss claim JWTs must have")
+	jwtAudience := flag.String("jwt-audience", "", "aud claim JWTs must have")
+	jwtSkew := flag.Duration("jwt-skew", time.Minute, "clock skew allowed when checking exp and nbf")
+	jwtNameClaim := flag.String("jwt-name-claim", "sub", "claim patrons are known by")
+	jwtRoleClaim := flag.String("jwt-role-claim", "roles", "claim holding the user's roles, can be a dotted path like realm_access.roles")
+	jwtRoles := flag.String("jwt-roles", "librarian=librarian,patron=patron", "role claim values mapped to roles, as value=role pairs")
+	rateLimiting := flag.Bool("rate-limit", false, "limit how many requests each client can make, see -rate-limits")
+	rateLimits := flag.String("rate-limits", "", "per role limits as role.read=rate/burst or role.write=rate/burst, comma separated, used with -rate-limit. Unset limits keep their defaults")
+	proxyList := flag.String("trusted-proxies", "", "comma separated addresses or CIDR ranges of proxies whose X-Forwarded-For is believed")
+	flag.DurationVar(&trashRetention, "trash-retention", trashRetention, "how long deleted books stay in the trash before they are purged. 0 keeps them forever")
+	changesPath := flag.String("changes", "changes.jsonl", "file the change feed is kept in so it carries on after a restart. Empty keeps it in memory only")
+	changesRetain := flag.Int("changes-retain", 10000, "how many changes the change feed keeps, and so how many can be made while a -publish broker is down before some are never published")
+	webhooksPath := flag.String("webhooks", "webhooks.json", "file webhook subscriptions are saved in")
+	publish := flag.String("publish", "", "comma separated places to publish changes to: stdout, file:<path> or a nats:// URL")
+	publishSubject := flag.String("publish-subject", "library", "NATS subject changes are published under, followed by the event type")
+	outboxDir := flag.String("outbox-dir", ".", "directory that keeps how far each publisher has got through the change feed")
+	auditPath := flag.String("audit-log", "audit.jsonl", "file every change to the catalog is appended to. Empty turns the audit log off")
+	sources, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *printSettings {
+		printConfig(os.Stdout, flag.CommandLine, sources)
+		return
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalln("log-level:", err)
+	}
+	logger, err := newLogger(os.Stderr, level, *logFormat)
+	if err != nil {
+		log.Fatalln("log-format:", err)
+	}
+	slog.SetDefault(logger)
+	if *traceSample < 0 || *traceSample > 1 {
+		log.Fatalln("trace-sample must be from 0 to 1")
+	}
+	shutdownTracing, err := setupTracing(context.Background(), *traceExporter, *otlpEndpoint, *traceSample)
+	if err != nil {
+		log.Fatalln("trace-exporter:", err)
+	}
+	if *storage != "csv" {
+		log.Fatalf("storage: %q is not supported, only csv is", *storage)
+	}
+	if ratingScale < 1 {
+		log.Fatalln("rating-scale must be at least 1")
+	}
+	if maxReviewLength < 1 {
+		log.Fatalln("max-review-length must be at least 1")
+	}
+
+	readKeys(*keysFile, *tokenTTL)
+	var jwtKeys *jwksCache
+	if *jwks != "" {
+		if *jwtIssuer == "" || *jwtAudience == "" {
+			log.Fatalln("jwt-issuer and jwt-audience must be set to accept JWTs")
+		}
+		roleMap, err := parseRoleMap(*jwtRoles)
+		if err != nil {
+			log.Fatalln("jwt-roles:", err)
+		}
+		jwtKeys = newJWKSCache(*jwks, *jwksTTL)
+		authenticators = append(authenticators, &jwtAuthenticator{
+			keys:      jwtKeys,
+			issuer:    *jwtIssuer,
+			audience:  *jwtAudience,
+			skew:      *jwtSkew,
+			nameClaim: *jwtNameClaim,
+			roleClaim: *jwtRoleClaim,
+			roleMap:   roleMap,
+			now:       time.Now,
+		})
+	}
+	if len(authenticators) == 0 {
+		if !*insecureNoAuth {
+			log.Fatalf("keys: there are none in %v and no -jwks is set, use -insecure-no-auth to start with authentication off", *keysFile)
+		}
+		slog.Warn("No API keys loaded, authentication is off and anyone can change the catalog")
+	}
+
+	trustedProxies, err = parseTrustedProxies(*proxyList)
+	if err != nil {
+		log.Fatalln("trusted-proxies:", err)
+	}
+	if *rateLimiting {
+		limits, err := parseRateLimits(*rateLimits)
+		if err != nil {
+			log.Fatalln("rate-limits:", err)
+		}
+		limiter = newRateLimiter(limits, trustedProxies)
+	}
+
+	if *changesRetain < 1 {
+		log.Fatalln("changes-retain must be at least 1")
+	}
+	feed = newChangeFeed(*changesRetain)
+	if *changesPath != "" {
+		if err := feed.open(*changesPath); err != nil {
+			log.Fatalln("changes:", err)
+		}
+	}
+
+	app := newLifecycle(server, *shutdownTimeout, *dataPath)
+	app.delay = *shutdownDelay
+	app.genres = *genresPath
+	app.shutdownTracing = shutdownTracing
+	webhooks = newWebhookStore(*webhooksPath)
+	if err := webhooks.load(); err != nil {
+		log.Fatalln("webhooks:", err)
+	}
+	last := feed.latest()
+	app.start(func(ctx context.Context) { webhooks.run(ctx, last) })
+
+	published := map[string]bool{}
+	for _, value := range strings.Split(*publish, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		name, publisher, err := parsePublisher(value, *publishSubject)
+		if err != nil {
+			log.Fatalln("publish:", err)
+		}
+		if published[name] {
+			log.Fatalln("publish: only one", name, "publisher can be used")
+		}
+		published[name] = true
+		o := newOutbox(publisher, filepath.Join(*outboxDir, "outbox-"+name+".seq"))
+		if _, err := o.cursor(); err != nil { // Read now so nothing changed before the server starts is missed
+			log.Fatalln("publish:", err)
+		}
+		app.outboxes[name] = o
+		app.start(func(ctx context.Context) {
+			if err := o.run(ctx); err != nil {
+				app.fail(fmt.Errorf("publish %v: %w", name, err))
+			}
+		})
+	}
+
+	if *auditPath != "" {
+		auditLog, err = openAuditLog(*auditPath)
+		if err != nil {
+			log.Fatalln("audit-log:", err)
+		}
+	}
+
+	readGenres(*genresPath)
+	readFromFile(*dataPath)
+	catalogFile, genresFile = *dataPath, *genresPath
+	readiness.dataPath = *dataPath
+	readiness.outboxes = app.outboxes
+	app.start(func(ctx context.Context) {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				mutex.Lock()
+				purgeExpired(now)
+				mutex.Unlock()
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	handleRequests(server)
+	if *grpcAddr != "" {
+		app.grpcAddr = *grpcAddr
+		app.grpcServer = newGRPCServer(&bookService{handler: guard(routes()), stopping: app.requests})
+	}
 
+	/*
+		SIGHUP reloads the API keys and the JWKS. Every other setting needs a restart.
+	*/
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	app.reloads = reloads
+	app.reload = func() error {
+		if jwtKeys != nil {
+			jwtKeys.expire()
+		}
+		if apiKeys == nil {
+			return nil // Authentication is off, or only JWTs are accepted
+		}
+		return reloadKeys(*keysFile)
+	}
+
+	stopping, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	status := app.run(stopping)
+	stop()
+	os.Exit(status)
 }
 
 /*
 The csv file acts as the database behind the API. This will read the csv and then store the books in a slice.
+
+Each row is a book: title, author, publisher, publish date, rating, status, ratings, reviews, tags, genres, call
+number, ID, revisions, and when and by whom it was deleted if it is in the trash. Ratings, reviews, tags, genres and
+revisions are JSON. Older files only have the first six columns, with true/false instead of the status, and the
+server fills in the rest: books without an ID are numbered in the order they come in, and the rating column is read
+in as the only rating the book has. A first row of #next-id and a number keeps nextBookID, so the IDs of purged books
+aren't given out again.
 */
 func readFromFile(filepath string) {
 	f, err := os.Open(filepath)
@@ -63,9 +312,13 @@ func readFromFile(filepath string) {
 		log.Fatalln("File open failed", err)
 	}
 	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
 	defer f.Close()
 	Books = nil
-	for {
+	nextBookID = 1
+	revisions = map[int][]Revision{}
+	Trash = nil
+	for line := 1; ; line++ {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
@@ -73,62 +326,323 @@ func readFromFile(filepath string) {
 		if err != nil {
 			log.Fatal(err)
 		}
-		readRating, _ := strconv.Atoi(record[4])
-		readCheckIn, _ := strconv.ParseBool(record[5])
-		Books = append(Books, Book{Title: record[0], Author: record[1], Publisher: record[2], PublishDate: record[3], Rating: readRating, IsCheckedIn: readCheckIn})
+		if record[0] == nextIDColumn && len(record) == 2 {
+			if next, err := strconv.Atoi(record[1]); err == nil && next > nextBookID {
+				nextBookID = next
+			}
+			continue
+		}
+		if len(record) < 6 {
+			log.Fatalf("%v line %v: expected at least 6 fields, found %v", filepath, line, len(record))
+		}
+		book, deleted, err := parseBookRecord(record)
+		if err != nil {
+			log.Fatalf("%v line %v: %v", filepath, line, err)
+		}
+		if book.ID >= nextBookID {
+			nextBookID = book.ID + 1
+		}
+		if deleted != nil {
+			deleted.Book = book
+			Trash = append(Trash, *deleted)
+		} else {
+			Books = append(Books, book)
+		}
+	}
+
+	/*
+		Books are numbered once every ID in the file is known, so a book without one can't be given an ID that a later
+		row already has. A book whose ID has already been used is renumbered too, rather than two books sharing one.
+		Books in the trash keep their IDs the same way, so restoring one doesn't clash with a book on the shelf.
+	*/
+	var all []*Book
+	for i := range Books {
+		all = append(all, &Books[i])
+	}
+	for i := range Trash {
+		all = append(all, &Trash[i].Book)
+	}
+	seen := map[int]bool{}
+	for _, book := range all {
+		if book.ID == 0 || seen[book.ID] {
+			book.ID = nextBookID
+			nextBookID++
+		}
+		seen[book.ID] = true
+	}
+	for _, book := range all {
+		if revisions[book.ID] == nil {
+			importRevision(book)
+		}
 	}
+	catalogLoaded.Store(true)
+}
+
+/*
+The first row of the csv file when it keeps nextBookID.
+*/
+const nextIDColumn = "#next-id"
 
+/*
+A review as it is saved, with the patrons who voted for it, which the API doesn't show.
+*/
+type storedReview struct {
+	Review
+	Voters map[string]bool `json:"voters,omitempty"`
 }
 
 /*
-Because deleting and editing the books can break some of the unit tests, the write to file function is commented out, but its here for future implementation.
-However, it higlights the problem with a csv file, and that its hard to write to and the simplest way is to rewrite the entire file. This isnt feasable for large operations, and a database would be better.
+Reads one row of the csv file. A book that has revisions saved gets them back, keyed by the ID the row has. A row
+with a deletion time is a book in the trash, returned with when and by whom it was deleted.
 */
+func parseBookRecord(record []string) (Book, *TrashedBook, error) {
+	column := func(i int) string {
+		if i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	book := Book{Title: record[0], Author: record[1], Publisher: record[2], PublishDate: record[3]}
+	if ratings := column(6); ratings != "" {
+		if err := json.Unmarshal([]byte(ratings), &book.Ratings); err != nil {
+			return Book{}, nil, fmt.Errorf("ratings: %v", err)
+		}
+		book.summarizeRatings()
+	} else if readRating, err := parseRating(record[4]); err == nil {
+		book.rate(catalogRater, readRating)
+	} else {
+		book.summarizeRatings()
+	}
 
-func writeToFile(filepath string) {
+	/*
+		Older files store true/false in the last column, newer ones store the status name.
+	*/
+	if readCheckIn, err := strconv.ParseBool(record[5]); err == nil {
+		book.setStatus(statusFromCheckIn(StatusAvailable, readCheckIn))
+	} else if status, ok := parseStatus(record[5]); ok {
+		book.setStatus(status)
+	} else {
+		slog.Warn("Unknown status, treating it as checked out", "status", record[5], "title", record[0])
+		book.setStatus(StatusCheckedOut)
+	}
 
-	f, err := os.Create(filepath)
-	if err != nil {
-		log.Fatalln("File open failed", err)
+	if cell := column(7); cell != "" {
+		var reviews []storedReview
+		if err := json.Unmarshal([]byte(cell), &reviews); err != nil {
+			return Book{}, nil, fmt.Errorf("reviews: %v", err)
+		}
+		for _, stored := range reviews {
+			stored.Review.Voters = stored.Voters
+			book.Reviews = append(book.Reviews, stored.Review)
+		}
 	}
-	f.Seek(0, 0) //removing the content of the file
+	book.countReviews()
 
-	os.Truncate("books.csv", 0)
-	defer f.Close()
-	w := csv.NewWriter(f)
-	defer w.Flush()
-	var records [][]string
+	if cell := column(8); cell != "" {
+		if err := json.Unmarshal([]byte(cell), &book.Tags); err != nil {
+			return Book{}, nil, fmt.Errorf("tags: %v", err)
+		}
+	}
+	if cell := column(9); cell != "" {
+		if err := json.Unmarshal([]byte(cell), &book.Genres); err != nil {
+			return Book{}, nil, fmt.Errorf("genres: %v", err)
+		}
+	}
+	book.CallNumber = column(10)
+
+	if id := column(11); id != "" {
+		n, err := strconv.Atoi(id)
+		if err != nil || n < 1 {
+			return Book{}, nil, fmt.Errorf("bad ID %q", id)
+		}
+		book.ID = n
+	}
+
+	if cell := column(12); cell != "" && book.ID != 0 && revisions[book.ID] == nil {
+		var history []Revision
+		if err := json.Unmarshal([]byte(cell), &history); err != nil {
+			return Book{}, nil, fmt.Errorf("revisions: %v", err)
+		}
+		revisions[book.ID] = history
+	}
+
+	if cell := column(13); cell != "" {
+		deletedAt, err := time.Parse(time.RFC3339Nano, cell)
+		if err != nil {
+			return Book{}, nil, fmt.Errorf("bad deletion time %q", cell)
+		}
+		return book, &TrashedBook{DeletedAt: deletedAt, DeletedBy: column(14)}, nil
+	}
+	return book, nil, nil
+}
 
+/*
+One row of the csv file, see readFromFile. deleted is set for a book in the trash.
+*/
+func bookRecord(book Book, deleted *TrashedBook) []string {
+	var reviews []storedReview
+	for _, review := range book.Reviews {
+		reviews = append(reviews, storedReview{Review: review, Voters: review.Voters})
+	}
+	record := []string{
+		book.Title, book.Author, book.Publisher, book.PublishDate, strconv.Itoa(book.Rating), string(book.Status),
+		jsonColumn(book.Ratings), jsonColumn(reviews), jsonColumn(book.Tags), jsonColumn(book.Genres),
+		book.CallNumber, strconv.Itoa(book.ID), jsonColumn(revisions[book.ID]),
+	}
+	if deleted != nil {
+		record = append(record, deleted.DeletedAt.Format(time.RFC3339Nano), deleted.DeletedBy)
+	}
+	return record
+}
+
+/*
+Empty lists and maps are left as an empty column rather than written out.
+*/
+func jsonColumn(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil || string(data) == "null" || string(data) == "[]" || string(data) == "{}" {
+		return ""
+	}
+	return string(data)
+}
+
+/*
+Because deleting and editing the books can break some of the unit tests, the handlers don't write to the file themselves.
+Instead every change saves the catalog through saveCatalog once the server is running, and it is saved again when the
+server shuts down.
+However, it higlights the problem with a csv file, and that its hard to write to and the simplest way is to rewrite the entire file. This isnt feasable for large operations, and a database would be better.
+The file is written next to the old one and then renamed over it, so a crash part way through leaves the old one whole.
+*/
+func writeToFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".books-*.csv")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // Does nothing once it has been renamed
+	if info, err := os.Stat(path); err == nil {
+		f.Chmod(info.Mode().Perm())
+	}
+	w := csv.NewWriter(f)
+	records := [][]string{{nextIDColumn, strconv.Itoa(nextBookID)}}
 	for _, book := range Books {
-		var bookData []string
-		bookData = append(bookData, book.Title)
-		bookData = append(bookData, book.Author)
-		bookData = append(bookData, book.Publisher)
-		bookData = append(bookData, book.PublishDate)
-		rat := strconv.Itoa(book.Rating)
-		bookData = append(bookData, rat)
-		check := strconv.FormatBool(book.IsCheckedIn)
-		bookData = append(bookData, check)
-		records = append(records, bookData)
+		records = append(records, bookRecord(book, nil))
+	}
+	for i := range Trash {
+		records = append(records, bookRecord(Trash[i].Book, &Trash[i]))
+	}
+
+	if err := w.WriteAll(records); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
 	}
+	return os.Rename(f.Name(), path)
+}
 
-	for _, record := range records {
-		if err := w.Write(record); err != nil {
-			log.Fatalln("Error in writing to csv")
+/*
+Saves the books, and the genre vocabulary they use, after a change. It is called from recordMutation before the change
+goes into the feed, so the feed never has a sequence number for a change a crash lost from the catalog. Must be called
+with the mutex held.
+*/
+func saveCatalog(ctx context.Context) {
+	if catalogFile == "" {
+		return
+	}
+	if err := persist(ctx, "catalog", func() error { return writeToFile(catalogFile) }); err != nil {
+		slog.ErrorContext(ctx, "Could not save the catalog", "err", err)
+	}
+	if genresFile != "" {
+		if err := persist(ctx, "genres", func() error { return writeGenres(genresFile) }); err != nil {
+			slog.ErrorContext(ctx, "Could not save the genres", "err", err)
 		}
 	}
+}
 
+/*
+Finds the index of the book whose title matches the id given in the URL, where spaces in the title are replaced with '-'.
+Returns -1 if there is no such book.
+*/
+func findBook(id string) int {
+	for i, book := range Books {
+		if strings.EqualFold(id, bookSlug(book)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func bookSlug(book Book) string {
+	return strings.ReplaceAll(book.Title, " ", "-")
 }
 
 /*
 Returns all of the books stored. Only works with GET, and is part of the READ component of CRUD.
+Withdrawn books are left out unless they are asked for with ?status=withdrawn. Any other status can be used as a filter too.
+Books can also be filtered with ?tag= and ?genre=, which can be repeated to require all of them. A genre includes its subgenres.
+?sort=callnumber returns the books in shelf order instead of the order they were added, with books that have no call number last.
+The X-Change-Seq header has the change feed's latest sequence number, so a client can follow /changes from there.
 */
 func allEnteries(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 
 	case "GET":
+		var want BookStatus
+		if r.URL.Query().Get("status") != "" {
+			status, ok := parseStatus(r.URL.Query().Get("status"))
+			if !ok {
+				http.Error(w, "400, unknown status", http.StatusBadRequest)
+				return
+			}
+			want = status
+		}
 
-		json.NewEncoder(w).Encode(Books)
+		tags := normalizeTags(r.URL.Query()["tag"])
+		genres, err := normalizeGenres(r.URL.Query()["genre"])
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mutex.LockContext(r.Context())
+		defer mutex.Unlock()
+		w.Header().Set("X-Change-Seq", strconv.FormatInt(feed.latest(), 10))
+
+		books := []Book{}
+		for _, book := range Books {
+			if want == "" && book.Status == StatusWithdrawn {
+				continue
+			}
+			if want != "" && book.Status != want {
+				continue
+			}
+			if !bookMatches(book, tags, genres) {
+				continue
+			}
+			books = append(books, book)
+		}
+
+		switch r.URL.Query().Get("sort") {
+		case "":
+		case "callnumber":
+			sort.SliceStable(books, func(i, j int) bool {
+				a, aErr := parseCallNumber(books[i].CallNumber)
+				b, bErr := parseCallNumber(books[j].CallNumber)
+				if aErr != nil || bErr != nil {
+					return aErr == nil && bErr != nil
+				}
+				return compareCallNumbers(a, b) < 0
+			})
+		default:
+			http.Error(w, "400, sort must be callnumber", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(books)
 
 	default:
 		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
@@ -150,9 +664,28 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 
 /*
 This function serves as read, update, and delete components. One could read individual books with GET, update with PATCH, and delete with DELETE http methods.
+Anything below a book, like /books/{id}/checkout, is handed off to the function for that action.
 */
 
 func returnSingleBook(w http.ResponseWriter, r *http.Request) {
+	if id, action, ok := splitBookPath(r.URL.Path); ok {
+		switch {
+		case action == "checkout" || action == "checkin":
+			circulationAction(w, r, id, action)
+		case action == "ratings":
+			bookRatings(w, r, id)
+		case action == "reviews" || strings.HasPrefix(action, "reviews/"):
+			bookReviews(w, r, id, strings.TrimPrefix(strings.TrimPrefix(action, "reviews"), "/"))
+		case action == "revisions" || strings.HasPrefix(action, "revisions/"):
+			bookRevisions(w, r, id, strings.TrimPrefix(strings.TrimPrefix(action, "revisions"), "/"))
+		case action == "revert":
+			revertBook(w, r, id)
+		default:
+			http.Error(w, "404, not found.", http.StatusNotFound)
+		}
+		return
+	}
+
 	switch r.Method {
 
 	case "GET":
@@ -163,16 +696,16 @@ func returnSingleBook(w http.ResponseWriter, r *http.Request) {
 		}
 
 		id := strings.TrimPrefix(r.URL.Path, "/books/")
+		if r.URL.Query().Get("asOf") != "" {
+			bookAsOf(w, r, id)
+			return
+		}
 
-		for _, book := range Books {
-			idTest := strings.ReplaceAll(book.Title, " ", "-")
-			fmt.Println(id + " compared to" + idTest)
-
-			if strings.EqualFold(id, idTest) {
-				json.NewEncoder(w).Encode(book)
-				fmt.Println("test")
-				return
-			}
+		mutex.LockContext(r.Context())
+		defer mutex.Unlock()
+		if i := findBook(id); i >= 0 {
+			json.NewEncoder(w).Encode(Books[i])
+			return
 		}
 		http.Error(w, "404, not found.", http.StatusNotFound)
 
@@ -187,33 +720,43 @@ func returnSingleBook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+Splits /books/{id}/{action} into its id and action. ok is false when the path is just /books/{id}.
+*/
+func splitBookPath(path string) (id string, action string, ok bool) {
+	rest := strings.TrimPrefix(path, "/books/")
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return rest, "", false
+	}
+	return rest[:slash], rest[slash+1:], true
+}
+
 /*
 This fuction will delete the book with the given by the URL. If that book isnt in the list, it will return 404.
+Deleted books go to the trash, where they can be restored from until the retention period runs out. ?purge=true
+skips the trash and deletes the book for good.
+The book's reviews and ratings are stored with it, so they are deleted along with it.
 */
 func deleteBook(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/books/")
 
-	for i, book := range Books {
-		idTest := strings.ReplaceAll(book.Title, " ", "-")
-		fmt.Println(id + " compared to" + idTest)
-
-		if strings.EqualFold(id, idTest) {
-			mutex.Lock()
-			//Last element
-			if i == len(Books) {
-				Books = Books[:len(Books)-1]
-
-				//one of the middle elements or first element
-			} else {
-				Books = append(Books[:i], Books[i+1:]...)
-			}
-			fmt.Fprintf(w, "Book: "+idTest+" deleted!")
-			//writeToFile("books.csv")
-			mutex.Unlock()
-			return
-		}
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	book := Books[i]
+	if purge, _ := strconv.ParseBool(r.URL.Query().Get("purge")); purge {
+		Books = append(Books[:i:i], Books[i+1:]...)
+		purgeBook(r, book)
+	} else {
+		trashBook(r, i)
 	}
-	http.Error(w, "404, not found.", http.StatusNotFound)
+	fmt.Fprint(w, "Book: "+bookSlug(book)+" deleted!")
+	//writeToFile("books.csv")
 }
 
 /*
@@ -223,86 +766,103 @@ If the data is invalid, it returns error code 400 and doesnt update the list.
 
 func patchBook(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/books/")
-	for i, book := range Books {
-		idTest := strings.ReplaceAll(book.Title, " ", "-")
-		fmt.Println(id + " compared to" + idTest)
-
-		if strings.EqualFold(id, idTest) {
+	r.ParseForm()
 
-			mutex.Lock()
-			var newBook = book
-			r.ParseForm()
-			if r.FormValue("title") != "" { // Form value returns an empty string if the key value isn't present
-				newBook.Title = r.FormValue("title")
-			}
-
-			if r.FormValue("author") != "" {
-				newBook.Author = r.FormValue("author")
-			}
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	book := Books[i]
+	var newBook = book
+	if r.FormValue("title") != "" { // Form value returns an empty string if the key value isn't present
+		newBook.Title = r.FormValue("title")
+	}
 
-			if r.FormValue("publisher") != "" {
-				newBook.Publisher = r.FormValue("publisher")
-			}
+	if r.FormValue("author") != "" {
+		newBook.Author = r.FormValue("author")
+	}
 
-			if r.FormValue("publishdate") != "" {
-				if len(r.FormValue("publishdate")) == 8 {
-					_, err := strconv.Atoi(r.FormValue("publishdate")) //Dont care about the integer value returned, just making sure that there are only numbers in the publishdate
-					if err != nil {
-						http.Error(w, "400, publishddate not correct, not an int", http.StatusBadRequest)
-						fmt.Printf("recieved %v", r.FormValue("publishdate"))
-						mutex.Unlock()
-						return
-					}
-					newBook.PublishDate = r.FormValue("publishdate")
-				} else {
-					http.Error(w, "400, publishddate not correct", http.StatusBadRequest)
-					mutex.Unlock()
-					return
-				}
+	if r.FormValue("publisher") != "" {
+		newBook.Publisher = r.FormValue("publisher")
+	}
 
+	if r.FormValue("publishdate") != "" {
+		if len(r.FormValue("publishdate")) == 8 {
+			_, err := strconv.Atoi(r.FormValue("publishdate")) //Dont care about the integer value returned, just making sure that there are only numbers in the publishdate
+			if err != nil {
+				http.Error(w, "400, publishddate not correct, not an int", http.StatusBadRequest)
+				slog.DebugContext(r.Context(), "Bad publishdate", "publishdate", r.FormValue("publishdate"))
+				return
 			}
+			newBook.PublishDate = r.FormValue("publishdate")
+		} else {
+			http.Error(w, "400, publishddate not correct", http.StatusBadRequest)
+			return
+		}
 
-			if r.FormValue("rating") != "" {
-				rating, err := strconv.Atoi(r.FormValue("rating"))
-				if err != nil {
-					http.Error(w, "400, rating not correct", http.StatusBadRequest)
-					mutex.Unlock()
-					return
-				}
-				if rating == 1 || rating == 2 || rating == 3 {
-					newBook.Rating = rating
-				} else {
-					http.Error(w, "400, rating not on 1-3 scale", http.StatusBadRequest)
-					mutex.Unlock()
-					return
-				}
-			}
+	}
 
-			if r.FormValue("rating") != "" {
-				checkin, err := strconv.ParseBool(r.FormValue("ischeckedin"))
+	if r.FormValue("rating") != "" {
+		rating, err := parseRating(r.FormValue("rating"))
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		newBook.rate(catalogRater, rating)
+	}
 
-				if err != nil {
-					http.Error(w, "400, ischeckedin not a boolean", http.StatusBadRequest)
-					mutex.Unlock()
-					return
-				} else {
-					newBook.IsCheckedIn = checkin
-				}
-			}
-			Books[i] = newBook
-			json.NewEncoder(w).Encode(Books[i])
+	if r.FormValue("callnumber") != "" {
+		if _, err := parseCallNumber(r.FormValue("callnumber")); err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		newBook.CallNumber = normalizeCallNumber(r.FormValue("callnumber"))
+	}
 
-			for value := range Books {
+	if tags, ok := formTags(r); ok {
+		newBook.Tags = tags
+	}
+	if genres, ok, err := formGenres(r); err != nil {
+		http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+		return
+	} else if ok {
+		newBook.Genres = genres
+	}
 
-				fmt.Printf("  %v\n", Books[value])
-			}
-			//writeToFile("books.csv")
+	/*
+		Status changes have to follow the transition table. ischeckedin is still accepted and is treated as a
+		move to available or checked_out.
+	*/
+	target := newBook.Status
+	if r.FormValue("status") != "" {
+		status, ok := parseStatus(r.FormValue("status"))
+		if !ok {
+			http.Error(w, "400, status not correct", http.StatusBadRequest)
+			return
+		}
+		target = status
+	} else if r.FormValue("ischeckedin") != "" {
+		checkin, err := strconv.ParseBool(r.FormValue("ischeckedin"))
 
-			mutex.Unlock()
+		if err != nil {
+			http.Error(w, "400, ischeckedin not a boolean", http.StatusBadRequest)
 			return
 		}
+		target = statusFromCheckIn(newBook.Status, checkin)
 	}
-	http.Error(w, "404, not found.", http.StatusNotFound)
+	if !canTransition(newBook.Status, target) {
+		http.Error(w, fmt.Sprintf("409, cannot change status from %v to %v", newBook.Status, target), http.StatusConflict)
+		return
+	}
+	newBook.setStatus(target)
+	Books[i] = newBook
+	recordMutation(r, "update", &book, &newBook)
+	json.NewEncoder(w).Encode(Books[i])
+	slog.DebugContext(r.Context(), "Book updated", "book", newBook.ID, "changed", fieldNames(diffBooks(&book, &newBook)))
+	//writeToFile("books.csv")
 }
 
 /*
@@ -315,11 +875,9 @@ func createNewBook(w http.ResponseWriter, r *http.Request) {
 		This method will only use the POST http keyword. If anyother keyword is used, it will result in a 405 error.
 	*/
 	case "POST":
-		mutex.Lock()
+		mutex.LockContext(r.Context())
 		r.ParseForm()
-		for key, value := range r.Form {
-			fmt.Printf("%s = %s\n", key, value)
-		}
+		slog.DebugContext(r.Context(), "Creating a book", "fields", formKeys(r.Form))
 		var newBook Book
 
 		/*
@@ -335,6 +893,30 @@ func createNewBook(w http.ResponseWriter, r *http.Request) {
 
 		newBook.Author = r.FormValue("author")
 		newBook.Publisher = r.FormValue("publisher")
+		newBook.Tags, _ = formTags(r)
+
+		/*
+			Genres are optional, but the ones given have to be in the vocabulary.
+		*/
+		genres, _, err := formGenres(r)
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			mutex.Unlock()
+			return
+		}
+		newBook.Genres = genres
+
+		/*
+			Call numbers are optional too, but have to be valid Dewey or LCC call numbers.
+		*/
+		if r.FormValue("callnumber") != "" {
+			if _, err := parseCallNumber(r.FormValue("callnumber")); err != nil {
+				http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+				mutex.Unlock()
+				return
+			}
+			newBook.CallNumber = normalizeCallNumber(r.FormValue("callnumber"))
+		}
 
 		/*
 			Because '-' would conflict in URL encoding, the dates are given in the format of MMDDYYYY.
@@ -343,7 +925,7 @@ func createNewBook(w http.ResponseWriter, r *http.Request) {
 		if len(r.FormValue("publishdate")) == 8 {
 			_, err := strconv.Atoi(r.FormValue("publishdate")) //Dont care about the integer value returned, just making sure that there are only numbers in the publishdate
 			if err != nil {
-				fmt.Printf("recieved %v", r.FormValue("publishdate"))
+				slog.DebugContext(r.Context(), "Bad publishdate", "publishdate", r.FormValue("publishdate"))
 				http.Error(w, "400, publishddate not correct", http.StatusBadRequest)
 				mutex.Unlock()
 				return
@@ -357,41 +939,51 @@ func createNewBook(w http.ResponseWriter, r *http.Request) {
 		}
 
 		/*
-			Similar concept with the rating and isChecked in, they have to be able to be parsed as an integer (1-3 in this case) or a boolean respectivly
+			Similar concept with the rating and isChecked in, they have to be able to be parsed as an integer (on the rating scale in this case) or a boolean respectivly
 		*/
-		rating, err := strconv.Atoi(r.FormValue("rating"))
+		rating, err := parseRating(r.FormValue("rating"))
 		if err != nil {
-			http.Error(w, "400, rating not correct", http.StatusBadRequest)
-			mutex.Unlock()
-			return
-		}
-		if rating == 1 || rating == 2 || rating == 3 {
-			newBook.Rating = rating
-		} else {
-			http.Error(w, "400, rating not on 1-3 scale", http.StatusBadRequest)
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
 			mutex.Unlock()
 			return
 		}
+		newBook.rate(catalogRater, rating)
 
-		checkin, err := strconv.ParseBool(r.FormValue("ischeckedin"))
+		/*
+			A new book can be given a status directly. Older clients send ischeckedin instead, which becomes available or checked_out.
+		*/
+		if r.FormValue("status") != "" {
+			status, ok := parseStatus(r.FormValue("status"))
+			if !ok {
+				http.Error(w, "400, status not correct", http.StatusBadRequest)
+				mutex.Unlock()
+				return
+			}
+			newBook.setStatus(status)
+		} else {
+			checkin, err := strconv.ParseBool(r.FormValue("ischeckedin"))
 
-		if err != nil {
+			if err != nil {
 
-			http.Error(w, "400, ischeckedin not a boolean", http.StatusBadRequest)
-			mutex.Unlock()
-			return
-		} else {
-			newBook.IsCheckedIn = checkin
+				http.Error(w, "400, ischeckedin not a boolean", http.StatusBadRequest)
+				mutex.Unlock()
+				return
+			}
+			newBook.setStatus(statusFromCheckIn(StatusAvailable, checkin))
 		}
 
 		/*
 			The string has been sucessfuly parsed, and there are no errors with it. We can now add it to the list of books and writed to the csv file.
 		*/
+		newBook.ID = nextBookID
+		nextBookID++
 		Books = append(Books, newBook)
+		recordMutation(r, "create", nil, &newBook)
 
 		//writeToFile("books.csv")
 
 		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newBook)
 
 		mutex.Unlock()
 	default:
@@ -403,10 +995,59 @@ func createNewBook(w http.ResponseWriter, r *http.Request) {
 /*
 The main method reads the csv file, and passes the functions to the handler
 */
-func handleRequests() {
-	http.HandleFunc("/", homePage)
-	http.HandleFunc("/books", allEnteries)
-	http.HandleFunc("/books/", returnSingleBook)
-	http.HandleFunc("/new", createNewBook)
-	log.Fatal(http.ListenAndServe(":80", nil))
+func handleRequests(server *http.Server) {
+	server.Handler = traceRequests(accessLog(measure(serverRoutes())))
+}
+
+/*
+The routes behind guard, except for the health checks and metrics, which are served in front of it so probes and
+scrapers are never turned away for their credentials or rate limited.
+*/
+func serverRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", guard(routes()))
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	return mux
+}
+
+/*
+Authentication, then rate limiting, then authorization, which is what stands in front of the routes for both HTTP and
+gRPC.
+*/
+func guard(next http.Handler) http.Handler {
+	handler := authorize(next)
+	if limiter != nil {
+		handler = limiter.middleware(handler)
+	}
+	return authenticate(handler)
+}
+
+/*
+Every route the API serves. Kept apart from handleRequests so the tests can send requests through the same routes.
+*/
+func routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", homePage)
+	mux.HandleFunc("/books", allEnteries)
+	mux.HandleFunc("/books/", returnSingleBook)
+	mux.HandleFunc("/new", createNewBook)
+	mux.HandleFunc("/genres", genresHandler)
+	mux.HandleFunc("/genres/", genresHandler)
+	mux.HandleFunc("/shelf", shelfHandler)
+	mux.HandleFunc("/auth/token", authToken)
+	mux.HandleFunc("/admin/audit", auditHandler)
+	mux.HandleFunc("/admin/webhooks", webhooksHandler)
+	mux.HandleFunc("/admin/webhooks/", webhooksHandler)
+	mux.HandleFunc("/trash", trashHandler)
+	mux.HandleFunc("/trash/", trashHandler)
+	mux.HandleFunc("/changes", changesHandler)
+	mux.HandleFunc("/events", eventsHandler)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/openapi.json", openAPIHandler)
+	mux.HandleFunc("/docs", docsHandler)
+	return mux
 }
@@ -6,6 +6,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -23,6 +26,139 @@ func TestRead(t *testing.T) {
 	}
 }
 
+/*
+Everything about the catalog has to survive the server saving it and reading it back in.
+*/
+func TestWriteAndReadBack(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+	requests := []struct {
+		method string
+		path   string
+		data   url.Values
+	}{
+		{"PATCH", "/books/book-1", url.Values{"tag": {"classic,Signed"}, "genre": {"Fiction > Mystery"}, "callnumber": {"823.912 WOO"}}},
+		{"POST", "/books/book-1/ratings", url.Values{"patron": {"alice"}, "rating": {"3"}}},
+		{"POST", "/books/book-1/reviews", url.Values{"patron": {"alice"}, "text": {"Loved it, \"twice\""}}},
+		{"POST", "/books/book-1/reviews/1/moderate", url.Values{"state": {"published"}}},
+		{"POST", "/books/book-1/reviews/1/helpful", url.Values{"patron": {"bob"}}},
+		{"POST", "/new", url.Values{"title": {"Book 3"}, "author": {"Author 3"}, "publisher": {"publisher"}, "publishdate": {"11111113"}, "rating": {"2"}, "ischeckedin": {"true"}}},
+		{"DELETE", "/books/book-3", nil},
+		{"DELETE", "/trash/book-3", nil},
+		{"DELETE", "/books/book-2", nil},
+	}
+	for _, r := range requests {
+		if w := formRequest(requireRole(routes()), r.method, r.path, r.data); w.Code >= 300 {
+			t.Fatal(r.method, " ", r.path, ": expected success. Recieved ", w.Code, " ", w.Body.String())
+		}
+	}
+
+	records := func() [][]string {
+		var records [][]string
+		for _, book := range Books {
+			records = append(records, bookRecord(book, nil))
+		}
+		for i := range Trash {
+			records = append(records, bookRecord(Trash[i].Book, &Trash[i]))
+		}
+		return records
+	}
+	if len(Books) != 1 || len(Trash) != 1 || nextBookID != 4 {
+		t.Fatal("Catalog incorrect before saving. Recieved ", Books, Trash, nextBookID)
+	}
+	saved := records()
+	path := filepath.Join(t.TempDir(), "books.csv")
+	if err := writeToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	readFromFile(path)
+
+	if !reflect.DeepEqual(records(), saved) {
+		t.Error("Catalog changed when read back in.\nSaved:  ", saved, "\nRecieved: ", records())
+	}
+	book := Books[0]
+	if book.ID != 1 || book.Ratings["alice"] != 3 || book.Rating != 2 || book.ReviewCount != 1 || !book.Reviews[0].Voters["bob"] ||
+		strings.Join(book.Tags, ",") != "classic,signed" || book.Genres[0] != "Fiction > Mystery" || book.CallNumber != "823.912 WOO" {
+		t.Error("Book 1 incorrect. Recieved ", book, book.Ratings, book.Reviews)
+	}
+	if trashed := Trash[0]; trashed.ID != 2 || trashed.DeletedBy != "anonymous" || trashed.DeletedAt.IsZero() || trashed.Status != StatusCheckedOut {
+		t.Error("Book 2 incorrect in the trash. Recieved ", trashed)
+	}
+	if nextBookID != 4 {
+		t.Error("Expected the purged Book 3's ID not to be given out again. Recieved ", nextBookID)
+	}
+	if len(revisions[1]) != 6 || len(revisions[2]) != 2 || revisions[3] != nil {
+		t.Error("Revisions incorrect. Recieved ", revisions)
+	}
+}
+
+/*
+Once the server is running every change is saved straight away, so a crash doesn't lose changes the feed has already
+given out.
+*/
+func TestEveryChangeSaved(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+	dir := t.TempDir()
+	catalogFile, genresFile = filepath.Join(dir, "books.csv"), filepath.Join(dir, "genres.csv")
+	t.Cleanup(func() { catalogFile, genresFile = "", "" })
+
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"author": {"New Author"}, "genre": {"Fiction > Mystery"}})
+	formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/rename", url.Values{"from": {"Fiction > Mystery"}, "to": {"Fiction > Crime"}})
+
+	// Read back in without shutting down, as after a crash
+	readGenres(genresFile)
+	readFromFile(catalogFile)
+	if book := Books[0]; book.Author != "New Author" || len(book.Genres) != 1 || book.Genres[0] != "Fiction > Crime" {
+		t.Error("Expected the changes to have been saved. Recieved ", book)
+	}
+	if _, ok := lookupGenre("Fiction > Crime"); !ok {
+		t.Error("Expected the renamed genre to have been saved")
+	}
+	if history := revisions[1]; len(history) != 3 || history[2].Op != "genre" {
+		t.Error("Expected the revisions to have been saved. Recieved ", history)
+	}
+}
+
+/*
+Listing the books while they are being changed. Run with -race to check the list is read under the mutex.
+*/
+func TestListBooksWhileChanging(t *testing.T) {
+	readFromFile("books.csv")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"author": {fmt.Sprint("Author ", i)}})
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if books := listBooks(t, "/books"); len(books) == 0 {
+			t.Fatal("Expected the books to be listed")
+		}
+	}
+	<-done
+}
+
+/*
+Files written before books had IDs are numbered in order, after any IDs that are already taken.
+*/
+func TestReadOldFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.csv")
+	books := "Book 1,Author 1,publisher,11111111,1,true\nBook 2,Author 2,publisher,11111112,3,on_hold,,,,,,5\nBook 3,Author 3,publisher,11111113,2,lost,,,,,,5\n"
+	if err := os.WriteFile(path, []byte(books), 0600); err != nil {
+		t.Fatal(err)
+	}
+	readFromFile(path)
+	ids := []int{}
+	for _, book := range Books {
+		ids = append(ids, book.ID)
+	}
+	if fmt.Sprint(ids) != "[6 5 7]" || nextBookID != 8 || Books[1].Status != StatusOnHold || Books[2].RatingCount != 1 {
+		t.Error("Expected books numbered after 5. Recieved ", Books, " ", nextBookID)
+	}
+}
+
 func TestHomePage(t *testing.T) {
 
 	resp, err := http.Get("http://localhost")
@@ -66,7 +202,7 @@ func TestAllBooks(t *testing.T) {
 		t.Error("Expeced Response code 200. Recieved ", resp.StatusCode)
 	}
 
-	expectedBody := strings.TrimSpace(`[{"title":"Book 1","author":"Author 1","publisher":"publisher","publishdate":"11111111","rating":1,"ischeckedin":true},{"title":"Book 2","author":"Author 2","publisher":"publisher","publishdate":"11111112","rating":3,"ischeckedin":false}]`)
+	expectedBody := strings.TrimSpace(`[{"title":"Book 1","author":"Author 1","publisher":"publisher","publishdate":"11111111","rating":1,"ischeckedin":true,"status":"available","ratingaverage":1,"ratingcount":1,"ratingdistribution":{"1":1,"2":0,"3":0},"reviewcount":0,"id":1},{"title":"Book 2","author":"Author 2","publisher":"publisher","publishdate":"11111112","rating":3,"ischeckedin":false,"status":"checked_out","ratingaverage":3,"ratingcount":1,"ratingdistribution":{"1":0,"2":0,"3":1},"reviewcount":0,"id":2}]`)
 
 	defer resp.Body.Close()
 
@@ -243,7 +379,7 @@ func TestSingleBookGet(t *testing.T) {
 	}
 	bodyStr := strings.TrimSpace(string(body))
 
-	expectedBody := `{"title":"Book 2","author":"Author 2","publisher":"publisher","publishdate":"11111112","rating":3,"ischeckedin":false}`
+	expectedBody := `{"title":"Book 2","author":"Author 2","publisher":"publisher","publishdate":"11111112","rating":3,"ischeckedin":false,"status":"checked_out","ratingaverage":3,"ratingcount":1,"ratingdistribution":{"1":0,"2":0,"3":1},"reviewcount":0,"id":2}`
 	if expectedBody != bodyStr {
 		t.Error("All of the books were not returned correctly. Recieved \n", bodyStr, "\n", expectedBody, strings.Compare(bodyStr, expectedBody))
 	}
@@ -297,7 +433,7 @@ func TestPatch(t *testing.T) {
 	}
 	bodyStr := strings.TrimSpace(string(body))
 
-	expectedBody := strings.TrimSpace(`{"title":"Book 1","author":"newAuthor","publisher":"publisher","publishdate":"11111111","rating":1,"ischeckedin":true}`)
+	expectedBody := strings.TrimSpace(`{"title":"Book 1","author":"newAuthor","publisher":"publisher","publishdate":"11111111","rating":1,"ischeckedin":true,"status":"available","ratingaverage":1,"ratingcount":1,"ratingdistribution":{"1":1,"2":0,"3":0},"reviewcount":0,"id":1}`)
 	if bodyStr != expectedBody {
 		t.Error("The book was not returned correctly. Recieved \n", bodyStr, "expected\n", expectedBody, strings.Compare(bodyStr, expectedBody))
 	}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+GET /metrics serves these in the Prometheus text format, along with the Go runtime and process stats. Requests are
+labelled with their route template, like /books/{id}, rather than the path, so there is one series per route and not
+one per book.
+*/
+var (
+	metrics = prometheus.NewRegistry()
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "books_http_requests_total",
+		Help: "HTTP requests handled, by route template, method and status.",
+	}, []string{"route", "method", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "books_http_request_duration_seconds",
+		Help:    "How long HTTP requests took to handle, by route template, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	persistenceDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "books_persistence_write_duration_seconds",
+		Help:    "How long writes to disk took, by what was written.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"store"})
+
+	persistenceFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "books_persistence_write_failures_total",
+		Help: "Writes to disk that failed, by what was written.",
+	}, []string{"store"})
+
+	changesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "books_outbox_changes_dropped_total",
+		Help: "Changes that left the change feed before an outbox published them, so were never published.",
+	})
+
+	mutexWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "books_catalog_mutex_wait_seconds",
+		Help:    "How long requests waited to lock the catalog.",
+		Buckets: []float64{.00001, .0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	})
+)
+
+func init() {
+	metrics.MustRegister(
+		requestsTotal, requestDuration, persistenceDuration, persistenceFailures, changesDropped, mutexWait,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "books_catalog_books",
+			Help: "Books in the catalog, not counting the trash.",
+		}, func() float64 {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return float64(len(Books))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "books_checked_out_books",
+			Help: "Books that are checked out.",
+		}, func() float64 {
+			mutex.Lock()
+			defer mutex.Unlock()
+			count := 0
+			for _, book := range Books {
+				if book.Status == StatusCheckedOut {
+					count++
+				}
+			}
+			return float64(count)
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metrics, promhttp.HandlerOpts{})
+}
+
+/*
+The catalog's mutex, which records how long each Lock waited for.
+*/
+type timedMutex struct {
+	sync.Mutex
+}
+
+/*
+Locks the mutex in a span of its own, so traces show how long a request waited for the catalog.
+*/
+func (m *timedMutex) LockContext(ctx context.Context) {
+	_, span := tracer().Start(ctx, "catalog.lock")
+	m.Lock()
+	span.End()
+}
+
+func (m *timedMutex) Lock() {
+	if m.TryLock() {
+		mutexWait.Observe(0)
+		return
+	}
+	started := time.Now()
+	m.Mutex.Lock()
+	mutexWait.Observe(time.Since(started).Seconds())
+}
+
+/*
+Every route the API serves, as templates. Segments in braces match any value. Static routes come before the templated
+ones they overlap with, like /admin/webhooks/deadletters and /admin/webhooks/{id}.
+*/
+var routeTemplates = [][]string{
+	{},
+	{"new"},
+	{"books"},
+	{"books", "{id}"},
+	{"books", "{id}", "checkout"},
+	{"books", "{id}", "checkin"},
+	{"books", "{id}", "ratings"},
+	{"books", "{id}", "reviews"},
+	{"books", "{id}", "reviews", "{rid}"},
+	{"books", "{id}", "reviews", "{rid}", "moderate"},
+	{"books", "{id}", "reviews", "{rid}", "helpful"},
+	{"books", "{id}", "revisions"},
+	{"books", "{id}", "revisions", "diff"},
+	{"books", "{id}", "revisions", "{n}"},
+	{"books", "{id}", "revert"},
+	{"genres"},
+	{"genres", "rename"},
+	{"genres", "merge"},
+	{"shelf"},
+	{"auth", "token"},
+	{"admin", "audit"},
+	{"admin", "webhooks"},
+	{"admin", "webhooks", "deadletters"},
+	{"admin", "webhooks", "deadletters", "{id}"},
+	{"admin", "webhooks", "{id}"},
+	{"admin", "webhooks", "{id}", "deliveries"},
+	{"admin", "webhooks", "{id}", "ping"},
+	{"trash"},
+	{"trash", "{id}"},
+	{"trash", "{id}", "restore"},
+	{"changes"},
+	{"events"},
+	{"metrics"},
+	{"healthz"},
+	{"readyz"},
+	{"openapi.json"},
+	{"docs"},
+}
+
+/*
+The route template a path matches, or "unmatched" for paths the API doesn't serve.
+*/
+func routeTemplate(path string) string {
+	path = strings.Trim(path, "/")
+	var segments []string
+	if path != "" {
+		segments = strings.Split(path, "/")
+	}
+next:
+	for _, template := range routeTemplates {
+		if len(template) != len(segments) {
+			continue
+		}
+		for i, segment := range template {
+			if !strings.HasPrefix(segment, "{") && segment != segments[i] {
+				continue next
+			}
+		}
+		return "/" + strings.Join(template, "/")
+	}
+	return "unmatched"
+}
+
+/*
+Methods the API doesn't use are counted together, so made up methods can't add series either.
+*/
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		return method
+	}
+	return "other"
+}
+
+/*
+Counts and times every request by its route template.
+*/
+func measure(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &accessRecorder{ResponseWriter: w}
+		started := time.Now()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		labels := []string{routeTemplate(r.URL.Path), methodLabel(r.Method), strconv.Itoa(recorder.status)}
+		requestsTotal.WithLabelValues(labels...).Inc()
+		requestDuration.WithLabelValues(labels...).Observe(time.Since(started).Seconds())
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	tests := map[string]string{
+		"/":                                 "/",
+		"/books":                            "/books",
+		"/books/book-1":                     "/books/{id}",
+		"/books/book-1/":                    "/books/{id}",
+		"/books/book-1/reviews/3/moderate":  "/books/{id}/reviews/{rid}/moderate",
+		"/books/book-1/revisions/diff":      "/books/{id}/revisions/diff",
+		"/books/book-1/revisions/2":         "/books/{id}/revisions/{n}",
+		"/admin/webhooks/deadletters":       "/admin/webhooks/deadletters",
+		"/admin/webhooks/abc123/deliveries": "/admin/webhooks/{id}/deliveries",
+		"/trash/4/restore":                  "/trash/{id}/restore",
+		"/books/book-1/nothing/here":        "unmatched",
+		"/wp-login.php":                     "unmatched",
+	}
+	for path, expected := range tests {
+		if got := routeTemplate(path); got != expected {
+			t.Error("Expected ", path, " to be ", expected, ". Recieved ", got)
+		}
+	}
+}
+
+func scrapeMetrics(t *testing.T) string {
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	saved := auditLog
+	t.Cleanup(func() { auditLog = saved })
+	var err error
+	if auditLog, err = openAuditLog(filepath.Join(t.TempDir(), "audit.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	handler := measure(requireRole(routes()))
+	for _, path := range []string{"/books/book-1/checkout", "/books/book-2/checkout"} {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("X-API-Key", "patron-key")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/books/no-such-book", nil))
+
+	body := scrapeMetrics(t)
+	for _, expected := range []string{
+		`books_http_requests_total{method="POST",route="/books/{id}/checkout",status="200"}`,
+		`books_http_requests_total{method="GET",route="/books/{id}",status="404"}`,
+		`books_http_request_duration_seconds_bucket{method="POST",route="/books/{id}/checkout",status="200",le="+Inf"}`,
+		`books_persistence_write_duration_seconds_count{store="audit"}`,
+		"books_catalog_books 2",
+		"books_checked_out_books 2",
+		"books_catalog_mutex_wait_seconds_count",
+		"go_goroutines",
+		"process_open_fds",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Error("Expected the metrics to have ", expected)
+		}
+	}
+	if strings.Contains(body, "book-1") {
+		t.Error("Expected no book ids in the labels. Recieved ", body)
+	}
+}
@@ -0,0 +1,863 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The API described as an OpenAPI 3 document, served at /openapi.json, with a page at /docs that reads it and lets the
+operations be tried out from the browser.
+
+The schemas of the JSON the API sends are made from the Go types it encodes, so a field added to Book shows up in the
+spec without anyone having to remember it. The routes and their parameters are listed by hand in apiRoutes, and
+openapi_test.go sends a request to every one of them and checks what comes back against the spec, so the two can't
+drift apart quietly. The role each operation needs is taken from requiredRole.
+
+Errors are sent as plain text that starts with the status code, like "404, not found.", except for the JSON 410 from
+/changes.
+*/
+type apiSchema struct {
+	Ref                  string                `json:"$ref,omitempty"`
+	AllOf                []*apiSchema          `json:"allOf,omitempty"`
+	Type                 string                `json:"type,omitempty"`
+	Format               string                `json:"format,omitempty"`
+	Description          string                `json:"description,omitempty"`
+	Enum                 []string              `json:"enum,omitempty"`
+	Pattern              string                `json:"pattern,omitempty"`
+	Properties           map[string]*apiSchema `json:"properties,omitempty"`
+	Required             []string              `json:"required,omitempty"`
+	Items                *apiSchema            `json:"items,omitempty"`
+	AdditionalProperties *apiSchema            `json:"additionalProperties,omitempty"`
+	Nullable             bool                  `json:"nullable,omitempty"`
+	Example              interface{}           `json:"example,omitempty"`
+}
+
+type apiParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      *apiSchema  `json:"schema"`
+	Example     interface{} `json:"example,omitempty"`
+}
+
+type apiMediaType struct {
+	Schema *apiSchema `json:"schema,omitempty"`
+}
+
+type apiHeader struct {
+	Description string     `json:"description"`
+	Schema      *apiSchema `json:"schema"`
+}
+
+type apiResponse struct {
+	Ref         string                  `json:"$ref,omitempty"`
+	Description string                  `json:"description,omitempty"`
+	Headers     map[string]apiHeader    `json:"headers,omitempty"`
+	Content     map[string]apiMediaType `json:"content,omitempty"`
+}
+
+type apiRequestBody struct {
+	Required bool                    `json:"required,omitempty"`
+	Content  map[string]apiMediaType `json:"content"`
+}
+
+type apiOperation struct {
+	OperationID string                 `json:"operationId"`
+	Summary     string                 `json:"summary"`
+	Description string                 `json:"description,omitempty"`
+	Tags        []string               `json:"tags"`
+	Parameters  []apiParameter         `json:"parameters,omitempty"`
+	RequestBody *apiRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]apiResponse `json:"responses"`
+	Security    []map[string][]string  `json:"security"`
+	Role        Role                   `json:"x-role"` // The least role needed, see requiredRole
+}
+
+/*
+One operation in apiRoutes. Form fields are sent as application/x-www-form-urlencoded, the way every handler reads
+them with r.FormValue.
+*/
+type apiRoute struct {
+	method      string
+	path        string
+	id          string
+	tag         string
+	summary     string
+	description string
+	query       []apiParameter
+	form        []apiParameter
+	responses   map[int]apiResponse
+}
+
+func apiString() *apiSchema  { return &apiSchema{Type: "string"} }
+func apiInteger() *apiSchema { return &apiSchema{Type: "integer"} }
+func apiBoolean() *apiSchema { return &apiSchema{Type: "boolean"} }
+func apiTimestamp() *apiSchema {
+	return &apiSchema{Type: "string", Format: "date-time"}
+}
+func apiEnum(values ...string) *apiSchema  { return &apiSchema{Type: "string", Enum: values} }
+func apiArray(items *apiSchema) *apiSchema { return &apiSchema{Type: "array", Items: items} }
+func apiRef(name string) *apiSchema        { return &apiSchema{Ref: "#/components/schemas/" + name} }
+
+func apiField(name string, schema *apiSchema, description string) apiParameter {
+	return apiParameter{Name: name, Schema: schema, Description: description}
+}
+
+func apiRequired(name string, schema *apiSchema, description string) apiParameter {
+	return apiParameter{Name: name, Schema: schema, Description: description, Required: true}
+}
+
+func apiObject(properties map[string]*apiSchema) *apiSchema {
+	s := &apiSchema{Type: "object", Properties: properties}
+	for name := range properties {
+		s.Required = append(s.Required, name)
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+func apiReturns(description string, schema *apiSchema) apiResponse {
+	return apiResponse{Description: description, Content: map[string]apiMediaType{"application/json": {Schema: schema}}}
+}
+
+func apiText(description string, mediaType string) apiResponse {
+	return apiResponse{Description: description, Content: map[string]apiMediaType{mediaType: {Schema: apiString()}}}
+}
+
+func apiEmpty(description string) apiResponse {
+	return apiResponse{Description: description}
+}
+
+func apiFails(description string) apiResponse {
+	return apiResponse{Description: description, Content: map[string]apiMediaType{"text/plain": {Schema: apiRef("Error")}}}
+}
+
+/*
+The parts of a book that can be given when creating or patching one.
+*/
+func bookFields(patch bool) []apiParameter {
+	fields := []apiParameter{
+		apiField("author", apiString(), ""),
+		apiField("publisher", apiString(), ""),
+		apiField("callnumber", apiString(), "a Dewey Decimal or Library of Congress call number"),
+		apiField("tag", apiArray(apiString()), "can be repeated, replaces the book's tags when patching"),
+		apiField("genre", apiArray(apiString()), "a genre path from the vocabulary, can be repeated, replaces the book's genres when patching"),
+		apiField("status", apiRef("BookStatus"), "must be a move the status transition table allows"),
+	}
+	if patch {
+		return append(fields,
+			apiField("title", apiString(), "changes the book's URL id too"),
+			apiField("publishdate", apiString(), "MMDDYYYY"),
+			apiField("rating", apiInteger(), "the catalog's rating, from 1 to the rating scale"),
+			apiField("ischeckedin", apiBoolean(), "older clients' way of checking a book in or out, ignored when status is given"),
+		)
+	}
+	return append(fields,
+		apiRequired("title", apiString(), "also the book's URL id, with spaces replaced by -"),
+		apiRequired("publishdate", apiString(), "MMDDYYYY"),
+		apiRequired("rating", apiInteger(), "the catalog's rating, from 1 to the rating scale"),
+		apiField("ischeckedin", apiBoolean(), "needed unless status is given"),
+	)
+}
+
+var apiRoutes = []apiRoute{
+	{method: "GET", path: "/", id: "homePage", tag: "service", summary: "Says the API is there",
+		responses: map[int]apiResponse{200: apiText("This is the Homepage", "text/plain")}},
+
+	{method: "GET", path: "/books", id: "listBooks", tag: "books", summary: "Every book in the catalog",
+		description: "Withdrawn books are left out unless asked for with status=withdrawn.",
+		query: []apiParameter{
+			apiField("status", apiRef("BookStatus"), "only books with this status"),
+			apiField("tag", apiArray(apiString()), "only books with every one of these tags"),
+			apiField("genre", apiArray(apiString()), "only books within every one of these genres, subgenres included"),
+			apiField("sort", apiEnum("callnumber"), "shelf order instead of the order the books were added"),
+		},
+		responses: map[int]apiResponse{
+			200: {Description: "The books", Content: map[string]apiMediaType{"application/json": {Schema: apiArray(apiRef("Book"))}},
+				Headers: map[string]apiHeader{"X-Change-Seq": {Description: "the change feed's latest sequence number, to follow /changes from", Schema: apiInteger()}}},
+			400: apiFails("A filter or sort isn't valid"),
+		}},
+	{method: "POST", path: "/new", id: "createBook", tag: "books", summary: "Add a book",
+		form: bookFields(false),
+		responses: map[int]apiResponse{
+			201: apiReturns("The book that was added", apiRef("Book")),
+			400: apiFails("A field isn't valid"),
+		}},
+	{method: "GET", path: "/books/{id}", id: "getBook", tag: "books", summary: "One book",
+		query: []apiParameter{apiField("asOf", apiTimestamp(), "the book as it was at this time")},
+		responses: map[int]apiResponse{
+			200: apiReturns("The book", apiRef("Book")),
+			400: apiFails("asOf isn't an RFC 3339 timestamp"),
+			404: apiFails("There is no such book, or it didn't exist at asOf"),
+		}},
+	{method: "PATCH", path: "/books/{id}", id: "updateBook", tag: "books", summary: "Change a book",
+		description: "Only the fields given are changed.",
+		form:        bookFields(true),
+		responses: map[int]apiResponse{
+			200: apiReturns("The changed book", apiRef("Book")),
+			400: apiFails("A field isn't valid"),
+			404: apiFails("There is no such book"),
+			409: apiFails("The status can't be changed to the one asked for"),
+		}},
+	{method: "DELETE", path: "/books/{id}", id: "deleteBook", tag: "books", summary: "Move a book to the trash",
+		query: []apiParameter{apiField("purge", apiBoolean(), "delete the book for good instead")},
+		responses: map[int]apiResponse{
+			200: apiText("The book was deleted", "text/plain"),
+			404: apiFails("There is no such book"),
+		}},
+
+	{method: "POST", path: "/books/{id}/checkout", id: "checkoutBook", tag: "circulation", summary: "Check a book out",
+		responses: map[int]apiResponse{
+			200: apiReturns("The book", apiRef("Book")),
+			404: apiFails("There is no such book"),
+			409: apiFails("The book can't be checked out in its current status"),
+		}},
+	{method: "POST", path: "/books/{id}/checkin", id: "checkinBook", tag: "circulation", summary: "Check a book in",
+		responses: map[int]apiResponse{
+			200: apiReturns("The book", apiRef("Book")),
+			404: apiFails("There is no such book"),
+			409: apiFails("The book can't be checked in in its current status"),
+		}},
+
+	{method: "GET", path: "/books/{id}/ratings", id: "getRatings", tag: "ratings", summary: "A book's rating summary",
+		responses: map[int]apiResponse{
+			200: apiReturns("The summary", apiRef("RatingSummary")),
+			404: apiFails("There is no such book"),
+		}},
+	{method: "POST", path: "/books/{id}/ratings", id: "rateBook", tag: "ratings", summary: "Rate a book",
+		description: "Each patron has one rating per book, rating again replaces it.",
+		form: []apiParameter{
+			apiRequired("rating", apiInteger(), "from 1 to the rating scale"),
+			apiField("patron", apiString(), "who is rating, only used when authentication is off"),
+		},
+		responses: map[int]apiResponse{
+			200: apiReturns("The patron's rating was replaced", apiRef("Book")),
+			201: apiReturns("The patron rated the book for the first time", apiRef("Book")),
+			400: apiFails("The rating or patron isn't valid"),
+			404: apiFails("There is no such book"),
+		}},
+
+	{method: "GET", path: "/books/{id}/reviews", id: "listReviews", tag: "reviews", summary: "A page of a book's reviews",
+		query: []apiParameter{
+			apiField("state", apiRef("ReviewState"), "reviews in this state, published by default. Librarians only for the others"),
+			apiField("page", apiInteger(), "starting at 1"),
+			apiField("perpage", apiInteger(), "from 1 to "+strconv.Itoa(maxReviewsPerPage)+", "+strconv.Itoa(defaultReviewsPerPage)+" by default"),
+			apiField("sort", apiEnum("helpful", "newest", "oldest"), "most helpful first by default"),
+		},
+		responses: map[int]apiResponse{
+			200: apiReturns("The page", apiRef("ReviewPage")),
+			400: apiFails("A parameter isn't valid"),
+			404: apiFails("There is no such book"),
+		}},
+	{method: "POST", path: "/books/{id}/reviews", id: "createReview", tag: "reviews", summary: "Review a book",
+		description: "The review is pending until a librarian publishes it.",
+		form: []apiParameter{
+			apiRequired("text", apiString(), "the review"),
+			apiField("patron", apiString(), "who is reviewing, only used when authentication is off"),
+		},
+		responses: map[int]apiResponse{
+			201: apiReturns("The review", apiRef("Review")),
+			400: apiFails("The text or patron isn't valid"),
+			404: apiFails("There is no such book"),
+		}},
+	{method: "GET", path: "/books/{id}/reviews/{rid}", id: "getReview", tag: "reviews", summary: "One review",
+		description: "Reviews that aren't published are only shown to their author and librarians.",
+		responses: map[int]apiResponse{
+			200: apiReturns("The review", apiRef("Review")),
+			404: apiFails("There is no such book or review, or it isn't published and the caller can't see it"),
+		}},
+	{method: "PATCH", path: "/books/{id}/reviews/{rid}", id: "updateReview", tag: "reviews", summary: "Edit a review",
+		description: "Only the author can edit a review, which goes back to pending.",
+		form: []apiParameter{
+			apiRequired("text", apiString(), "the new text"),
+			apiField("patron", apiString(), "who is editing, only used when authentication is off"),
+		},
+		responses: map[int]apiResponse{
+			200: apiReturns("The review", apiRef("Review")),
+			400: apiFails("The text isn't valid"),
+			403: apiFails("Only the author can edit a review"),
+			404: apiFails("There is no such book or review"),
+		}},
+	{method: "DELETE", path: "/books/{id}/reviews/{rid}", id: "deleteReview", tag: "reviews", summary: "Delete a review",
+		query: []apiParameter{apiField("patron", apiString(), "who is deleting, only used when authentication is off")},
+		responses: map[int]apiResponse{
+			200: apiText("The review was deleted", "text/plain"),
+			403: apiFails("Only the author or a librarian can delete a review"),
+			404: apiFails("There is no such book or review"),
+		}},
+	{method: "POST", path: "/books/{id}/reviews/{rid}/moderate", id: "moderateReview", tag: "reviews", summary: "Publish or reject a review",
+		form: []apiParameter{apiRequired("state", apiRef("ReviewState"), "")},
+		responses: map[int]apiResponse{
+			200: apiReturns("The review", apiRef("Review")),
+			400: apiFails("The state isn't valid"),
+			404: apiFails("There is no such book or review"),
+		}},
+	{method: "POST", path: "/books/{id}/reviews/{rid}/helpful", id: "voteReviewHelpful", tag: "reviews", summary: "Vote a review helpful",
+		form: []apiParameter{apiField("patron", apiString(), "who is voting, only used when authentication is off")},
+		responses: map[int]apiResponse{
+			200: apiReturns("The review", apiRef("Review")),
+			400: apiFails("There is no patron"),
+			404: apiFails("There is no such book or review"),
+			409: apiFails("The patron already voted for the review"),
+		}},
+
+	{method: "GET", path: "/books/{id}/revisions", id: "listRevisions", tag: "revisions", summary: "A book's revisions, oldest first",
+		responses: map[int]apiResponse{
+			200: apiReturns("The revisions", apiArray(apiRef("Revision"))),
+			404: apiFails("There is no such book"),
+		}},
+	{method: "GET", path: "/books/{id}/revisions/diff", id: "diffRevisions", tag: "revisions", summary: "What changed between two revisions",
+		query: []apiParameter{
+			apiField("from", apiInteger(), "the revision before to by default"),
+			apiField("to", apiInteger(), "the latest revision by default"),
+		},
+		responses: map[int]apiResponse{
+			200: apiReturns("The changes", apiRef("RevisionDiff")),
+			404: apiFails("There is no such book or revision"),
+		}},
+	{method: "GET", path: "/books/{id}/revisions/{n}", id: "getRevision", tag: "revisions", summary: "One revision",
+		responses: map[int]apiResponse{
+			200: apiReturns("The revision", apiRef("Revision")),
+			404: apiFails("There is no such book or revision"),
+		}},
+	{method: "POST", path: "/books/{id}/revert", id: "revertBook", tag: "revisions", summary: "Put a book's details back the way they were",
+		description: "Status, ratings and reviews are left alone. Genres no longer in the vocabulary are dropped.",
+		form:        []apiParameter{apiRequired("revision", apiInteger(), "the revision to go back to")},
+		responses: map[int]apiResponse{
+			200: {Description: "The book", Content: map[string]apiMediaType{"application/json": {Schema: apiRef("Book")}},
+				Headers: map[string]apiHeader{"X-Dropped-Genre": {Description: "a genre of the revision's that is no longer in the vocabulary, once for each", Schema: apiString()}}},
+			400: apiFails("There is no such revision"),
+			404: apiFails("There is no such book"),
+		}},
+
+	{method: "GET", path: "/genres", id: "listGenres", tag: "genres", summary: "The genre tree with book counts",
+		responses: map[int]apiResponse{200: apiReturns("The genres", apiArray(apiRef("Genre")))}},
+	{method: "POST", path: "/genres", id: "createGenre", tag: "genres", summary: "Add a genre",
+		form: []apiParameter{apiRequired("path", apiString(), `like "Fiction > Mystery", its parents are added too`)},
+		responses: map[int]apiResponse{
+			201: apiReturns("The genre was added, here is the new tree", apiArray(apiRef("Genre"))),
+			400: apiFails("The path isn't valid"),
+			409: apiFails("The genre already exists"),
+		}},
+	{method: "POST", path: "/genres/rename", id: "renameGenre", tag: "genres", summary: "Rename a genre",
+		form: []apiParameter{apiRequired("from", apiString(), ""), apiRequired("to", apiString(), "must not exist yet")},
+		responses: map[int]apiResponse{
+			200: apiReturns("The genres", apiArray(apiRef("Genre"))),
+			400: apiFails("The new path isn't valid"),
+			404: apiFails("There is no such genre"),
+			409: apiFails("The new genre already exists"),
+		}},
+	{method: "POST", path: "/genres/merge", id: "mergeGenre", tag: "genres", summary: "Merge a genre into another",
+		form: []apiParameter{apiRequired("from", apiString(), ""), apiRequired("into", apiString(), "must already exist")},
+		responses: map[int]apiResponse{
+			200: apiReturns("The genres", apiArray(apiRef("Genre"))),
+			400: apiFails("A genre can't be merged into itself"),
+			404: apiFails("There is no such genre"),
+		}},
+	{method: "GET", path: "/shelf", id: "browseShelf", tag: "genres", summary: "The books shelved around a call number",
+		query: []apiParameter{
+			apiField("from", apiString(), "a call number, the start of the shelf by default"),
+			apiField("count", apiInteger(), "how many books either side, from 1 to "+strconv.Itoa(maxShelfCount)),
+		},
+		responses: map[int]apiResponse{
+			200: apiReturns("The books in shelf order", apiArray(apiRef("Book"))),
+			400: apiFails("A parameter isn't valid"),
+		}},
+
+	{method: "GET", path: "/auth/token", id: "whoAmI", tag: "auth", summary: "Who the request is authenticated as",
+		responses: map[int]apiResponse{
+			200: apiReturns("The caller", apiRef("Principal")),
+			404: apiFails("Authentication is off"),
+		}},
+	{method: "POST", path: "/auth/token", id: "createToken", tag: "auth", summary: "Swap credentials for a bearer token",
+		responses: map[int]apiResponse{
+			201: apiReturns("The token", apiRef("Token")),
+			404: apiFails("Authentication is off"),
+			500: apiFails("The token couldn't be made"),
+		}},
+	{method: "DELETE", path: "/auth/token", id: "revokeToken", tag: "auth", summary: "Revoke the bearer token the request was made with",
+		responses: map[int]apiResponse{
+			204: apiEmpty("The token was revoked"),
+			400: apiFails("The request wasn't made with a bearer token"),
+			404: apiFails("Authentication is off"),
+		}},
+
+	{method: "GET", path: "/admin/audit", id: "queryAudit", tag: "admin", summary: "The audit log",
+		query: []apiParameter{
+			apiField("actor", apiString(), ""),
+			apiField("book", apiString(), "a book's URL id"),
+			apiField("bookid", apiInteger(), ""),
+			apiField("op", apiString(), "like create, update or checkout"),
+			apiField("since", apiTimestamp(), ""),
+			apiField("until", apiTimestamp(), ""),
+			apiField("format", apiEnum("json", "jsonl"), "jsonl exports the entries as JSON Lines"),
+		},
+		responses: map[int]apiResponse{
+			200: {Description: "The entries, oldest first", Content: map[string]apiMediaType{
+				"application/json":     {Schema: apiArray(apiRef("AuditEntry"))},
+				"application/x-ndjson": {Schema: apiRef("AuditEntry")},
+			}},
+			400: apiFails("A filter isn't valid"),
+			404: apiFails("The audit log is off"),
+			500: apiFails("The audit log couldn't be read"),
+		}},
+	{method: "GET", path: "/admin/webhooks", id: "listWebhooks", tag: "webhooks", summary: "Every webhook subscription",
+		responses: map[int]apiResponse{200: apiReturns("The subscriptions, without their secrets", apiArray(apiRef("Webhook")))}},
+	{method: "POST", path: "/admin/webhooks", id: "createWebhook", tag: "webhooks", summary: "Subscribe to events",
+		form: []apiParameter{
+			apiRequired("url", apiString(), "where deliveries are posted"),
+			apiField("events", apiString(), "comma separated event types, all of them when empty"),
+			apiField("secret", apiString(), "signs the deliveries, made up when empty"),
+		},
+		responses: map[int]apiResponse{
+			201: apiReturns("The subscription, with its secret", apiRef("Webhook")),
+			400: apiFails("The URL isn't valid"),
+			500: apiFails("The subscription couldn't be saved"),
+		}},
+	{method: "GET", path: "/admin/webhooks/deadletters", id: "listDeadLetters", tag: "webhooks", summary: "Deliveries that failed every attempt",
+		responses: map[int]apiResponse{200: apiReturns("The deliveries", apiArray(apiRef("Delivery")))}},
+	{method: "POST", path: "/admin/webhooks/deadletters/{id}", id: "retryDeadLetter", tag: "webhooks", summary: "Try a dead letter again",
+		responses: map[int]apiResponse{
+			202: apiReturns("The delivery, which is sent in the background", apiRef("Delivery")),
+			404: apiFails("There is no such dead letter"),
+			409: apiFails("The webhook has been deleted"),
+		}},
+	{method: "GET", path: "/admin/webhooks/{id}", id: "getWebhook", tag: "webhooks", summary: "One subscription",
+		responses: map[int]apiResponse{
+			200: apiReturns("The subscription, without its secret", apiRef("Webhook")),
+			404: apiFails("There is no such subscription"),
+		}},
+	{method: "DELETE", path: "/admin/webhooks/{id}", id: "deleteWebhook", tag: "webhooks", summary: "Unsubscribe",
+		responses: map[int]apiResponse{
+			204: apiEmpty("Unsubscribed"),
+			404: apiFails("There is no such subscription"),
+		}},
+	{method: "GET", path: "/admin/webhooks/{id}/deliveries", id: "listDeliveries", tag: "webhooks", summary: "A subscription's recent deliveries, newest first",
+		responses: map[int]apiResponse{
+			200: apiReturns("The deliveries", apiArray(apiRef("Delivery"))),
+			404: apiFails("There is no such subscription"),
+		}},
+	{method: "POST", path: "/admin/webhooks/{id}/ping", id: "pingWebhook", tag: "webhooks", summary: "Send a ping event",
+		responses: map[int]apiResponse{
+			202: apiReturns("The delivery, which is sent in the background", apiRef("Delivery")),
+			404: apiFails("There is no such subscription"),
+		}},
+
+	{method: "GET", path: "/trash", id: "listTrash", tag: "trash", summary: "Every deleted book, oldest first",
+		responses: map[int]apiResponse{200: apiReturns("The deleted books", apiArray(apiRef("TrashedBook")))}},
+	{method: "DELETE", path: "/trash/{id}", id: "purgeBook", tag: "trash", summary: "Delete a book for good",
+		responses: map[int]apiResponse{
+			204: apiEmpty("The book was purged"),
+			404: apiFails("There is no such book in the trash"),
+		}},
+	{method: "POST", path: "/trash/{id}/restore", id: "restoreBook", tag: "trash", summary: "Put a book back in the catalog",
+		form: []apiParameter{apiField("title", apiString(), "a new title, needed when another book has taken the old one")},
+		responses: map[int]apiResponse{
+			200: apiReturns("The book", apiRef("Book")),
+			404: apiFails("There is no such book in the trash"),
+			409: apiFails("Another book has the title"),
+		}},
+
+	{method: "GET", path: "/changes", id: "listChanges", tag: "changes", summary: "The changes made after a sequence number",
+		query: []apiParameter{
+			apiField("since", apiInteger(), "the last sequence number seen, 0 by default"),
+			apiField("limit", apiInteger(), "from 1 to 1000, 100 by default"),
+			apiField("wait", apiString(), "how long to wait for a change when there isn't one yet, like 30s, at most 1m"),
+		},
+		responses: map[int]apiResponse{
+			200: apiReturns("The changes, oldest first", apiRef("ChangePage")),
+			400: apiFails("A parameter isn't valid"),
+			410: apiReturns("The changes after since are no longer kept, or since is ahead of the feed, download the catalog again", apiRef("ChangesGone")),
+		}},
+	{method: "GET", path: "/events", id: "streamEvents", tag: "changes", summary: "Catalog changes as Server-Sent Events",
+		description: "Each event's id is the change's sequence number and its data is a Change. A reset event means " +
+			"changes were missed and the catalog should be downloaded again.",
+		query: []apiParameter{
+			apiField("type", apiString(), "comma separated event types, like book.created,book.checkout"),
+			apiField("author", apiString(), ""),
+			apiField("book", apiString(), "a book's URL id"),
+			apiField("lastEventId", apiInteger(), "for clients that can't send the Last-Event-ID header"),
+		},
+		responses: map[int]apiResponse{
+			200: apiText("The stream", "text/event-stream"),
+			400: apiFails("Last-Event-ID isn't a sequence number"),
+		}},
+
+	{method: "GET", path: "/metrics", id: "metrics", tag: "service", summary: "Prometheus metrics",
+		responses: map[int]apiResponse{200: apiText("The metrics", "text/plain")}},
+	{method: "GET", path: "/healthz", id: "healthz", tag: "service", summary: "Whether the process is up",
+		responses: map[int]apiResponse{200: apiReturns("It is", apiRef("Health"))}},
+	{method: "GET", path: "/readyz", id: "readyz", tag: "service", summary: "Whether the server should be sent traffic",
+		responses: map[int]apiResponse{
+			200: apiReturns("Ready", apiRef("Health")),
+			503: apiReturns("Not ready, the failing components say why", apiRef("Health")),
+		}},
+	{method: "GET", path: "/openapi.json", id: "openapi", tag: "service", summary: "This document",
+		responses: map[int]apiResponse{200: apiReturns("The OpenAPI document", &apiSchema{Type: "object"})}},
+	{method: "GET", path: "/docs", id: "docs", tag: "service", summary: "A page for reading and trying out this document",
+		responses: map[int]apiResponse{200: apiText("The page", "text/html")}},
+}
+
+/*
+The schemas made from Go types, by the name they are given in the spec.
+*/
+var apiModels = map[string]interface{}{
+	"Book":        Book{},
+	"Review":      Review{},
+	"Revision":    Revision{},
+	"FieldChange": FieldChange{},
+	"TrashedBook": TrashedBook{},
+	"Genre":       genreNode{},
+	"Change":      Change{},
+	"AuditEntry":  AuditEntry{},
+	"Webhook":     Webhook{},
+	"Delivery":    Delivery{},
+	"Attempt":     Attempt{},
+	"Principal":   Principal{},
+	"Health":      healthStatus{},
+	"Component":   componentStatus{},
+	"BookStatus":  BookStatus(""),
+	"ReviewState": ReviewState(""),
+	"Role":        Role(""),
+}
+
+/*
+Descriptions for fields in the models, by model and JSON name.
+*/
+var apiFieldDescriptions = map[string]string{
+	"Book.id":                 "never changes, even when the title does",
+	"Book.publishdate":        "MMDDYYYY",
+	"Book.rating":             "the average rating rounded to a whole number",
+	"Book.ischeckedin":        "false when the book is checked out or lost, kept for older clients",
+	"Book.ratingdistribution": "how many ratings were given at each point of the scale",
+	"Book.reviewcount":        "published reviews only",
+	"Book.genres":             `paths from the genre vocabulary, like "Fiction > Mystery"`,
+	"Book.callnumber":         "Dewey Decimal or Library of Congress",
+	"Revision.book":           "null for the revision that deleted the book",
+	"Change.type":             "created, updated or deleted",
+	"Change.op":               "the mutation behind the change, like checkout or revert",
+	"Change.book":             "left out for deleted books",
+	"AuditEntry.book":         "the book's title after the change, or before it for deletes",
+	"Delivery.state":          "pending, delivered or failed",
+	"Delivery.seq":            "the change's sequence number, pings don't have one",
+	"Attempt.duration":        "in nanoseconds",
+	"Webhook.secret":          "only sent when the webhook is created",
+}
+
+/*
+The values of the string types that are enums.
+*/
+func apiEnums() map[reflect.Type][]string {
+	statuses := []string{}
+	for status := range statusTransitions {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	return map[reflect.Type][]string{
+		reflect.TypeOf(BookStatus("")):  statuses,
+		reflect.TypeOf(ReviewState("")): {string(ReviewPending), string(ReviewPublished), string(ReviewRejected)},
+		reflect.TypeOf(Role("")):        {string(RoleAnonymous), string(RolePatron), string(RoleLibrarian)},
+	}
+}
+
+/*
+Makes the schemas for apiModels, with every other model they use referred to by name.
+*/
+type schemaBuilder struct {
+	names map[reflect.Type]string
+	enums map[reflect.Type][]string
+}
+
+func (b schemaBuilder) schema(t reflect.Type, inline bool) *apiSchema {
+	if name, ok := b.names[t]; ok && !inline {
+		return apiRef(name)
+	}
+	if values, ok := b.enums[t]; ok {
+		return apiEnum(values...)
+	}
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return apiTimestamp()
+	case reflect.TypeOf(time.Duration(0)):
+		return &apiSchema{Type: "integer", Format: "int64"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		s := b.schema(t.Elem(), false)
+		if s.Ref != "" {
+			return &apiSchema{AllOf: []*apiSchema{s}, Nullable: true}
+		}
+		s.Nullable = true
+		return s
+	case reflect.Interface:
+		return &apiSchema{Description: "any JSON value", Nullable: true}
+	case reflect.String:
+		return apiString()
+	case reflect.Bool:
+		return apiBoolean()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if t.Size() == 8 {
+			return &apiSchema{Type: "integer", Format: "int64"}
+		}
+		return apiInteger()
+	case reflect.Float32, reflect.Float64:
+		return &apiSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return apiArray(b.schema(schemaElem(t), false))
+	case reflect.Map:
+		return &apiSchema{Type: "object", AdditionalProperties: b.schema(schemaElem(t), false)}
+	case reflect.Struct:
+		s := &apiSchema{Type: "object", Properties: map[string]*apiSchema{}}
+		b.addFields(s, t, b.names[t])
+		sort.Strings(s.Required)
+		return s
+	}
+	return &apiSchema{}
+}
+
+/*
+The type of a slice or map's values. Pointers in them are never nil, so they are described as what they point to.
+*/
+func schemaElem(t reflect.Type) reflect.Type {
+	if t.Elem().Kind() == reflect.Pointer {
+		return t.Elem().Elem()
+	}
+	return t.Elem()
+}
+
+/*
+Adds a struct's fields the way encoding/json would encode them, with embedded structs' fields brought up a level.
+*/
+func (b schemaBuilder) addFields(s *apiSchema, t reflect.Type, modelName string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			b.addFields(s, f.Type, b.names[f.Type])
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		property := b.schema(f.Type, false)
+		if description := apiFieldDescriptions[modelName+"."+name]; description != "" {
+			if property.Ref != "" {
+				property = &apiSchema{AllOf: []*apiSchema{property}}
+			}
+			property.Description = description
+		}
+		s.Properties[name] = property
+		if !strings.Contains(options, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+/*
+Turns the {names} in a path into parameters.
+*/
+func pathParameters(path string) []apiParameter {
+	var parameters []apiParameter
+	for _, segment := range strings.Split(path, "/") {
+		if !strings.HasPrefix(segment, "{") {
+			continue
+		}
+		name := strings.Trim(segment, "{}")
+		p := apiParameter{Name: name, In: "path", Required: true, Schema: apiString()}
+		switch {
+		case name == "rid":
+			p.Description, p.Schema = "the review's number within the book", apiInteger()
+		case name == "n":
+			p.Description, p.Schema = "the revision's number, starting at 1", apiInteger()
+		case strings.HasPrefix(path, "/admin/webhooks/deadletters"):
+			p.Description = "the delivery's id"
+		case strings.HasPrefix(path, "/admin/webhooks"):
+			p.Description = "the webhook's id"
+		default:
+			p.Description = "the book's title with spaces replaced by -, in any case"
+			p.Example = "Book-1"
+		}
+		parameters = append(parameters, p)
+	}
+	return parameters
+}
+
+/*
+The role an operation needs, asked of requiredRole with a request like the ones the operation gets.
+*/
+func routeRole(method string, path string) Role {
+	return requiredRole(&http.Request{Method: method, URL: &url.URL{Path: path}})
+}
+
+func openAPIDocument() map[string]interface{} {
+	builder := schemaBuilder{names: map[reflect.Type]string{}, enums: apiEnums()}
+	for name, value := range apiModels {
+		builder.names[reflect.TypeOf(value)] = name
+	}
+	schemas := map[string]*apiSchema{}
+	for name, value := range apiModels {
+		schemas[name] = builder.schema(reflect.TypeOf(value), true)
+	}
+	schemas["Error"] = &apiSchema{Type: "string", Pattern: "^[0-9]{3}", Example: "404, not found.",
+		Description: "plain text starting with the status code"}
+	schemas["RatingSummary"] = apiObject(map[string]*apiSchema{
+		"average":      {Type: "number"},
+		"count":        apiInteger(),
+		"distribution": {Type: "object", AdditionalProperties: apiInteger()},
+	})
+	schemas["ReviewPage"] = apiObject(map[string]*apiSchema{
+		"reviews": apiArray(apiRef("Review")),
+		"page":    apiInteger(),
+		"perpage": apiInteger(),
+		"total":   apiInteger(),
+	})
+	schemas["RevisionDiff"] = apiObject(map[string]*apiSchema{
+		"from":    apiInteger(),
+		"to":      apiInteger(),
+		"changes": apiArray(apiRef("FieldChange")),
+	})
+	schemas["Token"] = apiObject(map[string]*apiSchema{
+		"token":   apiString(),
+		"type":    apiEnum("Bearer"),
+		"expires": apiTimestamp(),
+	})
+	schemas["ChangePage"] = apiObject(map[string]*apiSchema{
+		"changes": apiArray(apiRef("Change")),
+		"next":    {Type: "integer", Format: "int64", Description: "what to pass as since to carry on"},
+		"latest":  {Type: "integer", Format: "int64"},
+	})
+	schemas["ChangesGone"] = apiObject(map[string]*apiSchema{
+		"error":  apiString(),
+		"latest": {Type: "integer", Format: "int64"},
+	})
+
+	paths := map[string]map[string]apiOperation{}
+	for _, route := range apiRoutes {
+		op := apiOperation{
+			OperationID: route.id,
+			Summary:     route.summary,
+			Description: route.description,
+			Tags:        []string{route.tag},
+			Parameters:  pathParameters(route.path),
+			Responses:   map[string]apiResponse{},
+			Role:        routeRole(route.method, route.path),
+		}
+		for _, p := range route.query {
+			p.In = "query"
+			op.Parameters = append(op.Parameters, p)
+		}
+		if len(route.form) > 0 {
+			body := &apiSchema{Type: "object", Properties: map[string]*apiSchema{}}
+			for _, p := range route.form {
+				s := *p.Schema
+				if p.Description != "" {
+					if s.Ref != "" {
+						s = apiSchema{AllOf: []*apiSchema{p.Schema}}
+					}
+					s.Description = p.Description
+				}
+				body.Properties[p.Name] = &s
+				if p.Required {
+					body.Required = append(body.Required, p.Name)
+				}
+			}
+			sort.Strings(body.Required)
+			op.RequestBody = &apiRequestBody{
+				Required: len(body.Required) > 0,
+				Content:  map[string]apiMediaType{"application/x-www-form-urlencoded": {Schema: body}},
+			}
+		}
+		for code, response := range route.responses {
+			op.Responses[strconv.Itoa(code)] = response
+		}
+		op.Responses["429"] = apiResponse{Ref: "#/components/responses/TooManyRequests"}
+		if op.Role == RoleAnonymous {
+			op.Security = []map[string][]string{{}, {"apiKey": {}}, {"bearer": {}}}
+		} else {
+			op.Security = []map[string][]string{{"apiKey": {}}, {"bearer": {}}}
+			op.Responses["401"] = apiResponse{Ref: "#/components/responses/Unauthorized"}
+			op.Responses["403"] = apiResponse{Ref: "#/components/responses/Forbidden"}
+		}
+		if paths[route.path] == nil {
+			paths[route.path] = map[string]apiOperation{}
+		}
+		paths[route.path][strings.ToLower(route.method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Books",
+			"version": "1.0",
+			"description": "A library catalog. Reading is open to everyone, patrons can check books out, rate and review them, " +
+				"and librarians can do everything else. Authentication is only needed when the server has API keys or a JWKS " +
+				"configured, and x-role on each operation is the least role it needs.\n\n" +
+				"Errors are plain text that starts with the status code. Every response has an X-Request-ID header, and an " +
+				"X-Trace-ID header when tracing is on.",
+		},
+		"tags": []map[string]string{
+			{"name": "books"}, {"name": "circulation"}, {"name": "ratings"}, {"name": "reviews"}, {"name": "revisions"},
+			{"name": "genres"}, {"name": "trash"}, {"name": "changes"}, {"name": "webhooks"}, {"name": "auth"},
+			{"name": "admin"}, {"name": "service"},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"responses": map[string]apiResponse{
+				"Unauthorized":    apiFails("There are no credentials, or they aren't valid"),
+				"Forbidden":       apiFails("The caller's role isn't allowed to do this"),
+				"TooManyRequests": apiFails("The client has been rate limited, the Retry-After header says for how long"),
+			},
+			"securitySchemes": map[string]interface{}{
+				"apiKey": map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": map[string]string{"type": "http", "scheme": "bearer",
+					"description": "a token from POST /auth/token, or a JWT when a JWKS is configured"},
+			},
+		},
+	}
+}
+
+/*
+GET /openapi.json
+*/
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(openAPIDocument())
+}
+
+//go:embed docs.html
+var docsPage []byte
+
+/*
+GET /docs, a page that reads /openapi.json and lists the operations with a form for trying each one out. It is all in
+the one file, so it works without reaching anything but this server.
+*/
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type specObject = map[string]interface{}
+
+func loadSpec(t *testing.T) specObject {
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code)
+	}
+	var spec specObject
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+/*
+The spec's path for a request's path, preferring the one with the most fixed segments, so
+/admin/webhooks/deadletters isn't taken for a webhook's id.
+*/
+func specPath(spec specObject, path string) string {
+	segments := strings.Split(path, "/")
+	best, bestFixed := "", -1
+	for template := range spec["paths"].(specObject) {
+		parts := strings.Split(template, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		fixed := 0
+		for i, part := range parts {
+			if strings.HasPrefix(part, "{") {
+				continue
+			}
+			if part != segments[i] {
+				fixed = -1
+				break
+			}
+			fixed++
+		}
+		if fixed > bestFixed {
+			best, bestFixed = template, fixed
+		}
+	}
+	return best
+}
+
+func resolveRef(spec specObject, value specObject) specObject {
+	for {
+		ref, ok := value["$ref"].(string)
+		if !ok {
+			return value
+		}
+		parts := strings.Split(strings.TrimPrefix(ref, "#/"), "/")
+		value = spec
+		for _, part := range parts {
+			value = value[part].(specObject)
+		}
+	}
+}
+
+/*
+Checks value against a schema. It is stricter than OpenAPI: an object can't have properties its schema doesn't list
+unless it has additionalProperties, so a field added to a response has to be added to the spec too.
+*/
+func checkSchema(spec specObject, schema specObject, value interface{}, at string) []string {
+	schema = resolveRef(spec, schema)
+	if value == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{at + " is null"}
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		var problems []string
+		for _, s := range all {
+			problems = append(problems, checkSchema(spec, s.(specObject), value, at)...)
+		}
+		return problems
+	}
+
+	wrongType := []string{fmt.Sprintf("%v should be %v, was %#v", at, schema["type"], value)}
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return wrongType
+		}
+		var problems []string
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				problems = append(problems, at+"."+name.(string)+" is missing")
+			}
+		}
+		properties, _ := schema["properties"].(specObject)
+		additional, _ := schema["additionalProperties"].(specObject)
+		for name, v := range object {
+			if property, ok := properties[name]; ok {
+				problems = append(problems, checkSchema(spec, property.(specObject), v, at+"."+name)...)
+			} else if additional != nil {
+				problems = append(problems, checkSchema(spec, additional, v, at+"."+name)...)
+			} else if properties != nil {
+				problems = append(problems, at+"."+name+" is not in the spec")
+			}
+		}
+		return problems
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return wrongType
+		}
+		var problems []string
+		for i, v := range array {
+			problems = append(problems, checkSchema(spec, schema["items"].(specObject), v, fmt.Sprintf("%v[%v]", at, i))...)
+		}
+		return problems
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return wrongType
+		}
+		if enum, ok := schema["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == s
+			}
+			if !found {
+				return []string{fmt.Sprintf("%v is %q, not one of %v", at, s, enum)}
+			}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, s); err != nil {
+				return []string{at + " is not a date-time: " + s}
+			}
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(s) {
+			return []string{fmt.Sprintf("%v is %q, which doesn't match %v", at, s, pattern)}
+		}
+	case "integer":
+		if n, ok := value.(float64); !ok || n != float64(int64(n)) {
+			return wrongType
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return wrongType
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return wrongType
+		}
+	}
+	return nil
+}
+
+/*
+Sends requests through the routes and checks every response against the operation the spec has for it, keeping
+track of which operations have been tried.
+*/
+type specChecker struct {
+	t       *testing.T
+	spec    specObject
+	covered map[string]bool
+}
+
+func (c *specChecker) check(method string, target string, w *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	c.t.Helper()
+	u, _ := url.Parse(target)
+	path := specPath(c.spec, u.Path)
+	operation, ok := c.spec["paths"].(specObject)[path].(specObject)[strings.ToLower(method)].(specObject)
+	if path == "" || !ok {
+		c.t.Error(method, " ", target, " is not in the spec")
+		return w
+	}
+	c.covered[method+" "+path] = true
+
+	where := fmt.Sprintf("%v %v answered %v", method, target, w.Code)
+	response, ok := operation["responses"].(specObject)[fmt.Sprint(w.Code)].(specObject)
+	if !ok {
+		c.t.Error(where, ", which is not in the spec: ", w.Body.String())
+		return w
+	}
+	content, _ := resolveRef(c.spec, response)["content"].(specObject)
+	body := w.Body.Bytes()
+	var problems []string
+	switch {
+	case content == nil:
+		if len(body) > 0 {
+			problems = append(problems, "the spec has no body, but there was one")
+		}
+	case content["application/x-ndjson"] != nil && strings.HasPrefix(w.Header().Get("Content-Type"), "application/x-ndjson"):
+		schema := content["application/x-ndjson"].(specObject)["schema"].(specObject)
+		for scanner := bufio.NewScanner(w.Body); scanner.Scan(); {
+			var value interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &value); err != nil {
+				problems = append(problems, err.Error())
+			}
+			problems = append(problems, checkSchema(c.spec, schema, value, "line")...)
+		}
+	case content["application/json"] != nil:
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			problems = append(problems, "the body is not JSON: "+string(body))
+			break
+		}
+		problems = checkSchema(c.spec, content["application/json"].(specObject)["schema"].(specObject), value, "body")
+	case content["text/plain"] != nil:
+		schema := content["text/plain"].(specObject)["schema"].(specObject)
+		problems = checkSchema(c.spec, schema, strings.TrimSpace(string(body)), "body")
+	}
+	for _, problem := range problems {
+		c.t.Error(where, ": ", problem)
+	}
+	return w
+}
+
+func (c *specChecker) send(method string, target string, data url.Values, key string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	return c.check(method, target, formRequest(requireRole(routes()), method, target, data, "X-API-Key", key))
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	spec := loadSpec(t)
+	templates := map[string]bool{}
+	for _, template := range routeTemplates {
+		templates["/"+strings.Join(template, "/")] = true
+	}
+	for path := range spec["paths"].(specObject) {
+		if !templates[path] {
+			t.Error(path, " is in the spec but not in routeTemplates")
+		}
+	}
+	for template := range templates {
+		if _, ok := spec["paths"].(specObject)[template]; !ok {
+			t.Error(template, " is served but not in the spec")
+		}
+	}
+
+	// Every schema referred to has to be there
+	data, _ := json.Marshal(spec)
+	for _, ref := range regexp.MustCompile(`"#/components/(\w+)/(\w+)"`).FindAllStringSubmatch(string(data), -1) {
+		if _, ok := spec["components"].(specObject)[ref[1]].(specObject)[ref[2]]; !ok {
+			t.Error(ref[0], " is referred to but not defined")
+		}
+	}
+}
+
+/*
+Tries every operation in the spec, and some of the ways they fail, and checks that what comes back is what the spec
+says it will be.
+*/
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	withWebhooks(t)
+	withAuditLog(t)
+	readGenres("genres.csv")
+	t.Cleanup(func() { readGenres("genres.csv") })
+	readFromFile("books.csv")
+	webhooks.maxAttempts = 1
+	c := &specChecker{t: t, spec: loadSpec(t), covered: map[string]bool{}}
+	const librarian, patron = "librarian-key", "patron-key"
+
+	c.send("GET", "/", nil, "")
+	c.send("GET", "/books", nil, "")
+	c.send("GET", "/books?status=nope", nil, "")
+	c.send("POST", "/new", url.Values{"title": {"Spec Book"}, "author": {"Spec"}, "publisher": {"Spec"}, "publishdate": {"01022003"},
+		"rating": {"2"}, "ischeckedin": {"true"}, "tag": {"spec"}, "genre": {"Fiction > Fantasy"}, "callnumber": {"813.52"}}, librarian)
+	c.send("POST", "/new", url.Values{"author": {"Nobody"}}, librarian)
+	c.send("POST", "/new", nil, patron)
+	c.send("POST", "/new", nil, "")
+	c.send("GET", "/books/Spec-Book", nil, "")
+	c.send("GET", "/books/Spec-Book?asOf=yesterday", nil, "")
+	c.send("GET", "/books/no-such-book", nil, "")
+	c.send("PATCH", "/books/Spec-Book", url.Values{"author": {"Someone Else"}}, librarian)
+	c.send("PATCH", "/books/Spec-Book", url.Values{"status": {"nope"}}, librarian)
+	c.send("PATCH", "/books/Book-2", url.Values{"status": {"withdrawn"}}, librarian)
+
+	c.send("POST", "/books/Book-1/checkout", nil, patron)
+	c.send("POST", "/books/Book-1/checkin", nil, patron)
+	c.send("POST", "/books/no-such-book/checkin", nil, patron)
+	c.send("GET", "/books/Book-1/ratings", nil, "")
+	c.send("POST", "/books/Book-1/ratings", url.Values{"rating": {"3"}}, patron)
+	c.send("POST", "/books/Book-1/ratings", url.Values{"rating": {"2"}}, patron)
+	c.send("POST", "/books/Book-1/ratings", url.Values{"rating": {"9"}}, patron)
+
+	c.send("POST", "/books/Book-1/reviews", url.Values{"text": {"Good"}}, patron)
+	c.send("GET", "/books/Book-1/reviews", nil, "")
+	c.send("GET", "/books/Book-1/reviews?state=pending", nil, librarian)
+	c.send("GET", "/books/Book-1/reviews?sort=best", nil, "")
+	c.send("GET", "/books/Book-1/reviews/1", nil, "")
+	c.send("GET", "/books/Book-1/reviews/9", nil, "")
+	c.send("PATCH", "/books/Book-1/reviews/1", url.Values{"text": {"Very good"}}, patron)
+	c.send("PATCH", "/books/Book-1/reviews/1", url.Values{"text": {"Mine now"}}, librarian)
+	c.send("POST", "/books/Book-1/reviews/1/moderate", url.Values{"state": {"published"}}, librarian)
+	c.send("POST", "/books/Book-1/reviews/1/helpful", nil, patron)
+	c.send("POST", "/books/Book-1/reviews/1/helpful", nil, patron)
+	c.send("DELETE", "/books/Book-1/reviews/1", nil, patron)
+
+	c.send("GET", "/books/Spec-Book/revisions", nil, "")
+	c.send("GET", "/books/Spec-Book/revisions/diff", nil, "")
+	c.send("GET", "/books/Spec-Book/revisions/1", nil, "")
+	c.send("GET", "/books/Spec-Book/revisions/99", nil, "")
+	c.send("POST", "/books/Spec-Book/revert", url.Values{"revision": {"1"}}, librarian)
+	c.send("POST", "/books/Spec-Book/revert", url.Values{"revision": {"99"}}, librarian)
+
+	c.send("GET", "/genres", nil, "")
+	c.send("POST", "/genres", url.Values{"path": {"Fiction > Spec"}}, librarian)
+	c.send("POST", "/genres", url.Values{"path": {"Fiction > Spec"}}, librarian)
+	c.send("POST", "/genres/rename", url.Values{"from": {"Fiction > Spec"}, "to": {"Fiction > Specs"}}, librarian)
+	c.send("POST", "/genres/merge", url.Values{"from": {"Fiction > Specs"}, "into": {"Fiction > Fantasy"}}, librarian)
+	c.send("POST", "/genres/merge", url.Values{"from": {"Fiction > Specs"}, "into": {"Fiction > Fantasy"}}, librarian)
+	c.send("GET", "/shelf?from=800", nil, "")
+	c.send("GET", "/shelf?count=0", nil, "")
+
+	c.send("GET", "/auth/token", nil, patron)
+	var token struct{ Token string }
+	json.Unmarshal(c.send("POST", "/auth/token", nil, patron).Body.Bytes(), &token)
+	c.check("DELETE", "/auth/token", formRequest(requireRole(routes()), "DELETE", "/auth/token", nil, "Authorization", "Bearer "+token.Token))
+	c.send("DELETE", "/auth/token", nil, patron)
+
+	c.send("GET", "/admin/audit?book=Spec-Book", nil, librarian)
+	c.send("GET", "/admin/audit?format=jsonl", nil, librarian)
+	c.send("GET", "/admin/audit?bookid=one", nil, librarian)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	var hook Webhook
+	json.Unmarshal(c.send("POST", "/admin/webhooks", url.Values{"url": {failing.URL}, "events": {"book.updated"}}, librarian).Body.Bytes(), &hook)
+	c.send("POST", "/admin/webhooks", url.Values{"url": {"ftp://example.com"}}, librarian)
+	c.send("GET", "/admin/webhooks", nil, librarian)
+	c.send("GET", "/admin/webhooks/"+hook.ID, nil, librarian)
+	c.send("POST", "/admin/webhooks/"+hook.ID+"/ping", nil, librarian)
+	var letters []Delivery
+	for deadline := time.Now().Add(5 * time.Second); len(letters) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("The ping never failed")
+		}
+		json.Unmarshal(c.send("GET", "/admin/webhooks/deadletters", nil, librarian).Body.Bytes(), &letters)
+	}
+	c.send("GET", "/admin/webhooks/"+hook.ID+"/deliveries", nil, librarian)
+	c.send("POST", "/admin/webhooks/deadletters/"+letters[0].ID, nil, librarian)
+	c.send("POST", "/admin/webhooks/deadletters/no-such-letter", nil, librarian)
+	c.send("DELETE", "/admin/webhooks/"+hook.ID, nil, librarian)
+	c.send("GET", "/admin/webhooks/"+hook.ID, nil, librarian)
+
+	c.send("DELETE", "/books/Spec-Book", nil, librarian)
+	c.send("GET", "/trash", nil, librarian)
+	c.send("POST", "/trash/Spec-Book/restore", nil, librarian)
+	c.send("DELETE", "/books/Spec-Book", nil, librarian)
+	c.send("DELETE", "/trash/Spec-Book", nil, librarian)
+	c.send("DELETE", "/trash/Spec-Book", nil, librarian)
+	c.send("DELETE", "/books/Spec-Book", nil, librarian)
+
+	c.send("GET", "/changes?since=1&limit=5", nil, "")
+	c.send("GET", "/changes?since=-1", nil, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest("GET", "/events?type=book.created", nil).WithContext(ctx))
+	c.check("GET", "/events", w)
+	c.send("GET", "/events?lastEventId=last", nil, "")
+
+	for _, path := range []string{"/metrics", "/healthz", "/readyz", "/openapi.json", "/docs"} {
+		c.send("GET", path, nil, "")
+	}
+
+	var missed []string
+	for path, methods := range c.spec["paths"].(specObject) {
+		for method := range methods.(specObject) {
+			if operation := strings.ToUpper(method) + " " + path; !c.covered[operation] {
+				missed = append(missed, operation)
+			}
+		}
+	}
+	sort.Strings(missed)
+	if len(missed) > 0 {
+		t.Error("These operations weren't tried: ", missed)
+	}
+}
+
+func TestDocsPage(t *testing.T) {
+	w := httptest.NewRecorder()
+	routes().ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") || !strings.Contains(w.Body.String(), "openapi.json") {
+		t.Error("Expected the docs page. Recieved ", w.Code, " ", w.Header().Get("Content-Type"))
+	}
+}
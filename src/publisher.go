@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Publishes catalog changes somewhere outside the server, like a message broker. Publish should only return nil once
+the change has really been handed over, as the outbox tries it again until it does.
+*/
+type EventPublisher interface {
+	Publish(ctx context.Context, change Change) error
+	Close() error
+}
+
+/*
+Writes each change as a line of JSON. Used for both files and stdout.
+*/
+type jsonlPublisher struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func newFilePublisher(path string) (*jsonlPublisher, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlPublisher{w: f}, nil
+}
+
+func (p *jsonlPublisher) Publish(ctx context.Context, change Change) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, err := p.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if f, ok := p.w.(*os.File); ok && f != os.Stdout {
+		return f.Sync()
+	}
+	return nil
+}
+
+func (p *jsonlPublisher) Close() error {
+	if f, ok := p.w.(*os.File); ok && f != os.Stdout {
+		return f.Close()
+	}
+	return nil
+}
+
+/*
+Publishes to NATS on subject.<event type>, like library.book.checkout. The Nats-Msg-Id header is the change's
+sequence number, so JetStream can drop the duplicates that at-least-once delivery can cause.
+*/
+type natsPublisher struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func newNATSPublisher(url string, subject string) (*natsPublisher, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("books"),
+		nats.RetryOnFailedConnect(true), // The broker being down when the server starts is fine, the outbox waits for it
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(time.Second),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, change Change) error {
+	// While reconnecting the client buffers messages and says they were sent, which isn't good enough for the outbox
+	if !p.conn.IsConnected() {
+		return errors.New("not connected to NATS")
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	msg := nats.NewMsg(p.subject + "." + eventType(change))
+	msg.Header.Set(nats.MsgIdHdr, strconv.FormatInt(change.Seq, 10))
+	msg.Data = data
+	if err := p.conn.PublishMsg(msg); err != nil {
+		return err
+	}
+	// Only returns once the server has the message. It needs a deadline, and the outbox's context doesn't have one
+	flushing, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return p.conn.FlushWithContext(flushing)
+}
+
+func (p *natsPublisher) Close() error {
+	return p.conn.Drain()
+}
+
+/*
+Reads a publisher from -publish: stdout, file:<path>, or a nats:// URL.
+*/
+func parsePublisher(value string, subject string) (name string, publisher EventPublisher, err error) {
+	switch {
+	case value == "stdout":
+		return "stdout", &jsonlPublisher{w: os.Stdout}, nil
+	case strings.HasPrefix(value, "file:"):
+		publisher, err := newFilePublisher(strings.TrimPrefix(value, "file:"))
+		return "file", publisher, err
+	case strings.HasPrefix(value, "nats://") || strings.HasPrefix(value, "tls://"):
+		publisher, err := newNATSPublisher(value, subject)
+		return "nats", publisher, err
+	}
+	return "", nil, fmt.Errorf("unknown publisher %q, use stdout, file:<path> or a nats:// URL", value)
+}
+
+/*
+Makes sure every change gets to a publisher at least once. Changes are already written to the change feed while the
+mutex is held, so the feed is the outbox, and all that is kept here is how far through it the publisher has got.
+That is saved to a file after every change, so after a crash or restart publishing carries on where it left off,
+and while the publisher is failing the same change is tried again with a growing backoff.
+The feed only keeps the last -changes-retain changes though, 10000 by default, so if more changes than that are made
+while the publisher is failing the oldest are gone before they are published. Those are logged as an error and
+counted in books_outbox_changes_dropped_total, and publishing carries on after the latest change.
+*/
+type outbox struct {
+	publisher  EventPublisher
+	cursorPath string
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	published atomic.Int64 // The last change published
+	stopped   atomic.Bool  // Set once run has returned, after which nothing more is published
+}
+
+func newOutbox(publisher EventPublisher, cursorPath string) *outbox {
+	return &outbox{publisher: publisher, cursorPath: cursorPath, backoff: 100 * time.Millisecond, maxBackoff: 30 * time.Second}
+}
+
+/*
+The sequence number of the last change published. Without a saved cursor it starts from the latest change, so the
+whole feed isn't published the first time a publisher is turned on.
+*/
+func (o *outbox) cursor() (int64, error) {
+	data, err := os.ReadFile(o.cursorPath)
+	if os.IsNotExist(err) {
+		return feed.latest(), o.save(feed.latest())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (o *outbox) save(seq int64) error {
+	return persist(context.Background(), "outbox", func() error {
+		temp := o.cursorPath + ".tmp"
+		if err := os.WriteFile(temp, []byte(strconv.FormatInt(seq, 10)+"\n"), 0640); err != nil {
+			return err
+		}
+		return os.Rename(temp, o.cursorPath)
+	})
+}
+
+/*
+Publishes changes until ctx is done.
+*/
+func (o *outbox) run(ctx context.Context) error {
+	defer o.stopped.Store(true)
+	last, err := o.cursor()
+	if err != nil {
+		return err
+	}
+	o.published.Store(last)
+	wait := o.backoff
+	for {
+		changes, latest, waiting, ok := feed.since(last, 100)
+		if !ok {
+			if last > latest {
+				// The feed's file was lost or replaced and its sequence started again, so none of it has been published
+				slog.Warn("The outbox is ahead of the change feed, publishing the feed from the start", "after", last, "latest", latest)
+				last = 0
+			} else {
+				slog.Error("Changes were dropped from the change feed before they were published", "after", last, "carrying_on_from", latest)
+				changesDropped.Add(float64(latest - last))
+				last = latest
+			}
+			o.save(last)
+			o.published.Store(last)
+			continue
+		}
+
+		for _, change := range changes {
+			if err := o.publisher.Publish(ctx, change); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				slog.Warn("Publishing a change failed", "seq", change.Seq, "retry_in", wait.String(), "err", err)
+				break
+			}
+			wait = o.backoff
+			last = change.Seq
+			o.published.Store(last)
+			if err := o.save(last); err != nil {
+				slog.Error("Could not save the outbox cursor", "err", err)
+			}
+		}
+
+		if len(changes) > 0 && last == changes[len(changes)-1].Seq {
+			continue // All published, there may be more
+		}
+		if len(changes) > 0 {
+			// Publishing failed, so back off instead of waiting for the next change
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil
+			}
+			if wait *= 2; wait > o.maxBackoff {
+				wait = o.maxBackoff
+			}
+			continue
+		}
+		select {
+		case <-waiting:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+/*
+How many changes in the feed haven't been published yet.
+*/
+func (o *outbox) backlog() int64 {
+	return max(feed.latest()-o.published.Load(), 0)
+}
+
+/*
+Used when shutting down. Waits until everything in the feed has been published, while run keeps publishing.
+*/
+func (o *outbox) flush(ctx context.Context) error {
+	for o.published.Load() < feed.latest() {
+		if o.stopped.Load() {
+			return fmt.Errorf("the outbox has stopped with %v changes not published", feed.latest()-o.published.Load())
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("%v changes had not been published", feed.latest()-o.published.Load())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+/*
+A publisher that fails the first failures times it is called and then remembers what it was given.
+*/
+type testPublisher struct {
+	mutex     sync.Mutex
+	failures  int
+	published []Change
+	notify    chan struct{}
+}
+
+func newTestPublisher(failures int) *testPublisher {
+	return &testPublisher{failures: failures, notify: make(chan struct{}, 100)}
+}
+
+func (p *testPublisher) Publish(ctx context.Context, change Change) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker down")
+	}
+	p.published = append(p.published, change)
+	p.notify <- struct{}{}
+	return nil
+}
+
+func (p *testPublisher) Close() error { return nil }
+
+func (p *testPublisher) waitFor(t *testing.T, count int) []Change {
+	for {
+		p.mutex.Lock()
+		published := append([]Change(nil), p.published...)
+		p.mutex.Unlock()
+		if len(published) >= count {
+			return published
+		}
+		select {
+		case <-p.notify:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected ", count, " changes to be published. Recieved ", len(published))
+		}
+	}
+}
+
+/*
+Runs an outbox until the test ends, or until the returned function is called.
+*/
+func runOutbox(t *testing.T, publisher EventPublisher, cursorPath string) (stop func()) {
+	o := newOutbox(publisher, cursorPath)
+	o.backoff = 5 * time.Millisecond
+	if _, err := o.cursor(); err != nil { // Sets the cursor before the test changes anything
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		if err := o.run(ctx); err != nil {
+			t.Error(err)
+		}
+		close(done)
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func TestOutboxRetries(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	cursorPath := filepath.Join(t.TempDir(), "outbox.seq")
+	publisher := newTestPublisher(3)
+	runOutbox(t, publisher, cursorPath)
+
+	changeBook(0, "checkout", func(b *Book) { b.setStatus(StatusCheckedOut) })
+	published := publisher.waitFor(t, 1)
+	if len(published) != 1 || published[0].Seq != 1 || published[0].Op != "checkout" {
+		t.Error("Expected the checkout to be published once. Recieved ", published)
+	}
+}
+
+func TestOutboxCarriesOnAfterRestart(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	cursorPath := filepath.Join(t.TempDir(), "outbox.seq")
+
+	first := newTestPublisher(0)
+	stop := runOutbox(t, first, cursorPath)
+	changeBook(0, "update", func(b *Book) { b.Publisher = "One" })
+	first.waitFor(t, 1)
+	stop()
+
+	// Changes made while nothing is publishing are published when it starts again
+	changeBook(0, "update", func(b *Book) { b.Publisher = "Two" })
+	changeBook(1, "update", func(b *Book) { b.Publisher = "Three" })
+	second := newTestPublisher(0)
+	runOutbox(t, second, cursorPath)
+	published := second.waitFor(t, 2)
+	if len(published) != 2 || published[0].Seq != 2 || published[1].Seq != 3 {
+		t.Error("Expected changes 2 and 3. Recieved ", published)
+	}
+	if data, _ := os.ReadFile(cursorPath); strings.TrimSpace(string(data)) != "3" {
+		t.Error("Expected the cursor to be saved at 3. Recieved ", string(data))
+	}
+}
+
+/*
+A cursor the feed doesn't have changes after any more is moved on to the latest change, counting what was skipped as
+dropped, and one ahead of the feed, left from before the feed started again, goes back to its start.
+*/
+func TestOutboxCursorOutOfStep(t *testing.T) {
+	withChangeFeed(t, 2)
+	readFromFile("books.csv")
+	for _, publisher := range []string{"One", "Two", "Three"} {
+		changeBook(0, "update", func(b *Book) { b.Publisher = publisher })
+	}
+
+	cursorPath := filepath.Join(t.TempDir(), "outbox.seq")
+	os.WriteFile(cursorPath, []byte("0\n"), 0640)
+	dropped := testutil.ToFloat64(changesDropped)
+	behind := newTestPublisher(0)
+	stop := runOutbox(t, behind, cursorPath)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if data, _ := os.ReadFile(cursorPath); strings.TrimSpace(string(data)) == "3" {
+			break
+		}
+	}
+	if count := testutil.ToFloat64(changesDropped) - dropped; count != 3 {
+		t.Error("Expected 3 changes counted as dropped. Recieved ", count)
+	}
+	changeBook(0, "update", func(b *Book) { b.Publisher = "Four" })
+	if published := behind.waitFor(t, 1); len(published) != 1 || published[0].Seq != 4 {
+		t.Error("Expected only change 4. Recieved ", published)
+	}
+	stop()
+
+	withChangeFeed(t, 100)
+	changeBook(0, "update", func(b *Book) { b.Publisher = "Five" })
+	changeBook(1, "update", func(b *Book) { b.Publisher = "Six" })
+	ahead := newTestPublisher(0)
+	runOutbox(t, ahead, cursorPath)
+	if published := ahead.waitFor(t, 2); len(published) != 2 || published[0].Seq != 1 || published[1].Book.Publisher != "Six" {
+		t.Error("Expected the new feed from the start. Recieved ", published)
+	}
+}
+
+func TestFilePublisher(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	publisher, err := newFilePublisher(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	for seq := int64(1); seq <= 2; seq++ {
+		if err := publisher.Publish(context.Background(), Change{Seq: seq, Type: "updated"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, _ := os.Open(path)
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		var change Change
+		if err := json.Unmarshal(scanner.Bytes(), &change); err != nil || change.Seq != int64(lines+1) {
+			t.Error("Line ", lines, " incorrect: ", scanner.Text())
+		}
+	}
+	if lines != 2 {
+		t.Error("Expected 2 lines. Recieved ", lines)
+	}
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+/*
+Starts a NATS server on port for the test.
+Messages published to it under library.> are sent on the channel it returns.
+*/
+func startNATS(t *testing.T, port int) <-chan *nats.Msg {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = port
+	server := natsserver.RunServer(&opts)
+	t.Cleanup(server.Shutdown)
+	conn, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	published := make(chan *nats.Msg, 100)
+	if _, err := conn.ChanSubscribe("library.>", published); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return published
+}
+
+/*
+The broker is down when the change is made, and the change is published once it comes up.
+*/
+func TestNATSPublisher(t *testing.T) {
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	port := freePort(t)
+	url := "nats://127.0.0.1:" + strconv.Itoa(port)
+
+	publisher, err := newNATSPublisher(url, "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	if err := publisher.Publish(context.Background(), Change{Seq: 1}); err == nil {
+		t.Fatal("Expected publishing to fail while the broker is down")
+	}
+	cursorPath := filepath.Join(t.TempDir(), "outbox.seq")
+	runOutbox(t, publisher, cursorPath)
+	changeBook(0, "checkout", func(b *Book) { b.setStatus(StatusCheckedOut) })
+
+	var msg *nats.Msg
+	published := startNATS(t, port)
+	select {
+	case msg = <-published:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Nothing was published")
+	}
+	var change Change
+	json.Unmarshal(msg.Data, &change)
+	if msg.Subject != "library.book.checkout" || msg.Header.Get(nats.MsgIdHdr) != "1" || change.Book.Status != StatusCheckedOut {
+		t.Error("Message incorrect. Recieved ", msg.Subject, " ", msg.Header, " ", string(msg.Data))
+	}
+	// The outbox only moves on once the server has said it got the message
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if data, _ := os.ReadFile(cursorPath); strings.TrimSpace(string(data)) == "1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the outbox to see the change was published")
+		}
+	}
+}
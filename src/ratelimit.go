@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A token bucket limit. Rate tokens are added every second up to Burst, and every request takes one.
+*/
+type rateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+/*
+Reads and writes are limited separately, so a script spamming /new doesn't stop the same client from reading.
+*/
+type roleLimits struct {
+	Read  rateLimit
+	Write rateLimit
+}
+
+var defaultRateLimits = map[Role]roleLimits{
+	RoleAnonymous: {Read: rateLimit{Rate: 10, Burst: 20}, Write: rateLimit{Rate: 1, Burst: 5}},
+	RolePatron:    {Read: rateLimit{Rate: 20, Burst: 40}, Write: rateLimit{Rate: 2, Burst: 10}},
+	RoleLibrarian: {Read: rateLimit{Rate: 50, Burst: 100}, Write: rateLimit{Rate: 10, Burst: 20}},
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+/*
+Rate limits clients by who they are authenticated as, or by their IP address when they are anonymous. When the
+request comes through a trusted proxy the client's address is taken from X-Forwarded-For instead.
+It has its own mutex, so a flood of requests is turned away before it ever gets to the catalog's mutex.
+*/
+type rateLimiter struct {
+	limits         map[Role]roleLimits
+	trustedProxies []*net.IPNet
+	now            func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(limits map[Role]roleLimits, trustedProxies []*net.IPNet) *rateLimiter {
+	return &rateLimiter{limits: limits, trustedProxies: trustedProxies, now: time.Now, buckets: map[string]*tokenBucket{}}
+}
+
+/*
+Takes a token from the bucket for key. It returns whether the request is allowed, the tokens left, how long until the
+bucket is full again, and, when it isn't allowed, how long until it would be.
+*/
+func (l *rateLimiter) take(key string, limit rateLimit) (allowed bool, remaining int, reset time.Duration, retryAfter time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.last).Seconds()*limit.Rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		allowed = true
+	} else {
+		retryAfter = time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	}
+	reset = time.Duration((float64(limit.Burst) - bucket.tokens) / limit.Rate * float64(time.Second))
+	return allowed, int(bucket.tokens), reset, retryAfter
+}
+
+/*
+Drops buckets that haven't been used for long enough to have filled up again, as they'd be recreated full anyway.
+Must be called with the mutex held.
+*/
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	slowest := math.MaxFloat64
+	largest := 0
+	for _, limits := range l.limits {
+		for _, limit := range []rateLimit{limits.Read, limits.Write} {
+			slowest = math.Min(slowest, limit.Rate)
+			if limit.Burst > largest {
+				largest = limit.Burst
+			}
+		}
+	}
+	idle := time.Duration(float64(largest) / slowest * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+/*
+The proxies whose X-Forwarded-For header is believed, set with -trusted-proxies.
+*/
+var trustedProxies []*net.IPNet
+
+func isTrusted(ip net.IP, proxies []*net.IPNet) bool {
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+The client's IP address. X-Forwarded-For is only believed when the connection comes from a trusted proxy, and then
+the client is the last address in it that isn't another trusted proxy.
+*/
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrusted(ip, proxies) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrusted(hop, proxies) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+/*
+Middleware that answers 429 Too Many Requests once a client's bucket is empty. Every response carries the
+RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers so well behaved clients can slow down before that.
+It needs to run after authenticate so it knows the client's role.
+*/
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role := RoleAnonymous
+		client := "ip:" + clientIP(r, l.trustedProxies)
+		if principal := requestPrincipal(r); principal != nil {
+			role = principal.Role
+			client = "user:" + principal.Name
+		}
+
+		kind, limit := "read", l.limits[role].Read
+		if r.Method != "GET" && r.Method != "HEAD" {
+			kind, limit = "write", l.limits[role].Write
+		}
+
+		allowed, remaining, reset, retryAfter := l.take(kind+":"+client, limit)
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%v;w=%v", limit.Burst, int(math.Ceil(float64(limit.Burst)/limit.Rate))))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/*
+Reads rate limits like "anonymous.read=10/20,patron.write=2/10", each setting the rate per second and the burst for
+one role and kind of request. Anything not mentioned keeps its default.
+*/
+func parseRateLimits(value string) (map[Role]roleLimits, error) {
+	limits := map[Role]roleLimits{}
+	for role, limit := range defaultRateLimits {
+		limits[role] = limit
+	}
+
+	for _, setting := range strings.Split(value, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		var roleName, kind string
+		var rate float64
+		var burst int
+		name := strings.SplitN(setting, "=", 2)
+		parts := strings.SplitN(name[0], ".", 2)
+		if len(name) != 2 || len(parts) != 2 {
+			return nil, fmt.Errorf("rate limit %q should look like role.read=rate/burst", setting)
+		}
+		roleName, kind = parts[0], parts[1]
+		if _, err := fmt.Sscanf(name[1], "%g/%d", &rate, &burst); err != nil || rate <= 0 || burst < 1 {
+			return nil, fmt.Errorf("rate limit %q needs a positive rate and burst", setting)
+		}
+
+		role := Role(roleName)
+		limit, ok := limits[role]
+		if !ok {
+			return nil, fmt.Errorf("unknown role %q", roleName)
+		}
+		switch kind {
+		case "read":
+			limit.Read = rateLimit{Rate: rate, Burst: burst}
+		case "write":
+			limit.Write = rateLimit{Rate: rate, Burst: burst}
+		default:
+			return nil, fmt.Errorf("rate limit %q should be for read or write", setting)
+		}
+		limits[role] = limit
+	}
+	return limits, nil
+}
+
+/*
+Reads a comma separated list of proxy addresses or CIDR ranges.
+*/
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an address or CIDR range", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/*
+A limiter whose clock only moves when the test moves it.
+*/
+func newTestLimiter(t *testing.T, limits string, proxies string) (*rateLimiter, *time.Time) {
+	parsedLimits, err := parseRateLimits(limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedProxies, err := parseTrustedProxies(proxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000000, 0)
+	l := newRateLimiter(parsedLimits, parsedProxies)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func limitedRequest(handler http.Handler, method string, remoteAddr string, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/books", nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestRateLimitBurstAndRefill(t *testing.T) {
+	l, now := newTestLimiter(t, "anonymous.read=1/3", "")
+	handler := l.middleware(okHandler)
+
+	for i := 0; i < 3; i++ {
+		w := limitedRequest(handler, "GET", "192.0.2.1:1234", "")
+		if w.Code != http.StatusOK {
+			t.Fatal("Request ", i, " within the burst was limited")
+		}
+		if w.Header().Get("RateLimit-Remaining") != []string{"2", "1", "0"}[i] {
+			t.Error("Expected RateLimit-Remaining ", 2-i, ". Recieved ", w.Header().Get("RateLimit-Remaining"))
+		}
+	}
+
+	w := limitedRequest(handler, "GET", "192.0.2.1:1234", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatal("Expected Response code 429. Recieved ", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" || w.Header().Get("RateLimit-Limit") != "3" || w.Header().Get("RateLimit-Reset") != "3" {
+		t.Error("Rate limit headers are incorrect. Recieved ", w.Header())
+	}
+
+	// Another client has its own bucket
+	if w := limitedRequest(handler, "GET", "192.0.2.2:1234", ""); w.Code != http.StatusOK {
+		t.Error("A different client was limited")
+	}
+
+	*now = now.Add(time.Second)
+	if w := limitedRequest(handler, "GET", "192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Error("Bucket did not refill. Recieved ", w.Code)
+	}
+}
+
+func TestRateLimitReadsAndWritesSeparate(t *testing.T) {
+	l, _ := newTestLimiter(t, "anonymous.write=1/1", "")
+	handler := l.middleware(okHandler)
+
+	limitedRequest(handler, "POST", "192.0.2.1:1234", "")
+	if w := limitedRequest(handler, "POST", "192.0.2.1:1234", ""); w.Code != http.StatusTooManyRequests {
+		t.Error("Expected the second write to be limited. Recieved ", w.Code)
+	}
+	if w := limitedRequest(handler, "GET", "192.0.2.1:1234", ""); w.Code != http.StatusOK {
+		t.Error("Reads were limited by writes. Recieved ", w.Code)
+	}
+}
+
+func TestRateLimitTrustedProxies(t *testing.T) {
+	l, _ := newTestLimiter(t, "", "10.0.0.0/8")
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		client    string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"}, // Not a trusted proxy, so the header is ignored
+		{"10.0.0.5:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.0.0.5:1234", "203.0.113.9, 198.51.100.7, 10.0.0.4", "198.51.100.7"},
+		{"10.0.0.5:1234", "", "10.0.0.5"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/books", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if client := clientIP(req, l.trustedProxies); client != test.client {
+			t.Error("Expected client ", test.client, " for ", test.remote, " via ", test.forwarded, ". Recieved ", client)
+		}
+	}
+}
+
+/*
+Authenticated clients are limited by who they are and get their role's limits, wherever they connect from.
+*/
+func TestRateLimitByRole(t *testing.T) {
+	withTestKeys(t)
+	l, _ := newTestLimiter(t, "anonymous.read=1/1,librarian.read=1/5", "")
+	handler := authenticate(l.middleware(authorize(okHandler)))
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("GET", "/books", nil)
+		req.RemoteAddr = "192.0.2.10:1234"
+		req.Header.Set("X-API-Key", "librarian-key")
+		if i%2 == 1 {
+			req.RemoteAddr = "192.0.2.11:1234"
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatal("Librarian was limited on request ", i)
+		}
+	}
+	req := httptest.NewRequest("GET", "/books", nil)
+	req.Header.Set("X-API-Key", "librarian-key")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Error("Expected the librarian's sixth request to be limited. Recieved ", w.Code)
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("patron.write=0.5/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[RolePatron].Write != (rateLimit{Rate: 0.5, Burst: 3}) || limits[RolePatron].Read != defaultRateLimits[RolePatron].Read {
+		t.Error("Limits parsed incorrectly. Recieved ", limits[RolePatron])
+	}
+	for _, bad := range []string{"patron=1/2", "admin.read=1/2", "patron.delete=1/2", "patron.read=0/2", "patron.read=fast"} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Error("Expected an error for ", bad)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+/*
+Ratings go from 1 up to ratingScale. It defaults to the original 1 - 3 scale and can be changed with the -rating-scale flag.
+*/
+var ratingScale = 3
+
+/*
+The rating given when a book is created or patched, and the one read from the csv file, is stored under this key.
+It counts as one rating alongside the patrons' own.
+*/
+const catalogRater = ""
+
+/*
+Checks that the rating is a whole number on the configured scale.
+*/
+func parseRating(value string) (int, error) {
+	rating, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("rating not correct")
+	}
+	if rating < 1 || rating > ratingScale {
+		return 0, fmt.Errorf("rating not on 1-%v scale", ratingScale)
+	}
+	return rating, nil
+}
+
+/*
+Records one rater's rating, replacing any rating they gave before, and recalculates the summary fields.
+The map is copied first because patchBook works on a copy of the book and may still throw it away.
+*/
+func (b *Book) rate(rater string, rating int) {
+	ratings := make(map[string]int, len(b.Ratings)+1)
+	for k, v := range b.Ratings {
+		ratings[k] = v
+	}
+	ratings[rater] = rating
+	b.Ratings = ratings
+	b.summarizeRatings()
+}
+
+func (b *Book) summarizeRatings() {
+	b.RatingCount = len(b.Ratings)
+	b.RatingDistribution = make(map[int]int, ratingScale)
+	for i := 1; i <= ratingScale; i++ {
+		b.RatingDistribution[i] = 0
+	}
+	if b.RatingCount == 0 {
+		b.RatingAverage = 0
+		b.Rating = 0
+		return
+	}
+	total := 0
+	for _, rating := range b.Ratings {
+		total += rating
+		b.RatingDistribution[rating]++
+	}
+	b.RatingAverage = math.Round(float64(total)/float64(b.RatingCount)*100) / 100
+	b.Rating = int(math.Round(float64(total) / float64(b.RatingCount)))
+}
+
+/*
+Patrons rate books with POST /books/{id}/ratings. Each patron has one rating per book, so rating again replaces the old one.
+The patron is whoever the request is authenticated as, or the patron form value when authentication is off.
+GET returns the book's rating summary.
+*/
+func bookRatings(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+
+	case "GET":
+		mutex.LockContext(r.Context())
+		defer mutex.Unlock()
+		i := findBook(id)
+		if i < 0 {
+			http.Error(w, "404, not found.", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"average":      Books[i].RatingAverage,
+			"count":        Books[i].RatingCount,
+			"distribution": Books[i].RatingDistribution,
+		})
+
+	case "POST":
+		r.ParseForm()
+		patron := patronName(r)
+		if patron == catalogRater {
+			http.Error(w, "400, patron is required", http.StatusBadRequest)
+			return
+		}
+		rating, err := parseRating(r.FormValue("rating"))
+		if err != nil {
+			http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		mutex.LockContext(r.Context())
+		defer mutex.Unlock()
+		i := findBook(id)
+		if i < 0 {
+			http.Error(w, "404, not found.", http.StatusNotFound)
+			return
+		}
+		_, updated := Books[i].Ratings[patron]
+		before := Books[i]
+		Books[i].rate(patron, rating)
+		recordMutation(r, "rate", &before, &Books[i])
+		if !updated {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(Books[i])
+
+	default:
+		http.Error(w, "405 Method not allowed, only GET and POST are permited", http.StatusMethodNotAllowed)
+	}
+}
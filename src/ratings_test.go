@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/*
+The rating read from the csv counts as one rating, so the legacy field is unchanged for existing clients.
+*/
+func TestLegacyRatingJSON(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := httptest.NewRecorder()
+	returnSingleBook(w, httptest.NewRequest("GET", "/books/book-1", nil))
+	expectedBody := `{"title":"Book 1","author":"Author 1","publisher":"publisher","publishdate":"11111111","rating":1,"ischeckedin":true,"status":"available","ratingaverage":1,"ratingcount":1,"ratingdistribution":{"1":1,"2":0,"3":0},"reviewcount":0,"id":1}`
+	if bodyStr := strings.TrimSpace(w.Body.String()); bodyStr != expectedBody {
+		t.Error("The book was not returned correctly. Recieved \n", bodyStr, "\nexpected\n", expectedBody)
+	}
+}
+
+func TestPatronRatings(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/ratings", url.Values{"patron": {"alice"}, "rating": {"3"}})
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/ratings", url.Values{"patron": {"bob"}, "rating": {"3"}})
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+
+	// alice changes her mind, which replaces her rating instead of adding one
+	w = formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/ratings", url.Values{"patron": {"alice"}, "rating": {"2"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+
+	book := Books[0]
+	if book.RatingCount != 3 {
+		t.Error("Expected 3 ratings. Recieved ", book.RatingCount)
+	}
+	if book.RatingAverage != 2 || book.Rating != 2 {
+		t.Error("Expected an average of 2. Recieved ", book.RatingAverage, book.Rating)
+	}
+	if book.RatingDistribution[1] != 1 || book.RatingDistribution[2] != 1 || book.RatingDistribution[3] != 1 {
+		t.Error("Distribution is incorrect. Recieved ", book.RatingDistribution)
+	}
+
+	w = httptest.NewRecorder()
+	returnSingleBook(w, httptest.NewRequest("GET", "/books/book-1/ratings", nil))
+	var summary struct {
+		Average float64 `json:"average"`
+		Count   int     `json:"count"`
+	}
+	json.NewDecoder(w.Body).Decode(&summary)
+	if summary.Count != 3 || summary.Average != 2 {
+		t.Error("Summary is incorrect. Recieved ", summary)
+	}
+}
+
+func TestBadRatings(t *testing.T) {
+	readFromFile("books.csv")
+
+	for _, data := range []url.Values{
+		{"patron": {"alice"}, "rating": {"4"}},
+		{"patron": {"alice"}, "rating": {"0"}},
+		{"patron": {"alice"}, "rating": {"IShouldBeAnInt"}},
+		{"rating": {"2"}},
+	} {
+		w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/ratings", data)
+		if w.Code != http.StatusBadRequest {
+			t.Error("Expected Response code 400 for ", data, ". Recieved ", w.Code)
+		}
+	}
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/Great-Gatsby/ratings", url.Values{"patron": {"alice"}, "rating": {"2"}})
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected Response code 404. Recieved ", w.Code)
+	}
+}
+
+func TestRatingScale(t *testing.T) {
+	defer func(scale int) { ratingScale = scale }(ratingScale)
+	ratingScale = 5
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-2/ratings", url.Values{"patron": {"alice"}, "rating": {"5"}})
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+	if Books[1].Rating != 4 || len(Books[1].RatingDistribution) != 5 {
+		t.Error("Expected rounded average 4 on a 5 point scale. Recieved ", Books[1].Rating, Books[1].RatingDistribution)
+	}
+
+	// A failed patch must not leave the new rating behind
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"rating": {"1"}, "status": {"withdrawn"}})
+	if w.Code != http.StatusConflict {
+		t.Fatal("Expected Response code 409. Recieved ", w.Code)
+	}
+	if Books[1].Ratings[catalogRater] != 3 {
+		t.Error("Rejected patch changed the rating to ", Books[1].Ratings[catalogRater])
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+Reviews start out pending and are only shown to everyone once a librarian has published them.
+*/
+type ReviewState string
+
+const (
+	ReviewPending   ReviewState = "pending"
+	ReviewPublished ReviewState = "published"
+	ReviewRejected  ReviewState = "rejected"
+)
+
+/*
+A written review left by a patron. Reviews are stored with their book, so they go away when the book is deleted.
+*/
+type Review struct {
+	ID           int             `json:"id"` // Unique within the book
+	Patron       string          `json:"patron"`
+	Text         string          `json:"text"`
+	State        ReviewState     `json:"state"`
+	HelpfulVotes int             `json:"helpfulvotes"`
+	Created      time.Time       `json:"created"`
+	Updated      time.Time       `json:"updated"`
+	Voters       map[string]bool `json:"-"` // Patrons who voted this review helpful, so each can only vote once
+}
+
+const (
+	defaultReviewsPerPage = 10
+	maxReviewsPerPage     = 100
+)
+
+/*
+The most characters a review can have, set with -max-review-length.
+*/
+var maxReviewLength = 5000
+
+/*
+Returns the error to send back for review text, or "" if it is fine.
+*/
+func checkReviewText(text string) string {
+	if strings.TrimSpace(text) == "" {
+		return "400, review text is required"
+	}
+	if utf8.RuneCountInString(text) > maxReviewLength {
+		return fmt.Sprintf("400, review text is longer than %v characters", maxReviewLength)
+	}
+	return ""
+}
+
+/*
+Keeps the published review count in the book's JSON up to date.
+*/
+func (b *Book) countReviews() {
+	b.ReviewCount = 0
+	for _, review := range b.Reviews {
+		if review.State == ReviewPublished {
+			b.ReviewCount++
+		}
+	}
+}
+
+func (b *Book) findReview(reviewID int) int {
+	for i, review := range b.Reviews {
+		if review.ID == reviewID {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Handles everything under /books/{id}/reviews. The path after "reviews" is either empty for the list of reviews,
+a review id, or a review id followed by the "moderate" or "helpful" actions. The patron is whoever the request is
+authenticated as, or the patron form value when authentication is off.
+
+	GET    /books/{id}/reviews                  list reviews, see listReviews
+	POST   /books/{id}/reviews                  patron, text: create a pending review
+	GET    /books/{id}/reviews/{rid}            a single review, only shown to its author and librarians until published
+	PATCH  /books/{id}/reviews/{rid}            patron, text: the author edits their review, which goes back to pending
+	DELETE /books/{id}/reviews/{rid}?patron=    the author or a librarian deletes the review
+	POST   /books/{id}/reviews/{rid}/moderate   state: librarians publish or reject a review
+	POST   /books/{id}/reviews/{rid}/helpful    patron: vote a review as helpful, once per patron
+*/
+func bookReviews(w http.ResponseWriter, r *http.Request, id string, rest string) {
+	if rest == "" {
+		switch r.Method {
+		case "GET":
+			listReviews(w, r, id)
+		case "POST":
+			createReview(w, r, id)
+		default:
+			http.Error(w, "405 Method not allowed, only GET and POST are permited", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	parts := strings.Split(rest, "/")
+	reviewID, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+
+	r.ParseForm()
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	j := Books[i].findReview(reviewID)
+	if j < 0 {
+		http.Error(w, "404, review not found.", http.StatusNotFound)
+		return
+	}
+	before := Books[i]
+	before.Reviews = append([]Review(nil), Books[i].Reviews...) // The review is changed in place below
+	review := &Books[i].Reviews[j]
+
+	if len(parts) == 2 {
+		if r.Method != "POST" {
+			http.Error(w, "405 Method not allowed, only POST is permited", http.StatusMethodNotAllowed)
+			return
+		}
+		switch parts[1] {
+		case "moderate":
+			state := ReviewState(r.FormValue("state"))
+			if state != ReviewPending && state != ReviewPublished && state != ReviewRejected {
+				http.Error(w, "400, state must be pending, published or rejected", http.StatusBadRequest)
+				return
+			}
+			review.State = state
+		case "helpful":
+			patron := patronName(r)
+			if patron == "" {
+				http.Error(w, "400, patron is required", http.StatusBadRequest)
+				return
+			}
+			if review.Voters[patron] {
+				http.Error(w, "409, patron already voted for this review", http.StatusConflict)
+				return
+			}
+			if review.Voters == nil {
+				review.Voters = make(map[string]bool)
+			}
+			review.Voters[patron] = true
+			review.HelpfulVotes++
+		default:
+			http.Error(w, "404, not found.", http.StatusNotFound)
+			return
+		}
+		Books[i].countReviews()
+		recordMutation(r, "review", &before, &Books[i])
+		json.NewEncoder(w).Encode(review)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if review.State != ReviewPublished && !actingFor(r, review.Patron) {
+			http.Error(w, "404, review not found.", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(review)
+
+	case "PATCH":
+		if patronName(r) != review.Patron {
+			http.Error(w, "403, only the author can edit a review", http.StatusForbidden)
+			return
+		}
+		if problem := checkReviewText(r.FormValue("text")); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		review.Text = r.FormValue("text")
+		review.State = ReviewPending // Edited reviews need to be moderated again
+		review.Updated = time.Now().UTC()
+		Books[i].countReviews()
+		recordMutation(r, "review", &before, &Books[i])
+		json.NewEncoder(w).Encode(review)
+
+	case "DELETE":
+		if !actingFor(r, review.Patron) {
+			http.Error(w, "403, only the author or a librarian can delete a review", http.StatusForbidden)
+			return
+		}
+		Books[i].Reviews = append(Books[i].Reviews[:j:j], Books[i].Reviews[j+1:]...)
+		Books[i].countReviews()
+		recordMutation(r, "review", &before, &Books[i])
+		fmt.Fprintf(w, "Review: %v deleted!", reviewID)
+
+	default:
+		http.Error(w, "405 Method not allowed, only PATCH, DELETE, and GET are permited", http.StatusMethodNotAllowed)
+	}
+}
+
+func createReview(w http.ResponseWriter, r *http.Request, id string) {
+	r.ParseForm()
+	patron := patronName(r)
+	if patron == "" {
+		http.Error(w, "400, patron is required", http.StatusBadRequest)
+		return
+	}
+	if problem := checkReviewText(r.FormValue("text")); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+
+	nextID := 1
+	for _, review := range Books[i].Reviews {
+		if review.ID >= nextID {
+			nextID = review.ID + 1
+		}
+	}
+	now := time.Now().UTC()
+	review := Review{ID: nextID, Patron: patron, Text: r.FormValue("text"), State: ReviewPending, Created: now, Updated: now}
+	before := Books[i]
+	Books[i].Reviews = append(Books[i].Reviews[:len(Books[i].Reviews):len(Books[i].Reviews)], review)
+	Books[i].countReviews()
+	recordMutation(r, "review", &before, &Books[i])
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(review)
+}
+
+/*
+Lists a book's reviews a page at a time with ?page= and ?perpage=. Only published reviews are listed unless another
+state is asked for with ?state=. ?sort= can be helpful (the default, most votes first), newest or oldest.
+*/
+func listReviews(w http.ResponseWriter, r *http.Request, id string) {
+	query := r.URL.Query()
+
+	state := ReviewPublished
+	if query.Get("state") != "" {
+		state = ReviewState(query.Get("state"))
+		if state != ReviewPending && state != ReviewPublished && state != ReviewRejected {
+			http.Error(w, "400, state must be pending, published or rejected", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page := 1
+	if query.Get("page") != "" {
+		var err error
+		page, err = strconv.Atoi(query.Get("page"))
+		if err != nil || page < 1 {
+			http.Error(w, "400, page must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	perPage := defaultReviewsPerPage
+	if query.Get("perpage") != "" {
+		var err error
+		perPage, err = strconv.Atoi(query.Get("perpage"))
+		if err != nil || perPage < 1 || perPage > maxReviewsPerPage {
+			http.Error(w, "400, perpage must be between 1 and "+strconv.Itoa(maxReviewsPerPage), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var less func(a, b Review) bool
+	switch query.Get("sort") {
+	case "", "helpful":
+		less = func(a, b Review) bool {
+			if a.HelpfulVotes != b.HelpfulVotes {
+				return a.HelpfulVotes > b.HelpfulVotes
+			}
+			return a.Created.After(b.Created)
+		}
+	case "newest":
+		less = func(a, b Review) bool { return a.Created.After(b.Created) }
+	case "oldest":
+		less = func(a, b Review) bool { return a.Created.Before(b.Created) }
+	default:
+		http.Error(w, "400, sort must be helpful, newest or oldest", http.StatusBadRequest)
+		return
+	}
+
+	mutex.LockContext(r.Context())
+	i := findBook(id)
+	if i < 0 {
+		mutex.Unlock()
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	reviews := []Review{}
+	for _, review := range Books[i].Reviews {
+		if review.State == state {
+			reviews = append(reviews, review)
+		}
+	}
+	mutex.Unlock()
+
+	sort.SliceStable(reviews, func(a, b int) bool { return less(reviews[a], reviews[b]) })
+
+	total := len(reviews)
+	start := total // Pages past the last are empty, worked out without multiplying so a huge page can't overflow
+	if page-1 <= total/perPage {
+		start = min((page-1)*perPage, total)
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"reviews": reviews[start:end],
+		"page":    page,
+		"perpage": perPage,
+		"total":   total,
+	})
+}
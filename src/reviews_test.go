@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+type reviewPage struct {
+	Reviews []Review `json:"reviews"`
+	Total   int      `json:"total"`
+}
+
+func listBookReviews(t *testing.T, path string) reviewPage {
+	w := formRequest(http.HandlerFunc(returnSingleBook), "GET", path, nil)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	var page reviewPage
+	if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	return page
+}
+
+func TestReviewModeration(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews", url.Values{"patron": {"alice"}, "text": {"Loved it"}})
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+	if history := revisions[1]; history[len(history)-1].Op != "review" {
+		t.Error("Expected the new review in the book's history. Recieved ", history)
+	}
+
+	// Pending reviews aren't listed or counted
+	if page := listBookReviews(t, "/books/book-1/reviews"); page.Total != 0 {
+		t.Error("Pending review was listed. Recieved ", page.Reviews)
+	}
+	if page := listBookReviews(t, "/books/book-1/reviews?state=pending"); page.Total != 1 {
+		t.Error("Expected one pending review. Recieved ", page.Reviews)
+	}
+	if Books[0].ReviewCount != 0 {
+		t.Error("Expected reviewcount 0. Recieved ", Books[0].ReviewCount)
+	}
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews/1/moderate", url.Values{"state": {"published"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if page := listBookReviews(t, "/books/book-1/reviews"); page.Total != 1 || page.Reviews[0].Text != "Loved it" {
+		t.Error("Published review was not listed. Recieved ", page.Reviews)
+	}
+	if Books[0].ReviewCount != 1 {
+		t.Error("Expected reviewcount 1. Recieved ", Books[0].ReviewCount)
+	}
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews/1/moderate", url.Values{"state": {"great"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+
+	// Editing sends the review back for moderation
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1/reviews/1", url.Values{"patron": {"alice"}, "text": {"Loved it, twice"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if Books[0].Reviews[0].State != ReviewPending || Books[0].ReviewCount != 0 {
+		t.Error("Edited review should be pending. Recieved ", Books[0].Reviews[0].State)
+	}
+}
+
+func TestReviewAuthorOnly(t *testing.T) {
+	readFromFile("books.csv")
+
+	formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews", url.Values{"patron": {"alice"}, "text": {"Loved it"}})
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1/reviews/1", url.Values{"patron": {"bob"}, "text": {"Hated it"}})
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected Response code 403. Recieved ", w.Code)
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "DELETE", "/books/book-1/reviews/1?patron=bob", nil)
+	if w.Code != http.StatusForbidden {
+		t.Error("Expected Response code 403. Recieved ", w.Code)
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "DELETE", "/books/book-1/reviews/1?patron=alice", nil)
+	if w.Code != http.StatusOK {
+		t.Error("Expected Response code 200. Recieved ", w.Code)
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "GET", "/books/book-1/reviews/1", nil)
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected Response code 404. Recieved ", w.Code)
+	}
+}
+
+/*
+A review that isn't published is only shown to its author and librarians, whatever state it is in.
+*/
+func TestUnpublishedReviewHidden(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+
+	w := formRequest(requireRole(routes()), "POST", "/books/book-1/reviews", url.Values{"text": {"Loved it"}}, "X-API-Key", "patron-key")
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+	for _, state := range []ReviewState{ReviewPending, ReviewRejected, ReviewPublished} {
+		if state != ReviewPending {
+			formRequest(requireRole(routes()), "POST", "/books/book-1/reviews/1/moderate", url.Values{"state": {string(state)}}, "X-API-Key", "librarian-key")
+		}
+		anonymous := http.StatusNotFound
+		if state == ReviewPublished {
+			anonymous = http.StatusOK
+		}
+		for key, code := range map[string]int{"": anonymous, "patron-key": http.StatusOK, "librarian-key": http.StatusOK} {
+			if w := formRequest(requireRole(routes()), "GET", "/books/book-1/reviews/1", nil, "X-API-Key", key); w.Code != code {
+				t.Error(state, " review with key ", key, ": expected Response code ", code, ". Recieved ", w.Code)
+			}
+		}
+	}
+}
+
+func TestReviewLength(t *testing.T) {
+	readFromFile("books.csv")
+	defer func(length int) { maxReviewLength = length }(maxReviewLength)
+	maxReviewLength = 10
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews", url.Values{"patron": {"alice"}, "text": {"Far too long to fit"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews", url.Values{"patron": {"alice"}, "text": {"Très bien"}})
+	if w.Code != http.StatusCreated {
+		t.Error("Expected Response code 201. Recieved ", w.Code, w.Body.String())
+	}
+}
+
+func TestReviewPagingAndHelpful(t *testing.T) {
+	readFromFile("books.csv")
+
+	for i, patron := range []string{"alice", "bob", "carol"} {
+		formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews", url.Values{"patron": {patron}, "text": {"Review by " + patron}})
+		formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews/"+strconv.Itoa(i+1)+"/moderate", url.Values{"state": {"published"}})
+	}
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews/2/helpful", url.Values{"patron": {"dave"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews/2/helpful", url.Values{"patron": {"dave"}})
+	if w.Code != http.StatusConflict {
+		t.Error("Expected Response code 409 for a second vote. Recieved ", w.Code)
+	}
+
+	page := listBookReviews(t, "/books/book-1/reviews?perpage=2")
+	if page.Total != 3 || len(page.Reviews) != 2 || page.Reviews[0].Patron != "bob" {
+		t.Error("Expected bob's review first on a page of 2. Recieved ", page.Reviews)
+	}
+	page = listBookReviews(t, "/books/book-1/reviews?perpage=2&page=2&sort=oldest")
+	if len(page.Reviews) != 1 || page.Reviews[0].Patron != "carol" {
+		t.Error("Expected carol's review alone on page 2. Recieved ", page.Reviews)
+	}
+	page = listBookReviews(t, "/books/book-1/reviews?perpage=2&page=9223372036854775807")
+	if len(page.Reviews) != 0 || page.Total != 3 {
+		t.Error("Expected a page far past the end to be empty. Recieved ", page.Reviews)
+	}
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "GET", "/books/book-1/reviews?sort=random", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+}
+
+func TestReviewsDeletedWithBook(t *testing.T) {
+	readFromFile("books.csv")
+
+	formRequest(http.HandlerFunc(returnSingleBook), "POST", "/books/book-1/reviews", url.Values{"patron": {"alice"}, "text": {"Loved it"}})
+	w := formRequest(http.HandlerFunc(returnSingleBook), "DELETE", "/books/book-1", nil)
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code)
+	}
+	w = formRequest(http.HandlerFunc(returnSingleBook), "GET", "/books/book-1/reviews", nil)
+	if w.Code != http.StatusNotFound {
+		t.Error("Expected Response code 404. Recieved ", w.Code)
+	}
+	for _, book := range Books {
+		if len(book.Reviews) != 0 {
+			t.Error("Reviews left behind on ", book.Title)
+		}
+	}
+}
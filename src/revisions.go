@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+One version of a book. Every mutation that changes a book adds a revision, so a bad PATCH can always be undone.
+*/
+type Revision struct {
+	Number int       `json:"revision"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Op     string    `json:"op"`
+	Book   *Book     `json:"book"` // nil for the revision that deleted the book
+}
+
+/*
+Every book's revisions, oldest first, keyed by book ID. Guarded by the catalog's mutex like Books.
+They are kept after a book is deleted so its history can still be looked at.
+*/
+var revisions = map[int][]Revision{}
+
+/*
+The parts of a book a revision keeps. Ratings and reviews belong to patrons and have their own history, so they are
+left out rather than holding on to every version of them.
+*/
+func snapshot(book *Book) *Book {
+	if book == nil {
+		return nil
+	}
+	b := *book
+	b.Ratings = nil
+	b.Reviews = nil
+	return &b
+}
+
+/*
+Adds a revision for a mutation. Called from recordMutation, so it has the mutex.
+*/
+func recordRevision(m Mutation) {
+	book := m.After
+	if book == nil {
+		book = m.Before
+	}
+	history := revisions[book.ID]
+	revisions[book.ID] = append(history, Revision{Number: len(history) + 1, Time: m.Time, Actor: m.Actor, Op: m.Op, Book: snapshot(m.After)})
+}
+
+/*
+Starts a book's history with the version read in from the csv file.
+*/
+func importRevision(book *Book) {
+	revisions[book.ID] = []Revision{{Number: 1, Time: time.Now().UTC(), Actor: "catalog", Op: "import", Book: snapshot(book)}}
+}
+
+/*
+The revision a book was at, at the given time. ok is false if the book didn't exist yet or had been deleted.
+*/
+func revisionAt(id int, at time.Time) (Revision, bool) {
+	history := revisions[id]
+	for i := len(history) - 1; i >= 0; i-- {
+		if !history[i].Time.After(at) {
+			return history[i], history[i].Book != nil
+		}
+	}
+	return Revision{}, false
+}
+
+func findRevision(id int, number string) (Revision, bool) {
+	n, err := strconv.Atoi(number)
+	history := revisions[id]
+	if err != nil || n < 1 || n > len(history) {
+		return Revision{}, false
+	}
+	return history[n-1], true
+}
+
+/*
+GET /books/{id}?asOf=<timestamp> returns the book as it was at that time, given in RFC 3339.
+*/
+func bookAsOf(w http.ResponseWriter, r *http.Request, id string) {
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("asOf"))
+	if err != nil {
+		http.Error(w, "400, asOf must be an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	revision, ok := revisionAt(Books[i].ID, at)
+	if !ok {
+		http.Error(w, "404, the book did not exist at "+at.Format(time.RFC3339), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(revision.Book)
+}
+
+/*
+A book's revision history.
+
+	GET /books/{id}/revisions                     every revision, oldest first
+	GET /books/{id}/revisions/{n}                 one revision
+	GET /books/{id}/revisions/diff?from=&to=      the fields that changed between two revisions. to defaults to the
+	                                              latest revision and from to the one before to
+*/
+func bookRevisions(w http.ResponseWriter, r *http.Request, id string, rest string) {
+	if r.Method != "GET" {
+		http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	history := revisions[Books[i].ID]
+	if len(history) == 0 {
+		http.Error(w, "404, the book has no revisions", http.StatusNotFound)
+		return
+	}
+
+	switch rest {
+	case "":
+		json.NewEncoder(w).Encode(history)
+
+	case "diff":
+		query := r.URL.Query()
+		to, ok := history[len(history)-1], true
+		if query.Get("to") != "" {
+			to, ok = findRevision(Books[i].ID, query.Get("to"))
+		}
+		if !ok {
+			http.Error(w, "404, no such revision", http.StatusNotFound)
+			return
+		}
+		from := Revision{}
+		if query.Get("from") != "" {
+			from, ok = findRevision(Books[i].ID, query.Get("from"))
+		} else if to.Number > 1 {
+			from = history[to.Number-2]
+		}
+		if !ok {
+			http.Error(w, "404, no such revision", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":    from.Number,
+			"to":      to.Number,
+			"changes": diffBooks(from.Book, to.Book),
+		})
+
+	default:
+		revision, ok := findRevision(Books[i].ID, rest)
+		if !ok {
+			http.Error(w, "404, no such revision", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(revision)
+	}
+}
+
+/*
+POST /books/{id}/revert with revision=n puts the book's catalog details back the way they were at revision n. The
+revert is a new revision, so it can be undone too. Status, ratings and reviews are left alone, since reverting a typo
+shouldn't check a book back in or throw away what patrons have said about it.
+Genres that have since been renamed, merged away or removed from the vocabulary are dropped, and each one is sent
+back in an X-Dropped-Genre header so the caller can put the book under the genres it belongs in now.
+*/
+func revertBook(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "POST" {
+		http.Error(w, "405 Method not allowed, only POST is permited", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	revision, ok := findRevision(Books[i].ID, strings.TrimSpace(r.FormValue("revision")))
+	if !ok || revision.Book == nil {
+		http.Error(w, "400, revision must be the number of one of the book's revisions", http.StatusBadRequest)
+		return
+	}
+
+	old := revision.Book
+	var known []string
+	for _, genre := range old.Genres {
+		if _, ok := lookupGenre(genre); ok {
+			known = append(known, genre)
+		} else {
+			w.Header().Add("X-Dropped-Genre", genre)
+		}
+	}
+	genres, _ := normalizeGenres(known)
+
+	before := Books[i]
+	Books[i].Title, Books[i].Author, Books[i].Publisher, Books[i].PublishDate = old.Title, old.Author, old.Publisher, old.PublishDate
+	Books[i].Tags, Books[i].Genres, Books[i].CallNumber = old.Tags, genres, old.CallNumber
+	recordMutation(r, "revert", &before, &Books[i])
+	json.NewEncoder(w).Encode(Books[i])
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRevisionHistory(t *testing.T) {
+	readFromFile("books.csv")
+
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"author": {"Wrong Author"}})
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"publisher": {"Wrong Publisher"}})
+
+	w := formRequest(requireRole(routes()), "GET", "/books/book-1/revisions", nil)
+	var history []Revision
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Op != "import" || history[2].Number != 3 || history[2].Book.Publisher != "Wrong Publisher" {
+		t.Fatal("History incorrect. Recieved ", history)
+	}
+
+	w = formRequest(requireRole(routes()), "GET", "/books/book-1/revisions/diff?from=1", nil)
+	var diff struct {
+		From    int
+		To      int
+		Changes []FieldChange
+	}
+	if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.From != 1 || diff.To != 3 || len(diff.Changes) != 2 || diff.Changes[0].Field != "author" || diff.Changes[1].Field != "publisher" {
+		t.Error("Diff incorrect. Recieved ", diff)
+	}
+
+	for _, path := range []string{"/books/book-1/revisions/4", "/books/book-1/revisions/diff?from=0", "/books/book-9/revisions"} {
+		if w := formRequest(requireRole(routes()), "GET", path, nil); w.Code != http.StatusNotFound {
+			t.Error("Expected Response code 404 for ", path, ". Recieved ", w.Code)
+		}
+	}
+}
+
+func TestRevert(t *testing.T) {
+	readFromFile("books.csv")
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"author": {"Wrong Author"}, "status": {"in_repair"}})
+
+	w := formRequest(requireRole(routes()), "POST", "/books/book-1/revert", url.Values{"revision": {"1"}})
+	var book Book
+	if err := json.NewDecoder(w.Body).Decode(&book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Author != "Author 1" || book.Status != StatusInRepair {
+		t.Error("Expected the author to be reverted and the status kept. Recieved ", book.Author, " ", book.Status)
+	}
+	if history := revisions[book.ID]; len(history) != 3 || history[2].Op != "revert" {
+		t.Error("The revert was not recorded as a new revision")
+	}
+
+	if w := formRequest(requireRole(routes()), "POST", "/books/book-1/revert", url.Values{"revision": {"7"}}); w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+}
+
+/*
+Genres renamed since the revision can't be put back, so they are dropped and the rest of the revert still happens.
+*/
+func TestRevertAfterGenreRename(t *testing.T) {
+	readGenres("genres.csv")
+	readFromFile("books.csv")
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"genre": {"Fiction > Mystery > Cozy", "Fiction > Fantasy"}})
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"author": {"Wrong Author"}})
+	formRequest(http.HandlerFunc(genresHandler), "POST", "/genres/rename", url.Values{"from": {"Fiction > Mystery"}, "to": {"Fiction > Crime"}})
+
+	w := formRequest(requireRole(routes()), "POST", "/books/book-1/revert", url.Values{"revision": {"2"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if dropped := w.Header().Values("X-Dropped-Genre"); len(dropped) != 1 || dropped[0] != "Fiction > Mystery > Cozy" {
+		t.Error("Expected the renamed genre to be reported. Recieved ", dropped)
+	}
+	if book := Books[0]; book.Author != "Author 1" || len(book.Genres) != 1 || book.Genres[0] != "Fiction > Fantasy" {
+		t.Error("Expected the author reverted and only the genre still in the vocabulary kept. Recieved ", book)
+	}
+}
+
+func TestBookAsOf(t *testing.T) {
+	readFromFile("books.csv")
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"author": {"New Author"}})
+	now := time.Now().UTC().Truncate(time.Second)
+	revisions[1][0].Time = now.Add(-2 * time.Hour)
+	revisions[1][1].Time = now.Add(-time.Hour)
+
+	tests := []struct {
+		asOf   time.Time
+		author string
+	}{
+		{now.Add(-90 * time.Minute), "Author 1"},
+		{now.Add(-time.Hour), "New Author"},
+		{now, "New Author"},
+	}
+	for _, test := range tests {
+		w := formRequest(requireRole(routes()), "GET", "/books/book-1?asOf="+url.QueryEscape(test.asOf.Format(time.RFC3339)), nil)
+		var book Book
+		if err := json.NewDecoder(w.Body).Decode(&book); err != nil {
+			t.Fatal(err)
+		}
+		if book.Author != test.author {
+			t.Error("Expected ", test.author, " as of ", test.asOf, ". Recieved ", book.Author)
+		}
+	}
+
+	if w := formRequest(requireRole(routes()), "GET", "/books/book-1?asOf="+url.QueryEscape(now.Add(-3*time.Hour).Format(time.RFC3339)), nil); w.Code != http.StatusNotFound {
+		t.Error("Expected Response code 404 before the book existed. Recieved ", w.Code)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/books/book-1?asOf=yesterday", nil); w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+}
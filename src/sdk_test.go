@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RESTChallenge/client"
+)
+
+func TestClientAgainstServer(t *testing.T) {
+	withTestKeys(t)
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	server := httptest.NewServer(requireRole(routes()))
+	defer server.Close()
+	ctx := context.Background()
+
+	librarian, err := client.New(server.URL, client.WithAPIKey("librarian-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := librarian.CreateBook(ctx, client.NewBook{Title: "Book 3", Author: "Author 3", PublishDate: "11111113", Rating: 2, Tags: []string{"classic"}})
+	if err != nil || book.ID != 3 || book.Author != "Author 3" || book.Status != client.StatusAvailable || len(book.Tags) != 1 {
+		t.Fatal("Expected the new book. Recieved ", book, " ", err)
+	}
+	if got, err := librarian.GetBook(ctx, client.BookID("Book 3")); err != nil || got.ID != book.ID {
+		t.Fatal("Expected to find the new book. Recieved ", got, " ", err)
+	}
+	if _, err := librarian.CreateBook(ctx, client.NewBook{Title: "Book 4", PublishDate: "11111114", Rating: 5}); !errors.Is(err, client.ErrBadRequest) {
+		t.Error("Expected a rating off the scale to be refused. Recieved ", err)
+	}
+
+	author := "Someone Else"
+	book, err = librarian.UpdateBook(ctx, book.URLID(), client.BookUpdate{Author: &author, Tags: []string{}})
+	if err != nil || book.Author != author || len(book.Tags) != 0 {
+		t.Error("Expected the update to change the author and clear the tags. Recieved ", book, " ", err)
+	}
+
+	book, err = librarian.Checkout(ctx, book.URLID())
+	if err != nil || book.Status != client.StatusCheckedOut {
+		t.Error("Expected the book to be checked out. Recieved ", book, " ", err)
+	}
+	if _, err := librarian.SetStatus(ctx, book.URLID(), client.StatusWithdrawn); !errors.Is(err, client.ErrConflict) {
+		t.Error("Expected a checked out book not to be withdrawn. Recieved ", err)
+	}
+	book, err = librarian.Checkin(ctx, book.URLID())
+	if err != nil || book.Status != client.StatusAvailable {
+		t.Error("Expected the book to be checked in. Recieved ", book, " ", err)
+	}
+
+	books, err := librarian.ListBooks(ctx, client.ListOptions{Status: client.StatusAvailable})
+	if err != nil || len(books) != 2 {
+		t.Error("Expected Book 1 and Book 3 to be available. Recieved ", books, " ", err)
+	}
+
+	if err := librarian.DeleteBook(ctx, book.URLID()); err != nil {
+		t.Error(err)
+	}
+	if _, err := librarian.GetBook(ctx, book.URLID()); !errors.Is(err, client.ErrNotFound) {
+		t.Error("Expected the deleted book to be gone. Recieved ", err)
+	}
+
+	var types []string
+	for change, err := range librarian.Changes(ctx, 0) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, change.Type)
+	}
+	if len(types) != 5 || types[0] != "created" || types[4] != "deleted" {
+		t.Error("Expected every change to Book 3. Recieved ", types)
+	}
+
+	anonymous, _ := client.New(server.URL)
+	if _, err := anonymous.CreateBook(ctx, client.NewBook{Title: "Book 4", PublishDate: "11111114", Rating: 1}); !errors.Is(err, client.ErrUnauthorized) {
+		t.Error("Expected a book to need a key to add. Recieved ", err)
+	}
+}
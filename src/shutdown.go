@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+/*
+Runs the HTTP server, the gRPC server when there is one, and the goroutines that go with them, like webhook dispatch
+and the outboxes, until it is told to stop, and then shuts them all down in order.
+*/
+type lifecycle struct {
+	server   *http.Server
+	timeout  time.Duration // How long shutting down can take, from when it is told to stop
+	delay    time.Duration // How long /readyz fails for before the server stops accepting connections
+	dataPath string        // Where the catalog is saved once more when shutting down
+	genres   string        // Where the genre vocabulary is saved once more when shutting down, or nowhere when empty
+	outboxes map[string]*outbox
+
+	reloads <-chan os.Signal // SIGHUP outside the tests, each one calls reload
+	reload  func() error     // Loads the settings that can change without a restart again, see reloadSettings
+
+	grpcServer *grpc.Server // nil when gRPC is turned off
+	grpcAddr   string
+
+	shutdownTracing func(context.Context) error // Flushes the spans not exported yet
+
+	ctx     context.Context // Done once the background goroutines should stop
+	cancel  context.CancelFunc
+	workers sync.WaitGroup
+	failed  chan error // The first background goroutine that couldn't carry on, which shuts the server down
+
+	requests    context.Context // Done once the servers start shutting down, which ends streams like /events
+	endRequests context.CancelFunc
+}
+
+func newLifecycle(server *http.Server, timeout time.Duration, dataPath string) *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	requests, endRequests := context.WithCancel(context.Background())
+	return &lifecycle{server: server, timeout: timeout, dataPath: dataPath, outboxes: map[string]*outbox{}, ctx: ctx, cancel: cancel,
+		failed: make(chan error, 1), requests: requests, endRequests: endRequests}
+}
+
+/*
+Runs work in the background until the server has shut down.
+*/
+func (l *lifecycle) start(work func(ctx context.Context)) {
+	l.workers.Add(1)
+	go func() {
+		defer l.workers.Done()
+		work(l.ctx)
+	}()
+}
+
+/*
+Called by background work that has failed and can't carry on. The server shuts down the same way as for SIGTERM, so
+the catalog is still saved, and exits with status 1.
+*/
+func (l *lifecycle) fail(err error) {
+	select {
+	case l.failed <- err:
+	default: // Already shutting down because of an earlier failure
+	}
+}
+
+/*
+Serves until stopping is done, which is SIGTERM or ctrl-c outside the tests, or until background work fails, and then
+shuts down:
+
+ 1. /readyz starts failing, and the server carries on as normal for the delay so load balancers can notice.
+ 2. The servers stop accepting connections, streams like /events and WatchBooks are ended, and the requests and
+    calls in flight are finished.
+ 3. The catalog and genre vocabulary are saved, and the change feed and audit log are flushed to disk.
+ 4. The outboxes and webhooks get to send everything left in the change feed.
+ 5. The background goroutines are stopped and the publishers are closed.
+
+While serving, each signal on reloads reloads the settings that can change without a restart, see reloadSettings.
+All of it after the delay has to be done within the timeout. Returns the exit status, which is 0 when everything finished and 1 when
+something didn't, or the server couldn't start.
+*/
+func (l *lifecycle) run(stopping context.Context) int {
+	l.server.BaseContext = func(net.Listener) context.Context { return l.requests }
+	l.server.RegisterOnShutdown(l.endRequests)
+
+	grpcServed := make(chan error, 1)
+	if l.grpcServer != nil {
+		listener, err := net.Listen("tcp", l.grpcAddr)
+		if err != nil {
+			slog.Error("The gRPC server could not start", "err", err)
+			l.stop()
+			return 1
+		}
+		go func() { grpcServed <- l.grpcServer.Serve(listener) }()
+	}
+	served := make(chan error, 1)
+	go func() { served <- l.server.ListenAndServe() }()
+	status := 0
+serving:
+	for {
+		select {
+		case err := <-served:
+			slog.Error("The server could not start", "err", err)
+			if l.grpcServer != nil {
+				l.grpcServer.Stop()
+			}
+			l.stop()
+			return 1
+		case err := <-grpcServed:
+			slog.Error("The gRPC server stopped", "err", err)
+			l.server.Close()
+			l.stop()
+			return 1
+		case <-l.reloads:
+			l.reloadSettings()
+		case <-stopping.Done():
+			break serving
+		case err := <-l.failed:
+			slog.Error("Shutting down after a failure", "err", err)
+			status = 1
+			break serving
+		}
+	}
+
+	readiness.drain("shutting down")
+	if l.delay > 0 {
+		slog.Info("Failing readiness checks before shutting down", "delay", l.delay.String())
+		time.Sleep(l.delay)
+	}
+	slog.Info("Shutting down, waiting for requests and deliveries to finish", "timeout", l.timeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	if err := l.server.Shutdown(ctx); err != nil {
+		slog.Error("Requests were still running when the shutdown timeout ran out", "err", err)
+		status = 1
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Serving failed", "err", err)
+	}
+	if l.grpcServer != nil {
+		// The WatchBooks streams ended along with the HTTP ones, so this only waits for unary calls
+		stopped := make(chan struct{})
+		go func() {
+			l.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			slog.Error("gRPC calls were still running when the shutdown timeout ran out")
+			l.grpcServer.Stop()
+			status = 1
+		}
+	}
+
+	// Nothing can change the catalog now, but the hourly purge could be running
+	saving, span := tracer().Start(ctx, "catalog.save")
+	mutex.LockContext(saving)
+	err := persist(saving, "catalog", func() error { return writeToFile(l.dataPath) })
+	count := len(Books)
+	var genresErr error
+	if l.genres != "" {
+		genresErr = persist(saving, "genres", func() error { return writeGenres(l.genres) })
+	}
+	mutex.Unlock()
+	span.End()
+	if err != nil {
+		slog.Error("Could not save the catalog", "err", err)
+		status = 1
+	} else {
+		slog.Info("Saved the catalog", "books", count, "path", l.dataPath)
+	}
+	if genresErr != nil {
+		slog.Error("Could not save the genres", "err", genresErr)
+		status = 1
+	}
+	if err := feed.close(); err != nil {
+		slog.Error("Could not flush the change feed", "err", err)
+		status = 1
+	}
+	if auditLog != nil {
+		if err := auditLog.Close(); err != nil {
+			slog.Error("Could not flush the audit log", "err", err)
+			status = 1
+		}
+	}
+
+	for name, o := range l.outboxes {
+		if err := o.flush(ctx); err != nil {
+			slog.Error("Not everything was published", "publisher", name, "err", err)
+			status = 1
+		}
+	}
+	if err := webhooks.flush(ctx); err != nil {
+		slog.Error("Not every webhook was delivered", "err", err)
+		status = 1
+	}
+
+	l.stop()
+	if l.shutdownTracing != nil {
+		if err := l.shutdownTracing(ctx); err != nil {
+			slog.Error("Could not flush traces", "err", err)
+		}
+	}
+	if status == 0 {
+		slog.Info("Shut down cleanly")
+	}
+	return status
+}
+
+/*
+Calls reload with /readyz failing, so load balancers hold off while the settings change. The server keeps serving
+throughout, and if reloading fails it carries on with the settings it had.
+*/
+func (l *lifecycle) reloadSettings() {
+	if l.reload == nil {
+		return
+	}
+	readiness.drain("reloading")
+	defer readiness.undrain()
+	if err := l.reload(); err != nil {
+		slog.Error("Could not reload, carrying on with the settings already loaded", "err", err)
+		return
+	}
+	slog.Info("Reloaded")
+}
+
+func (l *lifecycle) stop() {
+	l.cancel()
+	l.workers.Wait()
+	for name, o := range l.outboxes {
+		if err := o.publisher.Close(); err != nil {
+			slog.Error("Could not close a publisher", "publisher", name, "err", err)
+		}
+	}
+}
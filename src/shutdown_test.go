@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func copyFile(t *testing.T, from string, to string) {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(to, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func buildServer(t *testing.T) string {
+	bin := filepath.Join(t.TempDir(), "books")
+	if out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput(); err != nil {
+		t.Fatal("Build failed: ", string(out))
+	}
+	return bin
+}
+
+/*
+Builds and starts the server in its own directory, and waits for it to answer. Authentication is off unless args
+turn it on.
+*/
+func startServer(t *testing.T, dir string, args ...string) (*exec.Cmd, string, *bytes.Buffer) {
+	bin := buildServer(t)
+	copyFile(t, "books.csv", filepath.Join(dir, "books.csv"))
+	copyFile(t, "genres.csv", filepath.Join(dir, "genres.csv"))
+
+	addr := fmt.Sprintf("127.0.0.1:%v", freePort(t))
+	var output bytes.Buffer
+	cmd := exec.Command(bin, append([]string{"-addr", addr, "-insecure-no-auth"}, args...)...)
+	cmd.Dir = dir
+	cmd.Stdout, cmd.Stderr = &output, &output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	base := "http://" + addr
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+		if resp, err := http.Get(base + "/books"); err == nil {
+			resp.Body.Close()
+			return cmd, base, &output
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The server did not start: ", output.String())
+		}
+	}
+}
+
+/*
+Without any keys the server won't start with authentication off by accident.
+*/
+func TestNoKeysRefusesToStart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the server")
+	}
+	dir := t.TempDir()
+	copyFile(t, "books.csv", filepath.Join(dir, "books.csv"))
+	copyFile(t, "genres.csv", filepath.Join(dir, "genres.csv"))
+	cmd := exec.Command(buildServer(t), "-addr", fmt.Sprintf("127.0.0.1:%v", freePort(t)))
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "-insecure-no-auth") {
+		t.Error("Expected the server to refuse to start. Recieved ", err, " ", string(out))
+	}
+}
+
+/*
+SIGTERM arrives while books are being created. Every book the server said it created has to be in the csv and
+published once it has exited.
+*/
+func TestShutdownKeepsAcknowledgedWrites(t *testing.T) {
+	if testing.Short() || runtime.GOOS == "windows" {
+		t.Skip("builds and signals the server")
+	}
+	dir := t.TempDir()
+	cmd, base, output := startServer(t, dir, "-publish", "file:events.jsonl", "-shutdown-timeout", "5s")
+	resp, err := http.PostForm(base+"/genres", url.Values{"path": {"Poetry"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatal("Could not add a genre. Recieved ", resp.StatusCode)
+	}
+
+	// A stream that never ends on its own mustn't hold up the shutdown
+	stream, err := http.Get(base + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	var (
+		lock         sync.Mutex
+		acknowledged []string
+		workers      sync.WaitGroup
+	)
+	signalled := make(chan struct{})
+	for worker := 0; worker < 8; worker++ {
+		workers.Add(1)
+		go func(worker int) {
+			defer workers.Done()
+			for i := 0; ; i++ {
+				title := fmt.Sprintf("Burst %v-%v", worker, i)
+				form := url.Values{"title": {title}, "author": {"Burst"}, "publisher": {"Burst"}, "publishdate": {"01022003"}, "rating": {"1"}, "ischeckedin": {"true"}}
+				resp, err := http.PostForm(base+"/new", form)
+				if err != nil {
+					return // Refused once the server has stopped listening
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusCreated {
+					return
+				}
+				lock.Lock()
+				acknowledged = append(acknowledged, title)
+				if len(acknowledged) == 100 {
+					close(signalled)
+					cmd.Process.Signal(syscall.SIGTERM)
+				}
+				lock.Unlock()
+			}
+		}(worker)
+	}
+
+	select {
+	case <-signalled:
+	case <-time.After(20 * time.Second):
+		t.Fatal("The writes did not get going: ", output.String())
+	}
+	started := time.Now()
+	err = cmd.Wait()
+	workers.Wait()
+	if err != nil {
+		t.Fatal("Expected a clean exit. Recieved ", err, "\n", output.String())
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Error("Shutting down took ", time.Since(started))
+	}
+
+	f, err := os.Open(filepath.Join(dir, "books.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := map[string]bool{}
+	for _, record := range records {
+		saved[record[0]] = true
+	}
+
+	events, err := os.Open(filepath.Join(dir, "events.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	published := map[string]bool{}
+	for scanner := bufio.NewScanner(events); scanner.Scan(); {
+		var change Change
+		if json.Unmarshal(scanner.Bytes(), &change) == nil && change.Type == "created" {
+			published[change.Book.Title] = true
+		}
+	}
+
+	for _, title := range acknowledged {
+		if !saved[title] {
+			t.Error(title, " was acknowledged but not saved")
+		}
+		if !published[title] {
+			t.Error(title, " was acknowledged but not published")
+		}
+	}
+	if genres, _ := os.ReadFile(filepath.Join(dir, "genres.csv")); !strings.Contains(string(genres), "Poetry\n") {
+		t.Error("Expected the new genre to be saved. Recieved ", string(genres))
+	}
+	if !strings.Contains(output.String(), "Shut down cleanly") {
+		t.Error("Expected the shutdown to be logged. Recieved ", output.String())
+	}
+}
+
+/*
+Background work that fails shuts the server down the normal way, so the catalog is still saved.
+*/
+func TestShutdownAfterFailure(t *testing.T) {
+	withWebhooks(t)
+	withReadiness(t)
+	readFromFile("books.csv")
+	dataPath := filepath.Join(t.TempDir(), "books.csv")
+	server := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%v", freePort(t)), Handler: serverRoutes()}
+	app := newLifecycle(server, 5*time.Second, dataPath)
+	for _, err := range []string{"the disk is full", "so is the other one"} {
+		app.start(func(ctx context.Context) { app.fail(errors.New(err)) })
+	}
+
+	if status := app.run(context.Background()); status != 1 {
+		t.Error("Expected exit status 1. Recieved ", status)
+	}
+	if _, err := os.Stat(dataPath); err != nil {
+		t.Error("Expected the catalog to have been saved. Recieved ", err)
+	}
+	if status := readiness.check(); status.Status != "failing" {
+		t.Error("Expected /readyz to fail once shutting down. Recieved ", status)
+	}
+}
+
+/*
+SIGHUP swaps in the keys file's new keys with /readyz failing while it does, and a keys file that can't be read leaves
+the keys as they were.
+*/
+func TestReloadKeys(t *testing.T) {
+	withWebhooks(t)
+	withReadiness(t)
+	keysFile := filepath.Join(t.TempDir(), "keys.csv")
+	if err := os.WriteFile(keysFile, []byte("new-librarian-key,lucy,librarian\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Addr: fmt.Sprintf("127.0.0.1:%v", freePort(t)), Handler: serverRoutes()}
+	app := newLifecycle(server, 5*time.Second, filepath.Join(t.TempDir(), "books.csv"))
+	reloads := make(chan os.Signal)
+	during := make(chan healthStatus, 1)
+	app.reloads = reloads
+	app.reload = func() error {
+		during <- readiness.check()
+		return reloadKeys(keysFile)
+	}
+
+	stopping, stop := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() { done <- app.run(stopping) }()
+	reloads <- syscall.SIGHUP
+	if status := <-during; status.Status != "failing" {
+		t.Error("Expected /readyz to fail while reloading. Recieved ", status)
+	}
+	reloads <- syscall.SIGHUP // Taken once the first reload has finished
+	<-during
+	stop()
+	if status := <-done; status != 0 {
+		t.Error("Expected exit status 0. Recieved ", status)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/trash", nil, "X-API-Key", "new-librarian-key"); w.Code != http.StatusOK {
+		t.Error("Expected the new key to work. Recieved ", w.Code)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/trash", nil, "X-API-Key", "librarian-key"); w.Code != http.StatusUnauthorized {
+		t.Error("Expected the old key to be gone. Recieved ", w.Code)
+	}
+
+	readiness.undrain()
+	app.reload = func() error { return reloadKeys(filepath.Join(t.TempDir(), "missing.csv")) }
+	app.reloadSettings()
+	if w := formRequest(requireRole(routes()), "GET", "/trash", nil, "X-API-Key", "new-librarian-key"); w.Code != http.StatusOK {
+		t.Error("Expected the keys to be kept when the file can't be read. Recieved ", w.Code)
+	}
+	if status := readiness.check(); status.Status != "ok" {
+		t.Error("Expected /readyz to pass again after reloading. Recieved ", status)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+/*
+A book's place in its lifecycle. The old IsCheckedIn boolean could only say whether a book was on the shelf or not,
+so it is now derived from the status and kept for existing clients.
+*/
+type BookStatus string
+
+const (
+	StatusAvailable  BookStatus = "available"
+	StatusCheckedOut BookStatus = "checked_out"
+	StatusOnHold     BookStatus = "on_hold"
+	StatusInRepair   BookStatus = "in_repair"
+	StatusLost       BookStatus = "lost"
+	StatusWithdrawn  BookStatus = "withdrawn"
+)
+
+/*
+The allowed moves between statuses. Anything not listed here is rejected with 409 Conflict.
+Staying in the same status is always allowed so that repeating a request is harmless.
+*/
+var statusTransitions = map[BookStatus][]BookStatus{
+	StatusAvailable:  {StatusCheckedOut, StatusOnHold, StatusInRepair, StatusLost, StatusWithdrawn},
+	StatusCheckedOut: {StatusAvailable, StatusInRepair, StatusLost},
+	StatusOnHold:     {StatusAvailable, StatusCheckedOut, StatusLost},
+	StatusInRepair:   {StatusAvailable, StatusLost, StatusWithdrawn},
+	StatusLost:       {StatusAvailable, StatusWithdrawn},
+	StatusWithdrawn:  {StatusAvailable},
+}
+
+func parseStatus(s string) (BookStatus, bool) {
+	status := BookStatus(strings.ToLower(strings.TrimSpace(s)))
+	_, ok := statusTransitions[status]
+	return status, ok
+}
+
+func canTransition(from, to BookStatus) bool {
+	if from == to {
+		return true
+	}
+	for _, next := range statusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+A book counts as checked in whenever the library has it, which is every status except checked out and lost.
+*/
+func (s BookStatus) isCheckedIn() bool {
+	return s != StatusCheckedOut && s != StatusLost
+}
+
+/*
+All status changes go through here so that the legacy IsCheckedIn field never disagrees with the status.
+*/
+func (b *Book) setStatus(status BookStatus) {
+	b.Status = status
+	b.IsCheckedIn = status.isCheckedIn()
+}
+
+/*
+Maps the legacy ischeckedin value onto a status. Asking for the value the book already has is not a change,
+so a book on hold stays on hold when a client sends ischeckedin=true.
+*/
+func statusFromCheckIn(current BookStatus, checkedIn bool) BookStatus {
+	if current.isCheckedIn() == checkedIn {
+		return current
+	}
+	if checkedIn {
+		return StatusAvailable
+	}
+	return StatusCheckedOut
+}
+
+/*
+Handles the circulation actions at /books/{id}/checkout and /books/{id}/checkin. Only POST is permitted.
+*/
+func circulationAction(w http.ResponseWriter, r *http.Request, id string, action string) {
+	if r.Method != "POST" {
+		http.Error(w, "405 Method not allowed, only POST is permited", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var target BookStatus
+	switch action {
+	case "checkout":
+		target = StatusCheckedOut
+	case "checkin":
+		target = StatusAvailable
+	default:
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+
+	i := findBook(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+	if !canTransition(Books[i].Status, target) {
+		http.Error(w, fmt.Sprintf("409, cannot %v a book that is %v", action, Books[i].Status), http.StatusConflict)
+		return
+	}
+	before := Books[i]
+	Books[i].setStatus(target)
+	recordMutation(r, action, &before, &Books[i])
+	json.NewEncoder(w).Encode(Books[i])
+}
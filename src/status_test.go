@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/*
+These tests call the handlers directly so they don't need the server running. formRequest sends data to handler as
+a form, with header holding name, value pairs of headers to set. Headers without a value aren't set.
+*/
+func formRequest(handler http.Handler, method string, path string, data url.Values, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(data.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for i := 0; i+1 < len(header); i += 2 {
+		if header[i+1] != "" {
+			req.Header.Set(header[i], header[i+1])
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestReadLegacyStatus(t *testing.T) {
+	readFromFile("books.csv")
+	if Books[0].Status != StatusAvailable || !Books[0].IsCheckedIn {
+		t.Error("Expected Book 1 to be available. Recieved ", Books[0].Status, Books[0].IsCheckedIn)
+	}
+	if Books[1].Status != StatusCheckedOut || Books[1].IsCheckedIn {
+		t.Error("Expected Book 2 to be checked out. Recieved ", Books[1].Status, Books[1].IsCheckedIn)
+	}
+}
+
+func TestPatchStatus(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"status": {"in_repair"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	var book Book
+	if err := json.NewDecoder(w.Body).Decode(&book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Status != StatusInRepair || !book.IsCheckedIn {
+		t.Error("Expected in_repair and checked in. Recieved ", book.Status, book.IsCheckedIn)
+	}
+
+	// in_repair can't go straight to checked_out
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"status": {"checked_out"}})
+	if w.Code != http.StatusConflict {
+		t.Error("Expected Response code 409. Recieved ", w.Code)
+	}
+	if Books[0].Status != StatusInRepair {
+		t.Error("A rejected transition changed the book to ", Books[0].Status)
+	}
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"status": {"misplaced"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+}
+
+func TestPatchLegacyCheckIn(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"ischeckedin": {"true"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+	if Books[1].Status != StatusAvailable || !Books[1].IsCheckedIn {
+		t.Error("Expected Book 2 to be available. Recieved ", Books[1].Status)
+	}
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-2", url.Values{"ischeckedin": {"notabool"}})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400. Recieved ", w.Code)
+	}
+}
+
+func TestCirculationActions(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := httptest.NewRecorder()
+	returnSingleBook(w, httptest.NewRequest("POST", "/books/book-1/checkout", nil))
+	if w.Code != http.StatusOK || Books[0].Status != StatusCheckedOut {
+		t.Fatal("Checkout failed. Recieved ", w.Code, Books[0].Status)
+	}
+
+	w = httptest.NewRecorder()
+	returnSingleBook(w, httptest.NewRequest("POST", "/books/book-1/checkout", nil))
+	if w.Code != http.StatusOK {
+		t.Error("Checking out twice should be harmless. Recieved ", w.Code)
+	}
+
+	w = formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"status": {"withdrawn"}})
+	if w.Code != http.StatusConflict {
+		t.Error("Expected Response code 409. Recieved ", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	returnSingleBook(w, httptest.NewRequest("POST", "/books/book-1/checkin", nil))
+	if w.Code != http.StatusOK || Books[0].Status != StatusAvailable {
+		t.Error("Checkin failed. Recieved ", w.Code, Books[0].Status)
+	}
+
+	w = httptest.NewRecorder()
+	returnSingleBook(w, httptest.NewRequest("GET", "/books/book-1/checkin", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("Expected Response code 405. Recieved ", w.Code)
+	}
+}
+
+func TestWithdrawnHidden(t *testing.T) {
+	readFromFile("books.csv")
+
+	w := formRequest(http.HandlerFunc(returnSingleBook), "PATCH", "/books/book-1", url.Values{"status": {"withdrawn"}})
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	allEnteries(w, httptest.NewRequest("GET", "/books", nil))
+	var books []Book
+	json.NewDecoder(w.Body).Decode(&books)
+	if len(books) != 1 || books[0].Title != "Book 2" {
+		t.Error("Withdrawn book was listed. Recieved ", books)
+	}
+
+	w = httptest.NewRecorder()
+	allEnteries(w, httptest.NewRequest("GET", "/books?status=withdrawn", nil))
+	books = nil
+	json.NewDecoder(w.Body).Decode(&books)
+	if len(books) != 1 || books[0].Title != "Book 1" {
+		t.Error("Expected only the withdrawn book. Recieved ", books)
+	}
+}
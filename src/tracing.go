@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+Every request gets an OpenTelemetry span, carrying on the trace from a W3C traceparent header when the client sends
+one. Inside it are spans for waiting on the catalog's mutex, recording the change, and each write to disk, so a slow
+request shows whether the time went on the lock, the handler itself, or the disk.
+
+Spans are only exported when -trace-exporter is stdout or otlp. The OTLP exporter sends to -otlp-endpoint, or to
+where the standard OTEL_EXPORTER_OTLP_* environment variables say. Trace IDs are in the logs either way, and sent
+back in the X-Trace-ID header, so an error a client saw can be found in the logs.
+*/
+const tracerName = "github.com/RESTChallenge"
+
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+/*
+Fetched each time rather than kept, so it follows the tracer provider when it is set after start up.
+*/
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+/*
+Sets up the exporter and returns what flushes and stops it. The tracer provider is set up without one too, so spans
+still get IDs for the logs and X-Trace-ID when they aren't exported.
+*/
+func setupTracing(ctx context.Context, exporter string, endpoint string, sampleRatio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("books"))),
+	}
+	var spans sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "":
+	case "stdout":
+		spans, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		var exporterOptions []otlptracehttp.Option
+		if endpoint != "" {
+			exporterOptions = append(exporterOptions, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		spans, err = otlptracehttp.New(ctx, exporterOptions...)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q, use stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if spans != nil {
+		options = append(options, sdktrace.WithBatcher(spans))
+	}
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+/*
+Starts each request's span, named after its route template so there is one name per route.
+*/
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r.URL.Path)
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+		if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+			w.Header().Set("X-Trace-ID", spanContext.TraceID().String())
+		}
+
+		recorder := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+/*
+Writes something to disk for store, like "audit" or "catalog". The write is timed for /metrics, and gets a span when
+ctx is part of a trace.
+*/
+func persist(ctx context.Context, store string, write func() error) error {
+	var span trace.Span
+	if trace.SpanFromContext(ctx).IsRecording() {
+		_, span = tracer().Start(ctx, "persist."+store, trace.WithAttributes(attribute.String("store", store)))
+		defer span.End()
+	}
+
+	started := time.Now()
+	err := write()
+	persistenceDuration.WithLabelValues(store).Observe(time.Since(started).Seconds())
+	if err != nil {
+		persistenceFailures.WithLabelValues(store).Inc()
+		if span != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+/*
+Records the spans made during the test.
+*/
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	saved := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(saved) })
+	return recorder
+}
+
+func TestTracing(t *testing.T) {
+	withTestKeys(t)
+	withChangeFeed(t, 100)
+	readFromFile("books.csv")
+	saved := auditLog
+	t.Cleanup(func() { auditLog = saved })
+	var err error
+	if auditLog, err = openAuditLog(filepath.Join(t.TempDir(), "audit.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+	spans := withSpanRecorder(t)
+	logs := captureLogs(t)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	w := formRequest(traceRequests(accessLog(requireRole(routes()))), "PATCH", "/books/book-1", url.Values{"author": {"Someone"}}, "X-API-Key", "librarian-key", "traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	if w.Code != http.StatusOK || w.Header().Get("X-Trace-ID") != traceID {
+		t.Fatal("Expected the trace to carry on. Recieved ", w.Code, " ", w.Header().Get("X-Trace-ID"))
+	}
+
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range spans.Ended() {
+		byName[span.Name()] = span
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Error(span.Name(), " is not part of the trace")
+		}
+	}
+	request, ok := byName["PATCH /books/{id}"]
+	if !ok || request.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Fatal("Expected a span for the request under the client's. Recieved ", byName)
+	}
+	parents := map[string]string{
+		"catalog.lock":    "PATCH /books/{id}",
+		"catalog.record":  "PATCH /books/{id}",
+		"persist.changes": "catalog.record",
+		"persist.audit":   "catalog.record",
+	}
+	for name, parent := range parents {
+		span, ok := byName[name]
+		if !ok || span.Parent().SpanID() != byName[parent].SpanContext().SpanID() {
+			t.Error("Expected ", name, " under ", parent)
+		}
+	}
+
+	for _, line := range logs() {
+		if line["trace_id"] != traceID {
+			t.Error("Expected the trace ID in every log line. Recieved ", line)
+		}
+	}
+}
+
+func TestTraceIDOnErrors(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	withSpanRecorder(t)
+
+	w := formRequest(traceRequests(accessLog(requireRole(routes()))), "GET", "/books/no-such-book", nil, "X-API-Key", "librarian-key", "traceparent", "")
+	if w.Code != http.StatusNotFound || len(w.Header().Get("X-Trace-ID")) != 32 {
+		t.Error("Expected a new trace ID on the 404. Recieved ", w.Code, " ", w.Header().Get("X-Trace-ID"))
+	}
+}
+
+func TestTraceIDsWithoutExporter(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	saved := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(saved) })
+	shutdown, err := setupTracing(context.Background(), "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+	logs := captureLogs(t)
+
+	w := formRequest(traceRequests(accessLog(requireRole(routes()))), "GET", "/books/no-such-book", nil, "X-API-Key", "librarian-key", "traceparent", "")
+	traceID := w.Header().Get("X-Trace-ID")
+	if len(traceID) != 32 {
+		t.Fatal("Expected a trace ID even with nothing exported or sampled. Recieved ", w.Header())
+	}
+	lines := logs()
+	if len(lines) == 0 || lines[len(lines)-1]["trace_id"] != traceID {
+		t.Error("Expected the trace ID in the access log. Recieved ", lines)
+	}
+}
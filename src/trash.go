@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+A deleted book waiting in the trash. It is hidden from the catalog until it is restored, or purged for good once it
+has been there longer than trashRetention.
+*/
+type TrashedBook struct {
+	Book
+	DeletedAt time.Time `json:"deletedat"`
+	DeletedBy string    `json:"deletedby"`
+}
+
+var (
+	Trash []TrashedBook // Guarded by the catalog's mutex like Books
+
+	trashRetention = 30 * 24 * time.Hour // 0 keeps deleted books forever
+)
+
+/*
+Moves the book at i in Books to the trash. Must be called with the mutex held.
+*/
+func trashBook(r *http.Request, i int) {
+	book := Books[i]
+	Books = append(Books[:i:i], Books[i+1:]...)
+	deletedBy := "anonymous"
+	if principal := requestPrincipal(r); principal != nil {
+		deletedBy = principal.Name
+	}
+	Trash = append(Trash, TrashedBook{Book: book, DeletedAt: time.Now().UTC(), DeletedBy: deletedBy})
+	recordMutation(r, "delete", &book, nil)
+}
+
+/*
+Deletes a book for good, along with its revisions. r is nil when the purge comes from the retention period running out.
+*/
+func purgeBook(r *http.Request, book Book) {
+	recordMutation(r, "purge", &book, nil)
+	delete(revisions, book.ID)
+}
+
+/*
+Purges everything that has been in the trash longer than the retention period. Must be called with the mutex held.
+*/
+func purgeExpired(now time.Time) {
+	if trashRetention <= 0 {
+		return
+	}
+	kept := Trash[:0:0]
+	for _, trashed := range Trash {
+		if now.Sub(trashed.DeletedAt) > trashRetention {
+			purgeBook(nil, trashed.Book)
+		} else {
+			kept = append(kept, trashed)
+		}
+	}
+	Trash = kept
+}
+
+/*
+Finds a book in the trash by its ID or by its URL id. Several deleted books can have had the same title, so a URL id
+finds the one deleted most recently.
+*/
+func findTrashed(id string) int {
+	if n, err := strconv.Atoi(id); err == nil {
+		for i, trashed := range Trash {
+			if trashed.ID == n {
+				return i
+			}
+		}
+	}
+	for i := len(Trash) - 1; i >= 0; i-- {
+		if strings.EqualFold(id, bookSlug(Trash[i].Book)) {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+The trash, for librarians only.
+
+	GET    /trash                   every deleted book, oldest first
+	POST   /trash/{id}/restore      put a book back in the catalog. title: a new title, needed when another book has
+	                                taken the old one in the meantime
+	DELETE /trash/{id}              purge a book for good
+*/
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/trash"), "/")
+
+	mutex.LockContext(r.Context())
+	defer mutex.Unlock()
+	purgeExpired(time.Now())
+
+	if path == "" {
+		if r.Method != "GET" {
+			http.Error(w, "405 Method not allowed, only GET is permited", http.StatusMethodNotAllowed)
+			return
+		}
+		trash := Trash
+		if trash == nil {
+			trash = []TrashedBook{}
+		}
+		json.NewEncoder(w).Encode(trash)
+		return
+	}
+
+	id, action := path, ""
+	if slash := strings.Index(path, "/"); slash >= 0 {
+		id, action = path[:slash], path[slash+1:]
+	}
+	i := findTrashed(id)
+	if i < 0 {
+		http.Error(w, "404, not found.", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "DELETE":
+		book := Trash[i].Book
+		Trash = append(Trash[:i:i], Trash[i+1:]...)
+		purgeBook(r, book)
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "restore" && r.Method == "POST":
+		restoreBook(w, r, i)
+
+	case action == "" || action == "restore":
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.Error(w, "404, not found.", http.StatusNotFound)
+	}
+}
+
+/*
+Puts the book at i in the trash back in the catalog. Its URL id can't be used by another book, so if the title has
+been taken it has to be restored under a new one. It keeps its ID unless that has somehow been given to another book.
+*/
+func restoreBook(w http.ResponseWriter, r *http.Request, i int) {
+	book := Trash[i].Book
+	if title := strings.TrimSpace(r.FormValue("title")); title != "" {
+		book.Title = title
+	}
+	if findBook(bookSlug(book)) >= 0 {
+		http.Error(w, fmt.Sprintf("409, a book called %q is already in the catalog, restore it with a new title", book.Title), http.StatusConflict)
+		return
+	}
+	for _, other := range Books {
+		if other.ID == book.ID {
+			revisions[nextBookID] = revisions[book.ID]
+			delete(revisions, book.ID)
+			book.ID = nextBookID
+			nextBookID++
+			break
+		}
+	}
+
+	Trash = append(Trash[:i:i], Trash[i+1:]...)
+	Books = append(Books, book)
+	recordMutation(r, "restore", nil, &book)
+	json.NewEncoder(w).Encode(book)
+}
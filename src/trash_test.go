@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listTrash(t *testing.T) []TrashedBook {
+	w := formRequest(requireRole(routes()), "GET", "/trash", nil, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, " ", w.Body.String())
+	}
+	var trash []TrashedBook
+	if err := json.NewDecoder(w.Body).Decode(&trash); err != nil {
+		t.Fatal(err)
+	}
+	return trash
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+
+	if w := formRequest(requireRole(routes()), "DELETE", "/books/book-1", nil, "X-API-Key", "librarian-key"); w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/books/book-1", nil); w.Code != http.StatusNotFound {
+		t.Error("A deleted book can still be looked up")
+	}
+	if books := listBooks(t, "/books"); len(books) != 1 {
+		t.Error("A deleted book is still listed")
+	}
+	trash := listTrash(t)
+	if len(trash) != 1 || trash[0].Title != "Book 1" || trash[0].DeletedBy != "lucy" {
+		t.Fatal("Trash incorrect. Recieved ", trash)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/trash", nil, "X-API-Key", "patron-key"); w.Code != http.StatusForbidden {
+		t.Error("Expected Response code 403 for a patron. Recieved ", w.Code)
+	}
+
+	w := formRequest(requireRole(routes()), "POST", "/trash/book-1/restore", nil, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected Response code 200. Recieved ", w.Code, " ", w.Body.String())
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/books/book-1", nil); w.Code != http.StatusOK {
+		t.Error("The restored book can't be looked up")
+	}
+	if len(listTrash(t)) != 0 {
+		t.Error("The restored book is still in the trash")
+	}
+	if history := revisions[1]; history[len(history)-1].Op != "restore" || history[len(history)-2].Op != "delete" {
+		t.Error("The delete and restore are missing from the book's history")
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+
+	formRequest(requireRole(routes()), "DELETE", "/books/book-1", nil, "X-API-Key", "librarian-key")
+	data := url.Values{"title": {"Book 1"}, "publishdate": {"11111111"}, "rating": {"1"}, "ischeckedin": {"true"}}
+	formRequest(requireRole(routes()), "POST", "/new", data, "X-API-Key", "librarian-key")
+
+	if w := formRequest(requireRole(routes()), "POST", "/trash/1/restore", nil, "X-API-Key", "librarian-key"); w.Code != http.StatusConflict {
+		t.Fatal("Expected Response code 409. Recieved ", w.Code)
+	}
+	w := formRequest(requireRole(routes()), "POST", "/trash/1/restore", url.Values{"title": {"Book 1 Old"}}, "X-API-Key", "librarian-key")
+	var book Book
+	if err := json.NewDecoder(w.Body).Decode(&book); err != nil {
+		t.Fatal(err)
+	}
+	if book.Title != "Book 1 Old" || book.ID != 1 {
+		t.Error("Book restored incorrectly. Recieved ", book)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	saved := trashRetention
+	t.Cleanup(func() { trashRetention = saved })
+
+	formRequest(requireRole(routes()), "DELETE", "/books/book-1?purge=true", nil, "X-API-Key", "librarian-key")
+	if len(listTrash(t)) != 0 || revisions[1] != nil {
+		t.Error("A purged book went to the trash")
+	}
+
+	formRequest(requireRole(routes()), "DELETE", "/books/book-2", nil, "X-API-Key", "librarian-key")
+	if w := formRequest(requireRole(routes()), "DELETE", "/trash/book-2", nil, "X-API-Key", "librarian-key"); w.Code != http.StatusNoContent {
+		t.Error("Expected Response code 204. Recieved ", w.Code)
+	}
+	if len(listTrash(t)) != 0 {
+		t.Error("Purging did not empty the trash")
+	}
+
+	readFromFile("books.csv")
+	trashRetention = time.Hour
+	formRequest(requireRole(routes()), "DELETE", "/books/book-1", nil, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "DELETE", "/books/book-2", nil, "X-API-Key", "librarian-key")
+	Trash[0].DeletedAt = Trash[0].DeletedAt.Add(-2 * time.Hour)
+	if trash := listTrash(t); len(trash) != 1 || trash[0].Title != "Book 2" {
+		t.Error("Expected only Book 2 to be left in the trash. Recieved ", trash)
+	}
+}
+
+/*
+Deletes move the books after them down the list, so a delete and a PATCH at the same time mustn't work on where a book
+was before the other one got the lock.
+*/
+func TestDeleteWhilePatching(t *testing.T) {
+	withTestKeys(t)
+	readFromFile("books.csv")
+	for i := 3; i <= 40; i++ {
+		data := url.Values{"title": {fmt.Sprint("Book ", i)}, "publishdate": {"11111111"}, "rating": {"1"}, "ischeckedin": {"true"}}
+		formRequest(requireRole(routes()), "POST", "/new", data, "X-API-Key", "librarian-key")
+	}
+
+	var requests sync.WaitGroup
+	for i := 1; i <= 40; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			if i%2 == 0 {
+				formRequest(requireRole(routes()), "DELETE", fmt.Sprint("/books/book-", i), nil, "X-API-Key", "librarian-key")
+			} else {
+				formRequest(requireRole(routes()), "PATCH", fmt.Sprint("/books/book-", i), url.Values{"author": {"Patched"}}, "X-API-Key", "librarian-key")
+			}
+		}()
+	}
+	requests.Wait()
+
+	if len(Books) != 20 || len(Trash) != 20 {
+		t.Fatal("Expected 20 books left and 20 in the trash. Recieved ", len(Books), " and ", len(Trash))
+	}
+	for _, book := range Books {
+		if book.ID%2 == 0 || book.Author != "Patched" {
+			t.Error("Expected only odd books, all patched. Recieved ", book.ID, " ", book.Author)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+A webhook subscription. Events are the event types it wants, the same as the ones sent on /events, and it gets all of
+them when there are none. The secret signs every delivery and is only shown when the webhook is created.
+*/
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Secret  string    `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+
+	deliveries []*Delivery // The most recent deliveries, newest last
+}
+
+func (h *Webhook) wants(event string) bool {
+	if len(h.Events) == 0 || event == "ping" {
+		return true
+	}
+	for _, want := range h.Events {
+		if want == event {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+One event sent to one webhook, with every attempt made to send it.
+*/
+type Delivery struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhookid"`
+	Event     string    `json:"event"`
+	Seq       int64     `json:"seq,omitempty"` // The change feed sequence number, pings don't have one
+	State     string    `json:"state"`         // pending, delivered or failed
+	Attempts  []Attempt `json:"attempts"`
+
+	body []byte
+}
+
+type Attempt struct {
+	Time     time.Time     `json:"time"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+/*
+The body of every delivery.
+*/
+type webhookPayload struct {
+	Delivery string    `json:"delivery"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Change   *Change   `json:"change,omitempty"`
+}
+
+const (
+	webhookDeliveriesKept = 50
+	deadLettersKept       = 1000
+)
+
+/*
+Webhook subscriptions, their delivery logs, and the deliveries that ran out of attempts. Subscriptions are saved to a
+file so they survive a restart, the logs are only kept in memory.
+*/
+type webhookStore struct {
+	mutex       sync.Mutex
+	path        string
+	hooks       map[string]*Webhook
+	deadLetters []*Delivery
+
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration // Doubled after every failed attempt
+
+	dispatched atomic.Int64  // The last change in the feed that has been dispatched
+	sending    int           // Deliveries that haven't finished yet
+	stopping   chan struct{} // Closed when shutting down, after which failed deliveries aren't tried again
+}
+
+var webhooks = newWebhookStore("")
+
+func newWebhookStore(path string) *webhookStore {
+	return &webhookStore{
+		path:        path,
+		hooks:       map[string]*Webhook{},
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: 6,
+		backoff:     time.Second,
+		stopping:    make(chan struct{}),
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/*
+Loads the subscriptions from the store's file, if there is one yet.
+*/
+func (s *webhookStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var hooks []*Webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		s.hooks[hook.ID] = hook
+	}
+	return nil
+}
+
+/*
+Writes the subscriptions to the store's file. Must be called with the store's mutex.
+*/
+func (s *webhookStore) save(ctx context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.list(true), "", "  ")
+	if err != nil {
+		return err
+	}
+	return persist(ctx, "webhooks", func() error {
+		return os.WriteFile(s.path, data, 0600) // It has the secrets in it
+	})
+}
+
+/*
+Every subscription, oldest first. Secrets are left out unless withSecrets is set. Must be called with the store's mutex.
+*/
+func (s *webhookStore) list(withSecrets bool) []Webhook {
+	hooks := []Webhook{}
+	for _, hook := range s.hooks {
+		h := *hook
+		if !withSecrets {
+			h.Secret = ""
+		}
+		hooks = append(hooks, h)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].Created.Before(hooks[j].Created) })
+	return hooks
+}
+
+/*
+Follows the change feed from after the change numbered last, sending each change to the webhooks that want it, until
+ctx is done. The server starts it from the latest change, so changes made while it was down aren't sent.
+*/
+func (s *webhookStore) run(ctx context.Context, last int64) {
+	s.dispatched.Store(last)
+	for {
+		changes, latest, waiting, ok := feed.since(last, 100)
+		if !ok {
+			slog.Warn("Webhooks fell behind the change feed", "skipping_to", latest)
+			last = latest
+			s.dispatched.Store(last)
+			continue
+		}
+		for i := range changes {
+			last = changes[i].Seq
+			s.dispatch(eventType(changes[i]), &changes[i])
+			s.dispatched.Store(last)
+		}
+		if len(changes) > 0 {
+			continue
+		}
+		select {
+		case <-waiting:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+/*
+Starts a delivery of the event to every webhook that wants it.
+*/
+func (s *webhookStore) dispatch(event string, change *Change) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, hook := range s.hooks {
+		if hook.wants(event) {
+			s.deliver(hook, event, change)
+		}
+	}
+}
+
+/*
+Starts delivering an event to a webhook in the background. Must be called with the store's mutex.
+*/
+func (s *webhookStore) deliver(hook *Webhook, event string, change *Change) *Delivery {
+	delivery := &Delivery{ID: randomID(), WebhookID: hook.ID, Event: event, State: "pending", Attempts: []Attempt{}}
+	if change != nil {
+		delivery.Seq = change.Seq
+	}
+	delivery.body, _ = json.Marshal(webhookPayload{Delivery: delivery.ID, Event: event, Time: time.Now().UTC(), Change: change})
+
+	hook.deliveries = append(hook.deliveries, delivery)
+	if len(hook.deliveries) > webhookDeliveriesKept {
+		hook.deliveries = hook.deliveries[len(hook.deliveries)-webhookDeliveriesKept:]
+	}
+	s.sending++
+	go s.send(*hook, delivery)
+	return delivery
+}
+
+/*
+Makes the attempts at a delivery, waiting longer after each failure. Once they have all failed it goes on the
+dead letter list.
+*/
+func (s *webhookStore) send(hook Webhook, delivery *Delivery) {
+	wait := s.backoff
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		status, err := s.post(hook, delivery)
+
+		s.mutex.Lock()
+		result := Attempt{Time: started.UTC(), Status: status, Duration: time.Since(started)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		delivery.Attempts = append(delivery.Attempts, result)
+		_, subscribed := s.hooks[hook.ID]
+		switch {
+		case err == nil:
+			delivery.State = "delivered"
+		case attempt >= s.maxAttempts || !subscribed || s.isStopping():
+			delivery.State = "failed"
+			s.deadLetters = append(s.deadLetters, delivery)
+			if len(s.deadLetters) > deadLettersKept {
+				s.deadLetters = s.deadLetters[len(s.deadLetters)-deadLettersKept:]
+			}
+		}
+		done := delivery.State != "pending"
+		if done {
+			s.sending--
+		}
+		s.mutex.Unlock()
+
+		if done {
+			return
+		}
+		select {
+		case <-time.After(wait):
+		case <-s.stopping:
+		}
+		wait *= 2
+	}
+}
+
+func (s *webhookStore) isStopping() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+How many changes haven't been dispatched yet and how many deliveries haven't finished. Without any subscriptions
+there is nothing to wait for.
+*/
+func (s *webhookStore) backlog() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.hooks) == 0 {
+		return int64(s.sending)
+	}
+	return max(feed.latest()-s.dispatched.Load(), 0) + int64(s.sending)
+}
+
+/*
+Used when shutting down. Waits for every change in the feed to be dispatched and for the deliveries to finish, with
+failed deliveries going straight to the dead letters instead of being tried again.
+*/
+func (s *webhookStore) flush(ctx context.Context) error {
+	if !s.isStopping() {
+		close(s.stopping)
+	}
+	for {
+		s.mutex.Lock()
+		sending := s.sending
+		s.mutex.Unlock()
+		if sending == 0 && s.dispatched.Load() >= feed.latest() {
+			return nil
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("%v webhook deliveries had not finished", sending)
+		}
+	}
+}
+
+/*
+The signature sent in X-Webhook-Signature, an HMAC-SHA256 of the timestamp, a dot, and the body. Receivers should
+check it and that the timestamp is recent, so old deliveries can't be replayed.
+*/
+func webhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookStore) post(hook Webhook, delivery *Delivery) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "books-webhooks")
+	req.Header.Set("X-Webhook-ID", hook.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", webhookSignature(hook.Secret, timestamp, delivery.body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver answered %v", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func parseWebhookURL(value string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(value))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errors.New("url must be an http or https URL")
+	}
+	return u.String(), nil
+}
+
+/*
+Webhook subscriptions, for librarians only.
+
+	GET    /admin/webhooks                       every subscription
+	POST   /admin/webhooks                       url, events (comma separated, all if empty), secret (made up if empty)
+	GET    /admin/webhooks/{id}                  one subscription
+	DELETE /admin/webhooks/{id}                  unsubscribe
+	GET    /admin/webhooks/{id}/deliveries       the subscription's recent deliveries, newest first
+	POST   /admin/webhooks/{id}/ping             send a ping event to check the receiver works
+	GET    /admin/webhooks/deadletters           deliveries that failed every attempt
+	POST   /admin/webhooks/deadletters/{id}      try a dead letter again
+*/
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/webhooks"), "/")
+	parts := strings.Split(path, "/")
+
+	webhooks.mutex.Lock()
+	defer webhooks.mutex.Unlock()
+
+	switch {
+	case path == "" && r.Method == "GET":
+		json.NewEncoder(w).Encode(webhooks.list(false))
+
+	case path == "" && r.Method == "POST":
+		createWebhook(w, r)
+
+	case parts[0] == "deadletters":
+		deadLetters(w, r, parts[1:])
+
+	case path == "":
+		http.Error(w, "405 Method not allowed, only GET and POST are permited", http.StatusMethodNotAllowed)
+
+	default:
+		hook, ok := webhooks.hooks[parts[0]]
+		if !ok || len(parts) > 2 {
+			http.Error(w, "404, not found.", http.StatusNotFound)
+			return
+		}
+		action := ""
+		if len(parts) == 2 {
+			action = parts[1]
+		}
+
+		switch {
+		case action == "" && r.Method == "GET":
+			h := *hook
+			h.Secret = ""
+			json.NewEncoder(w).Encode(h)
+
+		case action == "" && r.Method == "DELETE":
+			delete(webhooks.hooks, hook.ID)
+			if err := webhooks.save(r.Context()); err != nil {
+				slog.ErrorContext(r.Context(), "Could not save webhooks", "err", err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case action == "deliveries" && r.Method == "GET":
+			deliveries := []Delivery{}
+			for i := len(hook.deliveries) - 1; i >= 0; i-- {
+				deliveries = append(deliveries, *hook.deliveries[i])
+			}
+			json.NewEncoder(w).Encode(deliveries)
+
+		case action == "ping" && r.Method == "POST":
+			delivery := webhooks.deliver(hook, "ping", nil)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(delivery)
+
+		case action == "" || action == "deliveries" || action == "ping":
+			http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+
+		default:
+			http.Error(w, "404, not found.", http.StatusNotFound)
+		}
+	}
+}
+
+/*
+Must be called with the store's mutex.
+*/
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+	target, err := parseWebhookURL(r.FormValue("url"))
+	if err != nil {
+		http.Error(w, "400, "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	hook := &Webhook{ID: randomID(), URL: target, Events: []string{}, Secret: r.FormValue("secret"), Created: time.Now().UTC()}
+	for _, event := range strings.Split(r.FormValue("events"), ",") {
+		if event = strings.TrimSpace(event); event != "" {
+			hook.Events = append(hook.Events, event)
+		}
+	}
+	if hook.Secret == "" {
+		hook.Secret = randomID() + randomID()
+	}
+
+	webhooks.hooks[hook.ID] = hook
+	if err := webhooks.save(r.Context()); err != nil {
+		delete(webhooks.hooks, hook.ID)
+		http.Error(w, "500, could not save the webhook", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+/*
+Must be called with the store's mutex.
+*/
+func deadLetters(w http.ResponseWriter, r *http.Request, parts []string) {
+	switch {
+	case len(parts) == 0 && r.Method == "GET":
+		letters := []Delivery{}
+		for _, letter := range webhooks.deadLetters {
+			letters = append(letters, *letter)
+		}
+		json.NewEncoder(w).Encode(letters)
+
+	case len(parts) == 1 && r.Method == "POST":
+		for i, letter := range webhooks.deadLetters {
+			if letter.ID != parts[0] {
+				continue
+			}
+			hook, ok := webhooks.hooks[letter.WebhookID]
+			if !ok {
+				http.Error(w, "409, the webhook has been deleted", http.StatusConflict)
+				return
+			}
+			webhooks.deadLetters = append(webhooks.deadLetters[:i:i], webhooks.deadLetters[i+1:]...)
+			letter.State = "pending"
+			hook.deliveries = append(hook.deliveries, letter)
+			webhooks.sending++
+			go webhooks.send(*hook, letter)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(letter)
+			return
+		}
+		http.Error(w, "404, not found.", http.StatusNotFound)
+
+	default:
+		http.Error(w, "405 Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
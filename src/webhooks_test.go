@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+Gives the test its own webhook store and change feed, with the dispatcher running and retries that don't take long.
+*/
+func withWebhooks(t *testing.T) {
+	withTestKeys(t)
+	withChangeFeed(t, 100)
+	saved := webhooks
+	webhooks = newWebhookStore(filepath.Join(t.TempDir(), "webhooks.json"))
+	webhooks.backoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		webhooks = saved
+	})
+	go func(store *webhookStore, last int64) {
+		store.run(ctx, last)
+		close(done)
+	}(webhooks, feed.latest())
+}
+
+type receivedHook struct {
+	header http.Header
+	body   []byte
+}
+
+/*
+A receiver that answers each delivery with the next status in statuses, and 200 once they run out.
+*/
+func newHookReceiver(t *testing.T, statuses ...int) (*httptest.Server, <-chan receivedHook) {
+	received := make(chan receivedHook, 100)
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- receivedHook{header: r.Header, body: body}
+		if call := int(atomic.AddInt32(&calls, 1)); call <= len(statuses) {
+			w.WriteHeader(statuses[call-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, received
+}
+
+func nextHook(t *testing.T, received <-chan receivedHook) receivedHook {
+	select {
+	case hook := <-received:
+		return hook
+	case <-time.After(5 * time.Second):
+		t.Fatal("No delivery arrived")
+	}
+	return receivedHook{}
+}
+
+func subscribe(t *testing.T, data url.Values) Webhook {
+	w := formRequest(requireRole(routes()), "POST", "/admin/webhooks", data, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusCreated {
+		t.Fatal("Expected Response code 201. Recieved ", w.Code, " ", w.Body.String())
+	}
+	var hook Webhook
+	if err := json.NewDecoder(w.Body).Decode(&hook); err != nil {
+		t.Fatal(err)
+	}
+	return hook
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	withWebhooks(t)
+	readFromFile("books.csv")
+	receiver, received := newHookReceiver(t)
+	hook := subscribe(t, url.Values{"url": {receiver.URL}, "events": {"book.checkout"}, "secret": {"shh"}})
+
+	formRequest(requireRole(routes()), "PATCH", "/books/book-1", url.Values{"author": {"Not Sent"}}, "X-API-Key", "librarian-key")
+	formRequest(requireRole(routes()), "POST", "/books/book-1/checkout", nil, "X-API-Key", "patron-key")
+
+	delivery := nextHook(t, received)
+	if delivery.header.Get("X-Webhook-Event") != "book.checkout" || delivery.header.Get("X-Webhook-ID") != hook.ID {
+		t.Error("Delivery headers incorrect. Recieved ", delivery.header)
+	}
+	signature := webhookSignature("shh", delivery.header.Get("X-Webhook-Timestamp"), delivery.body)
+	if delivery.header.Get("X-Webhook-Signature") != signature {
+		t.Error("Signature incorrect. Recieved ", delivery.header.Get("X-Webhook-Signature"))
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal(delivery.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Change == nil || payload.Change.Book.Status != StatusCheckedOut {
+		t.Error("Payload incorrect. Recieved ", string(delivery.body))
+	}
+
+	w := formRequest(requireRole(routes()), "GET", "/admin/webhooks", nil, "X-API-Key", "librarian-key")
+	var hooks []Webhook
+	json.NewDecoder(w.Body).Decode(&hooks)
+	if len(hooks) != 1 || hooks[0].Secret != "" {
+		t.Error("Expected one webhook without its secret. Recieved ", hooks)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/admin/webhooks", nil, "X-API-Key", "patron-key"); w.Code != http.StatusForbidden {
+		t.Error("Expected Response code 403 for a patron. Recieved ", w.Code)
+	}
+}
+
+func TestWebhookRetriesAndDeadLetters(t *testing.T) {
+	withWebhooks(t)
+	webhooks.maxAttempts = 3
+	readFromFile("books.csv")
+	receiver, received := newHookReceiver(t, 500, 503, 500, 500, 500, 500)
+	hook := subscribe(t, url.Values{"url": {receiver.URL}})
+
+	w := formRequest(requireRole(routes()), "POST", "/admin/webhooks/"+hook.ID+"/ping", nil, "X-API-Key", "librarian-key")
+	if w.Code != http.StatusAccepted {
+		t.Fatal("Expected Response code 202. Recieved ", w.Code)
+	}
+	for i := 0; i < 3; i++ {
+		nextHook(t, received)
+	}
+
+	var letters []Delivery
+	for deadline := time.Now().Add(5 * time.Second); len(letters) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := formRequest(requireRole(routes()), "GET", "/admin/webhooks/deadletters", nil, "X-API-Key", "librarian-key")
+		json.NewDecoder(w.Body).Decode(&letters)
+	}
+	if len(letters) != 1 || letters[0].State != "failed" || len(letters[0].Attempts) != 3 || letters[0].Attempts[1].Status != 503 {
+		t.Fatal("Expected a dead letter after 3 attempts. Recieved ", letters)
+	}
+
+	// Trying the dead letter again goes back to the receiver, which now fails three more times before it works
+	webhooks.maxAttempts = 4
+	if w := formRequest(requireRole(routes()), "POST", "/admin/webhooks/deadletters/"+letters[0].ID, nil, "X-API-Key", "librarian-key"); w.Code != http.StatusAccepted {
+		t.Fatal("Expected Response code 202. Recieved ", w.Code)
+	}
+	for i := 0; i < 4; i++ {
+		nextHook(t, received)
+	}
+	var deliveries []Delivery
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := formRequest(requireRole(routes()), "GET", "/admin/webhooks/"+hook.ID+"/deliveries", nil, "X-API-Key", "librarian-key")
+		json.NewDecoder(w.Body).Decode(&deliveries)
+		if len(deliveries) > 0 && deliveries[0].State == "delivered" {
+			break
+		}
+	}
+	if len(deliveries) == 0 || deliveries[0].State != "delivered" || deliveries[0].Event != "ping" {
+		t.Error("Expected the ping to be delivered in the end. Recieved ", deliveries)
+	}
+	if backlog := webhooks.backlog(); backlog != 0 {
+		t.Error("Expected nothing left to send. Recieved ", backlog)
+	}
+}
+
+func TestWebhookDoesNotDelayRequests(t *testing.T) {
+	withWebhooks(t)
+	readFromFile("books.csv")
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	t.Cleanup(func() {
+		close(release)
+		receiver.Close()
+	})
+	subscribe(t, url.Values{"url": {receiver.URL}})
+
+	start := time.Now()
+	formRequest(requireRole(routes()), "POST", "/books/book-1/checkout", nil, "X-API-Key", "patron-key")
+	formRequest(requireRole(routes()), "POST", "/books/book-1/checkin", nil, "X-API-Key", "patron-key")
+	if time.Since(start) > time.Second {
+		t.Error("A slow receiver held up the requests")
+	}
+}
+
+func TestWebhookSubscriptions(t *testing.T) {
+	withWebhooks(t)
+	if w := formRequest(requireRole(routes()), "POST", "/admin/webhooks", url.Values{"url": {"ftp://example.com"}}, "X-API-Key", "librarian-key"); w.Code != http.StatusBadRequest {
+		t.Error("Expected Response code 400 for a bad URL. Recieved ", w.Code)
+	}
+	hook := subscribe(t, url.Values{"url": {"http://example.com/hook"}})
+	if hook.Secret == "" {
+		t.Error("Expected a secret to be made up")
+	}
+
+	// Subscriptions are saved, so a new store gets them back
+	loaded := newWebhookStore(webhooks.path)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if saved, ok := loaded.hooks[hook.ID]; !ok || saved.Secret != hook.Secret {
+		t.Error("The webhook was not saved")
+	}
+
+	if w := formRequest(requireRole(routes()), "DELETE", "/admin/webhooks/"+hook.ID, nil, "X-API-Key", "librarian-key"); w.Code != http.StatusNoContent {
+		t.Error("Expected Response code 204. Recieved ", w.Code)
+	}
+	if w := formRequest(requireRole(routes()), "GET", "/admin/webhooks/"+hook.ID, nil, "X-API-Key", "librarian-key"); w.Code != http.StatusNotFound {
+		t.Error("Expected Response code 404 after deleting. Recieved ", w.Code)
+	}
+}